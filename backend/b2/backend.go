@@ -70,47 +70,105 @@ func (b *B2Backend) Exists(flake string, ctx context.Context) error {
 
 // Get reads the B2 File from the backend
 func (b *B2Backend) Get(flake string, ctx context.Context) (*common.File, error) {
-	log := logger.LogFromCtx(packageName+".Get", ctx).WithField("object", flake)
-	var file = &common.File{}
 	dataName := common.DataName(flake, skipSize)
-	metaName := common.MetaName(flake, skipSize, metaFormat)
+
+	file, err := b.getMeta(flake, ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	{
-		log.Debug("Loading Meta File")
-		dat, err := b.readFile(metaName, ctx)
+		dat, err := b.readFile(dataName, ctx)
 		if err != nil {
 			return nil, err
 		}
-		log.Debug("Unmarshalling Meta File")
-		err = json.Unmarshal(dat, file)
+		file.Data = dat
+	}
+
+	return file, nil
+}
+
+// UploadReader writes the metadata and streams the data into B2
+func (b *B2Backend) UploadReader(flake string, file *common.File, data io.ReadSeeker, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".UploadReader", ctx)
+	log.Debug("Creating object '", flake, "'")
+	file.CreatedAt = common.FromTime(time.Now().UTC())
+	dataName := common.DataName(flake, skipSize)
+	metaName := common.MetaName(flake, skipSize, metaFormat)
+	log.Debug("Marshalling for ", metaName)
+	var meta = *file
+	meta.Data = []byte{}
+	dat, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	log.Debug("Writing to ", metaName)
+	if err := b.writeFile(metaName, dat, ctx); err != nil {
+		log.Error("Error writing data ", err)
+		return err
+	}
+
+	log.Debug("Streaming to ", dataName)
+	if err := b.writeReader(dataName, data, ctx); err != nil {
+		log.Error("Error writing data ", err)
+		return err
+	}
+	return nil
+}
+
+// GetReader returns a reader over the data object in B2
+func (b *B2Backend) GetReader(flake string, ctx context.Context) (*common.File, io.ReadCloser, error) {
+	file, err := b.getMeta(flake, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return file, b.dataBucket.Object(common.DataName(flake, skipSize)).NewReader(ctx), nil
+}
+
+// WriteReader streams a raw object into B2
+func (b *B2Backend) WriteReader(name string, data io.ReadSeeker, ctx context.Context) error {
+	return b.writeReader(name, data, ctx)
+}
+
+// ReadReader returns a reader over a raw object in B2
+func (b *B2Backend) ReadReader(name string, ctx context.Context) (io.ReadCloser, error) {
+	return b.dataBucket.Object(name).NewReader(ctx), nil
+}
+
+// getMeta reads the metadata of a file and deletes it if it expired
+func (b *B2Backend) getMeta(flake string, ctx context.Context) (*common.File, error) {
+	log := logger.LogFromCtx(packageName+".getMeta", ctx).WithField("object", flake)
+	var file = &common.File{}
+	dataName := common.DataName(flake, skipSize)
+	metaName := common.MetaName(flake, skipSize, metaFormat)
+
+	log.Debug("Loading Meta File")
+	dat, err := b.readFile(metaName, ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Unmarshalling Meta File")
+	err = json.Unmarshal(dat, file)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Checking Expiry Data: ", file.DeleteAt.Sub(time.Now().UTC()))
+	if time.Now().UTC().After(file.DeleteAt.Time) {
+		log.Debug("Expired, deleting")
+		err = b.deleteFile(metaName, ctx)
 		if err != nil {
+			log.Error("Error deleting metadata: ", err)
 			return nil, err
 		}
-		log.Debug("Checking Expiry Data: ", file.DeleteAt.Sub(time.Now().UTC()))
-		if time.Now().UTC().After(file.DeleteAt.Time) {
-			log.Debug("Expired, deleting")
-			err = b.deleteFile(metaName, ctx)
-			if err != nil {
-				log.Error("Error deleting metadata: ", err)
-				return nil, err
-			}
-			err = b.deleteFile(dataName, ctx)
-			if err != nil {
-				log.Error("Error deleting data: ", err)
-				return nil, err
-			}
-			return nil, common.ErrorExpired
-		}
-	}
-
-	{
-		dat, err := b.readFile(dataName, ctx)
+		err = b.deleteFile(dataName, ctx)
 		if err != nil {
+			log.Error("Error deleting data: ", err)
 			return nil, err
 		}
-		file.Data = dat
+		return nil, common.ErrorExpired
 	}
-
+	file.Data = []byte{}
 	return file, nil
 }
 
@@ -170,6 +228,27 @@ func (b *B2Backend) ListGlob(ctx context.Context, prefix string) ([]*common.File
 	}
 }
 
+// GetOptions returns the options of the B2 backend
+func (b *B2Backend) GetOptions() common.BackendOption {
+	return common.BackendOptionDirectReaderIO
+}
+
+// GetFirstWith returns the backend itself if it has the options
+func (b *B2Backend) GetFirstWith(options common.BackendOption) common.Backend {
+	if b.GetOptions()&options == options {
+		return b
+	}
+	return nil
+}
+
+// GetAllWith returns the backend itself if it has the options
+func (b *B2Backend) GetAllWith(options common.BackendOption) []common.Backend {
+	if b.GetOptions()&options == options {
+		return []common.Backend{b}
+	}
+	return []common.Backend{}
+}
+
 func (b *B2Backend) RunGC(ctx context.Context) ([]common.File, error) {
 	return common.GenericGC(b, nil, nil, ctx)
 }
@@ -33,6 +33,28 @@ func (b *B2Backend) writeFile(name string, data []byte, ctx context.Context) err
 	return nil
 }
 
+// writeReader streams the reader into the specified file, unlike
+// writeFile it has no size limit.
+func (b *B2Backend) writeReader(name string, data io.Reader, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".writeReader", ctx).
+		WithField("object", name)
+	obj := b.dataBucket.Object(name)
+	log.Debug("Opening new Writer")
+	w := obj.NewWriter(ctx)
+	n, err := io.Copy(w, data)
+	if err != nil {
+		w.Close()
+		log.Error("Error while uploading: ", err)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		log.Error("Error while finishing upload: ", err)
+		return err
+	}
+	log.Debugf("Wrote %d bytes", n)
+	return nil
+}
+
 // deleteFile is a wrapper around b2.Bucket.Object().Delete()
 func (b *B2Backend) deleteFile(name string, ctx context.Context) error {
 	return b.dataBucket.Object(name).Delete(ctx)
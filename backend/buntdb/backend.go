@@ -103,6 +103,10 @@ func (b *BuntDBBackend) Get(name string, ctx context.Context) (*common.File, err
 		return json.Unmarshal([]byte(dat), file)
 	})
 
+	if errTx == buntdb.ErrNotFound {
+		return nil, common.NewErrorFileNotExists(name, errTx)
+	}
+
 	if file.Data == nil {
 		file.Data = []byte{}
 	}
@@ -121,7 +125,7 @@ func (b *BuntDBBackend) ListGlob(ctx context.Context, prefix string) ([]*common.
 	log := logger.LogFromCtx(bePackagename+".ListGlob", ctx)
 	files := make([]*common.File, 0)
 	b.db.View(func(tx *buntdb.Tx) error {
-		return tx.AscendKeys("/file/"+prefix, func(key, value string) bool {
+		return tx.AscendKeys("/file/"+prefix+"*", func(key, value string) bool {
 			var next = &common.File{}
 			err := json.Unmarshal([]byte(value), next)
 			if err != nil {
@@ -146,6 +150,13 @@ func (b *BuntDBBackend) RunGC(ctx context.Context) ([]common.File, error) {
 	}, ctx)
 }
 
+// RunMaintenance shrinks the DB, expiry is handled by Bunt itself
+func (b *BuntDBBackend) RunMaintenance(ctx context.Context) error {
+	log := logger.LogFromCtx(bePackagename+".RunMaintenance", ctx)
+	log.Debugf("Shrunk DB by %d bytes", b.shrink(ctx))
+	return nil
+}
+
 // Shrink attempts to reduce the size of the DB file and returns
 // the number of bytes saved.
 // If an error occurs, it's ignored.
@@ -189,3 +200,8 @@ func (b *BuntDBBackend) shrink(ctx context.Context) int64 {
 	log.Debugf("Result shrink of %d kib", (shrink / 1024))
 	return shrink
 }
+
+// Close closes the DB
+func (b *BuntDBBackend) Close(ctx context.Context) error {
+	return b.db.Close()
+}
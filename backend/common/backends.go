@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"time"
 )
 
 type BackendPingFile interface {
@@ -14,9 +15,58 @@ type BackendDirectIOByte interface {
 	ReadBytes(string, context.Context) ([]byte, error)
 }
 
+// BackendDirectIOReader is implemented by backends advertising
+// BackendOptionDirectReaderIO. WriteReader and ReadReader store raw
+// objects, UploadReader and GetReader store files like Upload and Get
+// without holding the entire file in memory.
 type BackendDirectIOReader interface {
 	WriteReader(string, io.ReadSeeker, context.Context) error
 	ReadReader(string, context.Context) (io.ReadCloser, error)
+	// UploadReader works like Backend.Upload but reads the file data
+	// from the given reader, the Data field of the file is ignored.
+	UploadReader(name string, file *File, data io.ReadSeeker, ctx context.Context) error
+	// GetReader works like Backend.Get but returns the file data
+	// as reader, the Data field of the returned file is empty.
+	// The caller must close the reader.
+	GetReader(name string, ctx context.Context) (*File, io.ReadCloser, error)
+}
+
+// BackendWithMaintenance is implemented by backends that need to do
+// work on GC besides removing expired files, ie sweeping chunks.
+// An index that removes expired files itself calls RunMaintenance
+// instead of RunGC so the backend is not scanned.
+type BackendWithMaintenance interface {
+	RunMaintenance(ctx context.Context) error
+}
+
+// BackendWithClose is implemented by backends holding resources that
+// must be released on shutdown, ie open databases or pending uploads.
+// Backends wrapping other backends must close them as well.
+type BackendWithClose interface {
+	Close(ctx context.Context) error
+}
+
+// CloseBackend closes the backend if it implements BackendWithClose
+func CloseBackend(b Backend, ctx context.Context) error {
+	if c, ok := b.(BackendWithClose); ok {
+		return c.Close(ctx)
+	}
+	return nil
+}
+
+// BackendStatistics is implemented by backends advertising
+// BackendOptionStatistics.
+type BackendStatistics interface {
+	// Statistics returns a snapshot of the operations done so far,
+	// keyed by operation name, ie "get" or "upload".
+	Statistics() map[string]OperationStatistics
+}
+
+// OperationStatistics counts calls of a single backend operation
+type OperationStatistics struct {
+	Calls  uint64        `json:"calls"`
+	Errors uint64        `json:"errors"`
+	Time   time.Duration `json:"time"`
 }
 
 type BackendWithHTTPHandler interface {
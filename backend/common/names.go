@@ -43,6 +43,12 @@ func ClearPubName(name string, skipSize int) string {
 	return "named/" + SplitName(name, skipSize) + "/flakes.json"
 }
 
+// KeyFileName is used to store the key file of an encrypted flake
+// Format: "keys/<flake>/keyfile.json"
+func KeyFileName(flake string, skipSize int) string {
+	return "keys/" + SplitName(flake, skipSize) + "/keyfile.json"
+}
+
 // IsMetaFile returns true if the filename matches that of a Meta File
 func IsMetaFile(file, format string) bool {
 	return strings.HasPrefix(file, "file/") && strings.HasSuffix(file, "/meta."+format)
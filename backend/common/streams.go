@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+)
+
+// NewStreamAdapter returns the backend as BackendDirectIOReader.
+// If the backend does not advertise BackendOptionDirectReaderIO, the
+// returned adapter buffers the file data in memory and uses Upload and
+// Get. Buffered uploads larger than MaxDataSize return
+// ErrorQuotaExceeded, raw objects return ErrorNotImplemented.
+func NewStreamAdapter(b Backend) BackendDirectIOReader {
+	if s, ok := b.(BackendDirectIOReader); ok && BackendHasOptions(b, BackendOptionDirectReaderIO) {
+		return s
+	}
+	return &streamAdapter{backend: b}
+}
+
+type streamAdapter struct {
+	backend Backend
+}
+
+func (s *streamAdapter) WriteReader(name string, data io.ReadSeeker, ctx context.Context) error {
+	return ErrorNotImplemented
+}
+
+func (s *streamAdapter) ReadReader(name string, ctx context.Context) (io.ReadCloser, error) {
+	return nil, ErrorNotImplemented
+}
+
+func (s *streamAdapter) UploadReader(name string, file *File, data io.ReadSeeker, ctx context.Context) error {
+	if file == nil {
+		return ErrorSerializationFailure
+	}
+	dat, err := ioutil.ReadAll(io.LimitReader(data, MaxDataSize+1))
+	if err != nil {
+		return err
+	}
+	if len(dat) > MaxDataSize {
+		return ErrorQuotaExceeded
+	}
+	file.Data = dat
+	return s.backend.Upload(name, file, ctx)
+}
+
+// GetReader passes the file on even if the backend returned an
+// ErrorHTTPOptions, the caller needs to handle it like with Get.
+func (s *streamAdapter) GetReader(name string, ctx context.Context) (*File, io.ReadCloser, error) {
+	f, err := s.backend.Get(name, ctx)
+	if f == nil {
+		return nil, nil, err
+	}
+	// The backend may hand out a shared pointer, so the data is
+	// cleared on a copy.
+	var meta = *f
+	meta.Data = []byte{}
+	return &meta, NewBytesReadCloser(f.Data), err
+}
+
+// BytesReadCloser is a bytes.Reader with a no-op Close method.
+type BytesReadCloser struct {
+	*bytes.Reader
+}
+
+// NewBytesReadCloser returns a seekable ReadCloser over the data
+func NewBytesReadCloser(data []byte) *BytesReadCloser {
+	return &BytesReadCloser{Reader: bytes.NewReader(data)}
+}
+
+// Close does nothing
+func (b *BytesReadCloser) Close() error { return nil }
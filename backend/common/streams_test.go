@@ -0,0 +1,68 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memBackend is a minimal backend that keeps files in a map
+type memBackend struct {
+	files map[string]*File
+}
+
+func (m *memBackend) Name() string { return "mem" }
+func (m *memBackend) Upload(name string, file *File, ctx context.Context) error {
+	m.files[name] = file
+	return nil
+}
+func (m *memBackend) Exists(name string, ctx context.Context) error {
+	if _, ok := m.files[name]; !ok {
+		return NewErrorFileNotExists(name, nil)
+	}
+	return nil
+}
+func (m *memBackend) Get(name string, ctx context.Context) (*File, error) {
+	if f, ok := m.files[name]; ok {
+		return f, nil
+	}
+	return nil, NewErrorFileNotExists(name, nil)
+}
+func (m *memBackend) Delete(name string, ctx context.Context) error {
+	delete(m.files, name)
+	return nil
+}
+func (m *memBackend) ListGlob(ctx context.Context, prefix string) ([]*File, error) {
+	return nil, ErrorNotImplemented
+}
+func (m *memBackend) RunGC(ctx context.Context) ([]File, error) {
+	return nil, ErrorNotImplemented
+}
+
+func TestStreamAdapter(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	be := &memBackend{files: map[string]*File{}}
+	stream := NewStreamAdapter(be)
+
+	data := []byte("adapter test data")
+	assert.NoError(stream.UploadReader("test", &File{}, bytes.NewReader(data), ctx))
+
+	f, reader, err := stream.GetReader("test", ctx)
+	assert.NoError(err)
+	dat, err := ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.EqualValues(data, dat)
+	assert.Len(f.Data, 0)
+	assert.EqualValues(data, be.files["test"].Data, "Must not modify the stored file")
+
+	err = stream.UploadReader("large", &File{},
+		bytes.NewReader(make([]byte, MaxDataSize+1)), ctx)
+	assert.Equal(ErrorQuotaExceeded, err)
+
+	assert.Equal(ErrorNotImplemented, stream.WriteReader("raw", bytes.NewReader(data), ctx),
+		"The adapter cannot store raw objects")
+}
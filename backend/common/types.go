@@ -90,8 +90,8 @@ const (
 	// BackendOptionDirectBytesIO indicates the backends supports
 	// storing byte slices directly via Write, Read and Delete Methods
 	BackendOptionDirectBytesIO
-	// BackendOptionDirectReaderIO indicates the backend supports
-	// storing reader data directly via Write, Read and Delete Methods
+	// BackendOptionDirectReaderIO indicates the backend implements
+	// BackendDirectIOReader and does not buffer file data in memory
 	BackendOptionDirectReaderIO
 	BackendOptionPingFile
 )
@@ -105,7 +105,8 @@ const MaxTTL = time.Hour * 24 * 30
 // MinTTL is the minimum Lifetime of an Object
 const MinTTL = time.Hour * 1
 
-// MaxDataSize is the maximum size of a file
+// MaxDataSize is the maximum size of a file for backends that
+// do not support streaming.
 const MaxDataSize = 25 * 1024 * 1024
 
 // SkipSize marks how many characters should be grouped when
@@ -0,0 +1,49 @@
+package compltest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	streamTest = "buffered-stream-test"
+	streamCap  = "buffered-stream-cap"
+)
+
+// RunBufferedStreamTest checks that a backend without streaming
+// support works through NewStreamAdapter and that files larger
+// than common.MaxDataSize are refused instead of buffered.
+func RunBufferedStreamTest(b common.Backend, t *testing.T) {
+	ctx := GetTestCtx()
+	assert := assert.New(t)
+
+	assert.False(common.BackendHasOptions(b, common.BackendOptionDirectReaderIO),
+		"Backend must not advertise streaming")
+	stream := common.NewStreamAdapter(b)
+
+	data := bytes.Repeat([]byte("buffered"), 1024)
+	err := stream.UploadReader(streamTest, &common.File{
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, bytes.NewReader(data), ctx)
+	assert.NoError(err)
+
+	f, reader, err := stream.GetReader(streamTest, ctx)
+	if assert.NoError(err) {
+		dat, err := ioutil.ReadAll(reader)
+		assert.NoError(err)
+		assert.NoError(reader.Close())
+		assert.EqualValues(data, dat)
+		assert.Len(f.Data, 0)
+	}
+
+	err = stream.UploadReader(streamCap, &common.File{
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, bytes.NewReader(make([]byte, common.MaxDataSize+1)), ctx)
+	assert.Equal(common.ErrorQuotaExceeded, err, "Must refuse files above MaxDataSize")
+	assert.True(common.IsFileNotExists(b.Exists(streamCap, ctx)))
+}
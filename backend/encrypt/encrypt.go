@@ -0,0 +1,283 @@
+package encrypt
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"git.timschuster.info/rls.moe/catgi/backend"
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+type encryptConfig struct {
+	// Underlying Backend Driver
+	Driver string `cgc:"driver"`
+	// Underlying Backend Driver Configuration
+	DriverConfig map[string]interface{} `cgc:"params"`
+	// Master Secret, all file keys are derived from this
+	Key string `cgc:"key"`
+	// If set to true, the file extension and the owner are
+	// encrypted too. This hides them from listings of the
+	// underlying backend.
+	EncryptMeta bool `cgc:"encrypt_meta"`
+}
+
+const driverName = "encrypt"
+const packageName = "backend/encrypt"
+
+// OptionEncrypted marks files that were stored by the encrypt backend.
+// Files without this option are passed through as is so existing
+// data remains readable.
+const OptionEncrypted common.FileOption = "encrypted"
+
+// OptionEncryptedMeta marks files whose extension and owner
+// were encrypted.
+const OptionEncryptedMeta common.FileOption = "encrypted_meta"
+
+func init() {
+	backend.NewDriver(driverName, NewEncryptBackend)
+}
+
+// Encrypt implements Simple Resting Encryption, each file is encrypted
+// with a key derived from the master secret and the flake of the file.
+//
+// Files are encrypted as a whole, so Encrypt does not implement
+// common.BackendDirectIOReader. Through common.NewStreamAdapter files
+// are buffered in memory and limited to common.MaxDataSize.
+type Encrypt struct {
+	underlyingBackend common.Backend
+	key               crypto.SecretKey
+	encryptMeta       bool
+}
+
+func NewEncryptBackend(params map[string]interface{}, ctx context.Context) (common.Backend, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	var config = &encryptConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("encrypt_meta", false),
+		common.ConfigMustHave("driver", "key"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Key) == 0 {
+		return nil, errors.New("Encrypt backend requires a key")
+	}
+
+	ub, err := backend.NewBackend(config.Driver, config.DriverConfig, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Deriving backend key")
+	key, err := crypto.NewSecretKey([]byte(config.Key)).
+		DeriveKey("backends", driverName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encrypt{
+		underlyingBackend: ub,
+		key:               key,
+		encryptMeta:       config.EncryptMeta,
+	}, nil
+}
+
+func (n *Encrypt) Name() string { return driverName }
+
+// Upload encrypts a copy of the file, the file given is not modified
+// except for correcting the flake.
+func (n *Encrypt) Upload(flake string, file *common.File, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".Upload", ctx)
+
+	if file == nil {
+		return common.ErrorSerializationFailure
+	}
+
+	if file.Flake != flake {
+		file.Flake = flake
+	}
+
+	var encFile = *file
+	encFile.Options = append(append([]common.FileOption{}, file.Options...),
+		OptionEncrypted)
+
+	fileKey, err := n.fileKey(flake)
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Encrypting file data")
+	encFile.Data, err = crypto.EncryptBytes(fileKey.MustDeriveKey("data"), file.Data)
+	if err != nil {
+		log.Error("Could not encrypt file: ", err)
+		return err
+	}
+
+	if n.encryptMeta {
+		log.Debug("Encrypting file metadata")
+		encFile.Options = append(encFile.Options, OptionEncryptedMeta)
+		encFile.FileExtension, err = encryptString(fileKey.MustDeriveKey("ext"), file.FileExtension)
+		if err != nil {
+			return err
+		}
+		encFile.User, err = encryptString(fileKey.MustDeriveKey("usr"), file.User)
+		if err != nil {
+			return err
+		}
+	}
+
+	return n.underlyingBackend.Upload(flake, &encFile, ctx)
+}
+
+func (n *Encrypt) Exists(flake string, ctx context.Context) error {
+	return n.underlyingBackend.Exists(flake, ctx)
+}
+
+func (n *Encrypt) Get(flake string, ctx context.Context) (*common.File, error) {
+	log := logger.LogFromCtx(packageName+".Get", ctx)
+
+	f, err := n.underlyingBackend.Get(flake, ctx)
+	if err != nil {
+		return f, err
+	}
+	if f == nil || !f.HasOption(OptionEncrypted) {
+		log.Debug("File is not encrypted, passing through")
+		return f, nil
+	}
+
+	fileKey, err := n.fileKey(flake)
+	if err != nil {
+		return nil, err
+	}
+
+	// The underlying backend may hand out a shared pointer (ie fcache),
+	// so the decrypted file must be a copy.
+	var decFile = *f
+
+	log.Debug("Decrypting file data")
+	decFile.Data, err = crypto.DecryptBytes(fileKey.MustDeriveKey("data"), f.Data)
+	if err != nil {
+		log.Error("Could not decrypt file: ", err)
+		return nil, err
+	}
+	if decFile.Data == nil {
+		decFile.Data = []byte{}
+	}
+
+	if err = n.decryptMeta(&decFile); err != nil {
+		log.Error("Could not decrypt metadata: ", err)
+		return nil, err
+	}
+
+	return &decFile, nil
+}
+
+func (n *Encrypt) Delete(flake string, ctx context.Context) error {
+	return n.underlyingBackend.Delete(flake, ctx)
+}
+
+// ListGlob decrypts the metadata of the listed files, file data is
+// not decrypted.
+func (n *Encrypt) ListGlob(ctx context.Context, prefix string) ([]*common.File, error) {
+	log := logger.LogFromCtx(packageName+".ListGlob", ctx)
+	files, err := n.underlyingBackend.ListGlob(ctx, prefix)
+	for k := range files {
+		if files[k] == nil || !files[k].HasOption(OptionEncrypted) {
+			continue
+		}
+		var decFile = *files[k]
+		files[k] = &decFile
+		if err := n.decryptMeta(files[k]); err != nil {
+			log.Error("Could not decrypt metadata of ", files[k].Flake, ": ", err)
+		}
+	}
+	return files, err
+}
+
+func (n *Encrypt) RunGC(ctx context.Context) ([]common.File, error) {
+	log := logger.LogFromCtx(packageName+".RunGC", ctx)
+	files, err := n.underlyingBackend.RunGC(ctx)
+	for k := range files {
+		if !files[k].HasOption(OptionEncrypted) {
+			continue
+		}
+		if err := n.decryptMeta(&files[k]); err != nil {
+			log.Error("Could not decrypt metadata of ", files[k].Flake, ": ", err)
+		}
+	}
+	return files, err
+}
+
+// RunMaintenance passes maintenance to the underlying backend
+func (n *Encrypt) RunMaintenance(ctx context.Context) error {
+	if m, ok := n.underlyingBackend.(common.BackendWithMaintenance); ok {
+		return m.RunMaintenance(ctx)
+	}
+	return nil
+}
+
+// fileKey returns the key used for a specific flake
+// Path: master/backends/encrypt/files/<flake>
+func (n *Encrypt) fileKey(flake string) (crypto.SecretKey, error) {
+	return n.key.DeriveKey("files", flake)
+}
+
+// decryptMeta decrypts the metadata of the file and removes the
+// encryption option so the file looks like it was never encrypted.
+func (n *Encrypt) decryptMeta(f *common.File) error {
+	var encryptedMeta = f.HasOption(OptionEncryptedMeta)
+	var opts = []common.FileOption{}
+	for _, v := range f.Options {
+		if v != OptionEncrypted && v != OptionEncryptedMeta {
+			opts = append(opts, v)
+		}
+	}
+	if len(opts) == 0 {
+		opts = nil
+	}
+	f.Options = opts
+
+	if !encryptedMeta {
+		return nil
+	}
+
+	fileKey, err := n.fileKey(f.Flake)
+	if err != nil {
+		return err
+	}
+	f.FileExtension, err = decryptString(fileKey.MustDeriveKey("ext"), f.FileExtension)
+	if err != nil {
+		return err
+	}
+	f.User, err = decryptString(fileKey.MustDeriveKey("usr"), f.User)
+	return err
+}
+
+func encryptString(key crypto.SecretKey, s string) (string, error) {
+	dat, err := crypto.EncryptBytes(key, []byte(s))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(dat), nil
+}
+
+func decryptString(key crypto.SecretKey, s string) (string, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	dat, err = crypto.DecryptBytes(key, dat)
+	if err != nil {
+		return "", err
+	}
+	return string(dat), nil
+}
+
+// Close closes the underlying backend
+func (n *Encrypt) Close(ctx context.Context) error {
+	return common.CloseBackend(n.underlyingBackend, ctx)
+}
@@ -0,0 +1,73 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/backend/compl_test"
+	"github.com/stretchr/testify/assert"
+
+	_ "git.timschuster.info/rls.moe/catgi/backend/buntdb"
+)
+
+func getTestDB() (common.Backend, error) {
+	return NewEncryptBackend(map[string]interface{}{
+		"driver": "buntdb",
+		"params": map[string]interface{}{
+			"file": ":memory:",
+		},
+		"key":          "encrypt test key",
+		"encrypt_meta": true,
+	}, compltest.GetTestCtx())
+}
+
+func TestCompliance(t *testing.T) {
+	encryptWithBuntdb, err := getTestDB()
+
+	if err != nil {
+		t.Log("Error on creating Testing Backend: ", err)
+		t.FailNow()
+		return
+	}
+
+	compltest.RunTestSuite(encryptWithBuntdb, t)
+}
+
+func TestCiphertextAtRest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+
+	be, err := getTestDB()
+	assert.NoError(err)
+
+	file := &common.File{
+		Data:          []byte("This is a very secret plaintext"),
+		DeleteAt:      common.FromTime(time.Now().AddDate(0, 0, 2)),
+		FileExtension: ".secret",
+		User:          "secretuser",
+	}
+	assert.NoError(be.Upload("at-rest", file, ctx))
+
+	raw, err := be.(*Encrypt).underlyingBackend.Get("at-rest", ctx)
+	assert.NoError(err)
+	assert.False(bytes.Contains(raw.Data, file.Data), "Data must be encrypted")
+	assert.NotEqual(file.FileExtension, raw.FileExtension, "Extension must be encrypted")
+	assert.NotEqual(file.User, raw.User, "User must be encrypted")
+
+	dec, err := be.Get("at-rest", ctx)
+	assert.NoError(err)
+	assert.EqualValues(file.Data, dec.Data)
+	assert.EqualValues(file.FileExtension, dec.FileExtension)
+	assert.EqualValues(file.User, dec.User)
+	assert.Nil(dec.Options, "Encryption options must be hidden")
+}
+
+func TestBufferedStream(t *testing.T) {
+	be, err := getTestDB()
+	if err != nil {
+		t.Fatal("Error on creating Testing Backend: ", err)
+	}
+	compltest.RunBufferedStreamTest(be, t)
+}
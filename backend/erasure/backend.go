@@ -0,0 +1,621 @@
+package erasure
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"github.com/klauspost/reedsolomon"
+)
+
+// ErasureBackend spreads Reed-Solomon encoded shards of a file over
+// several backends. The n-th shard is always stored in the n-th backend.
+//
+// Each backend stores a full common.File for it's shard, the data of
+// that file is a msgpack encoded shard record. This keeps the metadata
+// replicated across all backends if no index is configured.
+//
+// Shards are encoded from the complete file, so ErasureBackend does not
+// implement common.BackendDirectIOReader. Through
+// common.NewStreamAdapter files are buffered in memory and limited to
+// common.MaxDataSize.
+type ErasureBackend struct {
+	children     []common.Backend
+	index        common.Backend
+	encoder      reedsolomon.Encoder
+	dataShards   int
+	parityShards int
+	writeQuorum  int
+	retrieveAll  bool
+	hmacKey      crypto.SecretKey
+	// repairs tracks running background repairs so Close can wait
+	// for them before closing the backends.
+	repairs sync.WaitGroup
+}
+
+// repairTimeout limits how long a background repair started by Get
+// may take, including loading the remaining shards.
+const repairTimeout = 5 * time.Minute
+
+// shardGroup collects the valid shards of one encoding of a file
+type shardGroup struct {
+	first *shardRecord
+	valid map[int]*shardRecord
+}
+
+// shardResult is the outcome of loading a shard from a child backend
+type shardResult struct {
+	child  int
+	file   *common.File
+	record *shardRecord
+	err    error
+}
+
+// Name returns erasure
+func (e *ErasureBackend) Name() string { return driverName }
+
+// Upload encodes the file and writes one shard into each backend.
+// If less than data shards plus confirm factor writes succeed, all
+// written shards are removed again and the upload fails.
+func (e *ErasureBackend) Upload(flake string, file *common.File, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".Upload", ctx)
+
+	if file == nil {
+		return common.ErrorSerializationFailure
+	}
+
+	if file.Flake != flake {
+		log.Debug("Flake mismatch, correcting flake in file")
+		file.Flake = flake
+	}
+
+	if err := e.Exists(flake, ctx); err == nil {
+		return common.ErrorFileExists
+	}
+
+	shards, err := e.newShards(flake, file.Data)
+	if err != nil {
+		log.Error("Could not encode shards: ", err)
+		return err
+	}
+
+	var errs = make(chan error, len(shards))
+	for k := range shards {
+		go func(child int) {
+			errs <- e.putShard(child, file, shards[child], ctx)
+		}(k)
+	}
+
+	var written = 0
+	var lastErr error
+	for range shards {
+		if err := <-errs; err != nil {
+			log.Warn("Shard write failed: ", err)
+			lastErr = err
+		} else {
+			written++
+		}
+	}
+
+	if written < e.writeQuorum {
+		log.Errorf("Only %d of %d required shards written, rolling back",
+			written, e.writeQuorum)
+		e.deleteShards(flake, ctx)
+		if lastErr == common.ErrorFileExists {
+			return lastErr
+		}
+		return common.ErrorIncompleteWrite
+	}
+
+	if e.index != nil {
+		log.Debug("Writing metadata into index")
+		meta := *file
+		meta.Data = []byte{}
+		if err := e.index.Upload(flake, &meta, ctx); err != nil {
+			log.Error("Could not write metadata, rolling back: ", err)
+			e.deleteShards(flake, ctx)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Exists uses the index if present, otherwise it requires enough
+// backends to have a shard of the file to reassemble it.
+func (e *ErasureBackend) Exists(flake string, ctx context.Context) error {
+	if e.index != nil {
+		return e.index.Exists(flake, ctx)
+	}
+
+	var errs = make(chan error, len(e.children))
+	for k := range e.children {
+		go func(child int) {
+			errs <- e.children[child].Exists(flake, ctx)
+		}(k)
+	}
+
+	var found = 0
+	var lastErr error
+	for range e.children {
+		if err := <-errs; err != nil {
+			lastErr = err
+		} else {
+			found++
+		}
+	}
+
+	if found >= e.dataShards {
+		return nil
+	}
+	if found == 0 && common.IsFileNotExists(lastErr) {
+		return lastErr
+	}
+	return common.NewErrorFileNotExists(flake,
+		fmt.Errorf("Only %d of %d required shards present: %v",
+			found, e.dataShards, lastErr))
+}
+
+// Get loads shards from all backends until enough valid shards of one
+// encoding are present to reassemble the file. If retrieve_all is set,
+// the remaining shards are loaded in the background and missing and
+// corrupt shards are rewritten.
+func (e *ErasureBackend) Get(flake string, ctx context.Context) (*common.File, error) {
+	log := logger.LogFromCtx(packageName+".Get", ctx).WithField("object", flake)
+
+	var meta *common.File
+	if e.index != nil {
+		log.Debug("Loading metadata from index")
+		var err error
+		meta, err = e.index.Get(flake, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// With retrieve_all the shards that are still loading when the
+	// file is returned are used for the repair, so they must not be
+	// cancelled together with the request.
+	var shardCtx, cancel = ctx, context.CancelFunc(func() {})
+	if e.retrieveAll {
+		shardCtx, cancel = context.WithTimeout(logger.DetachContext(ctx), repairTimeout)
+	}
+	var repairing = false
+	defer func() {
+		if !repairing {
+			cancel()
+		}
+	}()
+
+	var results = make(chan shardResult, len(e.children))
+	for k := range e.children {
+		go func(child int) {
+			results <- e.getShard(child, flake, shardCtx)
+		}(k)
+	}
+
+	var (
+		found    = map[int]*shardRecord{}
+		broken   = map[int]bool{}
+		groups   = []*shardGroup{}
+		decoded  *shardGroup
+		received = 0
+		missing  = 0
+		lastErr  error
+	)
+	for received < len(e.children) && decoded == nil {
+		res := <-results
+		received++
+		if res.err != nil {
+			// Corrupt shards are only replaced by the repair once the
+			// file was reassembled, if every shard fails the hmac_key
+			// is more likely wrong than all shards corrupt.
+			if res.err == ErrShardCorrupt {
+				log.Warnf("Shard in backend %d is corrupt", res.child)
+				broken[res.child] = true
+			} else if common.IsFileNotExists(res.err) {
+				broken[res.child] = true
+				missing++
+			}
+			lastErr = res.err
+			continue
+		}
+		if meta == nil {
+			meta = res.file
+		}
+		found[res.child] = res.record
+		for _, rec := range res.record.encodings() {
+			group := findGroup(&groups, rec)
+			group.valid[res.child] = rec
+			if len(group.valid) >= group.first.DataShards {
+				decoded = group
+				break
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		if missing == len(e.children) {
+			return nil, common.NewErrorFileNotExists(flake, lastErr)
+		}
+		return nil, fmt.Errorf("No valid shards for %s: %v", flake, lastErr)
+	}
+	if decoded == nil {
+		return nil, fmt.Errorf("Not enough valid shards of one encoding for %s: %v",
+			flake, lastErr)
+	}
+
+	data, err := e.decodeShards(decoded.first, decoded.valid)
+	if err != nil {
+		log.Error("Could not reassemble file: ", err)
+		return nil, err
+	}
+
+	var file = *meta
+	file.Flake = flake
+	file.Data = data
+
+	if file.DeleteAt != nil && file.DeleteAt.TTL() == 0 {
+		log.Info("Attempted to get expired file, deleting...")
+		if err := e.Delete(flake, ctx); err != nil {
+			log.Error("Error while deleting expired file: ", err)
+			return nil, err
+		}
+		return nil, common.ErrorExpired
+	}
+
+	if e.retrieveAll {
+		repairing = true
+		e.repairs.Add(1)
+		go func() {
+			defer e.repairs.Done()
+			defer cancel()
+			e.repair(flake, file, decoded.first, found, broken, results,
+				len(e.children)-received, shardCtx)
+		}()
+	}
+
+	return &file, nil
+}
+
+// findGroup returns the group of the encoding of rec, a new group
+// is added if there is none yet.
+func findGroup(groups *[]*shardGroup, rec *shardRecord) *shardGroup {
+	for _, v := range *groups {
+		if v.first.sameEncoding(rec) {
+			return v
+		}
+	}
+	group := &shardGroup{first: rec, valid: map[int]*shardRecord{}}
+	*groups = append(*groups, group)
+	return group
+}
+
+// Delete removes the shards from all backends and the metadata
+// from the index. It fails if a backend still holds a shard afterwards.
+func (e *ErasureBackend) Delete(flake string, ctx context.Context) error {
+	if err := e.Exists(flake, ctx); common.IsFileNotExists(err) {
+		return err
+	}
+
+	if err := e.deleteShards(flake, ctx); err != nil {
+		return err
+	}
+
+	if e.index != nil {
+		return e.index.Delete(flake, ctx)
+	}
+	return nil
+}
+
+// ListGlob uses the index if present, otherwise it merges the listings
+// of all backends.
+func (e *ErasureBackend) ListGlob(ctx context.Context, prefix string) ([]*common.File, error) {
+	log := logger.LogFromCtx(packageName+".ListGlob", ctx)
+
+	if e.index != nil {
+		return e.index.ListGlob(ctx, prefix)
+	}
+
+	var seen = map[string]bool{}
+	var retList = []*common.File{}
+	var failed = 0
+	var lastErr error
+	for k := range e.children {
+		files, err := e.children[k].ListGlob(ctx, prefix)
+		if err != nil {
+			log.Errorf("Could not list backend %d: %s", k, err)
+			failed++
+			lastErr = err
+			continue
+		}
+		for _, v := range files {
+			if seen[v.Flake] {
+				continue
+			}
+			seen[v.Flake] = true
+			v.Data = []byte{}
+			retList = append(retList, v)
+		}
+	}
+
+	if failed == len(e.children) {
+		return nil, lastErr
+	}
+	return retList, nil
+}
+
+// RunGC uses the GenericGC so expired files are removed from
+// all backends at once.
+func (e *ErasureBackend) RunGC(ctx context.Context) ([]common.File, error) {
+	return common.GenericGC(e, nil, nil, ctx)
+}
+
+// newShards splits the data and returns the shard records in the
+// order of the backends.
+func (e *ErasureBackend) newShards(flake string, data []byte) ([]*shardRecord, error) {
+	var shards = make([][]byte, e.dataShards+e.parityShards)
+	if len(data) > 0 {
+		var err error
+		shards, err = e.encoder.Split(data)
+		if err != nil {
+			return nil, err
+		}
+		if err = e.encoder.Encode(shards); err != nil {
+			return nil, err
+		}
+	}
+
+	var records = make([]*shardRecord, len(shards))
+	for k := range shards {
+		var err error
+		records[k], err = newShardRecord(e.hmacKey, flake, k, shards[k],
+			e.dataShards, e.parityShards, len(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// decodeShards reassembles the file data from the valid shards.
+// The encoding is taken from the shard records so files written
+// with an older configuration remain readable.
+func (e *ErasureBackend) decodeShards(first *shardRecord,
+	valid map[int]*shardRecord) ([]byte, error) {
+	if first.Size == 0 {
+		return []byte{}, nil
+	}
+
+	encoder := e.encoder
+	if !e.currentEncoding(first) {
+		var err error
+		encoder, err = reedsolomon.New(first.DataShards, first.ParityShards)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var shards = make([][]byte, first.DataShards+first.ParityShards)
+	for k, v := range valid {
+		if k < len(shards) {
+			shards[k] = v.Data
+		}
+	}
+
+	if err := encoder.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+
+	var buf = bytes.NewBuffer([]byte{})
+	if err := encoder.Join(buf, shards, first.Size); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// putShard writes the shard record into a backend using a copy of
+// the file metadata.
+func (e *ErasureBackend) putShard(child int, file *common.File,
+	rec *shardRecord, ctx context.Context) error {
+	data, err := rec.encode()
+	if err != nil {
+		return err
+	}
+	shardFile := *file
+	shardFile.Data = data
+	return e.children[child].Upload(file.Flake, &shardFile, ctx)
+}
+
+// replaceShard overwrites the shard stored in a backend. Backends do
+// not overwrite files, so the old shard is deleted first.
+func (e *ErasureBackend) replaceShard(child int, file *common.File,
+	rec *shardRecord, ctx context.Context) error {
+	err := e.children[child].Delete(file.Flake, ctx)
+	if err != nil && e.children[child].Exists(file.Flake, ctx) == nil {
+		return err
+	}
+	return e.putShard(child, file, rec, ctx)
+}
+
+// getShard loads and verifies the shard stored in a backend.
+func (e *ErasureBackend) getShard(child int, flake string, ctx context.Context) shardResult {
+	var res = shardResult{child: child}
+	res.file, res.err = e.children[child].Get(flake, ctx)
+	if res.err != nil {
+		return res
+	}
+	if res.file == nil {
+		res.err = common.NewErrorFileNotExists(flake, nil)
+		return res
+	}
+	res.record, res.err = decodeShardRecord(e.hmacKey, flake, res.file.Data)
+	if res.err == nil && res.record.Shard != child {
+		res.err = ErrShardCorrupt
+	}
+	return res
+}
+
+// deleteShards removes the shards of a file from all backends.
+// Backends that fail to delete are checked again and if they still
+// contain the shard, an error is returned.
+func (e *ErasureBackend) deleteShards(flake string, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".deleteShards", ctx)
+
+	var errs = make(chan error, len(e.children))
+	for k := range e.children {
+		go func(child int) {
+			err := e.children[child].Delete(flake, ctx)
+			if err != nil && e.children[child].Exists(flake, ctx) == nil {
+				log.Errorf("Backend %d could not delete shard: %s", child, err)
+				errs <- err
+				return
+			}
+			errs <- nil
+		}(k)
+	}
+
+	var lastErr error
+	for range e.children {
+		if err := <-errs; err != nil {
+			lastErr = err
+		}
+	}
+	if lastErr != nil {
+		return common.ErrorIncompleteWrite
+	}
+	return nil
+}
+
+// repair waits for the remaining shards of a Get and rewrites missing
+// and corrupt shards. Backends that failed for another reason are left
+// alone, they may still hold a valid shard.
+//
+// If the file was read with a different encoding, it is re-encoded in
+// two passes. First every backend gets the new shard stored next to
+// the old one, then the old shards are dropped. The old encoding stays
+// complete until all new shards are written, so the file remains
+// readable if the repair is interrupted.
+func (e *ErasureBackend) repair(flake string, file common.File, first *shardRecord,
+	found map[int]*shardRecord, broken map[int]bool, results <-chan shardResult,
+	pending int, ctx context.Context) {
+	log := logger.LogFromCtx(packageName+".repair", ctx).WithField("object", flake)
+
+	for ; pending > 0; pending-- {
+		res := <-results
+		switch {
+		case res.err == ErrShardCorrupt:
+			log.Warnf("Shard in backend %d is corrupt", res.child)
+			broken[res.child] = true
+		case common.IsFileNotExists(res.err):
+			broken[res.child] = true
+		case res.err == nil:
+			found[res.child] = res.record
+		}
+	}
+
+	shards, err := e.newShards(flake, file.Data)
+	if err != nil {
+		log.Error("Could not encode shards: ", err)
+		return
+	}
+
+	var reencode = !e.currentEncoding(first)
+	if reencode {
+		log.Info("Encoding changed, rewriting file")
+	}
+
+	var pendingOld []int
+	var failed = 0
+	for k := range e.children {
+		rec, ok := found[k]
+		switch {
+		case ok && e.currentEncoding(rec) && rec.Next == nil:
+			continue
+		case ok && e.holdsCurrent(rec):
+			pendingOld = append(pendingOld, k)
+		case ok && reencode && first.sameEncoding(rec):
+			next := *rec
+			next.Next = shards[k]
+			if err := e.replaceShard(k, &file, &next, ctx); err != nil {
+				log.Errorf("Could not add new shard %d: %s", k, err)
+				failed++
+				continue
+			}
+			pendingOld = append(pendingOld, k)
+		case ok || broken[k]:
+			log.Infof("Rewriting shard %d", k)
+			if err := e.replaceShard(k, &file, shards[k], ctx); err != nil {
+				log.Errorf("Could not rewrite shard %d: %s", k, err)
+				failed++
+			}
+		default:
+			failed++
+		}
+	}
+
+	if len(pendingOld) == 0 {
+		return
+	}
+	if failed > 0 {
+		log.Warnf("%d backends did not receive a new shard, keeping old shards", failed)
+		return
+	}
+	for _, k := range pendingOld {
+		if err := e.replaceShard(k, &file, shards[k], ctx); err != nil {
+			log.Errorf("Could not drop old shard %d: %s", k, err)
+		}
+	}
+}
+
+// currentEncoding returns true if the record was encoded with the
+// configuration the backend currently uses.
+func (e *ErasureBackend) currentEncoding(rec *shardRecord) bool {
+	return rec.DataShards == e.dataShards && rec.ParityShards == e.parityShards
+}
+
+// holdsCurrent returns true if the record or the shard it carries for
+// a re-encode was encoded with the current configuration.
+func (e *ErasureBackend) holdsCurrent(rec *shardRecord) bool {
+	for _, v := range rec.encodings() {
+		if e.currentEncoding(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close waits for running repairs and then closes all shard backends
+// and the index, the first error is returned after all backends have
+// been closed. It must not be called while Get is still in use.
+func (e *ErasureBackend) Close(ctx context.Context) error {
+	var done = make(chan struct{})
+	go func() {
+		e.repairs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logger.LogFromCtx(packageName+".Close", ctx).
+			Warn("Repairs still running while closing backends")
+	}
+
+	var firstErr error
+	for _, v := range e.children {
+		if err := common.CloseBackend(v, ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if e.index != nil {
+		if err := common.CloseBackend(e.index, ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
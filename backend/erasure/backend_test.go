@@ -0,0 +1,241 @@
+package erasure
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/backend/compl_test"
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"github.com/klauspost/reedsolomon"
+	"github.com/stretchr/testify/assert"
+
+	_ "git.timschuster.info/rls.moe/catgi/backend/buntdb"
+)
+
+func getTestBackend(t *testing.T) *ErasureBackend {
+	memDB := map[string]interface{}{
+		"driver": "buntdb",
+		"params": map[string]interface{}{
+			"file": ":memory:",
+		},
+	}
+	be, err := NewErasureBackend(map[string]interface{}{
+		"backends":      []interface{}{memDB, memDB, memDB},
+		"allowed_fails": 1,
+		"hmac_key":      "erasure test key",
+	}, compltest.GetTestCtx())
+
+	if err != nil {
+		t.Log("Error on creating Testing Backend: ", err)
+		t.FailNow()
+	}
+	return be.(*ErasureBackend)
+}
+
+func TestCompliance(t *testing.T) {
+	compltest.RunTestSuite(getTestBackend(t), t)
+}
+
+func TestMissingShard(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	file := &common.File{
+		Data:     []byte("This file survives losing one backend"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}
+
+	assert.NoError(be.Upload("missing-shard", file, ctx))
+	assert.NoError(be.children[0].Delete("missing-shard", ctx))
+
+	f, err := be.Get("missing-shard", ctx)
+	assert.NoError(err, "Must reassemble file with one missing shard")
+	assert.EqualValues(file.Data, f.Data)
+
+	assert.NoError(be.children[1].Delete("missing-shard", ctx))
+
+	_, err = be.Get("missing-shard", ctx)
+	assert.Error(err, "Must not reassemble file with two missing shards")
+}
+
+func TestCorruptShard(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	file := &common.File{
+		Data:     []byte("This file survives a corrupt backend"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}
+
+	assert.NoError(be.Upload("corrupt-shard", file, ctx))
+
+	shard, err := be.children[2].Get("corrupt-shard", ctx)
+	assert.NoError(err)
+	rec, err := decodeShardRecord(be.hmacKey, "corrupt-shard", shard.Data)
+	assert.NoError(err)
+	rec.Data[0] ^= 0xFF
+	shard.Data, err = rec.encode()
+	assert.NoError(err)
+	assert.NoError(be.children[2].Delete("corrupt-shard", ctx))
+	assert.NoError(be.children[2].Upload("corrupt-shard", shard, ctx))
+
+	be.retrieveAll = true
+	f, err := be.Get("corrupt-shard", ctx)
+	assert.NoError(err, "Must reassemble file with one corrupt shard")
+	assert.EqualValues(file.Data, f.Data)
+
+	be.repairs.Wait()
+	assertShards(t, be, "corrupt-shard", 2, 1)
+}
+
+func TestWrongHMACKey(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	file := &common.File{
+		Data:     []byte("This file survives a wrong hmac_key"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}
+	assert.NoError(be.Upload("wrong-key", file, ctx))
+
+	wrong := reopenBackend(be, 2, 1)
+	wrong.hmacKey = crypto.NewSecretKey([]byte("another erasure key")).
+		MustDeriveKey("backends", driverName, "shards")
+	_, err := wrong.Get("wrong-key", ctx)
+	assert.Error(err, "Shards failing verification must not be returned")
+	wrong.repairs.Wait()
+
+	f, err := be.Get("wrong-key", ctx)
+	assert.NoError(err, "Shards must be kept if the file cannot be reassembled")
+	assert.EqualValues(file.Data, f.Data)
+	assertShards(t, be, "wrong-key", 2, 1)
+}
+
+func TestRepairOutlivesRequest(t *testing.T) {
+	assert := assert.New(t)
+	be := getTestBackend(t)
+	be.retrieveAll = true
+
+	file := &common.File{
+		Data:     []byte("This shard is rewritten after the request is gone"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}
+
+	assert.NoError(be.Upload("detached-repair", file, compltest.GetTestCtx()))
+	assert.NoError(be.children[1].Delete("detached-repair", compltest.GetTestCtx()))
+
+	ctx, cancel := context.WithCancel(compltest.GetTestCtx())
+	_, err := be.Get("detached-repair", ctx)
+	cancel()
+	assert.NoError(err)
+
+	be.repairs.Wait()
+	assertShards(t, be, "detached-repair", 2, 1)
+}
+
+func TestReencode(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	file := &common.File{
+		Data:     []byte("This file moves to a new encoding"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}
+	assert.NoError(be.Upload("reencode", file, ctx))
+
+	next := reopenBackend(be, 1, 2)
+	f, err := next.Get("reencode", ctx)
+	assert.NoError(err, "Must read the old encoding")
+	assert.EqualValues(file.Data, f.Data)
+	next.repairs.Wait()
+
+	assertShards(t, next, "reencode", 1, 2)
+	f, err = next.Get("reencode", ctx)
+	assert.NoError(err, "Must read the new encoding")
+	assert.EqualValues(file.Data, f.Data)
+}
+
+func TestInterruptedReencode(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	file := &common.File{
+		Flake:    "interrupted",
+		Data:     []byte("This file survives an interrupted re-encode"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}
+	assert.NoError(be.Upload("interrupted", file, ctx))
+
+	// Backends 0 and 1 already hold both shards, the shard in
+	// backend 2 was deleted and the new one was never written.
+	next := reopenBackend(be, 1, 2)
+	shards, err := next.newShards("interrupted", file.Data)
+	assert.NoError(err)
+	for k := 0; k < 2; k++ {
+		shard, err := be.children[k].Get("interrupted", ctx)
+		assert.NoError(err)
+		rec, err := decodeShardRecord(be.hmacKey, "interrupted", shard.Data)
+		assert.NoError(err)
+		rec.Next = shards[k]
+		assert.NoError(be.replaceShard(k, file, rec, ctx))
+	}
+	assert.NoError(be.children[2].Delete("interrupted", ctx))
+
+	f, err := be.Get("interrupted", ctx)
+	assert.NoError(err, "Must read the old encoding")
+	assert.EqualValues(file.Data, f.Data)
+
+	f, err = next.Get("interrupted", ctx)
+	assert.NoError(err, "Must read the new encoding")
+	assert.EqualValues(file.Data, f.Data)
+	next.repairs.Wait()
+
+	assertShards(t, next, "interrupted", 1, 2)
+}
+
+// reopenBackend returns a backend on the same children with another
+// encoding and retrieve_all enabled.
+func reopenBackend(be *ErasureBackend, dataShards, parityShards int) *ErasureBackend {
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		panic(err)
+	}
+	return &ErasureBackend{
+		children:     be.children,
+		encoder:      encoder,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		writeQuorum:  dataShards,
+		retrieveAll:  true,
+		hmacKey:      be.hmacKey,
+	}
+}
+
+// assertShards checks that every backend holds exactly one shard
+// of the given encoding.
+func assertShards(t *testing.T, be *ErasureBackend, flake string,
+	dataShards, parityShards int) {
+	ctx := compltest.GetTestCtx()
+	for k := range be.children {
+		shard, err := be.children[k].Get(flake, ctx)
+		if !assert.NoError(t, err, "Backend %d must hold a shard", k) {
+			continue
+		}
+		rec, err := decodeShardRecord(be.hmacKey, flake, shard.Data)
+		assert.NoError(t, err)
+		assert.Equal(t, dataShards, rec.DataShards)
+		assert.Equal(t, parityShards, rec.ParityShards)
+		assert.Nil(t, rec.Next, "Old shard in backend %d must be dropped", k)
+	}
+}
+
+func TestBufferedStream(t *testing.T) {
+	compltest.RunBufferedStreamTest(getTestBackend(t), t)
+}
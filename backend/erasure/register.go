@@ -0,0 +1,135 @@
+package erasure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"git.timschuster.info/rls.moe/catgi/backend"
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"github.com/klauspost/reedsolomon"
+)
+
+const packageName = "backend/erasure"
+const driverName = "erasure"
+
+const (
+	// ModeSCFA (Single-Chunk File Addressed) encodes the whole file at once
+	ModeSCFA = "scfa"
+)
+
+// ChildConfig configures a single backend the erasure backend
+// spreads shards over.
+type ChildConfig struct {
+	Driver string                 `cgc:"driver"`
+	Params map[string]interface{} `cgc:"params"`
+}
+
+type erasureConfig struct {
+	// Backends is the list of backends that will receive shards.
+	// The order of the list determines which shard is stored where,
+	// reordering backends will invalidate existing files.
+	Backends []ChildConfig `cgc:"backends"`
+	// Mode is the encoding mode, only "scfa" is available atm.
+	Mode string `cgc:"mode"`
+	// AllowedFails is the number of backends that may fail or
+	// return corrupt data without losing a file. Must be atleast 1.
+	AllowedFails int `cgc:"allowed_fails"`
+	// ConfirmFactor is the number of writes over the number of
+	// data shards that must succeed before an upload is accepted.
+	ConfirmFactor int `cgc:"confirm_factor"`
+	// Index is an optional backend that stores the metadata of files.
+	// If unset metadata is replicated across all backends.
+	Index *ChildConfig `cgc:"index"`
+	// RetrieveAll will make Get wait on the remaining shards in the
+	// background after the file was reassembled and repair
+	// missing or corrupt shards.
+	RetrieveAll bool `cgc:"retrieve_all"`
+	// HMACKey is the serverside secret used to authenticate shards
+	HMACKey string `cgc:"hmac_key"`
+}
+
+func init() {
+	backend.NewDriver(driverName, NewErasureBackend)
+}
+
+// NewErasureBackend creates all configured child backends and
+// calculates the shard configuration.
+func NewErasureBackend(params map[string]interface{}, ctx context.Context) (common.Backend, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	log.Debug("Loading Config")
+	var config = &erasureConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("mode", ModeSCFA),
+		common.ConfigDefault("allowed_fails", 1),
+		common.ConfigDefault("confirm_factor", 0),
+		common.ConfigDefault("retrieve_all", false),
+		common.ConfigMustHave("backends", "hmac_key"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Mode != ModeSCFA {
+		return nil, fmt.Errorf("Erasure mode '%s' is not supported", config.Mode)
+	}
+	if len(config.HMACKey) == 0 {
+		return nil, errors.New("Erasure backend requires a hmac_key")
+	}
+
+	dataShards := len(config.Backends) - config.AllowedFails
+	if config.AllowedFails < 1 || dataShards < 1 {
+		return nil, fmt.Errorf(
+			"Need atleast %d backends for %d allowed fails, have %d",
+			config.AllowedFails+1, config.AllowedFails, len(config.Backends))
+	}
+	if config.ConfirmFactor < 0 || dataShards+config.ConfirmFactor > len(config.Backends) {
+		return nil, fmt.Errorf(
+			"Confirm factor %d requires more writes than there are backends",
+			config.ConfirmFactor)
+	}
+
+	var children = []common.Backend{}
+	for k, v := range config.Backends {
+		log.Debugf("Loading child backend %d (%s)", k, v.Driver)
+		child, err := backend.NewBackend(v.Driver, v.Params, ctx)
+		if err != nil {
+			log.Error("Could not load child backend: ", err)
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	var index common.Backend
+	if config.Index != nil {
+		log.Debug("Loading index backend ", config.Index.Driver)
+		index, err = backend.NewBackend(config.Index.Driver, config.Index.Params, ctx)
+		if err != nil {
+			log.Error("Could not load index backend: ", err)
+			return nil, err
+		}
+	}
+
+	encoder, err := reedsolomon.New(dataShards, config.AllowedFails)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Using %d data shards and %d parity shards",
+		dataShards, config.AllowedFails)
+
+	return &ErasureBackend{
+		children:     children,
+		index:        index,
+		encoder:      encoder,
+		dataShards:   dataShards,
+		parityShards: config.AllowedFails,
+		writeQuorum:  dataShards + config.ConfirmFactor,
+		retrieveAll:  config.RetrieveAll,
+		hmacKey: crypto.NewSecretKey([]byte(config.HMACKey)).
+			MustDeriveKey("backends", driverName, "shards"),
+	}, nil
+}
@@ -0,0 +1,120 @@
+package erasure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"golang.org/x/crypto/blake2b"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// ErrShardCorrupt is returned when a shard failed hash or hmac
+// verification. The shard is treated like a missing shard.
+var ErrShardCorrupt = errors.New("Shard failed verification")
+
+// shardRecord is stored as the data of the file placed in a child backend
+type shardRecord struct {
+	Data         []byte `msgpack:"data"`
+	Hash         []byte `msgpack:"hash"`
+	HMAC         []byte `msgpack:"hmac"`
+	DataShards   int    `msgpack:"data_shards"`
+	ParityShards int    `msgpack:"parity_shards"`
+	// Shard is the position of the shard in the encoding
+	Shard int `msgpack:"shard"`
+	// Size is the length of the file before encoding
+	Size int `msgpack:"size"`
+	// Next is the shard of a new encoding of the file. It is only set
+	// while the file is being re-encoded, so the old encoding stays
+	// complete until every backend holds its new shard.
+	Next *shardRecord `msgpack:"next,omitempty"`
+}
+
+// newShardRecord hashes and authenticates the shard data.
+// The HMAC covers the flake and the shard position so shards
+// cannot be swapped between files or positions.
+func newShardRecord(key crypto.SecretKey, flake string, shard int,
+	data []byte, dataShards, parityShards, size int) (*shardRecord, error) {
+	hash := blake2b.Sum512(data)
+	rec := &shardRecord{
+		Data:         data,
+		Hash:         hash[:],
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		Shard:        shard,
+		Size:         size,
+	}
+	mac, err := crypto.HMAC(key[:], rec.macData(flake))
+	if err != nil {
+		return nil, err
+	}
+	rec.HMAC = mac
+	return rec, nil
+}
+
+// decodeShardRecord unpacks a shard and verifies it against the
+// given key and flake.
+func decodeShardRecord(key crypto.SecretKey, flake string, dat []byte) (*shardRecord, error) {
+	var rec = &shardRecord{}
+	if err := msgpack.Unmarshal(dat, rec); err != nil {
+		return nil, err
+	}
+	if err := rec.verify(key, flake); err != nil {
+		return nil, err
+	}
+	if rec.Next != nil {
+		if rec.Next.Next != nil || rec.Next.Shard != rec.Shard {
+			return nil, ErrShardCorrupt
+		}
+		if err := rec.Next.verify(key, flake); err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+func (s *shardRecord) encode() ([]byte, error) {
+	return msgpack.Marshal(s)
+}
+
+// verify checks the hash and the hmac of the shard.
+func (s *shardRecord) verify(key crypto.SecretKey, flake string) error {
+	hash := blake2b.Sum512(s.Data)
+	if !bytes.Equal(hash[:], s.Hash) {
+		return ErrShardCorrupt
+	}
+	if err := crypto.VerifyHMAC(s.HMAC, key[:], s.macData(flake)); err != nil {
+		return ErrShardCorrupt
+	}
+	return nil
+}
+
+func (s *shardRecord) macData(flake string) *bytes.Buffer {
+	var buf = bytes.NewBufferString(flake)
+	var header = make([]byte, 8*4)
+	binary.LittleEndian.PutUint64(header[0:8], uint64(s.Shard))
+	binary.LittleEndian.PutUint64(header[8:16], uint64(s.DataShards))
+	binary.LittleEndian.PutUint64(header[16:24], uint64(s.ParityShards))
+	binary.LittleEndian.PutUint64(header[24:32], uint64(s.Size))
+	buf.Write(header)
+	buf.Write(s.Hash)
+	return buf
+}
+
+// encodings returns the shard and, during a re-encode, the shard of
+// the new encoding.
+func (s *shardRecord) encodings() []*shardRecord {
+	if s.Next != nil {
+		return []*shardRecord{s, s.Next}
+	}
+	return []*shardRecord{s}
+}
+
+// sameEncoding returns true if both shards belong to the same encoding
+// of a file.
+func (s *shardRecord) sameEncoding(o *shardRecord) bool {
+	return s.DataShards == o.DataShards &&
+		s.ParityShards == o.ParityShards &&
+		s.Size == o.Size
+}
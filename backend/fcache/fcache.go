@@ -2,10 +2,13 @@ package fcache
 
 import (
 	"context"
+	"io"
+	"sync"
 
 	"git.timschuster.info/rls.moe/catgi/backend"
 	"git.timschuster.info/rls.moe/catgi/backend/common"
 	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/metrics"
 	"github.com/bluele/gcache"
 	"github.com/mitchellh/mapstructure"
 )
@@ -27,6 +30,13 @@ type FCacheConfig struct {
 const driverName = "fcache"
 const packageName = "backend/fcache"
 
+var (
+	cacheRequests = metrics.Default.NewCounter("catgi_fcache_requests_total",
+		"Lookups in the file cache by result, hit or miss", "result")
+	cacheEvictions = metrics.Default.NewCounter("catgi_fcache_evictions_total",
+		"Files dropped from the cache, for capacity or removed on change", "reason")
+)
+
 func init() {
 	backend.NewDriver(driverName, NewFCacheBackend)
 }
@@ -36,6 +46,11 @@ type FCache struct {
 	underlyingBackend common.Backend
 	cache             gcache.Cache
 	asyncUpload       bool
+	// pending tracks asynchronous uploads that have not finished yet
+	pending sync.WaitGroup
+	// removing holds the flakes being removed so the eviction is not
+	// counted as capacity eviction
+	removing sync.Map
 }
 
 func NewFCacheBackend(params map[string]interface{}, ctx context.Context) (common.Backend, error) {
@@ -63,12 +78,39 @@ func NewFCacheBackend(params map[string]interface{}, ctx context.Context) (commo
 		return nil, err
 	}
 
-	intCache := gcache.New(config.Size).ARC().Build()
-	return &FCache{
+	n := &FCache{
 		underlyingBackend: ub,
-		cache:             intCache,
 		asyncUpload:       config.AsyncUpload,
-	}, nil
+	}
+	n.cache = gcache.New(config.Size).ARC().EvictedFunc(n.evicted).Build()
+	return n, nil
+}
+
+// evicted counts a file dropped by the cache
+func (n *FCache) evicted(key, value interface{}) {
+	if _, ok := n.removing.Load(key); ok {
+		cacheEvictions.Inc("removed")
+	} else {
+		cacheEvictions.Inc("capacity")
+	}
+}
+
+// remove drops a flake from the cache and returns true if it was cached
+func (n *FCache) remove(flake string) bool {
+	n.removing.Store(flake, true)
+	defer n.removing.Delete(flake)
+	return n.cache.Remove(flake)
+}
+
+// lookup returns the cached file and counts the hit or miss
+func (n *FCache) lookup(flake string) (interface{}, error) {
+	val, err := n.cache.Get(flake)
+	if err == nil {
+		cacheRequests.Inc("hit")
+	} else {
+		cacheRequests.Inc("miss")
+	}
+	return val, err
 }
 
 func (n *FCache) Name() string { return driverName }
@@ -90,11 +132,16 @@ func (n *FCache) Upload(flake string, file *common.File, ctx context.Context) er
 		return nil
 	} else if n.asyncUpload {
 		n.cache.Set(flake, file)
+		// The upload outlives the request, so it must not be
+		// cancelled with it.
+		ctx = context.WithoutCancel(ctx)
+		n.pending.Add(1)
 		go func() {
+			defer n.pending.Done()
 			err := n.underlyingBackend.Upload(flake, file, ctx)
 			if err != nil {
 				// If the upload fails, evict the file from cache
-				n.cache.Remove(flake)
+				n.remove(flake)
 			}
 		}()
 		return nil
@@ -104,7 +151,7 @@ func (n *FCache) Upload(flake string, file *common.File, ctx context.Context) er
 
 func (n *FCache) Exists(flake string, ctx context.Context) error {
 	log := logger.LogFromCtx(packageName+".Get", ctx)
-	if _, err := n.cache.Get(flake); err == nil {
+	if _, err := n.lookup(flake); err == nil {
 		log.Debug("File in cache, exists if not stale")
 		return nil
 	}
@@ -115,7 +162,7 @@ func (n *FCache) Exists(flake string, ctx context.Context) error {
 func (n *FCache) Get(flake string, ctx context.Context) (*common.File, error) {
 	log := logger.LogFromCtx(packageName+".Get", ctx)
 	log.Debug("Checking if file is in cache")
-	if val, err := n.cache.Get(flake); err == nil {
+	if val, err := n.lookup(flake); err == nil {
 		log.Debug("Checking if cache contains file (it should)")
 		if f, ok := val.(*common.File); ok {
 			log.Debug("Answering request from cache")
@@ -135,6 +182,75 @@ func (n *FCache) Get(flake string, ctx context.Context) (*common.File, error) {
 	return f, nil
 }
 
+// UploadReader streams the file into the underlying backend.
+// Streamed files are never cached and never uploaded asynchronously
+// since the reader is only valid during the request.
+func (n *FCache) UploadReader(flake string, file *common.File, data io.ReadSeeker, ctx context.Context) error {
+	n.remove(flake)
+	return common.NewStreamAdapter(n.underlyingBackend).UploadReader(flake, file, data, ctx)
+}
+
+// GetReader answers from the cache if possible, otherwise the
+// file is streamed from the underlying backend without caching it.
+func (n *FCache) GetReader(flake string, ctx context.Context) (*common.File, io.ReadCloser, error) {
+	log := logger.LogFromCtx(packageName+".GetReader", ctx)
+	if val, err := n.lookup(flake); err == nil {
+		if f, ok := val.(*common.File); ok {
+			log.Debug("Answering request from cache")
+			var meta = *f
+			meta.Data = []byte{}
+			return &meta, common.NewBytesReadCloser(f.Data), nil
+		}
+		log.Error("Cache did not contain file")
+	}
+	log.Info("Cache Miss, streaming from backend")
+	return common.NewStreamAdapter(n.underlyingBackend).GetReader(flake, ctx)
+}
+
+// WriteReader passes raw objects to the underlying backend uncached
+func (n *FCache) WriteReader(name string, data io.ReadSeeker, ctx context.Context) error {
+	return common.NewStreamAdapter(n.underlyingBackend).WriteReader(name, data, ctx)
+}
+
+// ReadReader reads raw objects from the underlying backend
+func (n *FCache) ReadReader(name string, ctx context.Context) (io.ReadCloser, error) {
+	return common.NewStreamAdapter(n.underlyingBackend).ReadReader(name, ctx)
+}
+
+// GetOptions returns BackendOptionDirectReaderIO if the underlying
+// backend supports streaming.
+func (n *FCache) GetOptions() common.BackendOption {
+	if common.BackendHasOptions(n.underlyingBackend, common.BackendOptionDirectReaderIO) {
+		return common.BackendOptionDirectReaderIO
+	}
+	return 0
+}
+
+// GetFirstWith returns the cache if it has the options, otherwise
+// the underlying backend is asked.
+func (n *FCache) GetFirstWith(options common.BackendOption) common.Backend {
+	if n.GetOptions()&options == options {
+		return n
+	}
+	if ob, ok := n.underlyingBackend.(common.OnionBackend); ok {
+		return ob.GetFirstWith(options)
+	}
+	return nil
+}
+
+// GetAllWith returns the cache and all underlying backends with
+// the options.
+func (n *FCache) GetAllWith(options common.BackendOption) []common.Backend {
+	var ret = []common.Backend{}
+	if n.GetOptions()&options == options {
+		ret = append(ret, n)
+	}
+	if ob, ok := n.underlyingBackend.(common.OnionBackend); ok {
+		ret = append(ret, ob.GetAllWith(options)...)
+	}
+	return ret
+}
+
 func (n *FCache) Delete(flake string, ctx context.Context) error {
 	log := logger.LogFromCtx(packageName+".Delete", ctx)
 	// We delete the item from cache first to prevent
@@ -142,10 +258,7 @@ func (n *FCache) Delete(flake string, ctx context.Context) error {
 	// period where the file is still in cache but not in
 	// the backend.
 	// Originally this was done inside a defer.
-	i, err := n.cache.Get(flake)
-	if err == nil {
-		n.cache.Remove(i)
-	} else {
+	if !n.remove(flake) {
 		log.Warn("Deleting non-cached file, ignoring error on cache.")
 	}
 
@@ -165,3 +278,33 @@ func (n *FCache) RunGC(ctx context.Context) ([]common.File, error) {
 	n.cache.Purge()
 	return files, err
 }
+
+// RunMaintenance passes maintenance to the underlying backend and
+// purges the cache like RunGC.
+func (n *FCache) RunMaintenance(ctx context.Context) error {
+	defer n.cache.Purge()
+	if m, ok := n.underlyingBackend.(common.BackendWithMaintenance); ok {
+		return m.RunMaintenance(ctx)
+	}
+	return nil
+}
+
+// Close waits for pending asynchronous uploads and closes the
+// underlying backend. If the context expires first, the remaining
+// uploads are lost.
+func (n *FCache) Close(ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".Close", ctx)
+	done := make(chan struct{})
+	go func() {
+		n.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Debug("All pending uploads flushed")
+	case <-ctx.Done():
+		log.Error("Pending uploads not flushed: ", ctx.Err())
+		return ctx.Err()
+	}
+	return common.CloseBackend(n.underlyingBackend, ctx)
+}
@@ -0,0 +1,419 @@
+package hcca
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sync"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+// HCCABackend implements Hash-Chunk Content Addressed storage.
+// Files are split into chunks which are stored once under their
+// Blake2b hash in the underlying backend, the flake itself only
+// stores a manifest listing the chunks.
+//
+// Each chunk has a reference count, chunks are removed by RunGC
+// once no live flake references them.
+//
+// Chunks are hashed from the complete file, so HCCABackend does not
+// implement common.BackendDirectIOReader. Through
+// common.NewStreamAdapter files are buffered in memory and limited to
+// common.MaxDataSize.
+type HCCABackend struct {
+	underlyingBackend common.Backend
+	chunkSize         int
+	// refLock protects the reference counts, it is held while
+	// references are added or released and during the chunk sweep.
+	refLock sync.Mutex
+}
+
+// Name returns hcca
+func (h *HCCABackend) Name() string { return driverName }
+
+// Upload splits the file into chunks, stores chunks that are not
+// yet known and writes the manifest.
+func (h *HCCABackend) Upload(flake string, file *common.File, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".Upload", ctx)
+
+	if file == nil {
+		return common.ErrorSerializationFailure
+	}
+
+	if file.Flake != flake {
+		log.Debug("Flake mismatch, correcting flake in file")
+		file.Flake = flake
+	}
+
+	if isReserved(flake) {
+		log.Warn("Refusing upload to reserved name ", flake)
+		return ErrReservedName
+	}
+
+	if err := h.Exists(flake, ctx); err == nil {
+		return common.ErrorFileExists
+	}
+
+	chunks, m := splitChunks(file.Data, h.chunkSize)
+	log.Debugf("Split file into %d chunks, %d unique", len(m.Chunks), len(chunks))
+
+	// Chunks are written before taking the lock, addRef will
+	// write them again if the sweep removed them in between.
+	for hash, dat := range chunks {
+		if err := h.putChunk(hash, dat, ctx); err != nil {
+			log.Error("Could not store chunk: ", err)
+			return err
+		}
+	}
+
+	dat, err := m.encode()
+	if err != nil {
+		return err
+	}
+	var mFile = *file
+	mFile.Data = dat
+	mFile.Options = append(append([]common.FileOption{}, file.Options...),
+		OptionManifest)
+
+	h.refLock.Lock()
+	defer h.refLock.Unlock()
+
+	var added = []string{}
+	for _, hash := range m.uniqueChunks() {
+		if err := h.addRef(hash, chunks[hash], ctx); err != nil {
+			log.Error("Could not reference chunk: ", err)
+			h.releaseRefs(added, ctx)
+			return err
+		}
+		added = append(added, hash)
+	}
+
+	if err := h.underlyingBackend.Upload(flake, &mFile, ctx); err != nil {
+		log.Error("Could not store manifest: ", err)
+		h.releaseRefs(added, ctx)
+		return err
+	}
+
+	return nil
+}
+
+// Exists checks the underlying backend, chunks and reference counts
+// do not exist for external callers.
+func (h *HCCABackend) Exists(flake string, ctx context.Context) error {
+	if isReserved(flake) {
+		return common.NewErrorFileNotExists(flake, ErrReservedName)
+	}
+	return h.underlyingBackend.Exists(flake, ctx)
+}
+
+// Get loads the manifest and reassembles the file from it's chunks.
+// Files without manifest are passed through.
+func (h *HCCABackend) Get(flake string, ctx context.Context) (*common.File, error) {
+	log := logger.LogFromCtx(packageName+".Get", ctx)
+
+	if isReserved(flake) {
+		return nil, common.NewErrorFileNotExists(flake, ErrReservedName)
+	}
+
+	mFile, err := h.underlyingBackend.Get(flake, ctx)
+	if err != nil {
+		return mFile, err
+	}
+	if mFile == nil || !mFile.HasOption(OptionManifest) {
+		log.Debug("File has no manifest, passing through")
+		return mFile, nil
+	}
+
+	if mFile.DeleteAt != nil && mFile.DeleteAt.TTL() == 0 {
+		log.Info("Attempted to get expired file, deleting...")
+		if err := h.Delete(flake, ctx); err != nil {
+			log.Error("Error while deleting file: ", err)
+			return nil, err
+		}
+		return nil, common.ErrorExpired
+	}
+
+	m, err := decodeManifest(mFile.Data)
+	if err != nil {
+		log.Error("Could not decode manifest: ", err)
+		return nil, err
+	}
+
+	var buf = bytes.NewBuffer(make([]byte, 0, m.Size))
+	var loaded = map[string][]byte{}
+	for _, v := range m.Chunks {
+		hash := hex.EncodeToString(v)
+		dat, ok := loaded[hash]
+		if !ok {
+			dat, err = h.getChunk(hash, ctx)
+			if err != nil {
+				log.Error("Could not load chunk ", hash, ": ", err)
+				return nil, err
+			}
+			loaded[hash] = dat
+		}
+		buf.Write(dat)
+	}
+	if buf.Len() != m.Size {
+		log.Errorf("Reassembled %d bytes, expected %d", buf.Len(), m.Size)
+		return nil, ErrChunkCorrupt
+	}
+
+	// The underlying backend may hand out a shared pointer (ie fcache),
+	// so the assembled file must be a copy.
+	var ret = *mFile
+	ret.Data = buf.Bytes()
+	ret.Options = stripOptions(mFile.Options)
+	return &ret, nil
+}
+
+// Delete removes the manifest and releases the chunks of the file.
+// The chunks themselves are removed by RunGC.
+func (h *HCCABackend) Delete(flake string, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".Delete", ctx)
+
+	if isReserved(flake) {
+		return common.NewErrorFileNotExists(flake, ErrReservedName)
+	}
+
+	h.refLock.Lock()
+	defer h.refLock.Unlock()
+
+	mFile, err := h.underlyingBackend.Get(flake, ctx)
+	if err == nil && mFile != nil && mFile.HasOption(OptionManifest) {
+		m, err := decodeManifest(mFile.Data)
+		if err != nil {
+			log.Warn("Could not decode manifest, chunks are released on GC: ", err)
+		} else {
+			h.releaseRefs(m.uniqueChunks(), ctx)
+		}
+	}
+
+	return h.underlyingBackend.Delete(flake, ctx)
+}
+
+// ListGlob returns the files of all manifests, chunks and reference
+// counts are not listed.
+func (h *HCCABackend) ListGlob(ctx context.Context, prefix string) ([]*common.File, error) {
+	files, err := h.underlyingBackend.ListGlob(ctx, prefix)
+	var ret = []*common.File{}
+	for _, v := range files {
+		if v == nil || !v.HasOption(OptionManifest) {
+			continue
+		}
+		var f = *v
+		f.Data = []byte{}
+		f.Options = stripOptions(v.Options)
+		ret = append(ret, &f)
+	}
+	return ret, err
+}
+
+// RunGC removes expired files and then sweeps all chunks that are
+// no longer referenced.
+func (h *HCCABackend) RunGC(ctx context.Context) ([]common.File, error) {
+	return common.GenericGC(h, nil,
+		func(b common.Backend, log logger.Logger) error {
+			return h.sweepChunks(ctx, log)
+		}, ctx)
+}
+
+// RunMaintenance sweeps unreferenced chunks, it is used instead of
+// RunGC when an index removes expired files.
+func (h *HCCABackend) RunMaintenance(ctx context.Context) error {
+	return h.sweepChunks(ctx, logger.LogFromCtx(packageName+".RunMaintenance", ctx))
+}
+
+// sweepChunks recounts all references from the live manifests. Chunks
+// without references are deleted and reference counts that drifted,
+// ie because a manifest expired in the underlying backend, are fixed.
+func (h *HCCABackend) sweepChunks(ctx context.Context, log logger.Logger) error {
+	h.refLock.Lock()
+	defer h.refLock.Unlock()
+
+	files, err := h.underlyingBackend.ListGlob(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	var refs = map[string]int{}
+	var known = map[string]bool{}
+	for _, v := range files {
+		if v == nil {
+			continue
+		}
+		if hash := chunkHash(v); hash != "" {
+			known[hash] = true
+			continue
+		}
+		if !v.HasOption(OptionManifest) {
+			continue
+		}
+		if h.underlyingBackend.Exists(v.Flake, ctx) != nil {
+			// Expired in the underlying backend since listing
+			continue
+		}
+		mFile, err := h.underlyingBackend.Get(v.Flake, ctx)
+		if err == common.ErrorExpired {
+			continue
+		} else if err != nil {
+			log.Error("Could not load manifest of ", v.Flake, ", aborting sweep: ", err)
+			return err
+		}
+		m, err := decodeManifest(mFile.Data)
+		if err != nil {
+			log.Error("Could not decode manifest of ", v.Flake, ", aborting sweep: ", err)
+			return err
+		}
+		for _, hash := range m.uniqueChunks() {
+			refs[hash]++
+		}
+	}
+
+	var swept = 0
+	for hash := range known {
+		if refs[hash] == 0 {
+			if err := h.deleteIfExists(chunkName(hash), ctx); err != nil {
+				log.Error("Could not delete chunk ", hash, ": ", err)
+				continue
+			}
+			if err := h.deleteIfExists(refsName(hash), ctx); err != nil {
+				log.Error("Could not delete references of ", hash, ": ", err)
+			}
+			swept++
+			continue
+		}
+		stored, err := h.getRefs(hash, ctx)
+		if err != nil || stored != refs[hash] {
+			log.Warnf("Fixing reference count of %s from %d to %d", hash, stored, refs[hash])
+			if err := h.setRefs(hash, refs[hash], ctx); err != nil {
+				log.Error("Could not fix reference count: ", err)
+			}
+		}
+	}
+
+	log.Debugf("Swept %d chunks", swept)
+	return nil
+}
+
+// putChunk stores a chunk unless it already exists
+func (h *HCCABackend) putChunk(hash string, data []byte, ctx context.Context) error {
+	name := chunkName(hash)
+	if err := h.underlyingBackend.Exists(name, ctx); err == nil {
+		return nil
+	}
+	err := h.underlyingBackend.Upload(name, &common.File{
+		Flake:    name,
+		Data:     data,
+		DeleteAt: internalDeleteAt(),
+		Options:  []common.FileOption{OptionChunk},
+	}, ctx)
+	if err == common.ErrorFileExists {
+		return nil
+	}
+	return err
+}
+
+// getChunk loads a chunk and verifies it against it's hash
+func (h *HCCABackend) getChunk(hash string, ctx context.Context) ([]byte, error) {
+	f, err := h.underlyingBackend.Get(chunkName(hash), ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyChunk(hash, f.Data); err != nil {
+		return nil, err
+	}
+	return f.Data, nil
+}
+
+// addRef increments the reference count of a chunk, the refLock
+// must be held.
+func (h *HCCABackend) addRef(hash string, data []byte, ctx context.Context) error {
+	if err := h.putChunk(hash, data, ctx); err != nil {
+		return err
+	}
+	refs, err := h.getRefs(hash, ctx)
+	if err != nil {
+		return err
+	}
+	return h.setRefs(hash, refs+1, ctx)
+}
+
+// releaseRefs decrements the reference count of the chunks, errors
+// are only logged since the sweep corrects the counts. The refLock
+// must be held.
+func (h *HCCABackend) releaseRefs(hashes []string, ctx context.Context) {
+	log := logger.LogFromCtx(packageName+".releaseRefs", ctx)
+	for _, hash := range hashes {
+		refs, err := h.getRefs(hash, ctx)
+		if err != nil {
+			log.Warn("Could not load references of ", hash, ": ", err)
+			continue
+		}
+		if refs > 0 {
+			refs--
+		}
+		if err := h.setRefs(hash, refs, ctx); err != nil {
+			log.Warn("Could not release references of ", hash, ": ", err)
+		}
+	}
+}
+
+// getRefs returns the reference count of a chunk, missing counts are 0
+func (h *HCCABackend) getRefs(hash string, ctx context.Context) (int, error) {
+	name := refsName(hash)
+	if err := h.underlyingBackend.Exists(name, ctx); err != nil {
+		return 0, nil
+	}
+	f, err := h.underlyingBackend.Get(name, ctx)
+	if err != nil {
+		return 0, err
+	}
+	return decodeRefs(f.Data)
+}
+
+// setRefs replaces the reference count of a chunk
+func (h *HCCABackend) setRefs(hash string, refs int, ctx context.Context) error {
+	name := refsName(hash)
+	dat, err := encodeRefs(refs)
+	if err != nil {
+		return err
+	}
+	if err := h.deleteIfExists(name, ctx); err != nil {
+		return err
+	}
+	return h.underlyingBackend.Upload(name, &common.File{
+		Flake:    name,
+		Data:     dat,
+		DeleteAt: internalDeleteAt(),
+		Options:  []common.FileOption{OptionRefs},
+	}, ctx)
+}
+
+func (h *HCCABackend) deleteIfExists(name string, ctx context.Context) error {
+	if err := h.underlyingBackend.Exists(name, ctx); err != nil {
+		return nil
+	}
+	return h.underlyingBackend.Delete(name, ctx)
+}
+
+// stripOptions removes the manifest option from a file
+func stripOptions(options []common.FileOption) []common.FileOption {
+	var opts = []common.FileOption{}
+	for _, v := range options {
+		if v != OptionManifest {
+			opts = append(opts, v)
+		}
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+	return opts
+}
+
+// Close closes the underlying backend
+func (h *HCCABackend) Close(ctx context.Context) error {
+	return common.CloseBackend(h.underlyingBackend, ctx)
+}
@@ -0,0 +1,148 @@
+package hcca
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/backend/compl_test"
+	"github.com/stretchr/testify/assert"
+
+	_ "git.timschuster.info/rls.moe/catgi/backend/buntdb"
+)
+
+func getTestBackend(t *testing.T) *HCCABackend {
+	be, err := NewHCCABackend(map[string]interface{}{
+		"driver": "buntdb",
+		"params": map[string]interface{}{
+			"file": ":memory:",
+		},
+		"chunk_size": 16,
+	}, compltest.GetTestCtx())
+
+	if err != nil {
+		t.Log("Error on creating Testing Backend: ", err)
+		t.FailNow()
+	}
+	return be.(*HCCABackend)
+}
+
+func countChunks(t *testing.T, be *HCCABackend) int {
+	files, err := be.underlyingBackend.ListGlob(compltest.GetTestCtx(), "")
+	assert.NoError(t, err)
+	var n = 0
+	for _, v := range files {
+		if v.HasOption(OptionChunk) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestCompliance(t *testing.T) {
+	compltest.RunTestSuite(getTestBackend(t), t)
+}
+
+func TestDeduplication(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4)
+	data = append(data, []byte("tail")...)
+
+	for _, flake := range []string{"dedup-1", "dedup-2"} {
+		assert.NoError(be.Upload(flake, &common.File{
+			Data:     data,
+			DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+		}, ctx))
+	}
+
+	assert.Equal(2, countChunks(t, be), "Repeated chunks must be stored once")
+
+	refs, err := be.getRefs(hex16(data[:16]), ctx)
+	assert.NoError(err)
+	assert.Equal(2, refs)
+
+	f, err := be.Get("dedup-2", ctx)
+	assert.NoError(err)
+	assert.EqualValues(data, f.Data)
+	assert.False(f.HasOption(OptionManifest))
+
+	files, err := be.ListGlob(ctx, "")
+	assert.NoError(err)
+	assert.Len(files, 2)
+}
+
+func TestChunkGC(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	shared := bytes.Repeat([]byte("s"), 16)
+	assert.NoError(be.Upload("gc-live", &common.File{
+		Data:     shared,
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, ctx))
+	assert.NoError(be.Upload("gc-dead", &common.File{
+		Data:     append(append([]byte{}, shared...), []byte("unique")...),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, ctx))
+	assert.Equal(2, countChunks(t, be))
+
+	assert.NoError(be.Delete("gc-dead", ctx))
+	assert.Equal(2, countChunks(t, be), "Chunks must only be removed by GC")
+
+	_, err := be.RunGC(ctx)
+	assert.NoError(err)
+	assert.Equal(1, countChunks(t, be), "Unreferenced chunk must be removed")
+
+	f, err := be.Get("gc-live", ctx)
+	assert.NoError(err)
+	assert.EqualValues(shared, f.Data)
+}
+
+func TestReservedNames(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	be := getTestBackend(t)
+
+	data := bytes.Repeat([]byte("r"), 16)
+	assert.NoError(be.Upload("reserved", &common.File{
+		Data:     data,
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, ctx))
+
+	hash := hex16(data)
+	for _, name := range []string{chunkName(hash), refsName(hash)} {
+		assert.NoError(be.underlyingBackend.Exists(name, ctx))
+		assert.True(common.IsFileNotExists(be.Exists(name, ctx)),
+			"Chunk storage must not exist for callers")
+		_, err := be.Get(name, ctx)
+		assert.True(common.IsFileNotExists(err), "Chunk storage must not be readable")
+		assert.Error(be.Delete(name, ctx))
+		assert.NoError(be.underlyingBackend.Exists(name, ctx))
+	}
+
+	assert.Equal(ErrReservedName, be.Upload(chunkName(hash), &common.File{
+		Data:     []byte("not the chunk"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, ctx))
+
+	f, err := be.Get("reserved", ctx)
+	assert.NoError(err)
+	assert.EqualValues(data, f.Data)
+}
+
+func hex16(dat []byte) string {
+	chunks, _ := splitChunks(dat, 16)
+	for k := range chunks {
+		return k
+	}
+	return ""
+}
+
+func TestBufferedStream(t *testing.T) {
+	compltest.RunBufferedStreamTest(getTestBackend(t), t)
+}
@@ -0,0 +1,123 @@
+package hcca
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"golang.org/x/crypto/blake2b"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// OptionManifest marks the file holding the chunk list of a flake
+const OptionManifest common.FileOption = "hcca_manifest"
+
+// OptionChunk marks a file holding the data of a chunk
+const OptionChunk common.FileOption = "hcca_chunk"
+
+// OptionRefs marks a file holding the reference count of a chunk
+const OptionRefs common.FileOption = "hcca_refs"
+
+// ErrChunkCorrupt is returned when a chunk does not match it's hash
+var ErrChunkCorrupt = errors.New("Chunk does not match hash")
+
+// ErrReservedName is returned when a flake uses the name of a chunk
+// or reference count
+var ErrReservedName = errors.New("Name is reserved for chunk storage")
+
+// manifest is stored as the data of a flake in the underlying backend
+type manifest struct {
+	// Chunks is the ordered list of chunk hashes
+	Chunks [][]byte `msgpack:"chunks"`
+	// Size is the length of the file
+	Size int `msgpack:"size"`
+}
+
+func (m *manifest) encode() ([]byte, error) {
+	return msgpack.Marshal(m)
+}
+
+func decodeManifest(dat []byte) (*manifest, error) {
+	var m = &manifest{}
+	return m, msgpack.Unmarshal(dat, m)
+}
+
+// uniqueChunks returns every chunk hash of the manifest once
+func (m *manifest) uniqueChunks() []string {
+	var seen = map[string]bool{}
+	var ret = []string{}
+	for _, v := range m.Chunks {
+		h := hex.EncodeToString(v)
+		if !seen[h] {
+			seen[h] = true
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+// splitChunks splits data into chunks of atmost size bytes and
+// returns them with the manifest listing them.
+func splitChunks(data []byte, size int) (map[string][]byte, *manifest) {
+	var chunks = map[string][]byte{}
+	var m = &manifest{Chunks: [][]byte{}, Size: len(data)}
+	for start := 0; start < len(data); start += size {
+		end := start + size
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := blake2b.Sum256(data[start:end])
+		m.Chunks = append(m.Chunks, hash[:])
+		chunks[hex.EncodeToString(hash[:])] = data[start:end]
+	}
+	return chunks, m
+}
+
+// verifyChunk checks the chunk data against the hex encoded hash
+func verifyChunk(hash string, data []byte) error {
+	sum := blake2b.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return ErrChunkCorrupt
+	}
+	return nil
+}
+
+// reservedPrefix is put in front of the names of chunks and reference
+// counts. Names with this prefix are refused for external callers so
+// chunks cannot be read or overwritten as if they were flakes.
+const reservedPrefix = "hcca."
+
+func chunkName(hash string) string { return reservedPrefix + "chunk-" + hash }
+func refsName(hash string) string  { return reservedPrefix + "refs-" + hash }
+
+// isReserved returns true if the name belongs to a chunk or a
+// reference count.
+func isReserved(name string) bool { return strings.HasPrefix(name, reservedPrefix) }
+
+// chunkHash returns the hash of a chunk or refs file name
+func chunkHash(f *common.File) string {
+	switch {
+	case f.HasOption(OptionChunk):
+		return strings.TrimPrefix(f.Flake, chunkName(""))
+	case f.HasOption(OptionRefs):
+		return strings.TrimPrefix(f.Flake, refsName(""))
+	}
+	return ""
+}
+
+// internalDeleteAt is used for chunks and reference counts, they
+// are removed by the chunk store GC and not by the underlying backend.
+func internalDeleteAt() *common.DateOnlyTime {
+	return common.FromTime(time.Now().UTC().AddDate(100, 0, 0))
+}
+
+func encodeRefs(refs int) ([]byte, error) {
+	return msgpack.Marshal(refs)
+}
+
+func decodeRefs(dat []byte) (int, error) {
+	var refs int
+	return refs, msgpack.Unmarshal(dat, &refs)
+}
@@ -0,0 +1,62 @@
+package hcca
+
+import (
+	"context"
+	"fmt"
+
+	"git.timschuster.info/rls.moe/catgi/backend"
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+const packageName = "backend/hcca"
+const driverName = "hcca"
+
+// DefaultChunkSize is the chunk size suggested by the erasure paper
+const DefaultChunkSize = 4 * 1024
+
+type hccaConfig struct {
+	// Underlying Backend Driver
+	Driver string `cgc:"driver"`
+	// Underlying Backend Driver Configuration
+	DriverConfig map[string]interface{} `cgc:"params"`
+	// ChunkSize is the maximum size of a chunk. Changing it only
+	// affects new uploads but files will no longer deduplicate
+	// against files uploaded with the old size.
+	ChunkSize int `cgc:"chunk_size"`
+}
+
+func init() {
+	backend.NewDriver(driverName, NewHCCABackend)
+}
+
+// NewHCCABackend creates the underlying backend for the chunk store.
+func NewHCCABackend(params map[string]interface{}, ctx context.Context) (common.Backend, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	log.Debug("Loading Config")
+	var config = &hccaConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("chunk_size", DefaultChunkSize),
+		common.ConfigMustHave("driver"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ChunkSize < 1 {
+		return nil, fmt.Errorf("Chunk size must be positive, is %d", config.ChunkSize)
+	}
+
+	ub, err := backend.NewBackend(config.Driver, config.DriverConfig, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Using chunks of %d bytes", config.ChunkSize)
+
+	return &HCCABackend{
+		underlyingBackend: ub,
+		chunkSize:         config.ChunkSize,
+	}, nil
+}
@@ -0,0 +1,225 @@
+// Package instrument provides a backend that records latencies and
+// errors of every operation of the backend it wraps. It can be put
+// anywhere in the backend onion, the label tells the layers apart.
+package instrument
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend"
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/metrics"
+)
+
+type instrumentConfig struct {
+	// Underlying Backend Driver
+	Driver string `cgc:"driver"`
+	// Underlying Backend Driver Configuration
+	DriverConfig map[string]interface{} `cgc:"params"`
+	// Label is the value of the backend label of the metrics,
+	// defaults to the name of the underlying backend.
+	Label string `cgc:"label"`
+}
+
+const driverName = "instrument"
+
+var (
+	operations = metrics.Default.NewCounter("catgi_backend_operations_total",
+		"Backend operations by result, ok, not_found or error",
+		"backend", "op", "result")
+	durations = metrics.Default.NewHistogram("catgi_backend_operation_duration_seconds",
+		"Latency of backend operations, readers until the data is returned",
+		metrics.DefBuckets, "backend", "op")
+)
+
+func init() {
+	backend.NewDriver(driverName, NewInstrumentBackend)
+}
+
+// Instrument passes all calls to the underlying backend and records
+// them in the default metrics registry.
+type Instrument struct {
+	underlyingBackend common.Backend
+	label             string
+
+	mu    sync.Mutex
+	stats map[string]common.OperationStatistics
+}
+
+func NewInstrumentBackend(params map[string]interface{}, ctx context.Context) (common.Backend, error) {
+	var config = &instrumentConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("label", ""),
+		common.ConfigMustHave("driver"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ub, err := backend.NewBackend(config.Driver, config.DriverConfig, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewInstrument(ub, config.Label), nil
+}
+
+// NewInstrument wraps the backend, an empty label is replaced by the
+// name of the backend.
+func NewInstrument(b common.Backend, label string) *Instrument {
+	if len(label) == 0 {
+		label = b.Name()
+	}
+	return &Instrument{
+		underlyingBackend: b,
+		label:             label,
+		stats:             map[string]common.OperationStatistics{},
+	}
+}
+
+// observe records an operation that started at start
+func (n *Instrument) observe(op string, start time.Time, err error) {
+	took := time.Since(start)
+	result := "ok"
+	switch {
+	case err == nil || common.IsHTTPOption(err):
+	case common.IsFileNotExists(err) || err == common.ErrorExpired:
+		result = "not_found"
+	default:
+		result = "error"
+	}
+	operations.Inc(n.label, op, result)
+	durations.Observe(took.Seconds(), n.label, op)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := n.stats[op]
+	s.Calls++
+	if result == "error" {
+		s.Errors++
+	}
+	s.Time += took
+	n.stats[op] = s
+}
+
+func (n *Instrument) Name() string { return n.underlyingBackend.Name() }
+
+func (n *Instrument) Upload(flake string, file *common.File, ctx context.Context) (err error) {
+	defer func(start time.Time) { n.observe("upload", start, err) }(time.Now())
+	return n.underlyingBackend.Upload(flake, file, ctx)
+}
+
+func (n *Instrument) Exists(flake string, ctx context.Context) (err error) {
+	defer func(start time.Time) { n.observe("exists", start, err) }(time.Now())
+	return n.underlyingBackend.Exists(flake, ctx)
+}
+
+func (n *Instrument) Get(flake string, ctx context.Context) (f *common.File, err error) {
+	defer func(start time.Time) { n.observe("get", start, err) }(time.Now())
+	return n.underlyingBackend.Get(flake, ctx)
+}
+
+func (n *Instrument) Delete(flake string, ctx context.Context) (err error) {
+	defer func(start time.Time) { n.observe("delete", start, err) }(time.Now())
+	return n.underlyingBackend.Delete(flake, ctx)
+}
+
+func (n *Instrument) ListGlob(ctx context.Context, prefix string) (files []*common.File, err error) {
+	defer func(start time.Time) { n.observe("list", start, err) }(time.Now())
+	return n.underlyingBackend.ListGlob(ctx, prefix)
+}
+
+func (n *Instrument) RunGC(ctx context.Context) (files []common.File, err error) {
+	defer func(start time.Time) { n.observe("gc", start, err) }(time.Now())
+	return n.underlyingBackend.RunGC(ctx)
+}
+
+// UploadReader streams into the underlying backend, backends without
+// streaming support are adapted.
+func (n *Instrument) UploadReader(flake string, file *common.File, data io.ReadSeeker, ctx context.Context) (err error) {
+	defer func(start time.Time) { n.observe("upload_reader", start, err) }(time.Now())
+	return common.NewStreamAdapter(n.underlyingBackend).UploadReader(flake, file, data, ctx)
+}
+
+// GetReader only measures the time until the reader is returned, not
+// reading the data.
+func (n *Instrument) GetReader(flake string, ctx context.Context) (f *common.File, r io.ReadCloser, err error) {
+	defer func(start time.Time) { n.observe("get_reader", start, err) }(time.Now())
+	return common.NewStreamAdapter(n.underlyingBackend).GetReader(flake, ctx)
+}
+
+// WriteReader passes raw objects to the underlying backend
+func (n *Instrument) WriteReader(name string, data io.ReadSeeker, ctx context.Context) (err error) {
+	defer func(start time.Time) { n.observe("write_reader", start, err) }(time.Now())
+	return common.NewStreamAdapter(n.underlyingBackend).WriteReader(name, data, ctx)
+}
+
+// ReadReader reads raw objects from the underlying backend
+func (n *Instrument) ReadReader(name string, ctx context.Context) (r io.ReadCloser, err error) {
+	defer func(start time.Time) { n.observe("read_reader", start, err) }(time.Now())
+	return common.NewStreamAdapter(n.underlyingBackend).ReadReader(name, ctx)
+}
+
+// RunMaintenance passes maintenance to the underlying backend
+func (n *Instrument) RunMaintenance(ctx context.Context) (err error) {
+	m, ok := n.underlyingBackend.(common.BackendWithMaintenance)
+	if !ok {
+		return nil
+	}
+	defer func(start time.Time) { n.observe("maintenance", start, err) }(time.Now())
+	return m.RunMaintenance(ctx)
+}
+
+// Close closes the underlying backend
+func (n *Instrument) Close(ctx context.Context) error {
+	return common.CloseBackend(n.underlyingBackend, ctx)
+}
+
+// Statistics returns the operations of this backend since start
+func (n *Instrument) Statistics() map[string]common.OperationStatistics {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var stats = map[string]common.OperationStatistics{}
+	for k, v := range n.stats {
+		stats[k] = v
+	}
+	return stats
+}
+
+// GetOptions returns BackendOptionStatistics and
+// BackendOptionDirectReaderIO if the underlying backend supports
+// streaming.
+func (n *Instrument) GetOptions() common.BackendOption {
+	var opts = common.BackendOptionStatistics
+	if common.BackendHasOptions(n.underlyingBackend, common.BackendOptionDirectReaderIO) {
+		opts |= common.BackendOptionDirectReaderIO
+	}
+	return opts
+}
+
+// GetFirstWith returns the instrument if it has the options, otherwise
+// the underlying backend is asked.
+func (n *Instrument) GetFirstWith(options common.BackendOption) common.Backend {
+	if n.GetOptions()&options == options {
+		return n
+	}
+	if ob, ok := n.underlyingBackend.(common.OnionBackend); ok {
+		return ob.GetFirstWith(options)
+	}
+	return nil
+}
+
+// GetAllWith returns the instrument and all underlying backends with
+// the options.
+func (n *Instrument) GetAllWith(options common.BackendOption) []common.Backend {
+	var ret = []common.Backend{}
+	if n.GetOptions()&options == options {
+		ret = append(ret, n)
+	}
+	if ob, ok := n.underlyingBackend.(common.OnionBackend); ok {
+		ret = append(ret, ob.GetAllWith(options)...)
+	}
+	return ret
+}
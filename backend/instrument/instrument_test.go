@@ -0,0 +1,41 @@
+package instrument
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/backend/compl_test"
+
+	_ "git.timschuster.info/rls.moe/catgi/backend/buntdb"
+)
+
+func getTestDB() (common.Backend, error) {
+	return NewInstrumentBackend(map[string]interface{}{
+		"driver": "buntdb",
+		"params": map[string]interface{}{
+			"file": ":memory:",
+		},
+		"label": "test",
+	}, compltest.GetTestCtx())
+}
+
+func TestCompliance(t *testing.T) {
+	instrumentWithBuntdb, err := getTestDB()
+
+	if err != nil {
+		t.Log("Error on creating Testing Backend: ", err)
+		t.FailNow()
+		return
+	}
+
+	compltest.RunTestSuite(instrumentWithBuntdb, t)
+
+	assert := assert.New(t)
+	stats := instrumentWithBuntdb.(common.BackendStatistics).Statistics()
+	assert.NotZero(stats["upload"].Calls, "Uploads must be counted")
+	assert.NotZero(operations.Value("test", "get", "ok"), "Metrics must be recorded")
+	assert.NotZero(durations.Count("test", "get"))
+	assert.True(common.BackendHasOptions(instrumentWithBuntdb, common.BackendOptionStatistics))
+}
@@ -111,22 +111,17 @@ func (l *LocalFSBackend) Get(name string, ctx context.Context) (*common.File, er
 	l.rwlock.RLock()
 	defer l.rwlock.RUnlock()
 
-	filePath := l.getPath(name)
-
-	var file = &common.File{}
-
-	dat, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, err
-	}
-
-	err = msgpack.Unmarshal(dat, file)
+	file, err := l.readMeta(name)
 	if err != nil {
 		return file, err
 	}
 
-	if file.Data == nil {
-		file.Data = []byte{}
+	// Files stored via UploadReader keep their data in a separate file
+	dat, err := ioutil.ReadFile(l.getDataPath(name))
+	if err == nil {
+		file.Data = dat
+	} else if !os.IsNotExist(err) {
+		return nil, err
 	}
 
 	return file, nil
@@ -136,6 +131,9 @@ func (l *LocalFSBackend) Delete(name string, ctx context.Context) error {
 	l.rwlock.Lock()
 	defer l.rwlock.Unlock()
 
+	if err := os.Remove(l.getDataPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return os.Remove(l.getPath(name))
 }
 
@@ -150,7 +148,8 @@ func (l *LocalFSBackend) ListGlob(ctx context.Context, prefix string) ([]*common
 		func(path string, info os.FileInfo, err error) error {
 			internalPath := strings.TrimPrefix(path, l.getRoot())
 			log.Debug("Descending on '", path, "'")
-			if strings.HasPrefix(internalPath, prefix) && !info.IsDir() {
+			if strings.HasPrefix(internalPath, prefix) && !info.IsDir() &&
+				isFullFile(internalPath) {
 				dat, err := ioutil.ReadFile(path)
 				if err != nil {
 					log.Error("Error on Read: ", err, " -> ", internalPath)
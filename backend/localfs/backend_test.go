@@ -1,14 +1,18 @@
 package localfs
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"testing"
 
 	"time"
 
 	"os"
 
+	"git.timschuster.info/rls.moe/catgi/backend/common"
 	"git.timschuster.info/rls.moe/catgi/backend/compl_test"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestCompliance(t *testing.T) {
@@ -30,3 +34,61 @@ func TestCompliance(t *testing.T) {
 	//t.Skip("Skipping test due to incomplete implementation.")
 	compltest.RunTestSuite(localfs, t)
 }
+
+func TestDirectReaderIO(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	tmpDir := "/tmp/test-catgi-stream-" + fmt.Sprintf("%d", time.Now().Unix()) + "/"
+	os.MkdirAll(tmpDir, 0700)
+	be, err := NewLocalFSBackend(map[string]interface{}{
+		"root":     tmpDir,
+		"abs_root": true,
+	}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+
+	assert.True(common.BackendHasOptions(be, common.BackendOptionDirectReaderIO))
+	stream := common.NewStreamAdapter(be)
+
+	data := bytes.Repeat([]byte("stream"), 1024)
+	file := &common.File{
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}
+	assert.NoError(stream.UploadReader("stream-test", file, bytes.NewReader(data), ctx))
+
+	f, reader, err := stream.GetReader("stream-test", ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	dat, err := ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.NoError(reader.Close())
+	assert.EqualValues(data, dat)
+	assert.Len(f.Data, 0)
+
+	f, err = be.Get("stream-test", ctx)
+	assert.NoError(err)
+	assert.EqualValues(data, f.Data)
+
+	files, err := be.ListGlob(ctx, "")
+	assert.NoError(err)
+	assert.Len(files, 1)
+
+	assert.NoError(be.Delete("stream-test", ctx))
+	_, err = os.Stat(tmpDir + common.DataName("stream-test", 2))
+	assert.True(os.IsNotExist(err))
+
+	raw := be.(common.BackendDirectIOReader)
+	assert.NoError(raw.WriteReader("raw-test", bytes.NewReader(data), ctx))
+	reader, err = raw.ReadReader("raw-test", ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	dat, err = ioutil.ReadAll(reader)
+	assert.NoError(err)
+	assert.NoError(reader.Close())
+	assert.EqualValues(data, dat)
+	_, err = raw.ReadReader("raw-missing", ctx)
+	assert.True(common.IsFileNotExists(err))
+}
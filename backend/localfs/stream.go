@@ -0,0 +1,193 @@
+package localfs
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// UploadReader stores the file data in a data.bin next to the
+// metadata. The data is written to a temporary file first so the
+// backend is not locked while the upload is copied.
+func (l *LocalFSBackend) UploadReader(name string, file *common.File, data io.ReadSeeker, ctx context.Context) error {
+	name = common.EscapeName(name)
+
+	if file == nil {
+		return common.ErrorSerializationFailure
+	}
+
+	log := logger.LogFromCtx(packageName+".UploadReader", ctx)
+
+	if file.Flake != name {
+		log.Debug("Flake mismatch, correcting flake in file")
+		file.Flake = name
+	}
+
+	filePath := l.getPath(name)
+	dataPath := l.getDataPath(name)
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		return common.ErrorFileExists
+	}
+
+	os.MkdirAll(filepath.Dir(filePath), 0700)
+	tmpPath := dataPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	n, err := io.Copy(f, data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Debugf("Wrote %d bytes to temporary file", n)
+
+	var meta = *file
+	meta.Data = []byte{}
+	dat, err := msgpack.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	l.rwlock.Lock()
+	defer l.rwlock.Unlock()
+
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		return common.ErrorFileExists
+	}
+
+	if err := os.Rename(tmpPath, dataPath); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filePath, dat, 0600); err != nil {
+		os.Remove(dataPath)
+		os.Remove(filePath)
+		return err
+	}
+
+	return nil
+}
+
+// GetReader opens the data.bin of the file, files stored with
+// Upload are served from memory.
+func (l *LocalFSBackend) GetReader(name string, ctx context.Context) (*common.File, io.ReadCloser, error) {
+	l.rwlock.RLock()
+	defer l.rwlock.RUnlock()
+
+	file, err := l.readMeta(name)
+	if err != nil {
+		return file, nil, err
+	}
+
+	dataFile, err := os.Open(l.getDataPath(name))
+	if os.IsNotExist(err) {
+		reader := common.NewBytesReadCloser(file.Data)
+		file.Data = []byte{}
+		return file, reader, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	return file, dataFile, nil
+}
+
+// WriteReader stores a raw object below raw/ in the root, unlike
+// files existing objects are overwritten.
+func (l *LocalFSBackend) WriteReader(name string, data io.ReadSeeker, ctx context.Context) error {
+	rawPath := l.getRawPath(name)
+	os.MkdirAll(filepath.Dir(rawPath), 0700)
+	f, err := os.Create(rawPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rawPath + ".tmp")
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(rawPath+".tmp", rawPath)
+}
+
+// ReadReader opens a raw object stored with WriteReader
+func (l *LocalFSBackend) ReadReader(name string, ctx context.Context) (io.ReadCloser, error) {
+	f, err := os.Open(l.getRawPath(name))
+	if os.IsNotExist(err) {
+		return nil, common.NewErrorFileNotExists(name, err)
+	}
+	return f, err
+}
+
+// GetOptions returns the options of the localfs backend
+func (l *LocalFSBackend) GetOptions() common.BackendOption {
+	return common.BackendOptionDirectReaderIO
+}
+
+// GetFirstWith returns the backend itself if it has the options
+func (l *LocalFSBackend) GetFirstWith(options common.BackendOption) common.Backend {
+	if l.GetOptions()&options == options {
+		return l
+	}
+	return nil
+}
+
+// GetAllWith returns the backend itself if it has the options
+func (l *LocalFSBackend) GetAllWith(options common.BackendOption) []common.Backend {
+	if l.GetOptions()&options == options {
+		return []common.Backend{l}
+	}
+	return []common.Backend{}
+}
+
+func (l *LocalFSBackend) readMeta(name string) (*common.File, error) {
+	var file = &common.File{}
+
+	dat, err := ioutil.ReadFile(l.getPath(name))
+	if os.IsNotExist(err) {
+		return nil, common.NewErrorFileNotExists(name, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = msgpack.Unmarshal(dat, file)
+	if err != nil {
+		return file, err
+	}
+
+	if file.Data == nil {
+		file.Data = []byte{}
+	}
+
+	return file, nil
+}
+
+func (l *LocalFSBackend) getDataPath(name string) string {
+	name = common.EscapeName(name)
+
+	return filepath.Join(l.getRoot(), common.DataName(name, 2))
+}
+
+func (l *LocalFSBackend) getRawPath(name string) string {
+	return filepath.Join(l.getRoot(), "raw", common.EscapeName(name))
+}
+
+// isFullFile checks if a path below the root is the metadata of a file
+func isFullFile(internalPath string) bool {
+	return common.IsFullFile(strings.TrimPrefix(internalPath, "/"), "msgpack")
+}
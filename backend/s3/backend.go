@@ -2,6 +2,7 @@ package s3
 
 import (
 	"context"
+	"io"
 	"time"
 
 	msgpack "gopkg.in/vmihailenco/msgpack.v2"
@@ -74,36 +75,11 @@ func (s *S3Backend) Exists(flake string, ctx context.Context) error {
 
 func (s *S3Backend) Get(flake string, ctx context.Context) (*common.File, error) {
 	log := logger.LogFromCtx(packageName+".Get", ctx).WithField("object", flake)
-	var file = &common.File{}
 	dataName := common.DataName(flake, skipSize)
-	metaName := common.MetaName(flake, skipSize, metaFormat)
 
-	{
-		log.Debug("Loading MetaFile")
-		dat, err := s.ReadBytes(flake, ctx)
-		if err != nil {
-			return nil, err
-		}
-		log.Debug("Unmarshalling MetaFile")
-		err = msgpack.Unmarshal(dat, file)
-		if err != nil {
-			return nil, err
-		}
-		log.Debug("Checking if File is expired")
-		if file.DeleteAt.TTL() == 0 {
-			log.Info("Attempted to get expired file, deleting...")
-			err := s.DeleteKey(dataName, ctx)
-			if err != nil {
-				log.Error("Error while deleting data file: ", err)
-				return nil, err
-			}
-			err = s.DeleteKey(metaName, ctx)
-			if err != nil {
-				log.Error("Error while deleting meta file: ", err)
-				return nil, err
-			}
-			return nil, common.ErrorExpired
-		}
+	file, err := s.getMeta(flake, ctx)
+	if err != nil {
+		return nil, err
 	}
 
 	{
@@ -119,6 +95,94 @@ func (s *S3Backend) Get(flake string, ctx context.Context) (*common.File, error)
 	return file, nil
 }
 
+// UploadReader writes the metadata and then streams the data into
+// the data object.
+func (s *S3Backend) UploadReader(flake string, file *common.File, data io.ReadSeeker, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".UploadReader", ctx)
+	log.Debug("Creating object '", flake, "'")
+	file.CreatedAt = common.FromTime(time.Now().UTC())
+	dataName := common.DataName(flake, skipSize)
+	metaName := common.MetaName(flake, skipSize, metaFormat)
+
+	var meta = *file
+	meta.Data = []byte{}
+
+	dat, err := msgpack.Marshal(meta)
+	if err != nil {
+		log.Error("Error encoding file metadata", err)
+		return err
+	}
+
+	if err := s.WriteBytes(metaName, dat, ctx); err != nil {
+		log.Error("Error writing metadata ", err)
+		return err
+	}
+
+	if err := s.WriteReader(dataName, data, ctx); err != nil {
+		log.Error("Error writing data ", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetReader returns the body of the data object as reader.
+func (s *S3Backend) GetReader(flake string, ctx context.Context) (*common.File, io.ReadCloser, error) {
+	log := logger.LogFromCtx(packageName+".GetReader", ctx).WithField("object", flake)
+	dataName := common.DataName(flake, skipSize)
+
+	file, err := s.getMeta(flake, ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	log.Debug("Opening Data for File")
+	reader, err := s.ReadReader(dataName, ctx)
+	if err != nil {
+		log.Error("Error while reading data file: ", err)
+		return nil, nil, err
+	}
+
+	return file, reader, nil
+}
+
+// getMeta loads the metadata of a file and deletes the file if
+// it is expired.
+func (s *S3Backend) getMeta(flake string, ctx context.Context) (*common.File, error) {
+	log := logger.LogFromCtx(packageName+".getMeta", ctx).WithField("object", flake)
+	var file = &common.File{}
+	dataName := common.DataName(flake, skipSize)
+	metaName := common.MetaName(flake, skipSize, metaFormat)
+
+	log.Debug("Loading MetaFile")
+	dat, err := s.ReadBytes(metaName, ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Unmarshalling MetaFile")
+	err = msgpack.Unmarshal(dat, file)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Checking if File is expired")
+	if file.DeleteAt.TTL() == 0 {
+		log.Info("Attempted to get expired file, deleting...")
+		err := s.DeleteKey(dataName, ctx)
+		if err != nil {
+			log.Error("Error while deleting data file: ", err)
+			return nil, err
+		}
+		err = s.DeleteKey(metaName, ctx)
+		if err != nil {
+			log.Error("Error while deleting meta file: ", err)
+			return nil, err
+		}
+		return nil, common.ErrorExpired
+	}
+	file.Data = []byte{}
+	return file, nil
+}
+
 func (s *S3Backend) Delete(flake string, ctx context.Context) error {
 	dataName := common.DataName(flake, skipSize)
 	metaName := common.MetaName(flake, skipSize, metaFormat)
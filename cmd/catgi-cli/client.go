@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// session is the login cached between invocations, together with
+// the delete tokens of files uploaded by the cli.
+type session struct {
+	Server       string            `json:"server"`
+	Token        string            `json:"token"`
+	DeleteTokens map[string]string `json:"delete_tokens,omitempty"`
+}
+
+// client talks to a catgi server, authenticating with the API token
+// or the cached auth cookie if there is one.
+type client struct {
+	server       string
+	sessionFile  string
+	token        string
+	apiToken     string
+	deleteTokens map[string]string
+	http         *http.Client
+}
+
+// apiFile mirrors the file object of the JSON API
+type apiFile struct {
+	Flake       string `json:"flake"`
+	URL         string `json:"url"`
+	Path        string `json:"path"`
+	Owner       string `json:"owner"`
+	Size        int64  `json:"size"`
+	Mime        string `json:"mime"`
+	Extension   string `json:"ext"`
+	Public      bool   `json:"public"`
+	CreatedAt   string `json:"created_at"`
+	ExpiresAt   string `json:"expires_at"`
+	DeleteToken string `json:"delete_token"`
+}
+
+type apiError struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func defaultSessionFile() string {
+	if home := os.Getenv("HOME"); len(home) > 0 {
+		return filepath.Join(home, ".catgi-session")
+	}
+	return ".catgi-session"
+}
+
+// newClient loads the session file, if the server is empty the server
+// of the session is used. An API token is used instead of the login
+// of the session.
+func newClient(server, sessionFile, apiToken string) (*client, error) {
+	c := &client{
+		server:      strings.TrimRight(server, "/"),
+		sessionFile: sessionFile,
+		apiToken:    apiToken,
+		http: &http.Client{
+			Timeout: 10 * time.Minute,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	var s session
+	if data, err := ioutil.ReadFile(sessionFile); err == nil {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("session file %s is corrupt: %s", sessionFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(c.server) == 0 {
+		c.server = strings.TrimRight(s.Server, "/")
+	}
+	// Only use the session with the server it was issued by
+	c.deleteTokens = map[string]string{}
+	if c.server == strings.TrimRight(s.Server, "/") {
+		c.token = s.Token
+		if s.DeleteTokens != nil {
+			c.deleteTokens = s.DeleteTokens
+		}
+	}
+	return c, nil
+}
+
+// saveSession writes the current server and token to the session file
+func (c *client) saveSession() error {
+	data, err := json.Marshal(&session{
+		Server:       c.server,
+		Token:        c.token,
+		DeleteTokens: c.deleteTokens,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.sessionFile, data, 0600)
+}
+
+// newRequest builds a request against the server, path is relative
+// to the server URL.
+func (c *client) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+	if len(c.server) == 0 {
+		return nil, errors.New("no server given, use -server or $CATGI_SERVER")
+	}
+	req, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.apiToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	} else if len(c.token) > 0 {
+		req.AddCookie(&http.Cookie{Name: "auth", Value: c.token})
+	}
+	return req, nil
+}
+
+// doAPI sends the request and decodes the JSON response into out,
+// errors of the API are returned as go errors.
+func (c *client) doAPI(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return readError(resp)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// readError turns an error response, JSON or plain, into an error
+func readError(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var apiErr apiError
+	if err := json.Unmarshal(data, &apiErr); err == nil && len(apiErr.Error.Code) > 0 {
+		return fmt.Errorf("%s: %s", apiErr.Error.Code, apiErr.Error.Message)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+}
+
+// parseFlake accepts a flake or an URL of a file and returns the flake
+// and the URL fragment, if any.
+func parseFlake(s string) (string, string, error) {
+	if !strings.Contains(s, "/") {
+		return s, "", nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i, p := range parts {
+		if (p == "f" || p == "file" || p == "files") && i+1 < len(parts) {
+			return parts[i+1], u.Fragment, nil
+		}
+	}
+	return "", "", fmt.Errorf("'%s' is not a file URL", s)
+}
@@ -0,0 +1,806 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"github.com/howeyc/gopass"
+)
+
+func cmdLogin(c *client, args []string) error {
+	var user string
+	if len(args) > 0 {
+		user = args[0]
+	} else {
+		fmt.Fprint(os.Stderr, "Username: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		user = strings.TrimSpace(line)
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	pass, err := gopass.GetPasswdMasked()
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"user": {user}, "pass": {string(pass)}}
+	req, err := c.newRequest("POST", "/auth", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	factor := resp.Header.Get("X-Catgi-Second-Factor")
+	if resp.StatusCode == http.StatusSeeOther && len(factor) > 0 {
+		resp, err = loginSecondFactor(c, resp, factor)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "auth" {
+			c.token = cookie.Value
+			if factor == "enroll" {
+				// The response lists the recovery codes
+				io.Copy(os.Stdout, resp.Body)
+			}
+			fmt.Fprintf(os.Stderr, "Logged in as %s\n", user)
+			return c.saveSession()
+		}
+	}
+	return errors.New("server did not return an auth token")
+}
+
+// loginSecondFactor asks for the code of a login waiting for the second
+// factor, if the server requires it an authenticator is enrolled first.
+func loginSecondFactor(c *client, first *http.Response, factor string) (*http.Response, error) {
+	var pending *http.Cookie
+	for _, cookie := range first.Cookies() {
+		if cookie.Name == "auth_2fa" {
+			pending = cookie
+		}
+	}
+	if pending == nil {
+		return nil, errors.New("server did not return a pending login")
+	}
+	if factor == "enroll" {
+		req, err := c.newRequest("POST", "/auth/2fa/enroll", nil)
+		if err != nil {
+			return nil, err
+		}
+		req.AddCookie(pending)
+		var setup apiTwoFactorSetup
+		if err := c.doAPI(req, &setup); err != nil {
+			return nil, err
+		}
+		fmt.Fprint(os.Stderr, "Your account requires an authenticator, add it to your authenticator app:\n\n")
+		fmt.Fprintf(os.Stderr, "    Secret: %s\n    URI:    %s\n\n", setup.Secret, setup.URI)
+	}
+	code, err := readCode()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"code": {code}}
+	req, err := c.newRequest("POST", "/auth/2fa", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(pending)
+	return c.http.Do(req)
+}
+
+// readCode prompts for a code of the authenticator or a recovery code
+func readCode() (string, error) {
+	fmt.Fprint(os.Stderr, "Code: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// cmdLogout ends the session on the server, the local login is
+// forgotten even if that fails.
+func cmdLogout(c *client, args []string) error {
+	var err error
+	if len(c.token) > 0 && len(c.apiToken) == 0 {
+		var req *http.Request
+		req, err = c.newRequest("POST", "/logout", nil)
+		if err == nil {
+			err = c.doAPI(req, nil)
+		}
+	}
+	c.token = ""
+	if serr := c.saveSession(); serr != nil {
+		return serr
+	}
+	return err
+}
+
+func cmdUpload(c *client, args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 7*24*time.Hour, "Lifetime of the file")
+	public := fs.Bool("public", false, "Show the file in the public gallery")
+	encrypt := fs.Bool("encrypt", false, "Encrypt the file, the key is put in the URL fragment")
+	name := fs.String("name", "stdin.txt", "Filename used when reading from stdin")
+	fs.Parse(args)
+
+	if *ttl < common.MinTTL || *ttl > common.MaxTTL {
+		return fmt.Errorf("ttl must be between %s and %s", common.MinTTL, common.MaxTTL)
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	for _, file := range files {
+		var data []byte
+		var err error
+		var filename = filepath.Base(file)
+		if file == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+			filename = *name
+		} else {
+			data, err = ioutil.ReadFile(file)
+		}
+		if err != nil {
+			return err
+		}
+
+		var fragment string
+		if *encrypt {
+			data, fragment, err = encryptData(filename, data)
+			if err != nil {
+				return err
+			}
+			filename = "encrypted"
+		}
+
+		f, err := c.upload(filename, data, time.Now().Add(*ttl), *public, *encrypt)
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		if len(fragment) > 0 {
+			fmt.Printf("%s#%s\n", f.URL, fragment)
+		} else {
+			fmt.Println(f.URL)
+		}
+		if len(f.DeleteToken) > 0 {
+			fmt.Fprintf(os.Stderr, "Delete token for %s: %s\n", f.Flake, f.DeleteToken)
+			c.deleteTokens[f.Flake] = f.DeleteToken
+		}
+	}
+	return c.saveSession()
+}
+
+// upload sends a file to the upload API
+func (c *client) upload(filename string, data []byte, deleteAt time.Time, public, encrypted bool) (*apiFile, error) {
+	var body = &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("delete_at", common.FromTime(deleteAt).Format("2006-01-02"))
+	if public {
+		mw.WriteField("public", "on")
+	}
+	if encrypted {
+		mw.WriteField("encrypted", "on")
+	}
+	part, err := mw.CreateFormFile("data", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest("POST", "/api/v1/files", body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var f apiFile
+	return &f, c.doAPI(req, &f)
+}
+
+func cmdGet(c *client, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	out := fs.String("o", "-", "Output file, - for stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("get needs exactly one flake or URL")
+	}
+	flake, fragment, err := parseFlake(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var path = "/f/" + flake
+	if len(fragment) > 0 {
+		path += "?ciphertext=1"
+	}
+	req, err := c.newRequest("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+
+	var data io.Reader = resp.Body
+	if len(fragment) > 0 {
+		ciphertext, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		plaintext, err := decryptData(ciphertext, fragment)
+		if err != nil {
+			return err
+		}
+		data = bytes.NewReader(plaintext)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, data)
+	return err
+}
+
+func cmdList(c *client, args []string) error {
+	req, err := c.newRequest("GET", "/api/v1/files", nil)
+	if err != nil {
+		return err
+	}
+	var list struct {
+		Files []apiFile `json:"files"`
+	}
+	if err := c.doAPI(req, &list); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLAKE\tSIZE\tTYPE\tCREATED\tEXPIRES\tURL")
+	for _, f := range list.Files {
+		size := "-"
+		if f.Size >= 0 {
+			size = fmt.Sprint(f.Size)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			f.Flake, size, f.Mime, f.CreatedAt, f.ExpiresAt, f.URL)
+	}
+	return tw.Flush()
+}
+
+func cmdQuota(c *client, args []string) error {
+	req, err := c.newRequest("GET", "/api/v1/quota", nil)
+	if err != nil {
+		return err
+	}
+	var quota struct {
+		User  string `json:"user"`
+		Usage struct {
+			Files int   `json:"files"`
+			Bytes int64 `json:"bytes"`
+		} `json:"usage"`
+		Quota struct {
+			MaxFileSize int64  `json:"max_file_size"`
+			MaxStorage  int64  `json:"max_storage"`
+			MaxFiles    int    `json:"max_files"`
+			MaxTTL      string `json:"max_ttl"`
+		} `json:"quota"`
+	}
+	if err := c.doAPI(req, &quota); err != nil {
+		return err
+	}
+	limit := func(v int64) string {
+		if v == 0 {
+			return "unlimited"
+		}
+		return fmt.Sprint(v)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "User\t%s\n", quota.User)
+	fmt.Fprintf(tw, "Files\t%d of %s\n", quota.Usage.Files, limit(int64(quota.Quota.MaxFiles)))
+	fmt.Fprintf(tw, "Storage\t%d of %s bytes\n", quota.Usage.Bytes, limit(quota.Quota.MaxStorage))
+	fmt.Fprintf(tw, "Max file size\t%s bytes\n", limit(quota.Quota.MaxFileSize))
+	if len(quota.Quota.MaxTTL) > 0 {
+		fmt.Fprintf(tw, "Max TTL\t%s\n", quota.Quota.MaxTTL)
+	} else {
+		fmt.Fprintf(tw, "Max TTL\t%s\n", common.MaxTTL)
+	}
+	return tw.Flush()
+}
+
+func cmdDelete(c *client, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	token := fs.String("token", "", "Delete token, defaults to the one remembered on upload")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("delete needs a flake or URL")
+	}
+	for _, arg := range fs.Args() {
+		flake, _, err := parseFlake(arg)
+		if err != nil {
+			return err
+		}
+		req, err := c.newRequest("DELETE", "/api/v1/files/"+flake, nil)
+		if err != nil {
+			return err
+		}
+		if len(*token) > 0 {
+			req.Header.Set("X-Catgi-Delete-Token", *token)
+		} else if t, ok := c.deleteTokens[flake]; ok {
+			req.Header.Set("X-Catgi-Delete-Token", t)
+		}
+		if err := c.doAPI(req, nil); err != nil {
+			return fmt.Errorf("%s: %s", flake, err)
+		}
+		delete(c.deleteTokens, flake)
+		fmt.Fprintf(os.Stderr, "Deleted %s\n", flake)
+	}
+	return c.saveSession()
+}
+
+// apiToken mirrors the token object of the JSON API
+type apiToken struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt string   `json:"created_at"`
+	ExpiresAt string   `json:"expires_at"`
+	Token     string   `json:"token"`
+}
+
+func cmdToken(c *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("token needs list, create or revoke")
+	}
+	switch args[0] {
+	case "list":
+		req, err := c.newRequest("GET", "/api/v1/tokens", nil)
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Tokens []apiToken `json:"tokens"`
+		}
+		if err := c.doAPI(req, &list); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tCREATED\tEXPIRES")
+		for _, t := range list.Tokens {
+			expires := t.ExpiresAt
+			if len(expires) == 0 {
+				expires = "never"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				t.ID, t.Name, strings.Join(t.Scopes, ","), t.CreatedAt, expires)
+		}
+		return tw.Flush()
+	case "create":
+		fs := flag.NewFlagSet("token create", flag.ExitOnError)
+		name := fs.String("name", "", "Name to tell the token apart")
+		ttl := fs.String("ttl", "", "Lifetime of the token, ie 720h, never expires if empty")
+		fs.Parse(args[1:])
+		if fs.NArg() == 0 {
+			return errors.New("token create needs at least one of the scopes read, upload, delete, admin")
+		}
+		form := url.Values{"name": {*name}, "scope": fs.Args()}
+		if len(*ttl) > 0 {
+			form.Set("expires_in", *ttl)
+		}
+		req, err := c.newRequest("POST", "/api/v1/tokens", strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		var token apiToken
+		if err := c.doAPI(req, &token); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created token %s, it is only shown once\n", token.ID)
+		fmt.Println(token.Token)
+		return nil
+	case "revoke":
+		if len(args) < 2 {
+			return errors.New("token revoke needs a token id")
+		}
+		for _, id := range args[1:] {
+			req, err := c.newRequest("DELETE", "/api/v1/tokens/"+url.PathEscape(id), nil)
+			if err != nil {
+				return err
+			}
+			if err := c.doAPI(req, nil); err != nil {
+				return fmt.Errorf("%s: %s", id, err)
+			}
+			fmt.Fprintf(os.Stderr, "Revoked %s\n", id)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown token command '%s'", args[0])
+}
+
+// apiSession mirrors the session object of the JSON API
+type apiSession struct {
+	ID        string `json:"id"`
+	UserAgent string `json:"user_agent"`
+	IP        string `json:"ip"`
+	CreatedAt string `json:"created_at"`
+	LastSeen  string `json:"last_seen"`
+	Current   bool   `json:"current"`
+}
+
+func cmdSession(c *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("session needs list, revoke or revoke-all")
+	}
+	switch args[0] {
+	case "list":
+		req, err := c.newRequest("GET", "/api/v1/sessions", nil)
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Sessions []apiSession `json:"sessions"`
+		}
+		if err := c.doAPI(req, &list); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tIP\tCREATED\tLAST SEEN\tUSER AGENT")
+		for _, s := range list.Sessions {
+			id := s.ID
+			if s.Current {
+				id += "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+				id, s.IP, s.CreatedAt, s.LastSeen, s.UserAgent)
+		}
+		return tw.Flush()
+	case "revoke":
+		if len(args) < 2 {
+			return errors.New("session revoke needs a session id")
+		}
+		for _, id := range args[1:] {
+			req, err := c.newRequest("DELETE", "/api/v1/sessions/"+url.PathEscape(id), nil)
+			if err != nil {
+				return err
+			}
+			if err := c.doAPI(req, nil); err != nil {
+				return fmt.Errorf("%s: %s", id, err)
+			}
+			fmt.Fprintf(os.Stderr, "Revoked %s\n", id)
+		}
+		return nil
+	case "revoke-all":
+		req, err := c.newRequest("DELETE", "/api/v1/sessions", nil)
+		if err != nil {
+			return err
+		}
+		if err := c.doAPI(req, nil); err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stderr, "Revoked all other sessions\n")
+		return nil
+	}
+	return fmt.Errorf("unknown session command '%s'", args[0])
+}
+
+// readNewPassword prompts twice for a password and fails if the
+// entries differ.
+func readNewPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := gopass.GetPasswdMasked()
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Repeat: ")
+	again, err := gopass.GetPasswdMasked()
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(pass, again) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(pass), nil
+}
+
+func cmdPasswd(c *client, args []string) error {
+	fmt.Fprint(os.Stderr, "Current password: ")
+	old, err := gopass.GetPasswdMasked()
+	if err != nil {
+		return err
+	}
+	pass, err := readNewPassword("New password: ")
+	if err != nil {
+		return err
+	}
+	form := url.Values{"password": {string(old)}, "new_password": {pass}}
+	req, err := c.newRequest("POST", "/api/v1/account/password", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := c.doAPI(req, nil); err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, "Password changed\n")
+	return nil
+}
+
+// apiUser mirrors the user object of the JSON API
+type apiUser struct {
+	Username string `json:"username"`
+	AuthType string `json:"authtype"`
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+	Source   string `json:"source"`
+}
+
+// updateUser sends the form to the admin API of the user
+func (c *client) updateUser(method, name string, form url.Values) error {
+	req, err := c.newRequest(method, "/api/v1/admin/users/"+url.PathEscape(name),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.doAPI(req, nil)
+}
+
+func cmdUser(c *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("user needs list, add, disable, enable, reset, reset-2fa or delete")
+	}
+	if args[0] != "list" && args[0] != "add" && len(args) < 2 {
+		return fmt.Errorf("user %s needs a username", args[0])
+	}
+	switch args[0] {
+	case "list":
+		req, err := c.newRequest("GET", "/api/v1/admin/users", nil)
+		if err != nil {
+			return err
+		}
+		var list struct {
+			Users []apiUser `json:"users"`
+		}
+		if err := c.doAPI(req, &list); err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "USER\tROLE\tAUTH\tSOURCE\tDISABLED")
+		for _, u := range list.Users {
+			auth := u.AuthType
+			if len(auth) == 0 {
+				auth = "passlib"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n",
+				u.Username, u.Role, auth, u.Source, u.Disabled)
+		}
+		return tw.Flush()
+	case "add":
+		fs := flag.NewFlagSet("user add", flag.ExitOnError)
+		role := fs.String("role", "", "Role of the user, defaults to uploader")
+		authtype := fs.String("authtype", "", "ldap or oidc, prompts for a password if empty")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return errors.New("user add needs a username")
+		}
+		form := url.Values{"username": {fs.Arg(0)}, "role": {*role}, "authtype": {*authtype}}
+		if len(*authtype) == 0 {
+			pass, err := readNewPassword("Password: ")
+			if err != nil {
+				return err
+			}
+			form.Set("password", pass)
+		}
+		req, err := c.newRequest("POST", "/api/v1/admin/users", strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := c.doAPI(req, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Added %s\n", fs.Arg(0))
+		return nil
+	case "disable", "enable":
+		form := url.Values{"disabled": {fmt.Sprint(args[0] == "disable")}}
+		if err := c.updateUser("PATCH", args[1], form); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%sd %s\n", args[0], args[1])
+		return nil
+	case "reset":
+		pass, err := readNewPassword("New password: ")
+		if err != nil {
+			return err
+		}
+		if err := c.updateUser("PATCH", args[1], url.Values{"password": {pass}}); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Password of %s reset\n", args[1])
+		return nil
+	case "reset-2fa":
+		req, err := c.newRequest("DELETE", "/api/v1/admin/users/"+url.PathEscape(args[1])+"/2fa", nil)
+		if err != nil {
+			return err
+		}
+		if err := c.doAPI(req, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "2FA of %s reset\n", args[1])
+		return nil
+	case "delete":
+		if err := c.updateUser("DELETE", args[1], nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Deleted %s\n", args[1])
+		return nil
+	}
+	return fmt.Errorf("unknown user command '%s'", args[0])
+}
+
+// encryptData encrypts the data with a fresh random key the same way
+// the browser does and returns the key encoded for the URL fragment.
+func encryptData(filename string, data []byte) ([]byte, string, error) {
+	key, err := crypto.NewClientKey()
+	if err != nil {
+		return nil, "", err
+	}
+	meta := crypto.ClientMeta{
+		Name: filename,
+		Type: http.DetectContentType(data),
+	}
+	ciphertext, err := crypto.EncryptClientFile(key, meta, data)
+	if err != nil {
+		return nil, "", err
+	}
+	return ciphertext, base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// decryptData decrypts data with the key from the URL fragment
+func decryptData(data []byte, fragment string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(fragment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key in URL: %s", err)
+	}
+	_, plaintext, err := crypto.DecryptClientFile(key, data)
+	return plaintext, err
+}
+
+// apiTwoFactorSetup is the secret of a new enrollment
+type apiTwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// printRecoveryCodes prints the codes of a response of the 2FA API
+func printRecoveryCodes(c *client, req *http.Request) error {
+	var resp struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := c.doAPI(req, &resp); err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stderr, "Store these recovery codes, each can be used once instead of a code:\n\n")
+	for _, code := range resp.RecoveryCodes {
+		fmt.Println(code)
+	}
+	return nil
+}
+
+// newCodeRequest prompts for a code and builds a form request with it
+func newCodeRequest(c *client, method, path string) (*http.Request, error) {
+	code, err := readCode()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"code": {code}}
+	req, err := c.newRequest(method, path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+func cmd2FA(c *client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("2fa needs status, enable, disable or recovery")
+	}
+	switch args[0] {
+	case "status":
+		req, err := c.newRequest("GET", "/api/v1/account/2fa", nil)
+		if err != nil {
+			return err
+		}
+		var status struct {
+			Enabled       bool `json:"enabled"`
+			Required      bool `json:"required"`
+			RecoveryCodes int  `json:"recovery_codes"`
+		}
+		if err := c.doAPI(req, &status); err != nil {
+			return err
+		}
+		fmt.Printf("Enabled:        %t\n", status.Enabled)
+		fmt.Printf("Required:       %t\n", status.Required)
+		if status.Enabled {
+			fmt.Printf("Recovery codes: %d left\n", status.RecoveryCodes)
+		}
+		return nil
+	case "enable":
+		req, err := c.newRequest("POST", "/api/v1/account/2fa", nil)
+		if err != nil {
+			return err
+		}
+		var setup apiTwoFactorSetup
+		if err := c.doAPI(req, &setup); err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stderr, "Add the authenticator to your authenticator app, then enter it's first code:\n\n")
+		fmt.Fprintf(os.Stderr, "    Secret: %s\n    URI:    %s\n\n", setup.Secret, setup.URI)
+		req, err = newCodeRequest(c, "POST", "/api/v1/account/2fa/confirm")
+		if err != nil {
+			return err
+		}
+		return printRecoveryCodes(c, req)
+	case "disable":
+		req, err := newCodeRequest(c, "DELETE", "/api/v1/account/2fa")
+		if err != nil {
+			return err
+		}
+		if err := c.doAPI(req, nil); err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stderr, "2FA disabled\n")
+		return nil
+	case "recovery":
+		req, err := newCodeRequest(c, "POST", "/api/v1/account/2fa/recovery")
+		if err != nil {
+			return err
+		}
+		return printRecoveryCodes(c, req)
+	}
+	return fmt.Errorf("unknown 2fa command '%s'", args[0])
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// command is a subcommand of the cli, it receives the client and the
+// arguments after the command name.
+type command struct {
+	usage string
+	run   func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"login":   {"login [user]", cmdLogin},
+	"logout":  {"logout", cmdLogout},
+	"upload":  {"upload [-ttl 168h] [-public] [-encrypt] [file|-]...", cmdUpload},
+	"get":     {"get [-o file] <flake|url>", cmdGet},
+	"list":    {"list", cmdList},
+	"quota":   {"quota", cmdQuota},
+	"delete":  {"delete [-token token] <flake|url>...", cmdDelete},
+	"token":   {"token list | create [-name name] [-ttl 720h] <scope>... | revoke <id>", cmdToken},
+	"passwd":  {"passwd", cmdPasswd},
+	"2fa":     {"2fa status | enable | disable | recovery", cmd2FA},
+	"session": {"session list | revoke <id>... | revoke-all", cmdSession},
+	"user": {"user list | add [-role role] [-authtype ldap|oidc] <name> | " +
+		"disable <name> | enable <name> | reset <name> | reset-2fa <name> | delete <name>", cmdUser},
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, "Usage: catgi-cli [-server url] [-session file] <command> [args]\n\n")
+	fmt.Fprint(os.Stderr, "Commands:\n")
+	for _, name := range []string{"login", "logout", "upload", "get", "list", "quota", "delete", "token", "session", "passwd", "2fa", "user"} {
+		fmt.Fprintf(os.Stderr, "    %s\n", commands[name].usage)
+	}
+	fmt.Fprint(os.Stderr, "\nThe server defaults to $CATGI_SERVER or the server of the last login.\n")
+	fmt.Fprint(os.Stderr, "If $CATGI_TOKEN is set the API token is used instead of the login.\n")
+}
+
+func main() {
+	var server, session string
+	flag.StringVar(&server, "server", os.Getenv("CATGI_SERVER"), "URL of the catgi server")
+	flag.StringVar(&session, "session", defaultSessionFile(), "File the login is cached in")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	c, err := newClient(server, session, os.Getenv("CATGI_TOKEN"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/utils"
+)
+
+// Stable error codes of the API, clients may rely on these.
+const (
+	apiCodeBadRequest          = "bad_request"
+	apiCodeUnauthorized        = "unauthorized"
+	apiCodeForbidden           = "forbidden"
+	apiCodeNotFound            = "file_not_found"
+	apiCodeExpired             = "file_expired"
+	apiCodeExists              = "file_exists"
+	apiCodeQuotaExceeded       = "quota_exceeded"
+	apiCodeRateLimited         = "rate_limited"
+	apiCodeTokenNotFound       = "token_not_found"
+	apiCodeUserNotFound        = "user_not_found"
+	apiCodeUserExists          = "user_exists"
+	apiCodeSessionNotFound     = "session_not_found"
+	apiCodeTwoFactorEnabled    = "twofactor_enabled"
+	apiCodeTwoFactorNotEnabled = "twofactor_not_enabled"
+	apiCodeCodeInvalid         = "code_invalid"
+	apiCodeNotConfigured       = "not_configured"
+	apiCodeInternal            = "internal_error"
+)
+
+// apiError is the body of every failed API request
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiFile is the public representation of a file in the API
+type apiFile struct {
+	Flake     string               `json:"flake"`
+	URL       string               `json:"url"`
+	Path      string               `json:"path"`
+	Owner     string               `json:"owner,omitempty"`
+	Size      int64                `json:"size"`
+	Mime      string               `json:"mime"`
+	Extension string               `json:"ext,omitempty"`
+	Public    bool                 `json:"public"`
+	CreatedAt *common.DateOnlyTime `json:"created_at"`
+	ExpiresAt *common.DateOnlyTime `json:"expires_at"`
+	// Encrypted is set if the file was encrypted by the client
+	Encrypted bool `json:"encrypted,omitempty"`
+	// DeleteToken is only sent in the response to an upload
+	DeleteToken string `json:"delete_token,omitempty"`
+}
+
+func newAPIFile(r *http.Request, f *common.File, size int64) apiFile {
+	path := "/f/" + f.Flake
+	return apiFile{
+		Flake:     f.Flake,
+		URL:       requestScheme(r, configFromContext(r.Context()).RateLimit.TrustProxy) + "://" + r.Host + path,
+		Path:      path,
+		Owner:     f.User,
+		Size:      size,
+		Mime:      f.ContentType,
+		Extension: f.FileExtension,
+		Public:    f.Public,
+		CreatedAt: f.CreatedAt,
+		ExpiresAt: f.DeleteAt,
+		Encrypted: f.HasOption(optionEncrypted),
+	}
+}
+
+// writeAPIJSON writes the value as JSON with the given status
+func writeAPIJSON(rw http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	log := logger.LogFromCtx("writeAPIJSON", r.Context())
+	dat, err := json.Marshal(v)
+	if err != nil {
+		log.Error("Error on encode: ", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte("Critical Server Error"))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	rw.Write(dat)
+}
+
+// writeAPIError writes an error with an explicit code
+func writeAPIError(rw http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	writeAPIJSON(rw, r, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: msg}})
+}
+
+// writeBackendError maps errors of the backend to status and code
+func writeBackendError(rw http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case common.IsFileNotExists(err):
+		writeAPIError(rw, r, 404, apiCodeNotFound, "File does not exist")
+	case err == common.ErrorExpired:
+		writeAPIError(rw, r, 410, apiCodeExpired, err.Error())
+	case err == common.ErrorFileExists:
+		writeAPIError(rw, r, 409, apiCodeExists, err.Error())
+	case errors.Is(err, common.ErrorQuotaExceeded):
+		writeAPIError(rw, r, 413, apiCodeQuotaExceeded, err.Error())
+	default:
+		logger.LogFromCtx("api", r.Context()).Error("Backend error: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+	}
+}
+
+// passHTTPOptions applies http options returned by the backend and
+// returns true if the backend took over the request.
+func passHTTPOptions(rw http.ResponseWriter, r *http.Request, err error) bool {
+	if !common.IsHTTPOption(err) {
+		return false
+	}
+	httpopt := err.(common.ErrorHTTPOptions)
+	httpopt.PassOverHTTP(rw)
+	if httpopt.WantsTakeover() {
+		httpopt.HTTPTakeover(r, rw, r.Context())
+		return true
+	}
+	return false
+}
+
+type handlerAPIUpload struct {
+	backend common.Backend
+}
+
+func newHandlerAPIUpload(b common.Backend) http.Handler {
+	return &handlerAPIUpload{backend: b}
+}
+
+// ServeHTTP accepts the same form as POST /file and replies with the
+// created file.
+func (h *handlerAPIUpload) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiUpload", r.Context())
+
+	upload, err := readUploadForm(r)
+	if err != nil {
+		log.Warn("Could not read upload: ", err)
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	defer upload.Close()
+	file := &upload.file
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	release, err := reserveQuota(h.backend, upload, r.Context())
+	if err != nil {
+		log.Warn("Upload rejected: ", err)
+		writeBackendError(rw, r, err)
+		return
+	}
+	defer release()
+
+	// <- BEGIN BACKEND INTERACTION ->
+	err = common.NewStreamAdapter(h.backend).UploadReader(file.Flake, file, upload.data, r.Context())
+	// -> END BACKEND INTERACTION <-
+
+	if err != nil && !common.IsHTTPOption(err) {
+		writeBackendError(rw, r, err)
+		return
+	} else if passHTTPOptions(rw, r, err) {
+		return
+	}
+
+	var resp = newAPIFile(r, file, upload.size)
+	resp.DeleteToken, err = newDeleteToken(file.Flake, r.Context())
+	if err != nil {
+		log.Error("Could not create delete token: ", err)
+	}
+	writeAPIJSON(rw, r, 201, resp)
+}
+
+type handlerAPIFile struct {
+	backend common.Backend
+}
+
+func newHandlerAPIFile(b common.Backend) http.Handler {
+	return &handlerAPIFile{backend: b}
+}
+
+// ServeHTTP returns the metadata of a file on GET and deletes the file
+// on DELETE if the caller owns it or presents the delete token.
+func (h *handlerAPIFile) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiFile", r.Context())
+	flake := mux.Vars(r)["flake"]
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	// <- BEGIN BACKEND INTERACTION ->
+	f, size, err := apiLookup(h.backend, flake, r)
+	if err != nil && !common.IsHTTPOption(err) {
+		writeBackendError(rw, r, err)
+		return
+	} else if passHTTPOptions(rw, r, err) {
+		return
+	}
+
+	if r.Method == "GET" {
+		writeAPIJSON(rw, r, 200, newAPIFile(r, f, size))
+		return
+	}
+
+	if !canDelete(r, f) {
+		log.Warn("Unauthorized delete of ", flake)
+		writeAPIError(rw, r, 403, apiCodeForbidden, "File belongs to another user")
+		return
+	}
+
+	err = h.backend.Delete(flake, r.Context())
+	// -> END BACKEND INTERACTION <-
+
+	if err != nil && !common.IsHTTPOption(err) {
+		writeBackendError(rw, r, err)
+		return
+	} else if passHTTPOptions(rw, r, err) {
+		return
+	}
+
+	removeKeyFile(h.backend, flake, r)
+
+	rw.WriteHeader(204)
+}
+
+type handlerAPIList struct {
+	backend common.Backend
+	all     bool
+}
+
+func newHandlerAPIList(b common.Backend) http.Handler {
+	return &handlerAPIList{backend: b}
+}
+
+// newHandlerAPIListAll lists the files of all users, the route must
+// be restricted to admins.
+func newHandlerAPIListAll(b common.Backend) http.Handler {
+	return &handlerAPIList{backend: b, all: true}
+}
+
+// ServeHTTP lists the files of the caller or of all users. Sizes are
+// only known if an index is configured, otherwise they are -1.
+func (h *handlerAPIList) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+	// Without configured users every upload belongs to anonymous, so
+	// anonymous does not own files for the purpose of listing them.
+	if len(user) == 0 || (user == "anonymous" && !h.all) {
+		writeAPIError(rw, r, 401, apiCodeUnauthorized, "Login required")
+		return
+	}
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	var files = []apiFile{}
+	// <- BEGIN BACKEND INTERACTION ->
+	if idx := index.FromBackend(h.backend); idx != nil {
+		var entries []index.Entry
+		var err error
+		if h.all {
+			entries, err = idx.List(r.Context(), "")
+		} else {
+			entries, err = idx.ListUser(r.Context(), user)
+		}
+		if err != nil {
+			writeBackendError(rw, r, err)
+			return
+		}
+		for _, v := range entries {
+			if !v.Expired() {
+				files = append(files, newAPIFile(r, v.File(), v.Size))
+			}
+		}
+	} else {
+		list, err := h.backend.ListGlob(r.Context(), "")
+		if err != nil {
+			writeBackendError(rw, r, err)
+			return
+		}
+		for _, v := range list {
+			if v == nil || (!h.all && v.User != user) {
+				continue
+			}
+			if v.DeleteAt != nil && v.DeleteAt.TTL() == 0 {
+				continue
+			}
+			files = append(files, newAPIFile(r, v, -1))
+		}
+	}
+	// -> END BACKEND INTERACTION <-
+
+	writeAPIJSON(rw, r, 200, struct {
+		Files []apiFile `json:"files"`
+	}{files})
+}
+
+// apiLookup returns the metadata and size of a file, the index is
+// used if available. Without index the file is streamed so the data
+// is not held in memory just to measure it.
+func apiLookup(b common.Backend, flake string, r *http.Request) (*common.File, int64, error) {
+	if idx := index.FromBackend(b); idx != nil {
+		entry, err := idx.Get(flake, r.Context())
+		if err == nil && !entry.Expired() {
+			return entry.File(), entry.Size, nil
+		}
+	}
+	f, data, err := common.NewStreamAdapter(b).GetReader(flake, r.Context())
+	if data != nil {
+		defer data.Close()
+	}
+	if err != nil && !common.IsHTTPOption(err) {
+		return nil, 0, err
+	}
+	if f == nil || data == nil {
+		return nil, 0, err
+	}
+	size, sizeErr := readerSize(data)
+	if sizeErr != nil {
+		return nil, 0, sizeErr
+	}
+	return f, size, err
+}
+
+// readerSize returns the number of bytes left in the reader, it seeks
+// to the end if possible and reads through the data otherwise.
+func readerSize(data io.Reader) (int64, error) {
+	if seeker, ok := data.(io.Seeker); ok {
+		cur, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		return end - cur, err
+	}
+	return io.Copy(ioutil.Discard, data)
+}
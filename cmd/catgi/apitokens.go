@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+)
+
+// apiToken is a token as returned by the API, the secret is only sent
+// once in the response to the creation.
+type apiToken struct {
+	ID        string         `json:"id"`
+	User      string         `json:"user"`
+	Name      string         `json:"name"`
+	Scopes    []tokens.Scope `json:"scopes"`
+	CreatedAt time.Time      `json:"created_at"`
+	ExpiresAt *time.Time     `json:"expires_at,omitempty"`
+	Token     string         `json:"token,omitempty"`
+}
+
+func newAPIToken(t tokens.Token) apiToken {
+	return apiToken{
+		ID:        t.ID,
+		User:      t.User,
+		Name:      t.Name,
+		Scopes:    t.Scopes,
+		CreatedAt: t.CreatedAt,
+		ExpiresAt: t.ExpiresAt,
+	}
+}
+
+// scopeRoles are the roles a user needs to create tokens with a scope
+var scopeRoles = map[tokens.Scope]config.Role{
+	tokens.ScopeRead:   config.RoleViewer,
+	tokens.ScopeUpload: config.RoleUploader,
+	tokens.ScopeDelete: config.RoleViewer,
+	tokens.ScopeAdmin:  config.RoleAdmin,
+}
+
+// tokenStoreOrError returns the token store or writes an error if API
+// tokens are disabled. Tokens cannot be used to manage tokens.
+func tokenStoreOrError(rw http.ResponseWriter, r *http.Request) tokens.Store {
+	user := userFromContext(r.Context())
+	if len(user) == 0 || user == "anonymous" {
+		writeAPIError(rw, r, 401, apiCodeUnauthorized, "Login required")
+		return nil
+	}
+	if apiTokenFromContext(r.Context()) != nil {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "API tokens cannot manage tokens")
+		return nil
+	}
+	store := stateFromContext(r.Context()).tokens
+	if store == nil {
+		writeAPIError(rw, r, 501, apiCodeNotConfigured, "No token store configured")
+		return nil
+	}
+	return store
+}
+
+type handlerAPITokens struct{}
+
+func newHandlerAPITokens() http.Handler {
+	return &handlerAPITokens{}
+}
+
+// ServeHTTP lists the tokens of the caller, or for admins of the user
+// query parameter, on GET and creates a token on POST. The form takes
+// a name, scopes as repeated or comma separated scope values and
+// expires_in as duration, ie "720h".
+func (h *handlerAPITokens) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiTokens", r.Context())
+	store := tokenStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	user := userFromContext(r.Context())
+
+	if r.Method == "GET" {
+		if other := r.URL.Query().Get("user"); len(other) > 0 && other != user {
+			if !roleFromContext(r.Context()).Includes(config.RoleAdmin) {
+				writeAPIError(rw, r, 403, apiCodeForbidden, "Requires role admin")
+				return
+			}
+			user = other
+		}
+		list, err := store.ListUser(r.Context(), user)
+		if err != nil {
+			log.Error("Could not list tokens: ", err)
+			writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+			return
+		}
+		var resp = []apiToken{}
+		for _, v := range list {
+			resp = append(resp, newAPIToken(v))
+		}
+		writeAPIJSON(rw, r, 200, struct {
+			Tokens []apiToken `json:"tokens"`
+		}{resp})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	var scopes []tokens.Scope
+	role := roleFromContext(r.Context())
+	for _, v := range r.Form["scope"] {
+		for _, s := range strings.Split(v, ",") {
+			scope := tokens.Scope(strings.TrimSpace(s))
+			if !scope.Valid() {
+				writeAPIError(rw, r, 400, apiCodeBadRequest, "Unknown scope "+string(scope))
+				return
+			}
+			if !role.Includes(scopeRoles[scope]) {
+				writeAPIError(rw, r, 403, apiCodeForbidden,
+					"Scope "+string(scope)+" requires role "+string(scopeRoles[scope]))
+				return
+			}
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, "At least one scope is required")
+		return
+	}
+	var ttl time.Duration
+	if exp := r.FormValue("expires_in"); len(exp) > 0 {
+		var err error
+		ttl, err = time.ParseDuration(exp)
+		if err != nil || ttl <= 0 {
+			writeAPIError(rw, r, 400, apiCodeBadRequest, "Invalid expires_in "+exp)
+			return
+		}
+	}
+
+	token, raw, err := tokens.New(user, r.FormValue("name"), scopes, ttl)
+	if err == nil {
+		err = store.Put(token, r.Context())
+	}
+	if err != nil {
+		log.Error("Could not create token: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	log.Infof("Created token %s for %s with scopes %v", token.ID, user, scopes)
+
+	resp := newAPIToken(token)
+	resp.Token = raw
+	writeAPIJSON(rw, r, 201, resp)
+}
+
+type handlerAPIRevokeToken struct{}
+
+func newHandlerAPIRevokeToken() http.Handler {
+	return &handlerAPIRevokeToken{}
+}
+
+// ServeHTTP revokes a token of the caller, admins may revoke tokens
+// of every user.
+func (h *handlerAPIRevokeToken) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiRevokeToken", r.Context())
+	store := tokenStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	token, err := store.Get(id, r.Context())
+	if err == tokens.ErrorTokenNotExists {
+		writeAPIError(rw, r, 404, apiCodeTokenNotFound, "Token does not exist")
+		return
+	} else if err != nil {
+		log.Error("Could not get token: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	user := userFromContext(r.Context())
+	if token.User != user && !roleFromContext(r.Context()).Includes(config.RoleAdmin) {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "Token belongs to another user")
+		return
+	}
+
+	if err := store.Remove(id, r.Context()); err != nil {
+		log.Error("Could not remove token: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	log.Infof("Token %s of %s revoked by %s", id, token.User, user)
+	rw.WriteHeader(204)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+)
+
+// newTokenRouter routes the token API like newRouter does
+func newTokenRouter() http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/api/v1/tokens",
+		newHandlerCheckToken(false, newHandlerAPITokens()),
+	).Methods("GET", "POST")
+	router.Handle("/api/v1/tokens/{id}",
+		newHandlerCheckToken(false, newHandlerAPIRevokeToken()),
+	).Methods("DELETE")
+	return router
+}
+
+// serveRequest sends a request with an optional form, auth cookie and
+// API token through the handler.
+func serveRequest(h http.Handler, method, target string, form url.Values,
+	cookie *http.Cookie, bearer string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	if len(bearer) > 0 {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw
+}
+
+// createToken creates an API token through the API and returns it
+func createToken(t *testing.T, h http.Handler, cookie *http.Cookie, scopes ...string) apiToken {
+	rw := serveRequest(h, "POST", "/api/v1/tokens",
+		url.Values{"name": {"test"}, "scope": scopes}, cookie, "")
+	if rw.Code != 201 {
+		t.Fatalf("Could not create token: %d %s", rw.Code, rw.Body)
+	}
+	var token apiToken
+	if err := json.Unmarshal(rw.Body.Bytes(), &token); err != nil {
+		t.Fatal("Could not decode token: ", err)
+	}
+	return token
+}
+
+func newTokenTestState(t *testing.T) *serverState {
+	return newTestState(t, config.Configuration{
+		Tokens: config.DriverConfig{
+			Name:   "buntdb",
+			Params: map[string]interface{}{"file": ":memory:"},
+		},
+	})
+}
+
+func TestAPITokenScopes(t *testing.T) {
+	assert := assert.New(t)
+	st := newTokenTestState(t)
+	router := newTokenRouter()
+	alice := loginCookie(t, st, "alice", config.RoleViewer)
+
+	rw := serveRequest(router, "POST", "/api/v1/tokens",
+		url.Values{"scope": {"upload"}}, alice, "")
+	assert.Equal(403, rw.Code, "Viewers must not create upload tokens")
+
+	rw = serveRequest(router, "POST", "/api/v1/tokens",
+		url.Values{"scope": {"everything"}}, alice, "")
+	assert.Equal(400, rw.Code)
+
+	token := createToken(t, router, alice, "read")
+	assert.NotEmpty(token.Token)
+
+	read := newHandlerCheckScope(false, tokens.ScopeRead, whoAmI)
+	rw = serveRequest(read, "GET", "/api/v1/files", nil, nil, token.Token)
+	assert.Equal(200, rw.Code)
+	assert.Equal("alice:viewer", rw.Body.String())
+
+	del := newHandlerCheckScope(true, tokens.ScopeDelete, whoAmI)
+	rw = serveRequest(del, "DELETE", "/api/v1/files/flake", nil, nil, token.Token)
+	assert.Equal(403, rw.Code, "Tokens must only be used for their scopes")
+
+	upload := newHandlerCheckRole(config.RoleUploader, whoAmI)
+	rw = serveRequest(upload, "POST", "/api/v1/files", nil, nil, token.Token)
+	assert.Equal(403, rw.Code)
+
+	rw = serveRequest(read, "GET", "/api/v1/files", nil, nil, token.Token+"x")
+	assert.Equal(401, rw.Code, "Invalid tokens must be rejected")
+
+	rw = serveRequest(router, "POST", "/api/v1/tokens",
+		url.Values{"scope": {"read"}}, nil, token.Token)
+	assert.Equal(403, rw.Code, "Tokens must not create tokens")
+}
+
+func TestAPITokenRevoke(t *testing.T) {
+	assert := assert.New(t)
+	st := newTokenTestState(t)
+	router := newTokenRouter()
+	alice := loginCookie(t, st, "alice", config.RoleViewer)
+	read := newHandlerCheckScope(false, tokens.ScopeRead, whoAmI)
+
+	token := createToken(t, router, alice, "read")
+
+	rw := serveRequest(router, "DELETE", "/api/v1/tokens/"+token.ID, nil,
+		loginCookie(t, st, "dave", config.RoleUploader), "")
+	assert.Equal(403, rw.Code, "Tokens of other users must not be revoked")
+
+	rw = serveRequest(router, "DELETE", "/api/v1/tokens/"+token.ID, nil, alice, "")
+	assert.Equal(204, rw.Code)
+	rw = serveRequest(read, "GET", "/api/v1/files", nil, nil, token.Token)
+	assert.Equal(401, rw.Code, "Revoked tokens must be rejected")
+
+	// Tokens stop working once their user is disabled
+	disabled, raw, err := tokens.New("carol", "test", []tokens.Scope{tokens.ScopeRead}, 0)
+	assert.NoError(err)
+	assert.NoError(st.tokens.Put(disabled, logger.NewLoggingContext()))
+	rw = serveRequest(read, "GET", "/api/v1/files", nil, nil, raw)
+	assert.Equal(401, rw.Code)
+}
+
+func TestListAnonymous(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	uploadTestFile(t, st, "anon-private", "anonymous")
+
+	r := httptest.NewRequest("GET", "/api/v1/files", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "user", "anonymous"))
+	rw := httptest.NewRecorder()
+	newHandlerAPIList(st.backend).ServeHTTP(rw, r)
+	assert.Equal(401, rw.Code, "Anonymous must not list the uploads of everyone")
+	assert.NotContains(rw.Body.String(), "anon-private")
+}
@@ -1,17 +1,36 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
+	"git.timschuster.info/rls.moe/catgi/config"
 	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/sessions"
 	"git.timschuster.info/rls.moe/catgi/snowflakes"
 
 	"git.timschuster.info/rls.moe/catgi/utils"
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
+// Authentication methods of a login as listed in the amr claim
+const (
+	amrPassword = "pwd"
+	amrOIDC     = "oidc"
+	amrOTP      = "otp"
+)
+
+// authClaims are the claims of the auth cookie
+type authClaims struct {
+	jwt.StandardClaims
+	Role config.Role `json:"role,omitempty"`
+	// AMR lists the methods the user authenticated with
+	AMR []string `json:"amr,omitempty"`
+}
+
 type handlerServeAuth struct{}
 
 func newHandlerServeAuth() http.Handler {
@@ -37,48 +56,36 @@ func (h *handlerServeAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Debug("Checking password")
 
-	err = utils.VerifyPassword(user, pass, curCfg)
+	st := stateFromContext(r.Context())
+	lockKey := "user:" + user
+	if locked, wait := st.limits.lockout.Locked(lockKey); locked {
+		log.Warn("Login attempt for locked user ", user)
+		writeTooManyRequests(w, r, wait)
+		return
+	}
+
+	role, err := verifyLogin(st, user, pass, r.Context())
 	if err != nil {
 		log.Warn("Wrong password attempt for user ", user, ": ", err)
+		if st.limits.lockout.Fail(lockKey) {
+			log.Warn("Too many failed logins, locking user ", user)
+		}
 		w.WriteHeader(401)
 		fmt.Fprint(w, "401 - Not Authorized")
 		return
 	} else {
-		claimflake, err := snowflakes.NewSnowflake()
+		done, err := finishLogin(w, r, user, role, amrPassword, st)
 		if err != nil {
-			log.Warn("Could not generate claim flake: ", err)
+			log.Error("Error on auth: ", err)
 			w.WriteHeader(401)
 			fmt.Fprint(w, "401 - Not Authorized")
 			return
 		}
-		claims := &jwt.StandardClaims{
-			ExpiresAt: time.Now().AddDate(0, 2, 0).Unix(),
-			Issuer:    "catgi.rls.moe",
-			IssuedAt:  time.Now().Unix(),
-			NotBefore: time.Now().Unix(),
-			Id:        claimflake,
-			Subject:   user,
-		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
-
-		tokenString, err := token.SignedString([]byte(curCfg.HMACKey))
-
-		if err != nil {
-			log.Error("Error on auth: ", err)
-			w.WriteHeader(401)
-			fmt.Fprint(w, "401 - Not Authorized")
+		// The lockout also counts wrong codes of the second factor
+		if !done {
 			return
 		}
-
-		log.Debug("Setting auth cooie: ", tokenString)
-
-		http.SetCookie(w, &http.Cookie{
-			Name:     "auth",
-			Value:    tokenString,
-			Expires:  time.Now().AddDate(0, 1, 0),
-			Secure:   true,
-			HttpOnly: true,
-		})
+		st.limits.lockout.Reset(lockKey)
 
 		fmt.Fprintf(w, "Logged in as %s.\nReturn to main page to upload files now.", user)
 		return
@@ -87,3 +94,118 @@ func (h *handlerServeAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(401)
 	fmt.Fprintf(w, "401 - Not Authorized")
 }
+
+// verifyLogin checks the password of a user and returns the role of
+// the user. LDAP users and, if LDAP is configured, unknown users are
+// verified by a bind and get the role of their groups. Legacy hashes
+// of the user store are replaced once a pepper is configured.
+func verifyLogin(st *serverState, user, pass string, ctx context.Context) (config.Role, error) {
+	ucfg, ok, err := lookupUser(st, user, ctx)
+	if err != nil {
+		return "", err
+	}
+	if ok && ucfg.Disabled {
+		return "", errors.New("User is disabled")
+	}
+	if st.ldap != nil && (!ok || ucfg.AuthType == config.ATLDAP) {
+		res, err := st.ldap.Authenticate(user, pass, ctx)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return ucfg.GetRole(), nil
+		}
+		return res.Role, nil
+	}
+	if !ok {
+		return "", errors.New("User not found")
+	}
+	if err := utils.VerifyUserPassword(ucfg, pass, st.cfg.Pepper); err != nil {
+		return "", err
+	}
+	if utils.NeedsRehash(ucfg, st.cfg.Pepper) {
+		rehashPassword(st, ucfg, pass, ctx)
+	}
+	return ucfg.GetRole(), nil
+}
+
+// maxUserAgent is the longest user agent recorded for a session
+const maxUserAgent = 256
+
+// setAuthCookie signs the login token of the user with the role and
+// the authentication methods and sets it as auth cookie. With a
+// session store the login is recorded as session so it can be revoked.
+func setAuthCookie(w http.ResponseWriter, r *http.Request, user string, role config.Role,
+	amr []string, st *serverState) error {
+	claimflake, err := snowflakes.NewSnowflake()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expires := now.AddDate(0, 2, 0)
+	// The role of users that are not configured comes from OIDC or
+	// LDAP groups, it is only trusted until it is looked up again.
+	_, configured, err := lookupUser(st, user, r.Context())
+	if err != nil {
+		return err
+	}
+	if ttl := st.cfg.ClaimedRoleDuration(); !configured && now.Add(ttl).Before(expires) {
+		expires = now.Add(ttl)
+	}
+	claims := &authClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: expires.Unix(),
+			Issuer:    "catgi.rls.moe",
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			Id:        claimflake,
+			Subject:   user,
+		},
+		Role: role,
+		AMR:  amr,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, claims)
+
+	tokenString, err := token.SignedString([]byte(st.cfg.HMACKey))
+	if err != nil {
+		return err
+	}
+
+	if st.sessions != nil {
+		agent := r.UserAgent()
+		if len(agent) > maxUserAgent {
+			agent = agent[:maxUserAgent]
+		}
+		err := st.sessions.Put(sessions.Session{
+			ID:        claimflake,
+			User:      user,
+			UserAgent: agent,
+			IP:        clientIP(r, st.cfg.RateLimit.TrustProxy),
+			CreatedAt: now.UTC(),
+			LastSeen:  now.UTC(),
+			ExpiresAt: expires.UTC(),
+		}, r.Context())
+		if err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth",
+		Value:    tokenString,
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+	})
+	return nil
+}
+
+// clearAuthCookie removes the auth cookie from the client
+func clearAuthCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
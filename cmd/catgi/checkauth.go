@@ -3,16 +3,31 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"context"
 
+	"git.timschuster.info/rls.moe/catgi/config"
 	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/sessions"
+	"git.timschuster.info/rls.moe/catgi/tokens"
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
 type handlerCheckToken struct {
-	next http.Handler
-	lazy bool
+	next  http.Handler
+	lazy  bool
+	role  config.Role
+	scope tokens.Scope
+}
+
+// roleScopes are the scopes API tokens need for routes requiring a
+// role.
+var roleScopes = map[config.Role]tokens.Scope{
+	config.RoleViewer:   tokens.ScopeRead,
+	config.RoleUploader: tokens.ScopeUpload,
+	config.RoleAdmin:    tokens.ScopeAdmin,
 }
 
 // lazy: If set to true it will check the token and return a Header
@@ -24,19 +39,49 @@ func newHandlerCheckToken(lazy bool, nextHandler http.Handler) http.Handler {
 	}
 }
 
+// newHandlerCheckRole works like newHandlerCheckToken without lazy auth
+// and aborts with a 403 if the user does not have the role. API tokens
+// need the scope matching the role.
+func newHandlerCheckRole(role config.Role, nextHandler http.Handler) http.Handler {
+	return &handlerCheckToken{
+		next:  nextHandler,
+		role:  role,
+		scope: roleScopes[role],
+	}
+}
+
+// newHandlerCheckScope works like newHandlerCheckToken but aborts with
+// a 403 if the request uses an API token without the scope.
+func newHandlerCheckScope(lazy bool, scope tokens.Scope, nextHandler http.Handler) http.Handler {
+	return &handlerCheckToken{
+		next:  nextHandler,
+		lazy:  lazy,
+		scope: scope,
+	}
+}
+
 func (h *handlerCheckToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log := logger.LogFromCtx("httpCheckAuth:"+fmt.Sprint(h.lazy), r.Context())
 	var decodedClaims jwt.MapClaims
 	var decodedToken *jwt.Token
 
-	// If no users are configured, disable authentication
-	if curCfg.Users == nil || len(curCfg.Users) == 0 || curCfg.IgnoreAuth {
-		log.Warn("No users configured, skipping auth-check")
+	st := stateFromContext(r.Context())
+	cfg := st.cfg
+
+	// If no users or logins are configured, disable authentication
+	if !cfg.AuthEnabled() {
+		log.Warn("No logins configured, skipping auth-check")
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, "user", "anonymous")
+		ctx = context.WithValue(ctx, "role", config.DefaultRole)
 
 		r = r.WithContext(ctx)
-		h.next.ServeHTTP(w, r)
+		h.serveWithRole(w, r)
+		return
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		h.serveAPIToken(w, r, strings.TrimPrefix(auth, "Bearer "))
 		return
 	}
 
@@ -47,15 +92,11 @@ func (h *handlerCheckToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		token := cookie.Value
-		t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
-			}
-			if token.Method.Alg() != jwt.SigningMethodHS512.Alg() {
-				return nil, jwt.ErrInvalidKeyType
-			}
-			return []byte(curCfg.HMACKey), nil
-		})
+		t, err := parseAuthToken(token, cfg.HMACKey)
+		if err != nil && cfg.PreviousKeyValid(time.Now()) {
+			// Logins signed before the jwtkey was rotated
+			t, err = parseAuthToken(token, cfg.PreviousHMACKey)
+		}
 		if err != nil {
 			log.Warn("Error on JWT Decode: ", err)
 			h.abortLogin(w, r)
@@ -78,23 +119,184 @@ func (h *handlerCheckToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if decodedClaims != nil {
+		// Pending logins waiting for the second factor have an audience
+		if aud, _ := decodedClaims["aud"].(string); len(aud) > 0 {
+			log.Warn("JWT for ", aud, " used as login")
+			h.abortLogin(w, r)
+			return
+		}
+		user, _ := decodedClaims["sub"].(string)
+		ucfg, configured, err := lookupUser(st, user, r.Context())
+		if err != nil {
+			log.Error("Could not lookup user: ", err)
+			h.abortLogin(w, r)
+			return
+		}
+		if configured && ucfg.Disabled {
+			log.Warn("Login of disabled user ", user)
+			h.abortLogin(w, r)
+			return
+		}
+		if !configured && !claimedRoleFresh(decodedClaims, cfg.ClaimedRoleDuration()) {
+			log.Warn("Role of ", user, " is too old, login again")
+			h.abortLogin(w, r)
+			return
+		}
+		role := claimedRole(ucfg, configured, decodedClaims)
+		if cfg.TwoFactor.Required(role) && !hasAMR(decodedClaims, amrOTP) {
+			log.Warn("Login of ", user, " lacks the required second factor")
+			h.abortLogin(w, r)
+			return
+		}
+
 		ctx := r.Context()
-		ctx = context.WithValue(ctx, "user", (decodedClaims)["sub"])
+		if st.sessions != nil {
+			id, _ := decodedClaims["jti"].(string)
+			_, err := sessions.Touch(st.sessions, id, user,
+				cfg.Sessions.IdleDuration(), r.Context())
+			if err != nil {
+				log.Warn("Session of ", user, " rejected: ", err)
+				h.abortLogin(w, r)
+				return
+			}
+			ctx = context.WithValue(ctx, "session", id)
+		}
+		ctx = context.WithValue(ctx, "user", user)
+		ctx = context.WithValue(ctx, "role", role)
 
 		r = r.WithContext(ctx)
 
-		w.Header().Add("X-Catgi-Logged-In-As", (decodedClaims)["sub"].(string))
+		w.Header().Add("X-Catgi-Logged-In-As", user)
 	} else {
 		log.Error("JWT had nil or invalid claims")
 		log.Debug("JWT dump: ", decodedToken, decodedClaims)
 	}
 
-	h.next.ServeHTTP(w, r)
+	h.serveWithRole(w, r)
+}
+
+// parseAuthToken verifies the signature of an auth cookie with the key,
+// only HS512 is accepted.
+func parseAuthToken(raw, key string) (*jwt.Token, error) {
+	return jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		if token.Method.Alg() != jwt.SigningMethodHS512.Alg() {
+			return nil, jwt.ErrInvalidKeyType
+		}
+		return []byte(key), nil
+	})
+}
+
+// hasAMR returns true if the login used the authentication method
+func hasAMR(claims jwt.MapClaims, method string) bool {
+	list, _ := claims["amr"].([]interface{})
+	for _, v := range list {
+		if v == method {
+			return true
+		}
+	}
+	return false
+}
+
+// claimedRole returns the role of the token. Known users cannot have
+// more than their configured role so changes apply to existing tokens,
+// tokens without a role have the configured or default role.
+func claimedRole(ucfg config.UserConfig, configured bool, claims jwt.MapClaims) config.Role {
+	role := config.DefaultRole
+	if configured {
+		role = ucfg.GetRole()
+	}
+	if val, ok := claims["role"].(string); ok && len(val) > 0 {
+		claimed := config.Role(val)
+		if configured {
+			return claimed.Min(role)
+		}
+		return claimed
+	}
+	return role
+}
+
+// claimedRoleFresh returns true if the login was issued within ttl.
+// Logins of users that are not configured carry a role from OIDC or
+// LDAP groups that cannot be checked again without a new login.
+func claimedRoleFresh(claims jwt.MapClaims, ttl time.Duration) bool {
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return false
+	}
+	return time.Since(time.Unix(int64(iat), 0)) <= ttl
+}
+
+// serveAPIToken authenticates a request with an API token from the
+// token store. The user gets the configured role, the scopes of
+// the token are checked by serveWithRole.
+func (h *handlerCheckToken) serveAPIToken(w http.ResponseWriter, r *http.Request, raw string) {
+	log := logger.LogFromCtx("httpCheckAuth:token", r.Context())
+	st := stateFromContext(r.Context())
+	if st.tokens == nil {
+		log.Warn("API token sent but no token store is configured")
+		h.abortLogin(w, r)
+		return
+	}
+
+	token, err := tokens.Verify(st.tokens, raw, r.Context())
+	if err != nil {
+		log.Warn("Invalid API token: ", err)
+		h.abortLogin(w, r)
+		return
+	}
+	ucfg, ok, err := lookupUser(st, token.User, r.Context())
+	if err != nil {
+		log.Error("Could not lookup user: ", err)
+		h.abortLogin(w, r)
+		return
+	}
+	if !ok || ucfg.Disabled {
+		log.Warn("API token of unknown or disabled user ", token.User)
+		h.abortLogin(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, "user", token.User)
+	ctx = context.WithValue(ctx, "role", ucfg.GetRole())
+	ctx = context.WithValue(ctx, "apitoken", token)
+	r = r.WithContext(ctx)
+
+	w.Header().Add("X-Catgi-Logged-In-As", token.User)
+	h.serveWithRole(w, r)
+}
+
+// serveWithRole passes the request on if the user has the role and the
+// API token, if any, the scope of the handler.
+func (h *handlerCheckToken) serveWithRole(w http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("httpCheckAuth:role", r.Context())
+	var msg string
+	if len(h.role) > 0 && !roleFromContext(r.Context()).Includes(h.role) {
+		log.Warnf("User %s lacks role %s", userFromContext(r.Context()), h.role)
+		msg = "Requires role " + string(h.role)
+	} else if len(h.scope) > 0 && !hasScope(r.Context(), h.scope) {
+		log.Warnf("API token of %s lacks scope %s", userFromContext(r.Context()), h.scope)
+		msg = "Requires token scope " + string(h.scope)
+	} else {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, r, 403, apiCodeForbidden, msg)
+	} else {
+		w.WriteHeader(403)
+		fmt.Fprint(w, "403 - Forbidden")
+	}
 }
 
 func (h *handlerCheckToken) abortLogin(w http.ResponseWriter, r *http.Request) {
 	log := logger.LogFromCtx("httpCheckAuth:abort", r.Context())
-	if !h.lazy {
+	if !h.lazy && strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(w, r, 401, apiCodeUnauthorized, "Not Authorized")
+	} else if !h.lazy {
 		w.WriteHeader(401)
 		fmt.Fprint(w, "401 - Not Authorized")
 	} else {
@@ -102,3 +304,48 @@ func (h *handlerCheckToken) abortLogin(w http.ResponseWriter, r *http.Request) {
 		h.next.ServeHTTP(w, r)
 	}
 }
+
+// userFromContext returns the user set by the token check or an
+// empty string if the request is not logged in.
+func userFromContext(ctx context.Context) string {
+	if val, ok := ctx.Value("user").(string); ok {
+		return val
+	}
+	return ""
+}
+
+// roleFromContext returns the role set by the token check, requests
+// that are not logged in have no role.
+func roleFromContext(ctx context.Context) config.Role {
+	if val, ok := ctx.Value("role").(config.Role); ok {
+		return val
+	}
+	return ""
+}
+
+// sessionFromContext returns the id of the session the request was
+// authenticated with, empty without session store or login.
+func sessionFromContext(ctx context.Context) string {
+	if val, ok := ctx.Value("session").(string); ok {
+		return val
+	}
+	return ""
+}
+
+// apiTokenFromContext returns the API token the request was
+// authenticated with, nil for logins and anonymous requests.
+func apiTokenFromContext(ctx context.Context) *tokens.Token {
+	if val, ok := ctx.Value("apitoken").(*tokens.Token); ok {
+		return val
+	}
+	return nil
+}
+
+// hasScope returns true if the request may use the scope, only
+// requests with API tokens are restricted.
+func hasScope(ctx context.Context, scope tokens.Scope) bool {
+	if token := apiTokenFromContext(ctx); token != nil {
+		return token.HasScope(scope)
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testUsers are configured in every test state
+var testUsers = []config.UserConfig{
+	{Username: "alice", Role: config.RoleViewer},
+	{Username: "bob", Role: config.RoleAdmin},
+	{Username: "carol", Role: config.RoleUploader, Disabled: true},
+}
+
+// newTestState sets up a server state with an in-memory backend and
+// the test users and makes it the current state.
+func newTestState(t *testing.T, cfg config.Configuration) *serverState {
+	ctx := logger.NewLoggingContext()
+	if len(cfg.Backend.Name) == 0 {
+		cfg.Backend = config.DriverConfig{Name: "buntdb", Params: map[string]interface{}{}}
+	}
+	if len(cfg.HMACKey) == 0 {
+		cfg.HMACKey = "test jwt key"
+	}
+	cfg.Users = append(cfg.Users, testUsers...)
+	st, err := newServerState(cfg, nil, ctx)
+	if err != nil {
+		t.Fatal("Could not setup state: ", err)
+	}
+	t.Cleanup(func() { st.closeUnshared(nil, ctx) })
+	state.Store(st)
+	return st
+}
+
+// loginCookie logs the user in and returns the auth cookie
+func loginCookie(t *testing.T, st *serverState, user string, role config.Role, amr ...string) *http.Cookie {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/auth", nil)
+	if err := setAuthCookie(rw, r, user, role, amr, st); err != nil {
+		t.Fatal("Could not login: ", err)
+	}
+	for _, v := range rw.Result().Cookies() {
+		if v.Name == "auth" {
+			return v
+		}
+	}
+	t.Fatal("No auth cookie set")
+	return nil
+}
+
+// signedCookie returns an auth cookie with the claims signed by the
+// jwtkey of the state.
+func signedCookie(t *testing.T, st *serverState, claims jwt.Claims) *http.Cookie {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).
+		SignedString([]byte(st.cfg.HMACKey))
+	if err != nil {
+		t.Fatal("Could not sign claims: ", err)
+	}
+	return &http.Cookie{Name: "auth", Value: token}
+}
+
+// whoAmI replies with the user and role the checks passed on
+var whoAmI = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(rw, "%s:%s", userFromContext(r.Context()), roleFromContext(r.Context()))
+})
+
+// serveWith sends a request through the handler and returns the
+// response.
+func serveWith(h http.Handler, method, target string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw
+}
+
+func TestCheckRole(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	h := newHandlerCheckRole(config.RoleUploader, whoAmI)
+
+	rw := serveWith(h, "GET", "/file", nil)
+	assert.Equal(401, rw.Code, "Requests without login must be rejected")
+
+	rw = serveWith(h, "GET", "/file", loginCookie(t, st, "alice", config.RoleViewer))
+	assert.Equal(403, rw.Code, "Viewers must not pass an uploader check")
+
+	rw = serveWith(h, "GET", "/api/v1/files", loginCookie(t, st, "alice", config.RoleViewer))
+	assert.Equal(403, rw.Code)
+	assert.Contains(rw.Body.String(), apiCodeForbidden)
+
+	rw = serveWith(h, "GET", "/file", loginCookie(t, st, "bob", config.RoleAdmin))
+	assert.Equal(200, rw.Code)
+	assert.Equal("bob:admin", rw.Body.String())
+
+	rw = serveWith(h, "GET", "/file", loginCookie(t, st, "carol", config.RoleUploader))
+	assert.Equal(401, rw.Code, "Disabled users must be rejected")
+}
+
+func TestCheckRoleLazy(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	h := newHandlerCheckScope(true, tokens.ScopeRead, whoAmI)
+
+	rw := serveWith(h, "GET", "/f/flake", nil)
+	assert.Equal(200, rw.Code)
+	assert.Equal(":", rw.Body.String(), "Lazy checks pass requests without login on")
+
+	rw = serveWith(h, "GET", "/f/flake", loginCookie(t, st, "alice", config.RoleViewer))
+	assert.Equal("alice:viewer", rw.Body.String())
+}
+
+func TestClaimedRole(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{ClaimedRoleTTL: "1h"})
+	h := newHandlerCheckToken(false, whoAmI)
+
+	// Configured users cannot claim more than their role
+	rw := serveWith(h, "GET", "/", loginCookie(t, st, "alice", config.RoleAdmin))
+	assert.Equal("alice:viewer", rw.Body.String())
+
+	// Users of OIDC or LDAP keep the role of their groups for a while
+	rw = serveWith(h, "GET", "/", loginCookie(t, st, "dave", config.RoleUploader, amrOIDC))
+	assert.Equal("dave:uploader", rw.Body.String())
+
+	now := time.Now()
+	stale := &authClaims{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: now.AddDate(0, 1, 0).Unix(),
+			IssuedAt:  now.Add(-2 * time.Hour).Unix(),
+			Subject:   "dave",
+		},
+		Role: config.RoleAdmin,
+	}
+	rw = serveWith(h, "GET", "/", signedCookie(t, st, stale))
+	assert.Equal(401, rw.Code, "Claimed roles must expire")
+
+	stale.Subject = "bob"
+	rw = serveWith(h, "GET", "/", signedCookie(t, st, stale))
+	assert.Equal("bob:admin", rw.Body.String(), "Configured roles do not expire early")
+
+	// A login waiting for the second factor is not a login
+	pending := &pendingClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  pendingAudience,
+			ExpiresAt: now.Add(time.Hour).Unix(),
+			IssuedAt:  now.Unix(),
+			Subject:   "bob",
+		},
+		Role: config.RoleAdmin,
+	}
+	rw = serveWith(h, "GET", "/", signedCookie(t, st, pending))
+	assert.Equal(401, rw.Code)
+
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS512, stale).
+		SignedString([]byte("another key"))
+	assert.NoError(err)
+	rw = serveWith(h, "GET", "/", &http.Cookie{Name: "auth", Value: forged})
+	assert.Equal(401, rw.Code, "Cookies signed with another key must be rejected")
+}
+
+func TestExternalAuthOnly(t *testing.T) {
+	assert := assert.New(t)
+	h := newHandlerCheckToken(false, whoAmI)
+
+	var tests = []struct {
+		name   string
+		amr    string
+		change func(*config.Configuration)
+	}{
+		{"ldap", amrPassword, func(cfg *config.Configuration) {
+			cfg.LDAP = config.LDAPConfig{URL: "ldaps://ldap.example.com", BaseDN: "dc=example,dc=com"}
+		}},
+		{"oidc", amrOIDC, func(cfg *config.Configuration) {
+			cfg.OIDC = config.OIDCConfig{Issuer: "https://id.example.com", ClientID: "catgi"}
+		}},
+	}
+	for _, v := range tests {
+		change := v.change
+		st := reloadTestState(t, newTestState(t, config.Configuration{ClaimedRoleTTL: "1h"}),
+			func(cfg *config.Configuration) {
+				cfg.Users = nil
+				change(cfg)
+			})
+		assert.True(st.cfg.AuthEnabled(), v.name)
+
+		rw := serveWith(h, "GET", "/", nil)
+		assert.Equal(401, rw.Code, "%s: requests must not be anonymous", v.name)
+
+		rw = serveWith(h, "GET", "/", loginCookie(t, st, "dave", config.RoleUploader, v.amr))
+		assert.Equal("dave:uploader", rw.Body.String(), "%s: logins must be read", v.name)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	rice "github.com/GeertJohan/go.rice"
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/utils"
+)
+
+// optionCollection marks the file storing a named collection
+const optionCollection common.FileOption = "collection"
+
+// collectionName limits names to something that is safe in URLs
+// and in all backends.
+var collectionName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// maxCollectionSize limits the size of a stored collection that is read
+const maxCollectionSize = 1024 * 1024
+
+// collection is stored as data of the file under ClearPubName
+type collection struct {
+	Name   string   `json:"name"`
+	Owner  string   `json:"owner"`
+	Flakes []string `json:"flakes"`
+}
+
+type handlerPublishCollection struct {
+	backend common.Backend
+}
+
+func newHandlerPublishCollection(b common.Backend) http.Handler {
+	return &handlerPublishCollection{
+		backend: b,
+	}
+}
+
+// ServeHTTP publishes the flakes listed in the form under a name.
+// Only the owner of a collection may replace it and only flakes owned
+// by the user may be published.
+func (h *handlerPublishCollection) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("publishCollection", r.Context())
+
+	if err := r.ParseForm(); err != nil {
+		log.Warn("Could not read form")
+		rw.WriteHeader(400)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	}
+
+	name := r.Form.Get("name")
+	if !collectionName.MatchString(name) {
+		rw.WriteHeader(400)
+		fmt.Fprint(rw, "Error: Invalid collection name")
+		return
+	}
+	flakes := strings.FieldsFunc(r.Form.Get("flakes"), func(c rune) bool {
+		return c == ',' || c == ' ' || c == '\n' || c == '\r' || c == '\t'
+	})
+	if len(flakes) == 0 {
+		rw.WriteHeader(400)
+		fmt.Fprint(rw, "Error: Collection contains no flakes")
+		return
+	}
+	user := userFromContext(r.Context())
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+	ctx := r.Context()
+	storeName := common.ClearPubName(name, common.SkipSize)
+
+	// <- BEGIN BACKEND INTERACTION ->
+	// The collection expires with the last of it's flakes, a flake
+	// without expiry keeps it forever.
+	var deleteAt *common.DateOnlyTime
+	var forever = false
+	for _, flake := range flakes {
+		f, err := lookupMeta(h.backend, flake, r)
+		if err != nil {
+			log.Warn("Could not publish ", flake, ": ", err)
+			rw.WriteHeader(404)
+			fmt.Fprintf(rw, "Error: Flake %s not found", flake)
+			return
+		}
+		if len(f.User) > 0 && f.User != user {
+			rw.WriteHeader(403)
+			fmt.Fprintf(rw, "Error: Flake %s is not yours", flake)
+			return
+		}
+		if f.DeleteAt == nil {
+			forever = true
+		} else if deleteAt == nil || f.DeleteAt.After(deleteAt.Time) {
+			deleteAt = f.DeleteAt
+		}
+	}
+	if forever {
+		deleteAt = nil
+	}
+
+	oldFile, old, err := loadCollectionFile(h.backend, name, r)
+	if err != nil && !common.IsFileNotExists(err) && err != common.ErrorExpired {
+		log.Error("Could not load old collection: ", err)
+		rw.WriteHeader(500)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	}
+	// Without login everyone is anonymous, so nobody owns a collection
+	// for the purpose of replacing it.
+	if old != nil && (old.Owner != user || user == "anonymous") {
+		rw.WriteHeader(403)
+		fmt.Fprint(rw, "Error: Collection belongs to another user")
+		return
+	}
+
+	dat, err := json.Marshal(collection{Name: name, Owner: user, Flakes: flakes})
+	if err != nil {
+		rw.WriteHeader(500)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	}
+	// The collection has no owner itself so it does not show up in
+	// listings of the user, the owner is kept in the data.
+	next := &common.File{
+		Flake:       storeName,
+		Data:        dat,
+		ContentType: "application/json",
+		CreatedAt:   common.FromTime(time.Now().UTC()),
+		DeleteAt:    deleteAt,
+		Options:     []common.FileOption{optionCollection},
+	}
+	if old == nil {
+		err = h.backend.Upload(storeName, next, ctx)
+	} else {
+		log.Debug("Replacing collection ", name)
+		oldFile.Data, err = json.Marshal(old)
+		if err == nil {
+			err = replaceFile(h.backend, storeName, oldFile, next, ctx)
+		}
+	}
+	// -> END BACKEND INTERACTION <-
+
+	if err != nil && !common.IsHTTPOption(err) {
+		log.Warn("Could not store collection: ", err)
+		rw.WriteHeader(500)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	} else if common.IsHTTPOption(err) {
+		httpopt := err.(common.ErrorHTTPOptions)
+		httpopt.PassOverHTTP(rw)
+		if httpopt.WantsTakeover() {
+			httpopt.HTTPTakeover(r, rw, r.Context())
+			return
+		}
+	}
+
+	if r.Form.Get("disable_redirect") != "on" {
+		http.Redirect(rw, r, "/n/"+name, 302)
+	} else {
+		fmt.Fprint(rw, "/n/"+name)
+	}
+}
+
+type handlerServeCollection struct {
+	backend common.Backend
+	rice    rice.Config
+}
+
+func newHandlerServeCollection(b common.Backend) http.Handler {
+	return &handlerServeCollection{
+		backend: b,
+		rice: rice.Config{
+			LocateOrder: []rice.LocateMethod{
+				rice.LocateWorkingDirectory,
+				rice.LocateFS,
+				rice.LocateEmbedded,
+			},
+		},
+	}
+}
+
+// ServeHTTP shows all files of a collection that still exist
+func (h *handlerServeCollection) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("serveCollection", r.Context())
+
+	name := mux.Vars(r)["name"]
+	if !collectionName.MatchString(name) {
+		rw.WriteHeader(404)
+		fmt.Fprint(rw, "Could not find collection")
+		return
+	}
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	// <- BEGIN BACKEND INTERACTION ->
+	c, err := loadCollection(h.backend, name, r)
+	if err != nil {
+		log.Warn("Collection error on backend: ", err)
+		rw.WriteHeader(404)
+		fmt.Fprint(rw, "Could not find collection")
+		return
+	}
+	var files = []*common.File{}
+	for _, flake := range c.Flakes {
+		f, err := lookupMeta(h.backend, flake, r)
+		if err != nil {
+			log.Debug("Skipping ", flake, ": ", err)
+			continue
+		}
+		files = append(files, f)
+	}
+	// -> END BACKEND INTERACTION <-
+
+	renderGallery(h.rice, rw, r, galleryPage{
+		Title: c.Name,
+		Files: files,
+		Page:  1,
+	})
+}
+
+func loadCollection(b common.Backend, name string, r *http.Request) (*collection, error) {
+	_, c, err := loadCollectionFile(b, name, r)
+	return c, err
+}
+
+// loadCollectionFile returns the stored collection and the metadata of
+// the file it is stored in.
+func loadCollectionFile(b common.Backend, name string, r *http.Request) (*common.File, *collection, error) {
+	var c = &collection{}
+	f, err := loadStoredJSON(b, common.ClearPubName(name, common.SkipSize),
+		maxCollectionSize, c, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, c, nil
+}
+
+// loadStoredJSON decodes a JSON file of up to limit bytes into v and
+// returns the metadata of the file. The file is streamed so backends
+// without index do not load a large file someone stored under the
+// name into memory.
+func loadStoredJSON(b common.Backend, storeName string, limit int64,
+	v interface{}, r *http.Request) (*common.File, error) {
+	f, data, err := common.NewStreamAdapter(b).GetReader(storeName, r.Context())
+	if data != nil {
+		defer data.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	dat, err := ioutil.ReadAll(io.LimitReader(data, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(dat)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", storeName, limit)
+	}
+	return f, json.Unmarshal(dat, v)
+}
+
+// replaceFile replaces the old file stored under the name with next.
+// Backends do not overwrite files, so the old file is deleted first
+// and stored again if next cannot be uploaded.
+func replaceFile(b common.Backend, storeName string, old, next *common.File,
+	ctx context.Context) error {
+	if err := b.Delete(storeName, ctx); err != nil {
+		return err
+	}
+	err := b.Upload(storeName, next, ctx)
+	if err == nil || common.IsHTTPOption(err) {
+		return err
+	}
+	if rerr := b.Upload(storeName, old, ctx); rerr != nil && !common.IsHTTPOption(rerr) {
+		logger.LogFromCtx("replaceFile", ctx).
+			Error("Could not restore ", storeName, " after failed replace: ", rerr)
+	}
+	return err
+}
+
+// lookupMeta returns the metadata of a flake without it's data.
+// The index is used if available so the file is not loaded.
+func lookupMeta(b common.Backend, flake string, r *http.Request) (*common.File, error) {
+	if idx := index.FromBackend(b); idx != nil {
+		entry, err := idx.Get(flake, r.Context())
+		if err != nil {
+			return nil, err
+		}
+		if entry.Expired() {
+			return nil, common.ErrorExpired
+		}
+		return entry.File(), nil
+	}
+	f, data, err := common.NewStreamAdapter(b).GetReader(flake, r.Context())
+	if data != nil {
+		data.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
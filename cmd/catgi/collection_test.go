@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+// failingUploads refuses uploads while fail is set
+type failingUploads struct {
+	common.Backend
+	fail bool
+}
+
+func (f *failingUploads) Upload(name string, file *common.File, ctx context.Context) error {
+	if f.fail {
+		f.fail = false
+		return errors.New("upload failed")
+	}
+	return f.Backend.Upload(name, file, ctx)
+}
+
+// publishAs publishes the flakes as collection with the request
+// made by the user.
+func publishAs(b common.Backend, user, name, flakes string) *httptest.ResponseRecorder {
+	form := url.Values{"name": {name}, "flakes": {flakes}, "disable_redirect": {"on"}}
+	r := httptest.NewRequest("POST", "/n", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx := context.WithValue(logger.NewLoggingContext(), "user", user)
+	rw := httptest.NewRecorder()
+	newHandlerPublishCollection(b).ServeHTTP(rw, r.WithContext(ctx))
+	return rw
+}
+
+func TestPublishCollection(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	uploadTestFile(t, st, "first", "alice")
+	uploadTestFile(t, st, "second", "alice")
+	uploadTestFile(t, st, "foreign", "dave")
+
+	rw := publishAs(st.backend, "alice", "holiday", "first")
+	assert.Equal(200, rw.Code)
+	rw = publishAs(st.backend, "alice", "other", "first,foreign")
+	assert.Equal(403, rw.Code, "Only own flakes may be published")
+
+	rw = publishAs(st.backend, "dave", "holiday", "foreign")
+	assert.Equal(403, rw.Code, "Collections of other users must not be replaced")
+
+	rw = publishAs(st.backend, "alice", "holiday", "first,second")
+	assert.Equal(200, rw.Code)
+	r := httptest.NewRequest("GET", "/n/holiday", nil)
+	c, err := loadCollection(st.backend, "holiday", r)
+	if assert.NoError(err) {
+		assert.Equal([]string{"first", "second"}, c.Flakes)
+	}
+}
+
+func TestPublishCollectionAnonymous(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	uploadTestFile(t, st, "anon", "anonymous")
+
+	rw := publishAs(st.backend, "anonymous", "shared", "anon")
+	assert.Equal(200, rw.Code)
+	rw = publishAs(st.backend, "anonymous", "shared", "anon")
+	assert.Equal(403, rw.Code, "Anonymous collections must not be replaced")
+}
+
+func TestReplaceCollectionFailure(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	uploadTestFile(t, st, "kept", "alice")
+	be := &failingUploads{Backend: st.backend}
+
+	rw := publishAs(be, "alice", "kept", "kept")
+	assert.Equal(200, rw.Code)
+
+	be.fail = true
+	rw = publishAs(be, "alice", "kept", "kept,kept")
+	assert.Equal(http.StatusInternalServerError, rw.Code)
+	c, err := loadCollection(be, "kept", httptest.NewRequest("GET", "/n/kept", nil))
+	if assert.NoError(err, "A failed replace must keep the old collection") {
+		assert.Equal([]string{"kept"}, c.Flakes)
+	}
+}
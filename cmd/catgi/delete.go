@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+	"git.timschuster.info/rls.moe/catgi/utils"
+)
+
+// deleteTokenHeader carries the delete token in upload responses and
+// delete requests.
+const deleteTokenHeader = "X-Catgi-Delete-Token"
+
+// newDeleteTokenKey derives the delete token key from the secret.
+// Without secret a random key is used and tokens do not survive
+// a restart.
+func newDeleteTokenKey(secret string) (crypto.SecretKey, error) {
+	var master = []byte(secret)
+	if len(master) == 0 {
+		master = make([]byte, 64)
+		if _, err := rand.Read(master); err != nil {
+			return crypto.SecretKey{}, err
+		}
+	}
+	return crypto.NewSecretKey(master).DeriveKey("catgi", "tokens", "delete")
+}
+
+// newDeleteToken returns the delete token of a flake
+func newDeleteToken(flake string, ctx context.Context) (string, error) {
+	key := stateFromContext(ctx).deleteKey
+	mac, err := crypto.HMAC(key[:], bytes.NewBufferString(flake))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(mac), nil
+}
+
+// checkDeleteToken returns true if the token belongs to the flake
+func checkDeleteToken(flake, token string, ctx context.Context) bool {
+	mac, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(mac) == 0 {
+		return false
+	}
+	key := stateFromContext(ctx).deleteKey
+	return crypto.VerifyHMAC(mac, key[:], bytes.NewBufferString(flake)) == nil
+}
+
+// canDelete returns true if the request is from the owner of the file
+// or an admin or presents a valid delete token, either in the header
+// or as token query parameter.
+// Without configured users everyone is anonymous, so the anonymous
+// user never owns a file for the purpose of deleting it.
+func canDelete(r *http.Request, f *common.File) bool {
+	user := userFromContext(r.Context())
+	if len(user) > 0 && user != "anonymous" && f.User == user {
+		return true
+	}
+	if roleFromContext(r.Context()).Includes(config.RoleAdmin) &&
+		hasScope(r.Context(), tokens.ScopeAdmin) {
+		return true
+	}
+	token := r.Header.Get(deleteTokenHeader)
+	if len(token) == 0 {
+		token = r.URL.Query().Get("token")
+	}
+	return len(token) > 0 && checkDeleteToken(f.Flake, token, r.Context())
+}
+
+type handlerServeDelete struct {
+	backend common.Backend
+}
+
+func newHandlerServeDelete(b common.Backend) http.Handler {
+	return &handlerServeDelete{
+		backend: b,
+	}
+}
+
+func (h *handlerServeDelete) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("deleteFile", r.Context())
+
+	flake := mux.Vars(r)["flake"]
+	if len(flake) == 0 {
+		log.Warn("Request contained no flake")
+		rw.WriteHeader(400)
+		fmt.Fprint(rw, "Missing flake")
+		return
+	}
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	// <- BEGIN BACKEND INTERACTION ->
+	f, err := lookupMeta(h.backend, flake, r)
+	if err != nil {
+		log.Warn("File error on backend: ", err)
+		rw.WriteHeader(404)
+		fmt.Fprint(rw, "Could not find file")
+		return
+	}
+
+	if !canDelete(r, f) {
+		log.Warn("Unauthorized delete of ", flake)
+		rw.WriteHeader(403)
+		fmt.Fprint(rw, "403 - Forbidden")
+		return
+	}
+
+	err = h.backend.Delete(flake, r.Context())
+	// -> END BACKEND INTERACTION <-
+
+	if err != nil && !common.IsHTTPOption(err) {
+		log.Error("Could not delete file: ", err)
+		rw.WriteHeader(500)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	} else if passHTTPOptions(rw, r, err) {
+		return
+	}
+
+	removeKeyFile(h.backend, flake, r)
+
+	log.Info("Deleted ", flake)
+	rw.WriteHeader(204)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+)
+
+// newDeleteRouter routes deletes like newRouter does
+func newDeleteRouter(st *serverState) http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/f/{flake}",
+		newHandlerCheckScope(true, tokens.ScopeDelete,
+			newHandlerServeDelete(st.backend),
+		),
+	).Methods("DELETE")
+	return router
+}
+
+// uploadTestFile stores a file owned by the user
+func uploadTestFile(t *testing.T, st *serverState, flake, user string) {
+	err := st.backend.Upload(flake, &common.File{
+		User:     user,
+		Data:     []byte("file of " + user),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 1)),
+	}, logger.NewLoggingContext())
+	if err != nil {
+		t.Fatal("Could not upload test file: ", err)
+	}
+}
+
+func TestDeleteAuthorisation(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	h := newDeleteRouter(st)
+
+	uploadTestFile(t, st, "owned", "alice")
+
+	rw := serveWith(h, "DELETE", "/f/owned", nil)
+	assert.Equal(403, rw.Code, "Anonymous deletes need the delete token")
+
+	rw = serveWith(h, "DELETE", "/f/owned", loginCookie(t, st, "dave", config.RoleUploader))
+	assert.Equal(403, rw.Code, "Other users must not delete the file")
+
+	rw = serveWith(h, "DELETE", "/f/owned?token=invalid", nil)
+	assert.Equal(403, rw.Code)
+
+	rw = serveWith(h, "DELETE", "/f/owned", loginCookie(t, st, "alice", config.RoleViewer))
+	assert.Equal(204, rw.Code, "The owner may delete the file")
+
+	uploadTestFile(t, st, "admin", "alice")
+	rw = serveWith(h, "DELETE", "/f/admin", loginCookie(t, st, "bob", config.RoleAdmin))
+	assert.Equal(204, rw.Code, "Admins may delete every file")
+
+	uploadTestFile(t, st, "token", "alice")
+	token, err := newDeleteToken("token", logger.NewLoggingContext())
+	assert.NoError(err)
+	rw = serveWith(h, "DELETE", "/f/token?token=wrong"+token, nil)
+	assert.Equal(403, rw.Code)
+	rw = serveWith(h, "DELETE", "/f/token?token="+token, nil)
+	assert.Equal(204, rw.Code, "The delete token may delete the file")
+
+	rw = serveWith(h, "DELETE", "/f/token?token="+token, nil)
+	assert.Equal(404, rw.Code)
+}
+
+func TestDeleteTokenRotation(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{DeleteTokenKey: "test delete key"})
+	h := newDeleteRouter(st)
+
+	uploadTestFile(t, st, "rotated", "alice")
+	token, err := newDeleteToken("rotated", logger.NewLoggingContext())
+	assert.NoError(err)
+
+	// Delete tokens do not depend on the jwtkey
+	rotated := reloadTestState(t, st, func(cfg *config.Configuration) {
+		cfg.PreviousHMACKey = cfg.HMACKey
+		cfg.PreviousHMACKeyUntil = time.Now().Add(-time.Hour).Format(time.RFC3339)
+		cfg.HMACKey = "new jwt key"
+	})
+	rw := serveWith(newDeleteRouter(rotated), "DELETE", "/f/rotated?token="+token, nil)
+	assert.Equal(204, rw.Code, "Delete tokens must survive a jwtkey rotation")
+
+	uploadTestFile(t, rotated, "changed", "alice")
+	token, err = newDeleteToken("changed", logger.NewLoggingContext())
+	assert.NoError(err)
+	reloadTestState(t, rotated, func(cfg *config.Configuration) {
+		cfg.DeleteTokenKey = "another delete key"
+	})
+	rw = serveWith(h, "DELETE", "/f/changed?token="+token, nil)
+	assert.Equal(403, rw.Code)
+}
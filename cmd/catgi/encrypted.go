@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	rice "github.com/GeertJohan/go.rice"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+// optionEncrypted marks files encrypted by the client, the server
+// only has the ciphertext and the key is in the fragment of the URL.
+const optionEncrypted common.FileOption = "e2e"
+
+// markEncrypted drops all metadata of an upload that could reveal
+// the content of a client encrypted file. Name and type are part
+// of the ciphertext instead.
+// Encrypted files are never public, the gallery could not show them.
+func markEncrypted(upload *uploadForm) {
+	upload.filename = ""
+	upload.file.ContentType = "application/octet-stream"
+	upload.file.FileExtension = ""
+	upload.file.Public = false
+	upload.file.Options = append(upload.file.Options, optionEncrypted)
+}
+
+// wantsCiphertext returns true if the request asks for the ciphertext
+// of an encrypted file instead of the viewer.
+func wantsCiphertext(r *http.Request) bool {
+	return r.URL.Query().Get("ciphertext") == "1"
+}
+
+// serveViewer writes the page that downloads and decrypts an
+// encrypted file in the browser.
+func serveViewer(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("serveViewer", r.Context())
+	dat, err := (&rice.Config{
+		LocateOrder: []rice.LocateMethod{
+			rice.LocateWorkingDirectory,
+			rice.LocateFS,
+			rice.LocateEmbedded,
+		},
+	}).MustFindBox("./resources").Bytes("viewer.html")
+	if err != nil {
+		log.Error("Could not load file from disk: ", err)
+		rw.WriteHeader(404)
+		fmt.Fprint(rw, "viewer.html not found")
+		return
+	}
+	rw.Header().Add("Content-Type", "text/html; charset=utf-8")
+	// The key is in the fragment, keep it out of referers anyway
+	rw.Header().Add("Referrer-Policy", "no-referrer")
+	rw.Header().Add("Cache-Control", "no-cache")
+	rw.WriteHeader(200)
+	rw.Write(dat)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+
+	rice "github.com/GeertJohan/go.rice"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/utils"
+)
+
+// galleryPageSize is the number of files shown per gallery page
+const galleryPageSize = 30
+
+type handlerServeGallery struct {
+	backend common.Backend
+	rice    rice.Config
+}
+
+// galleryPage is passed to the gallery.html template
+type galleryPage struct {
+	Title    string
+	Files    []*common.File
+	Page     int
+	PrevPage int
+	NextPage int
+}
+
+func newHandlerServeGallery(b common.Backend) http.Handler {
+	return &handlerServeGallery{
+		backend: b,
+		rice: rice.Config{
+			LocateOrder: []rice.LocateMethod{
+				rice.LocateWorkingDirectory,
+				rice.LocateFS,
+				rice.LocateEmbedded,
+			},
+		},
+	}
+}
+
+func (h *handlerServeGallery) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("serveGallery", r.Context())
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	// <- BEGIN BACKEND INTERACTION ->
+	files, err := publicFiles(h.backend, r)
+	// -> END BACKEND INTERACTION <-
+
+	if err != nil {
+		log.Error("Could not list public files: ", err)
+		rw.WriteHeader(500)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	}
+
+	sortFiles(files)
+
+	var data = galleryPage{Title: "Gallery", Page: page}
+	start := (page - 1) * galleryPageSize
+	if start < len(files) {
+		end := start + galleryPageSize
+		if end < len(files) {
+			data.NextPage = page + 1
+		} else {
+			end = len(files)
+		}
+		data.Files = files[start:end]
+	}
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+
+	renderGallery(h.rice, rw, r, data)
+}
+
+// publicFiles returns all public files that have not expired yet.
+// The index is used if available, otherwise the backend is listed.
+func publicFiles(b common.Backend, r *http.Request) ([]*common.File, error) {
+	var files = []*common.File{}
+	if idx := index.FromBackend(b); idx != nil {
+		entries, err := idx.ListPublic(r.Context())
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range entries {
+			if !v.Expired() {
+				files = append(files, v.File())
+			}
+		}
+		return files, nil
+	}
+
+	list, err := b.ListGlob(r.Context(), "")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range list {
+		if v == nil || !v.Public || v.HasOption(optionCollection) {
+			continue
+		}
+		if v.DeleteAt != nil && v.DeleteAt.TTL() == 0 {
+			continue
+		}
+		files = append(files, v)
+	}
+	return files, nil
+}
+
+// sortFiles orders files newest first, files of the same day are
+// ordered by flake so pages are stable.
+func sortFiles(files []*common.File) {
+	sort.Slice(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.CreatedAt != nil && b.CreatedAt != nil && !a.CreatedAt.Equal(b.CreatedAt.Time) {
+			return a.CreatedAt.After(b.CreatedAt.Time)
+		}
+		return a.Flake < b.Flake
+	})
+}
+
+func renderGallery(rc rice.Config, rw http.ResponseWriter, r *http.Request, data galleryPage) {
+	log := logger.LogFromCtx("renderGallery", r.Context())
+	dat, err := rc.MustFindBox("./resources").String("gallery.html")
+	if err != nil {
+		log.Error("Could not load file from disk or embed: ", err)
+		rw.WriteHeader(404)
+		fmt.Fprint(rw, "gallery.html not found")
+		return
+	}
+	tmpl, err := template.New("gallery").Parse(dat)
+	if err != nil {
+		log.Error("Could not parse gallery template: ", err)
+		rw.WriteHeader(500)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	}
+	rw.Header().Add("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(rw, data); err != nil {
+		log.Error("Could not render gallery: ", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+// gcRecheck is how often a disabled scheduler checks if a reload
+// enabled it.
+const gcRecheck = time.Minute
+
+// gcLock serialises GC runs, it is a channel so waiting for it can be
+// cancelled with the context.
+var gcLock = make(chan struct{}, 1)
+
+// runGC runs the GC of the backend, if another run is active it waits
+// for it to finish first. Runs are aborted after the configured
+// max runtime.
+func runGC(b common.Backend, ctx context.Context) ([]common.File, error) {
+	log := logger.LogFromCtx("runGC", ctx)
+	select {
+	case gcLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-gcLock }()
+
+	if max := configFromContext(ctx).GC.MaxRuntimeDuration(); max > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, max)
+		defer cancel()
+	}
+
+	log.Info("Starting GC")
+	start := time.Now()
+	// <- BEGIN BACKEND INTERACTION ->
+	files, err := b.RunGC(ctx)
+	// -> END BACKEND INTERACTION <-
+	observeGC(start, len(files), err)
+
+	if err != nil && !common.IsHTTPOption(err) {
+		log.Errorf("GC failed after %s and %d deleted files: %s",
+			time.Since(start), len(files), err)
+	} else {
+		log.Infof("GC deleted %d files in %s", len(files), time.Since(start))
+	}
+	return files, err
+}
+
+// gcWindow returns how long to wait until the window opens and how
+// long it stays open from then. Without a window it never closes.
+func gcWindow(cfg config.GCConfig, now time.Time) (wait, open time.Duration) {
+	start, end, ok, err := cfg.WindowTimes()
+	if !ok || err != nil {
+		return 0, 0
+	}
+	const day = 24 * time.Hour
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	length := (end - start + day) % day
+
+	wait = (start - offset + day) % day
+	if since := (offset - start + day) % day; since < length {
+		// Inside the window
+		return 0, length - since
+	}
+	return wait, length
+}
+
+// gcScheduler is the running scheduler, nil if it was not started
+var gcScheduler struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startGCScheduler runs the GC in the background as configured. The
+// config is read again before every wait, so reloads apply after the
+// current wait.
+func startGCScheduler(ctx context.Context) {
+	log := logger.LogFromCtx("gcScheduler", ctx)
+	ctx, gcScheduler.cancel = context.WithCancel(ctx)
+	gcScheduler.done = make(chan struct{})
+
+	sleep := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	go func() {
+		defer close(gcScheduler.done)
+		for {
+			cfg := currentConfig().GC
+			interval := cfg.IntervalDuration()
+			if interval == 0 {
+				if !sleep(gcRecheck) {
+					return
+				}
+				continue
+			}
+			if jitter := cfg.JitterDuration(); jitter > 0 {
+				interval += time.Duration(rand.Int63n(int64(jitter)))
+			}
+			log.Debug("Next GC in ", interval)
+			if !sleep(interval) {
+				return
+			}
+
+			cfg = currentConfig().GC
+			if cfg.IntervalDuration() == 0 {
+				continue
+			}
+			wait, open := gcWindow(cfg, time.Now())
+			if wait > 0 {
+				log.Debug("Waiting for GC window for ", wait)
+				if !sleep(wait) {
+					return
+				}
+			}
+
+			runCtx, cancel := ctx, context.CancelFunc(func() {})
+			if open > 0 {
+				runCtx, cancel = context.WithTimeout(ctx, open)
+			}
+			st := acquireState()
+			runGC(st.backend, runCtx)
+			st.inflight.RUnlock()
+			cancel()
+		}
+	}()
+}
+
+// stopGCScheduler stops the scheduler and aborts a running GC
+func stopGCScheduler() {
+	if gcScheduler.cancel == nil {
+		return
+	}
+	gcScheduler.cancel()
+	<-gcScheduler.done
+}
@@ -3,11 +3,11 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"time"
 
-	"bytes"
-
 	"git.timschuster.info/rls.moe/catgi/backend/common"
 	"git.timschuster.info/rls.moe/catgi/logger"
 	"git.timschuster.info/rls.moe/catgi/utils"
@@ -41,8 +41,11 @@ func (h *handlerServeGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	// <- BEGIN BACKEND INTERACTION ->
 	log.Debug("Loading File from Backend")
-	f, err := h.backend.Get(flake, r.Context())
+	f, data, err := common.NewStreamAdapter(h.backend).GetReader(flake, r.Context())
 	// -> END BACKEND INTERACTIOn <-
+	if data != nil {
+		defer data.Close()
+	}
 
 	if err != nil && !common.IsHTTPOption(err) {
 		log.Warn("File error on backend: ", err)
@@ -60,21 +63,35 @@ func (h *handlerServeGet) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	log.Debug("Writing out response")
 
+	if f.HasOption(optionEncrypted) && !wantsCiphertext(r) && r.URL.Query().Get("raw") != "1" {
+		log.Debug("File is client encrypted, serving viewer")
+		serveViewer(rw, r)
+		return
+	}
+
 	if r.URL.Query().Get("raw") == "1" {
 		rw.Header().Add("Content-Type", "application/json")
 		var dat []byte
+		f.Data, err = ioutil.ReadAll(data)
+		if err != nil {
+			log.Errorf("Raw read error")
+		}
 		dat, err = json.Marshal(f)
 		if err != nil {
 			log.Errorf("Raw output error")
 		}
 		_, err = rw.Write(dat)
 	} else {
-		buf := bytes.NewReader(f.Data)
 		remainingAge := fmt.Sprintf("%.0f", f.DeleteAt.Sub(time.Now().UTC()).Seconds())
 		rw.Header().Add("Cache-Control", "public, max-age="+remainingAge)
 		rw.Header().Add("X-Catgi-Expires-At", f.DeleteAt.Format("2006-01-02"))
 		rw.Header().Add("X-Catgi-Owner", f.User)
-		http.ServeContent(rw, r, f.Flake+"."+f.FileExtension, f.CreatedAt.Time, buf)
+		if seeker, ok := data.(io.ReadSeeker); ok {
+			http.ServeContent(rw, r, f.Flake+"."+f.FileExtension, f.CreatedAt.Time, seeker)
+		} else {
+			rw.Header().Add("Content-Type", f.ContentType)
+			_, err = io.Copy(rw, data)
+		}
 	}
 	if err != nil {
 		log.Errorf("Error on write: %s", err)
@@ -10,16 +10,18 @@ type handlerInjectLog struct {
 	next http.Handler
 }
 
+// newHandlerInjectLog sets up logging for a request, every route is
+// wrapped in it so it also records the request metrics.
 func newHandlerInjectLog(nextHandler http.Handler) http.Handler {
 	return &handlerInjectLog{
-		next: nextHandler,
+		next: newHandlerMetrics(nextHandler),
 	}
 }
 
 func (h *handlerInjectLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := logger.InjectLogToContext(r.Context())
 	ctx = logger.CreateRequestIDContext(ctx)
-	ctx = logger.SetLoggingLevel(curCfg.LogLevel, ctx)
+	ctx = logger.SetLoggingLevel(configFromContext(r.Context()).LogLevel, ctx)
 	log := logger.LogFromCtx("httpLogInject", ctx)
 	log.Debug("Starting new request")
 	h.next.ServeHTTP(w, r.WithContext(ctx))
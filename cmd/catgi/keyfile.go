@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/crypto/keyfile"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/utils"
+)
+
+// optionKeyFile marks the file storing the key file of a flake
+const optionKeyFile common.FileOption = "keyfile"
+
+// maxKeyFileSize limits the size of uploaded key files
+const maxKeyFileSize = 1024 * 1024
+
+type handlerAPIKeyFile struct {
+	backend common.Backend
+}
+
+func newHandlerAPIKeyFile(b common.Backend) http.Handler {
+	return &handlerAPIKeyFile{backend: b}
+}
+
+// ServeHTTP returns the key file of a flake on GET and stores it on
+// PUT. Key files must be signed for the flake they are stored for.
+// The first key file may only be stored by the owner of the flake
+// or with its delete token, updates must be signed by the primary key
+// or the primary keypair master of the stored key file.
+func (h *handlerAPIKeyFile) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiKeyFile", r.Context())
+	flake := mux.Vars(r)["flake"]
+	storeName := common.KeyFileName(flake, common.SkipSize)
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	// <- BEGIN BACKEND INTERACTION ->
+	f, _, err := apiLookup(h.backend, flake, r)
+	if err != nil && !common.IsHTTPOption(err) {
+		writeBackendError(rw, r, err)
+		return
+	} else if passHTTPOptions(rw, r, err) {
+		return
+	}
+
+	current, err := loadKeyFile(h.backend, storeName, r)
+	if err != nil && !common.IsFileNotExists(err) {
+		writeBackendError(rw, r, err)
+		return
+	}
+
+	if r.Method == "GET" {
+		if current == nil {
+			writeAPIError(rw, r, 404, apiCodeNotFound, "File has no key file")
+			return
+		}
+		writeAPIJSON(rw, r, 200, current)
+		return
+	}
+
+	dat, err := ioutil.ReadAll(io.LimitReader(r.Body, maxKeyFileSize+1))
+	if err != nil || len(dat) > maxKeyFileSize {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, "Key file too large")
+		return
+	}
+	var next = &keyfile.KeyFile{}
+	if err := json.Unmarshal(dat, next); err != nil {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	if err := next.Verify(); err != nil {
+		log.Warn("Key file for ", flake, " did not verify: ", err)
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	// The signed flake keeps key files from being copied to other files
+	if next.FLK != flake {
+		log.Warn("Key file for ", next.FLK, " uploaded to ", flake)
+		writeAPIError(rw, r, 400, apiCodeBadRequest, keyfile.ErrWrongFlake.Error())
+		return
+	}
+
+	if current != nil {
+		if err := current.AllowsUpdate(next); err != nil {
+			log.Warn("Rejected key file update for ", flake)
+			writeAPIError(rw, r, 403, apiCodeForbidden, err.Error())
+			return
+		}
+		log.Debug("Replacing key file of ", flake)
+		if err := h.backend.Delete(storeName, r.Context()); err != nil {
+			writeBackendError(rw, r, err)
+			return
+		}
+	} else if !canDelete(r, f) {
+		log.Warn("Unauthorized key file creation for ", flake)
+		writeAPIError(rw, r, 403, apiCodeForbidden, "File belongs to another user")
+		return
+	}
+
+	dat, err = json.Marshal(next)
+	if err != nil {
+		writeAPIError(rw, r, 500, apiCodeInternal, err.Error())
+		return
+	}
+	// The key file expires with the flake it belongs to
+	err = h.backend.Upload(storeName, &common.File{
+		Flake:       storeName,
+		Data:        dat,
+		ContentType: "application/json",
+		CreatedAt:   common.FromTime(time.Now().UTC()),
+		DeleteAt:    f.DeleteAt,
+		Options:     []common.FileOption{optionKeyFile},
+	}, r.Context())
+	// -> END BACKEND INTERACTION <-
+
+	if err != nil && !common.IsHTTPOption(err) {
+		writeBackendError(rw, r, err)
+		return
+	} else if passHTTPOptions(rw, r, err) {
+		return
+	}
+
+	if current == nil {
+		writeAPIJSON(rw, r, 201, next)
+	} else {
+		writeAPIJSON(rw, r, 200, next)
+	}
+}
+
+// loadKeyFile reads a stored key file
+func loadKeyFile(b common.Backend, storeName string, r *http.Request) (*keyfile.KeyFile, error) {
+	var kf = &keyfile.KeyFile{}
+	f, err := loadStoredJSON(b, storeName, maxKeyFileSize, kf, r)
+	if err != nil {
+		return nil, err
+	}
+	if f.DeleteAt != nil && f.DeleteAt.TTL() == 0 {
+		return nil, common.NewErrorFileNotExists(storeName, common.ErrorExpired)
+	}
+	return kf, nil
+}
+
+// removeKeyFile deletes the key file of a deleted flake, if any.
+func removeKeyFile(b common.Backend, flake string, r *http.Request) {
+	storeName := common.KeyFileName(flake, common.SkipSize)
+	if err := b.Exists(storeName, r.Context()); err != nil {
+		return
+	}
+	if err := b.Delete(storeName, r.Context()); err != nil {
+		logger.LogFromCtx("removeKeyFile", r.Context()).
+			Warn("Could not remove key file of ", flake, ": ", err)
+	}
+}
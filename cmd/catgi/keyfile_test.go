@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/crypto/keyfile"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+)
+
+// newKeyFileRouter routes key file updates like newRouter does
+func newKeyFileRouter(st *serverState) http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/api/v1/files/{flake}/keyfile",
+		newHandlerCheckScope(true, tokens.ScopeUpload,
+			newHandlerAPIKeyFile(st.backend),
+		),
+	).Methods("PUT")
+	return router
+}
+
+// putKeyFile stores the key file for the flake as the logged in user
+func putKeyFile(t *testing.T, h http.Handler, flake string, kf *keyfile.KeyFile, cookie *http.Cookie) *httptest.ResponseRecorder {
+	dat, err := json.Marshal(kf)
+	if err != nil {
+		t.Fatal("Could not encode key file: ", err)
+	}
+	r := httptest.NewRequest("PUT", "/api/v1/files/"+flake+"/keyfile", bytes.NewReader(dat))
+	r.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	return rw
+}
+
+func TestKeyFileFlake(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	h := newKeyFileRouter(st)
+	cookie := loginCookie(t, st, "alice", config.RoleUploader)
+
+	uploadTestFile(t, st, "first", "alice")
+	uploadTestFile(t, st, "second", "alice")
+
+	primary, err := keyfile.NewSigningKey()
+	assert.NoError(err)
+
+	kf := keyfile.New("first")
+	assert.NoError(kf.Sign(primary, nil))
+	rw := putKeyFile(t, h, "first", kf, cookie)
+	assert.Equal(201, rw.Code, rw.Body.String())
+
+	rw = putKeyFile(t, h, "second", kf, cookie)
+	assert.Equal(400, rw.Code, "A key file must not be stored for another flake")
+
+	moved := keyfile.New("second")
+	moved.Ver = 1
+	assert.NoError(moved.Sign(primary, nil))
+	rw = putKeyFile(t, h, "first", moved, cookie)
+	assert.Equal(400, rw.Code, "A key file of another flake must not replace this one")
+
+	next := keyfile.New("first")
+	next.Ver = 1
+	assert.NoError(next.Sign(primary, nil))
+	rw = putKeyFile(t, h, "first", next, cookie)
+	assert.Equal(200, rw.Code, rw.Body.String())
+}
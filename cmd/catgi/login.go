@@ -10,10 +10,22 @@ import (
 
 type handlerServeLogin struct {
 	rice rice.Config
+	file string
 }
 
 func newHandlerServeLogin() http.Handler {
+	return newHandlerServePage("login.html")
+}
+
+// newHandlerServeTwoFactorPage serves the form asking for the second
+// factor of a login.
+func newHandlerServeTwoFactorPage() http.Handler {
+	return newHandlerServePage("twofactor.html")
+}
+
+func newHandlerServePage(file string) http.Handler {
 	return &handlerServeLogin{
+		file: file,
 		rice: rice.Config{
 			LocateOrder: []rice.LocateMethod{
 				rice.LocateWorkingDirectory,
@@ -26,11 +38,11 @@ func newHandlerServeLogin() http.Handler {
 
 func (h *handlerServeLogin) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	log := logger.LogFromCtx("serveLogin", r.Context())
-	dat, err := h.rice.MustFindBox("./resources").Bytes("login.html")
+	dat, err := h.rice.MustFindBox("./resources").Bytes(h.file)
 	if err != nil {
 		log.Error("Could not load file from disk or embed: ", err)
 		rw.WriteHeader(404)
-		fmt.Fprint(rw, "login.html not found")
+		fmt.Fprint(rw, h.file+" not found")
 		return
 	}
 	rw.WriteHeader(200)
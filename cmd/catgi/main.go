@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
@@ -13,21 +14,32 @@ import (
 	"git.timschuster.info/rls.moe/catgi/backend"
 	_ "git.timschuster.info/rls.moe/catgi/backend/b2"
 	_ "git.timschuster.info/rls.moe/catgi/backend/buntdb"
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	_ "git.timschuster.info/rls.moe/catgi/backend/encrypt"
+	_ "git.timschuster.info/rls.moe/catgi/backend/erasure"
 	_ "git.timschuster.info/rls.moe/catgi/backend/fcache"
+	_ "git.timschuster.info/rls.moe/catgi/backend/hcca"
+	_ "git.timschuster.info/rls.moe/catgi/backend/instrument"
 	_ "git.timschuster.info/rls.moe/catgi/backend/localfs"
 	_ "git.timschuster.info/rls.moe/catgi/backend/s3"
 	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/index"
+	_ "git.timschuster.info/rls.moe/catgi/index/buntdb"
 	"git.timschuster.info/rls.moe/catgi/logger"
-	"git.timschuster.info/rls.moe/catgi/utils"
+	_ "git.timschuster.info/rls.moe/catgi/sessions/buntdb"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+	_ "git.timschuster.info/rls.moe/catgi/tokens/buntdb"
+	_ "git.timschuster.info/rls.moe/catgi/totp/buntdb"
+	_ "git.timschuster.info/rls.moe/catgi/users/buntdb"
 	"github.com/gorilla/mux"
 )
 
-var (
-	curCfg config.Configuration
-)
-
 func main() {
-	var err error
+	var (
+		err        error
+		curCfg     config.Configuration
+		configPath string
+	)
 	if len(os.Args) < 2 {
 		print("Using default config\n")
 		curCfg.Backend = config.DriverConfig{
@@ -46,7 +58,8 @@ func main() {
 
 	} else {
 		fmt.Printf("%s\n", os.Args)
-		curCfg, err = config.LoadConfig(os.Args[1])
+		configPath = os.Args[1]
+		curCfg, err = config.LoadConfig(configPath)
 		if err != nil {
 			fmt.Printf("Config not valid: %s\n", err)
 			return
@@ -57,23 +70,218 @@ func main() {
 	ctx = logger.SetLoggingLevel(curCfg.LogLevel, ctx)
 	log := logger.LogFromCtx("main", ctx)
 
-	log.Info("Starting Backend")
-	be, err := backend.NewBackend(curCfg.Backend.Name, curCfg.Backend.Params, ctx)
+	st, err := newServerState(curCfg, nil, ctx)
 	if err != nil {
 		log.Errorf("Error: %s", err)
 		return
 	}
+	state.Store(st)
+
+	listenOn := curCfg.HTTPConf.ListenOn +
+		fmt.Sprintf(":%d", curCfg.HTTPConf.Port)
+	log.Info("Starting HTTP Service on ", listenOn)
+
+	listener, err := net.Listen("tcp", listenOn)
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
+	srv := &http.Server{Handler: newHandlerReloadable()}
+	servers := []*http.Server{srv}
+
+	tlsConf := curCfg.HTTPConf.TLS
+	if tlsConf.Enabled() {
+		srv.TLSConfig, err = newTLSConfig(tlsConf, ctx)
+		if err != nil {
+			log.Fatal("Could not setup TLS: ", err)
+			return
+		}
+		if tlsConf.RedirectPort != 0 {
+			redirectOn := curCfg.HTTPConf.ListenOn +
+				fmt.Sprintf(":%d", tlsConf.RedirectPort)
+			log.Info("Redirecting HTTP to HTTPS on ", redirectOn)
+			redirectListener, err := net.Listen("tcp", redirectOn)
+			if err != nil {
+				log.Fatal(err)
+				return
+			}
+			redirect := &http.Server{
+				Handler: newHandlerInjectLog(
+					newHandlerRedirectHTTPS(curCfg.HTTPConf.Port),
+				),
+			}
+			servers = append(servers, redirect)
+			go func() {
+				if err := redirect.Serve(redirectListener); err != http.ErrServerClosed {
+					log.Error("Redirect listener failed: ", err)
+				}
+			}()
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+	)
+
+	startGCScheduler(ctx)
+
+	exitCode := make(chan int, 1)
+	go func() {
+		for v := range sigChan {
+			log.Print("Received System Signal ", v)
+			if v == syscall.SIGHUP {
+				// Reload the config, the listener stays open
+				if err := reloadConfig(configPath, ctx); err != nil {
+					log.Error("Config reload failed, keeping old config: ", err)
+				}
+				continue
+			}
+			signal.Stop(sigChan)
+			exitCode <- shutdown(servers, ctx)
+			return
+		}
+	}()
+
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(listener, "", "")
+	} else {
+		err = srv.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	os.Exit(<-exitCode)
+}
+
+// shutdown stops accepting connections and waits for running requests
+// until the configured deadline, then closes the backends. It returns
+// the exit code of the process, which is 1 if anything was cut short.
+func shutdown(servers []*http.Server, ctx context.Context) int {
+	log := logger.LogFromCtx("shutdown", ctx)
+	var code = 0
+
+	deadline := currentConfig().HTTPConf.ShutdownDeadline()
+	log.Infof("Shutting down, waiting up to %s for requests", deadline)
+	sctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(sctx); err != nil {
+			log.Error("Requests did not finish in time: ", err)
+			srv.Close()
+			code = 1
+		}
+	}
+	if code == 0 {
+		log.Info("All requests finished")
+	}
+
+	stopGCScheduler()
+
+	// Old states after a reload only finish once their requests do,
+	// which is guaranteed after the server is closed.
+	draining.Wait()
+
+	// Pending uploads get their own deadline, the one of the requests
+	// may already be used up.
+	cctx, ccancel := context.WithTimeout(ctx, deadline)
+	defer ccancel()
+	be := currentState().backend
+	if err := common.CloseBackend(be, cctx); err != nil {
+		log.Errorf("Could not close '%s' backend: %s", be.Name(), err)
+		code = 1
+	} else {
+		log.Info("Backend closed")
+	}
+	if ts := currentState().tokens; ts != nil {
+		if err := ts.Close(cctx); err != nil {
+			log.Error("Could not close token store: ", err)
+			code = 1
+		}
+	}
+	if us := currentState().users; us != nil {
+		if err := us.Close(cctx); err != nil {
+			log.Error("Could not close user store: ", err)
+			code = 1
+		}
+	}
+	if ss := currentState().sessions; ss != nil {
+		if err := ss.Close(cctx); err != nil {
+			log.Error("Could not close session store: ", err)
+			code = 1
+		}
+	}
+	if ts := currentState().totp; ts != nil {
+		if err := ts.Close(cctx); err != nil {
+			log.Error("Could not close TOTP store: ", err)
+			code = 1
+		}
+	}
+	return code
+}
+
+// setupStorage starts the storage backend of a configuration
+func setupStorage(cfg config.Configuration, ctx context.Context) (common.Backend, error) {
+	log := logger.LogFromCtx("setupStorage", ctx)
+
+	log.Info("Starting Backend")
+	be, err := backend.NewBackend(cfg.Backend.Name, cfg.Backend.Params, ctx)
+	if err != nil {
+		return nil, err
+	}
 	log.Infof("Loaded '%s' Backend Driver", be.Name())
+	return be, nil
+}
+
+// setupIndex starts the index of a configuration, an empty index is
+// rebuilt from the storage backend.
+func setupIndex(cfg config.Configuration, be common.Backend, ctx context.Context) (index.Index, error) {
+	log := logger.LogFromCtx("setupIndex", ctx)
+
+	log.Info("Starting Index")
+	idx, err := index.NewIndex(cfg.Index.Name, cfg.Index.Params, ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Loaded '%s' Index Driver", idx.Name())
+	if entries, err := idx.List(ctx, ""); err == nil && len(entries) == 0 {
+		log.Info("Index is empty, rebuilding from backend")
+		n, err := index.Rebuild(be, idx, ctx)
+		if err != nil {
+			closeIndex(idx, ctx)
+			return nil, err
+		}
+		log.Infof("Indexed %d files", n)
+	}
+	return idx, nil
+}
 
-	piwik := newHandlerPiwik(curCfg.Piwik.Base, curCfg.Piwik.ID,
-		curCfg.Piwik.Enable, curCfg.Piwik.IgnoreErrors)
+// closeIndex closes the index if it holds resources
+func closeIndex(idx index.Index, ctx context.Context) error {
+	if c, ok := idx.(common.BackendWithClose); ok {
+		return c.Close(ctx)
+	}
+	return nil
+}
+
+// newRouter sets up all routes of the server for a configuration
+// and backend.
+func newRouter(cfg config.Configuration, be common.Backend) http.Handler {
+	piwik := newHandlerPiwik(cfg.Piwik.Base, cfg.Piwik.ID,
+		cfg.Piwik.Enable, cfg.Piwik.IgnoreErrors)
 
 	router := mux.NewRouter()
 	{
 		fileGetHandler := newHandlerInjectLog(
 			piwik(
-				newHandlerCheckToken(true,
-					newHandlerServeGet(be),
+				newHandlerCheckScope(true, tokens.ScopeRead,
+					newHandlerRateLimit(rateDownload,
+						newHandlerServeGet(be),
+					),
 				),
 			),
 		)
@@ -93,21 +301,256 @@ func main() {
 		router.Handle("/f/{flake}/{name}.{ext}",
 			fileGetHandler,
 		).Methods("GET")
+
+		// Deleting works with a login or the delete token
+		fileDeleteHandler := newHandlerInjectLog(
+			newHandlerCheckScope(true, tokens.ScopeDelete,
+				newHandlerServeDelete(be),
+			),
+		)
+
+		router.StrictSlash(false).Handle("/file/{flake}",
+			fileDeleteHandler,
+		).Methods("DELETE")
+
+		router.StrictSlash(false).Handle("/f/{flake}",
+			fileDeleteHandler,
+		).Methods("DELETE")
 	}
 
 	router.Handle("/file",
 		newHandlerInjectLog(
 			piwik(
-				newHandlerCheckToken(false,
-					newHandlerServePost(be),
+				newHandlerCheckRole(config.RoleUploader,
+					newHandlerRateLimit(rateUpload,
+						newHandlerServePost(be),
+					),
+				),
+			),
+		),
+	).Methods("POST")
+
+	router.Handle("/gallery",
+		newHandlerInjectLog(
+			piwik(
+				newHandlerCheckScope(true, tokens.ScopeRead,
+					newHandlerServeGallery(be),
+				),
+			),
+		),
+	).Methods("GET")
+
+	router.Handle("/n",
+		newHandlerInjectLog(
+			newHandlerCheckRole(config.RoleUploader,
+				newHandlerRateLimit(rateUpload,
+					newHandlerPublishCollection(be),
 				),
 			),
 		),
 	).Methods("POST")
 
+	router.Handle("/n/{name}",
+		newHandlerInjectLog(
+			piwik(
+				newHandlerCheckScope(true, tokens.ScopeRead,
+					newHandlerRateLimit(rateDownload,
+						newHandlerServeCollection(be),
+					),
+				),
+			),
+		),
+	).Methods("GET")
+
+	{
+		api := router.PathPrefix("/api/v1").Subrouter()
+
+		api.Handle("/files",
+			newHandlerInjectLog(
+				newHandlerCheckRole(config.RoleUploader,
+					newHandlerRateLimit(rateUpload,
+						newHandlerAPIUpload(be),
+					),
+				),
+			),
+		).Methods("POST")
+
+		api.Handle("/files",
+			newHandlerInjectLog(
+				newHandlerCheckScope(false, tokens.ScopeRead,
+					newHandlerAPIList(be),
+				),
+			),
+		).Methods("GET")
+
+		api.Handle("/files/{flake}",
+			newHandlerInjectLog(
+				newHandlerCheckScope(true, tokens.ScopeRead,
+					newHandlerRateLimit(rateDownload,
+						newHandlerAPIFile(be),
+					),
+				),
+			),
+		).Methods("GET")
+
+		api.Handle("/files/{flake}",
+			newHandlerInjectLog(
+				newHandlerCheckScope(true, tokens.ScopeDelete,
+					newHandlerAPIFile(be),
+				),
+			),
+		).Methods("DELETE")
+
+		api.Handle("/quota",
+			newHandlerInjectLog(
+				newHandlerCheckScope(false, tokens.ScopeRead,
+					newHandlerAPIQuota(be),
+				),
+			),
+		).Methods("GET")
+
+		// Updates are authorised by the key file signature, the first
+		// key file needs the owner or the delete token
+		api.Handle("/files/{flake}/keyfile",
+			newHandlerInjectLog(
+				newHandlerCheckScope(true, tokens.ScopeRead,
+					newHandlerRateLimit(rateDownload,
+						newHandlerAPIKeyFile(be),
+					),
+				),
+			),
+		).Methods("GET")
+
+		api.Handle("/files/{flake}/keyfile",
+			newHandlerInjectLog(
+				newHandlerCheckScope(true, tokens.ScopeUpload,
+					newHandlerRateLimit(rateDownload,
+						newHandlerAPIKeyFile(be),
+					),
+				),
+			),
+		).Methods("PUT")
+
+		api.Handle("/tokens",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerAPITokens(),
+				),
+			),
+		).Methods("GET", "POST")
+
+		api.Handle("/tokens/{id}",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerAPIRevokeToken(),
+				),
+			),
+		).Methods("DELETE")
+
+		api.Handle("/sessions",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerAPISessions(),
+				),
+			),
+		).Methods("GET", "DELETE")
+
+		api.Handle("/sessions/{id}",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerAPIRevokeSession(),
+				),
+			),
+		).Methods("DELETE")
+
+		api.Handle("/account/password",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerRateLimit(rateAuth,
+						newHandlerAPIChangePassword(),
+					),
+				),
+			),
+		).Methods("POST")
+
+		api.Handle("/account/2fa",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerAPITwoFactor(),
+				),
+			),
+		).Methods("GET", "POST", "DELETE")
+
+		api.Handle("/account/2fa/confirm",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerRateLimit(rateAuth,
+						newHandlerAPITwoFactorConfirm(),
+					),
+				),
+			),
+		).Methods("POST")
+
+		api.Handle("/account/2fa/recovery",
+			newHandlerInjectLog(
+				newHandlerCheckToken(false,
+					newHandlerRateLimit(rateAuth,
+						newHandlerAPIRecoveryCodes(),
+					),
+				),
+			),
+		).Methods("POST")
+
+		api.Handle("/admin/users",
+			newHandlerInjectLog(
+				newHandlerCheckRole(config.RoleAdmin,
+					newHandlerAPIUsers(),
+				),
+			),
+		).Methods("GET", "POST")
+
+		api.Handle("/admin/users/{name}",
+			newHandlerInjectLog(
+				newHandlerCheckRole(config.RoleAdmin,
+					newHandlerAPIUser(),
+				),
+			),
+		).Methods("PATCH", "DELETE")
+
+		api.Handle("/admin/users/{name}/2fa",
+			newHandlerInjectLog(
+				newHandlerCheckRole(config.RoleAdmin,
+					newHandlerAPIResetTwoFactor(),
+				),
+			),
+		).Methods("DELETE")
+
+		api.Handle("/admin/files",
+			newHandlerInjectLog(
+				newHandlerCheckRole(config.RoleAdmin,
+					newHandlerAPIListAll(be),
+				),
+			),
+		).Methods("GET")
+
+		api.Handle("/admin/usage",
+			newHandlerInjectLog(
+				newHandlerCheckRole(config.RoleAdmin,
+					newHandlerAPIUsage(be),
+				),
+			),
+		).Methods("GET")
+	}
+
+	router.Handle("/metrics",
+		newHandlerInjectLog(
+			newHandlerServeMetrics(),
+		),
+	).Methods("GET")
+
 	router.Handle("/gc",
 		newHandlerInjectLog(
-			newHandlerCheckToken(false,
+			newHandlerCheckRole(config.RoleAdmin,
 				newHandlerRunGC(be),
 			),
 		),
@@ -139,72 +582,61 @@ func main() {
 		),
 	).Methods("GET")
 
-	router.Handle("/auth",
+	router.Handle("/login/oidc",
 		newHandlerInjectLog(
-			newHandlerServeAuth(),
+			newHandlerRateLimit(rateAuth,
+				newHandlerOIDCLogin(),
+			),
 		),
-	).Methods("POST")
+	).Methods("GET")
 
-	listenOn := curCfg.HTTPConf.ListenOn +
-		fmt.Sprintf(":%d", curCfg.HTTPConf.Port)
-	log.Info("Starting HTTP Service on ", listenOn)
+	router.Handle("/login/oidc/callback",
+		newHandlerInjectLog(
+			newHandlerRateLimit(rateAuth,
+				newHandlerOIDCCallback(),
+			),
+		),
+	).Methods("GET")
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan,
-		os.Interrupt,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGKILL,
-	)
+	router.Handle("/login/2fa",
+		newHandlerInjectLog(
+			piwik(
+				newHandlerServeTwoFactorPage(),
+			),
+		),
+	).Methods("GET")
 
-	listener, err := net.Listen("tcp", listenOn)
-	if err != nil {
-		log.Fatal(err)
-		return
-	}
+	router.Handle("/auth/2fa",
+		newHandlerInjectLog(
+			newHandlerRateLimit(rateAuth,
+				newHandlerServeAuthTwoFactor(),
+			),
+		),
+	).Methods("POST")
 
-	stpLst := utils.Handle(listener)
-
-	closeServ := func(stpLst *utils.StoppableListener) {
-		log.Print("Terminating Webserver")
-		stpLst.Stop <- true
-		log.Print("Waiting for connections to finish")
-		utils.WaitFor(func() bool { return stpLst.ConnCount.Get() == 0 })
-		log.Print("Server Stopped and All Connection Closed")
-	}
-
-	go func(sig chan os.Signal, stpLst *utils.StoppableListener) {
-		for {
-			v := <-sig
-			log.Print("Received System Signal")
-			switch v {
-			case os.Interrupt:
-				closeServ(stpLst)
-				os.Exit(1)
-			case syscall.SIGHUP:
-				closeServ(stpLst)
-				// 0-Code Exit on HUP
-				os.Exit(0)
-			case syscall.SIGINT:
-				closeServ(stpLst)
-				os.Exit(1)
-			case syscall.SIGTERM:
-				closeServ(stpLst)
-				os.Exit(1)
-			case syscall.SIGKILL:
-				closeServ(stpLst)
-				os.Exit(1)
-			default:
-			}
-		}
-	}(sigChan, stpLst)
+	router.Handle("/auth/2fa/enroll",
+		newHandlerInjectLog(
+			newHandlerRateLimit(rateAuth,
+				newHandlerServeAuthEnroll(),
+			),
+		),
+	).Methods("POST")
 
-	err = http.Serve(
-		stpLst,
-		router,
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
+	router.Handle("/logout",
+		newHandlerInjectLog(
+			newHandlerCheckToken(true,
+				newHandlerServeLogout(),
+			),
+		),
+	).Methods("POST")
+
+	router.Handle("/auth",
+		newHandlerInjectLog(
+			newHandlerRateLimit(rateAuth,
+				newHandlerServeAuth(),
+			),
+		),
+	).Methods("POST")
+
+	return router
 }
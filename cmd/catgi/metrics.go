@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/metrics"
+)
+
+var (
+	httpRequests = metrics.Default.NewCounter("catgi_http_requests_total",
+		"HTTP requests by route, method and status", "route", "method", "code")
+	httpDuration = metrics.Default.NewHistogram("catgi_http_request_duration_seconds",
+		"Time until the response is sent", metrics.DefBuckets, "route", "method")
+	httpReceived = metrics.Default.NewCounter("catgi_http_request_bytes_total",
+		"Bytes read from request bodies, ie uploads", "route")
+	httpSent = metrics.Default.NewCounter("catgi_http_response_bytes_total",
+		"Bytes written in responses, ie downloads", "route")
+
+	gcRuns = metrics.Default.NewCounter("catgi_gc_runs_total",
+		"GC runs by result, ok or error", "result")
+	gcDeleted = metrics.Default.NewCounter("catgi_gc_deleted_files_total",
+		"Files deleted by the GC")
+	gcDuration = metrics.Default.NewHistogram("catgi_gc_duration_seconds",
+		"Duration of GC runs", []float64{.1, .5, 1, 5, 10, 30, 60, 300, 600})
+)
+
+// observeGC records a GC run that started at start
+func observeGC(start time.Time, deleted int, err error) {
+	gcDuration.ObserveSince(start)
+	gcDeleted.Add(float64(deleted))
+	if err != nil && !common.IsHTTPOption(err) {
+		gcRuns.Inc("error")
+	} else {
+		gcRuns.Inc("ok")
+	}
+}
+
+// metricsWriter records status and size of a response
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	sent   int64
+}
+
+func (m *metricsWriter) WriteHeader(status int) {
+	if m.status == 0 {
+		m.status = status
+	}
+	m.ResponseWriter.WriteHeader(status)
+}
+
+func (m *metricsWriter) Write(b []byte) (int, error) {
+	if m.status == 0 {
+		m.status = 200
+	}
+	n, err := m.ResponseWriter.Write(b)
+	m.sent += int64(n)
+	return n, err
+}
+
+// Flush passes flushes to the underlying writer if it supports them
+func (m *metricsWriter) Flush() {
+	if f, ok := m.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying writer for http.ResponseController
+func (m *metricsWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
+
+// metricsReader counts the bytes read from a request body
+type metricsReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (m *metricsReader) Read(b []byte) (int, error) {
+	n, err := m.ReadCloser.Read(b)
+	m.read += int64(n)
+	return n, err
+}
+
+type handlerMetrics struct {
+	next http.Handler
+}
+
+// newHandlerMetrics records requests to the route it wraps, the route
+// is labeled with it's path template.
+func newHandlerMetrics(nextHandler http.Handler) http.Handler {
+	return &handlerMetrics{
+		next: nextHandler,
+	}
+}
+
+func (h *handlerMetrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	route := "unmatched"
+	if cur := mux.CurrentRoute(r); cur != nil {
+		if tpl, err := cur.GetPathTemplate(); err == nil {
+			route = tpl
+		}
+	}
+
+	mw := &metricsWriter{ResponseWriter: rw}
+	var mr *metricsReader
+	if r.Body != nil {
+		mr = &metricsReader{ReadCloser: r.Body}
+		r.Body = mr
+	}
+
+	h.next.ServeHTTP(mw, r)
+
+	if mw.status == 0 {
+		mw.status = 200
+	}
+	httpRequests.Inc(route, r.Method, fmt.Sprint(mw.status))
+	httpDuration.ObserveSince(start, route, r.Method)
+	httpSent.Add(float64(mw.sent), route)
+	if mr != nil {
+		httpReceived.Add(float64(mr.read), route)
+	}
+}
+
+type handlerServeMetrics struct{}
+
+// newHandlerServeMetrics exposes the metrics to Prometheus. If a
+// metrics token is configured it must be sent as bearer token.
+func newHandlerServeMetrics() http.Handler {
+	return &handlerServeMetrics{}
+}
+
+func (h *handlerServeMetrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if token := configFromContext(r.Context()).MetricsToken; len(token) > 0 {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			rw.WriteHeader(401)
+			fmt.Fprint(rw, "401 - Not Authorized")
+			return
+		}
+	}
+	metrics.Default.ServeHTTP(rw, r)
+}
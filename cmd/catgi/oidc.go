@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/oidc"
+)
+
+// oidcStateCookie carries state and nonce of a login from the redirect
+// to the callback.
+const oidcStateCookie = "oidc_state"
+
+// oidcStateTTL is how long a user may take at the provider in seconds
+const oidcStateTTL = 600
+
+// randomState returns a random URL safe string for state and nonce
+func randomState() (string, error) {
+	var dat = make([]byte, 24)
+	if _, err := rand.Read(dat); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(dat), nil
+}
+
+// oidcUser returns the catgi user and role of an identity. Known users
+// must have the oidc auth type and keep their role, others need a role
+// from their groups or the default role.
+func oidcUser(st *serverState, id oidc.Identity, ctx context.Context) (string, config.Role, error) {
+	ucfg, ok, err := lookupUser(st, id.Username, ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if ok {
+		if ucfg.Disabled {
+			return "", "", fmt.Errorf("User %s is disabled", id.Username)
+		}
+		if ucfg.AuthType != config.ATOIDC {
+			return "", "", fmt.Errorf("User %s is not an OIDC user", id.Username)
+		}
+		return id.Username, ucfg.GetRole(), nil
+	}
+	if !id.Role.Valid() {
+		return "", "", fmt.Errorf("User %s has no role", id.Username)
+	}
+	return id.Username, id.Role, nil
+}
+
+type handlerOIDCLogin struct{}
+
+// newHandlerOIDCLogin sends the user to the login of the provider
+func newHandlerOIDCLogin() http.Handler {
+	return &handlerOIDCLogin{}
+}
+
+func (h *handlerOIDCLogin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("oidcLogin", r.Context())
+	provider := stateFromContext(r.Context()).oidc
+	if provider == nil {
+		w.WriteHeader(404)
+		fmt.Fprint(w, "404 - OIDC login is not configured")
+		return
+	}
+
+	state, err := randomState()
+	if err != nil {
+		log.Error("Could not generate state: ", err)
+		w.WriteHeader(500)
+		fmt.Fprint(w, "500 - Internal Server Error")
+		return
+	}
+	nonce, err := randomState()
+	if err != nil {
+		log.Error("Could not generate nonce: ", err)
+		w.WriteHeader(500)
+		fmt.Fprint(w, "500 - Internal Server Error")
+		return
+	}
+	target, err := provider.AuthURL(state, nonce, r.Context())
+	if err != nil {
+		log.Error("Login provider unavailable: ", err)
+		w.WriteHeader(502)
+		fmt.Fprint(w, "502 - Login provider unavailable")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state + "." + nonce,
+		Path:     "/login/oidc",
+		MaxAge:   oidcStateTTL,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+type handlerOIDCCallback struct{}
+
+// newHandlerOIDCCallback verifies the login at the provider and sets
+// the usual auth cookie.
+func newHandlerOIDCCallback() http.Handler {
+	return &handlerOIDCCallback{}
+}
+
+func (h *handlerOIDCCallback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("oidcCallback", r.Context())
+	st := stateFromContext(r.Context())
+	if st.oidc == nil {
+		w.WriteHeader(404)
+		fmt.Fprint(w, "404 - OIDC login is not configured")
+		return
+	}
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%d - %s", status, msg)
+	}
+
+	if e := r.FormValue("error"); len(e) > 0 {
+		log.Warn("Provider returned error: ", e, " ", r.FormValue("error_description"))
+		fail(401, "Login failed at the provider")
+		return
+	}
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		fail(400, "Login expired, please try again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/login/oidc",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 ||
+		subtle.ConstantTimeCompare([]byte(parts[0]), []byte(r.FormValue("state"))) != 1 {
+		log.Warn("OIDC state mismatch")
+		fail(400, "Login expired, please try again")
+		return
+	}
+
+	raw, err := st.oidc.Exchange(r.FormValue("code"), r.Context())
+	if err != nil {
+		log.Error("Could not redeem code: ", err)
+		fail(502, "Login provider unavailable")
+		return
+	}
+	claims, err := st.oidc.Verify(raw, parts[1], r.Context())
+	if err != nil {
+		log.Warn("Rejected ID token: ", err)
+		fail(401, "Not Authorized")
+		return
+	}
+	id, err := st.oidc.Identity(claims)
+	if err != nil {
+		log.Warn("Rejected identity: ", err)
+		fail(401, "Not Authorized")
+		return
+	}
+	user, role, err := oidcUser(st, id, r.Context())
+	if err != nil {
+		log.Warn("Rejected OIDC login: ", err)
+		fail(403, "Forbidden")
+		return
+	}
+
+	done, err := finishLogin(w, r, user, role, amrOIDC, st)
+	if err != nil {
+		log.Error("Error on auth: ", err)
+		fail(500, "Internal Server Error")
+		return
+	}
+	if !done {
+		log.Infof("OIDC login of %s waits for second factor", user)
+		return
+	}
+	log.Infof("OIDC login of %s as %s", user, role)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
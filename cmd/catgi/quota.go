@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/utils"
+)
+
+// quotaUsage is what a user currently stores
+type quotaUsage struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// pendingUploads holds the usage of uploads that are still running so
+// parallel uploads cannot exceed a quota together. The mutex only
+// protects the map and the counters, the usage scan of a user runs
+// under the lock of that user.
+var pendingUploads = struct {
+	sync.Mutex
+	users map[string]*pendingUser
+}{users: map[string]*pendingUser{}}
+
+// pendingUser is locked while the quota of the user is checked so
+// uploads of one user are reserved one after another.
+type pendingUser struct {
+	sync.Mutex
+	// refs counts reservations and waiting checks, usage is the size
+	// of the reservations. Both are protected by pendingUploads.
+	refs  int
+	usage quotaUsage
+}
+
+// lockPendingUser returns the locked pending uploads of a user, it
+// must be released with releasePendingUser.
+func lockPendingUser(user string) *pendingUser {
+	pendingUploads.Lock()
+	p, ok := pendingUploads.users[user]
+	if !ok {
+		p = &pendingUser{}
+		pendingUploads.users[user] = p
+	}
+	p.refs++
+	pendingUploads.Unlock()
+
+	p.Lock()
+	return p
+}
+
+// releasePendingUser drops a reference and the usage of a reservation.
+// pendingUploads must be locked.
+func releasePendingUser(user string, p *pendingUser, usage quotaUsage) {
+	p.usage.Files -= usage.Files
+	p.usage.Bytes -= usage.Bytes
+	p.refs--
+	if p.refs == 0 {
+		delete(pendingUploads.users, user)
+	}
+}
+
+// userUsage returns the live files of a user. Sizes are only known
+// with an index, without one only files are counted.
+func userUsage(b common.Backend, user string, ctx context.Context) (quotaUsage, error) {
+	var used quotaUsage
+	if idx := index.FromBackend(b); idx != nil {
+		entries, err := idx.ListUser(ctx, user)
+		if err != nil {
+			return used, err
+		}
+		for _, v := range entries {
+			if v.Expired() {
+				continue
+			}
+			used.Files++
+			if v.Size > 0 {
+				used.Bytes += v.Size
+			}
+		}
+		return used, nil
+	}
+	list, err := b.ListGlob(ctx, "")
+	if err != nil {
+		return used, err
+	}
+	for _, v := range list {
+		if v == nil || v.User != user {
+			continue
+		}
+		if v.DeleteAt != nil && v.DeleteAt.TTL() == 0 {
+			continue
+		}
+		used.Files++
+	}
+	return used, nil
+}
+
+// allUsage returns the live files of every user that owns files,
+// like userUsage sizes are only known with an index.
+func allUsage(b common.Backend, ctx context.Context) (map[string]quotaUsage, error) {
+	var usage = map[string]quotaUsage{}
+	if idx := index.FromBackend(b); idx != nil {
+		entries, err := idx.List(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range entries {
+			if v.Expired() {
+				continue
+			}
+			used := usage[v.User]
+			used.Files++
+			if v.Size > 0 {
+				used.Bytes += v.Size
+			}
+			usage[v.User] = used
+		}
+		return usage, nil
+	}
+	list, err := b.ListGlob(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range list {
+		if v == nil {
+			continue
+		}
+		if v.DeleteAt != nil && v.DeleteAt.TTL() == 0 {
+			continue
+		}
+		used := usage[v.User]
+		used.Files++
+		usage[v.User] = used
+	}
+	return usage, nil
+}
+
+// userQuota returns the quota of a user, unknown users have no quota.
+func userQuota(user string, ctx context.Context) config.QuotaConfig {
+	ucfg, ok, err := lookupUser(stateFromContext(ctx), user, ctx)
+	if err != nil {
+		logger.LogFromCtx("userQuota", ctx).Error("Could not lookup user: ", err)
+	}
+	if ok {
+		return ucfg.Quota
+	}
+	return config.QuotaConfig{}
+}
+
+// reserveQuota checks an upload against the quota of it's owner and
+// counts it as used until release is called, the upload must be
+// stored or failed by then. The returned error wraps
+// common.ErrorQuotaExceeded if a limit is hit.
+func reserveQuota(b common.Backend, upload *uploadForm, ctx context.Context) (release func(), err error) {
+	log := logger.LogFromCtx("reserveQuota", ctx)
+	release = func() {}
+	user := upload.file.User
+	quota := userQuota(user, ctx)
+	if len(user) == 0 || quota == (config.QuotaConfig{}) {
+		return release, nil
+	}
+
+	if quota.MaxFileSize > 0 && upload.size > quota.MaxFileSize {
+		return release, fmt.Errorf("%w: files may not be larger than %d bytes",
+			common.ErrorQuotaExceeded, quota.MaxFileSize)
+	}
+	if ttl := quota.TTL(); ttl > 0 {
+		if upload.file.DeleteAt == nil || upload.file.DeleteAt.TTL() > ttl {
+			return release, fmt.Errorf("%w: files may not live longer than %s",
+				common.ErrorQuotaExceeded, ttl)
+		}
+	}
+	if quota.MaxFiles == 0 && quota.MaxStorage == 0 {
+		return release, nil
+	}
+
+	p := lockPendingUser(user)
+	defer p.Unlock()
+	var reserved = false
+	defer func() {
+		if !reserved {
+			pendingUploads.Lock()
+			releasePendingUser(user, p, quotaUsage{})
+			pendingUploads.Unlock()
+		}
+	}()
+
+	// <- BEGIN BACKEND INTERACTION ->
+	used, err := userUsage(b, user, ctx)
+	// -> END BACKEND INTERACTION <-
+	if err != nil {
+		return release, err
+	}
+
+	pendingUploads.Lock()
+	defer pendingUploads.Unlock()
+	used.Files += p.usage.Files
+	used.Bytes += p.usage.Bytes
+
+	if quota.MaxFiles > 0 && used.Files+1 > quota.MaxFiles {
+		return release, fmt.Errorf("%w: at most %d files may be stored",
+			common.ErrorQuotaExceeded, quota.MaxFiles)
+	}
+	if quota.MaxStorage > 0 && used.Bytes+upload.size > quota.MaxStorage {
+		return release, fmt.Errorf("%w: %d of %d bytes are used",
+			common.ErrorQuotaExceeded, used.Bytes, quota.MaxStorage)
+	}
+
+	log.Debugf("Reserving %d bytes for %s", upload.size, user)
+	var reservation = quotaUsage{Files: 1, Bytes: upload.size}
+	p.usage.Files += reservation.Files
+	p.usage.Bytes += reservation.Bytes
+	reserved = true
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pendingUploads.Lock()
+			defer pendingUploads.Unlock()
+			releasePendingUser(user, p, reservation)
+		})
+	}, nil
+}
+
+type handlerAPIQuota struct {
+	backend common.Backend
+}
+
+func newHandlerAPIQuota(b common.Backend) http.Handler {
+	return &handlerAPIQuota{backend: b}
+}
+
+// ServeHTTP reports the quota and usage of the caller
+func (h *handlerAPIQuota) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	user := userFromContext(r.Context())
+	if len(user) == 0 {
+		writeAPIError(rw, r, 401, apiCodeUnauthorized, "Login required")
+		return
+	}
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	// <- BEGIN BACKEND INTERACTION ->
+	used, err := userUsage(h.backend, user, r.Context())
+	// -> END BACKEND INTERACTION <-
+	if err != nil {
+		writeBackendError(rw, r, err)
+		return
+	}
+
+	writeAPIJSON(rw, r, 200, struct {
+		User  string             `json:"user"`
+		Usage quotaUsage         `json:"usage"`
+		Quota config.QuotaConfig `json:"quota"`
+	}{user, used, userQuota(user, r.Context())})
+}
+
+// apiUserUsage is the usage of one user as reported to admins
+type apiUserUsage struct {
+	User  string             `json:"user"`
+	Role  config.Role        `json:"role,omitempty"`
+	Usage quotaUsage         `json:"usage"`
+	Quota config.QuotaConfig `json:"quota"`
+}
+
+type handlerAPIUsage struct {
+	backend common.Backend
+}
+
+// newHandlerAPIUsage reports the usage of all users, the route must be
+// restricted to admins.
+func newHandlerAPIUsage(b common.Backend) http.Handler {
+	return &handlerAPIUsage{backend: b}
+}
+
+// ServeHTTP reports every configured or stored user and every other
+// owner of files, sorted by name.
+func (h *handlerAPIUsage) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	// <- BEGIN BACKEND INTERACTION ->
+	usage, err := allUsage(h.backend, r.Context())
+	// -> END BACKEND INTERACTION <-
+	if err != nil {
+		writeBackendError(rw, r, err)
+		return
+	}
+
+	st := stateFromContext(r.Context())
+	var known = map[string]config.UserConfig{}
+	if st.users != nil {
+		stored, err := st.users.List(r.Context())
+		if err != nil {
+			writeBackendError(rw, r, err)
+			return
+		}
+		for _, v := range stored {
+			known[v.Username] = v
+		}
+	}
+	// Users of the config take precedence over the store
+	for _, v := range st.cfg.Users {
+		known[v.Username] = v
+	}
+	for name := range known {
+		if _, ok := usage[name]; !ok {
+			usage[name] = quotaUsage{}
+		}
+	}
+
+	var users = []apiUserUsage{}
+	for user, used := range usage {
+		entry := apiUserUsage{User: user, Usage: used}
+		if ucfg, ok := known[user]; ok {
+			entry.Role = ucfg.GetRole()
+			entry.Quota = ucfg.Quota
+		}
+		users = append(users, entry)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+
+	writeAPIJSON(rw, r, 200, struct {
+		Users []apiUserUsage `json:"users"`
+	}{users})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReserveQuotaParallel(t *testing.T) {
+	assert := assert.New(t)
+	ctx := logger.NewLoggingContext()
+
+	st, err := newServerState(config.Configuration{
+		Backend: config.DriverConfig{Name: "buntdb", Params: map[string]interface{}{}},
+		Users: []config.UserConfig{{
+			Username: "alice",
+			Quota:    config.QuotaConfig{MaxFiles: 3},
+		}},
+	}, nil, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	defer st.closeUnshared(nil, ctx)
+	state.Store(st)
+
+	assert.NoError(st.backend.Upload("stored", &common.File{
+		User:     "alice",
+		Data:     []byte("counts against the quota"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 1)),
+	}, ctx))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		releases []func()
+		denied   int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := reserveQuota(st.backend, &uploadForm{
+				file: common.File{User: "alice"},
+				size: 1,
+			}, ctx)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				assert.ErrorIs(err, common.ErrorQuotaExceeded)
+				denied++
+				return
+			}
+			releases = append(releases, release)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(releases, 2, "Parallel uploads must not exceed the quota together")
+	assert.Equal(6, denied)
+
+	for _, release := range releases {
+		release()
+		release()
+	}
+	pendingUploads.Lock()
+	assert.Empty(pendingUploads.users, "Released users must be removed")
+	pendingUploads.Unlock()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/ratelimit"
+)
+
+// rateClass selects the budget a route is counted against
+type rateClass int
+
+const (
+	rateAuth rateClass = iota
+	rateUpload
+	rateDownload
+)
+
+// rateLimits are the limiters of a server state, they are kept over
+// reloads unless their config changes.
+type rateLimits struct {
+	limiters map[rateClass]*ratelimit.Limiter
+	lockout  *ratelimit.Lockout
+}
+
+func newRateLimits(cfg config.RateLimitConfig) *rateLimits {
+	return &rateLimits{
+		limiters: map[rateClass]*ratelimit.Limiter{
+			rateAuth:     ratelimit.NewLimiter(cfg.Auth.PerMinute, cfg.Auth.Burst),
+			rateUpload:   ratelimit.NewLimiter(cfg.Upload.PerMinute, cfg.Upload.Burst),
+			rateDownload: ratelimit.NewLimiter(cfg.Download.PerMinute, cfg.Download.Burst),
+		},
+		lockout: ratelimit.NewLockout(cfg.LockoutAttempts, cfg.LockoutDuration()),
+	}
+}
+
+// clientIP returns the IP of the client, X-Forwarded-For is only used
+// if the proxy is trusted. The rightmost entry is the one added by the
+// proxy, entries left of it come from the client and can be forged.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			hops := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); len(ip) > 0 {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestScheme returns the scheme the client used. Like clientIP the
+// X-Forwarded-Proto header is only used behind a trusted proxy, the
+// last entry is the one the proxy set.
+func requestScheme(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Values("X-Forwarded-Proto"); len(fwd) > 0 {
+			protos := strings.Split(fwd[len(fwd)-1], ",")
+			proto := strings.ToLower(strings.TrimSpace(protos[len(protos)-1]))
+			if proto == "http" || proto == "https" {
+				return proto
+			}
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// rateKey returns the key a request is limited by, logged in users
+// share their budget over all IPs.
+func rateKey(r *http.Request, trustProxy bool) string {
+	if user := userFromContext(r.Context()); len(user) > 0 && user != "anonymous" {
+		return "user:" + user
+	}
+	return "ip:" + clientIP(r, trustProxy)
+}
+
+// writeTooManyRequests replies with 429 and the time the client
+// should wait.
+func writeTooManyRequests(rw http.ResponseWriter, r *http.Request, wait time.Duration) {
+	rw.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(rw, r, 429, apiCodeRateLimited, "Too many requests")
+		return
+	}
+	rw.WriteHeader(429)
+	fmt.Fprint(rw, "429 - Too Many Requests")
+}
+
+type handlerRateLimit struct {
+	class rateClass
+	next  http.Handler
+}
+
+// newHandlerRateLimit counts requests against the budget of the class.
+// It must run after the token check so logged in users are known.
+func newHandlerRateLimit(class rateClass, nextHandler http.Handler) http.Handler {
+	return &handlerRateLimit{
+		class: class,
+		next:  nextHandler,
+	}
+}
+
+func (h *handlerRateLimit) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	st := stateFromContext(r.Context())
+	key := rateKey(r, st.cfg.RateLimit.TrustProxy)
+	if ok, wait := st.limits.limiters[h.class].Allow(key); !ok {
+		log := logger.LogFromCtx("rateLimit", r.Context())
+		log.Warn("Rate limit hit by ", key)
+		writeTooManyRequests(rw, r, wait)
+		return
+	}
+	h.next.ServeHTTP(rw, r)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	assert.Equal("10.0.0.1", clientIP(r, false), "Header must be ignored without trusted proxy")
+	assert.Equal("2.2.2.2", clientIP(r, true), "The entry of the proxy must be used")
+
+	r.Header.Add("X-Forwarded-For", "3.3.3.3")
+	assert.Equal("3.3.3.3", clientIP(r, true))
+
+	r.Header.Set("X-Forwarded-For", "")
+	assert.Equal("10.0.0.1", clientIP(r, true))
+}
+
+func TestRequestScheme(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Add("X-Forwarded-Proto", "https")
+	assert.Equal("http", requestScheme(r, false), "Header must be ignored without trusted proxy")
+	assert.Equal("https", requestScheme(r, true))
+
+	r.Header.Set("X-Forwarded-Proto", "https, javascript")
+	assert.Equal("http", requestScheme(r, true), "Unknown schemes must be ignored")
+}
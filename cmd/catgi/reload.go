@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/crypto"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"git.timschuster.info/rls.moe/catgi/ldapauth"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/oidc"
+	"git.timschuster.info/rls.moe/catgi/sessions"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+	"git.timschuster.info/rls.moe/catgi/totp"
+	"git.timschuster.info/rls.moe/catgi/users"
+)
+
+// serverState is everything that is replaced when the config is
+// reloaded. Requests use the state that was current when they started.
+type serverState struct {
+	cfg config.Configuration
+	// backend is the storage wrapped with the index, if any
+	backend common.Backend
+	storage common.Backend
+	// idx is nil if no index is configured
+	idx       index.Index
+	router    http.Handler
+	deleteKey crypto.SecretKey
+	limits    *rateLimits
+	// tokens is nil if no token store is configured
+	tokens tokens.Store
+	// users is nil if no user store is configured
+	users users.Store
+	// sessions is nil if no session store is configured
+	sessions sessions.Store
+	// totp is nil if 2FA is not configured
+	totp totp.Store
+	// oidc is nil if no OIDC provider is configured
+	oidc *oidc.Provider
+	// ldap is nil if no LDAP server is configured
+	ldap *ldapauth.Authenticator
+
+	// inflight is read locked by every request on this state, a reload
+	// write locks it to wait until the old state is no longer used.
+	inflight sync.RWMutex
+	retired  bool
+}
+
+// state holds the current *serverState
+var state atomic.Value
+
+// draining tracks old states that are still serving requests after a
+// reload, shutdown waits for them before closing backends.
+var draining sync.WaitGroup
+
+// currentState returns the state new requests are served with
+func currentState() *serverState {
+	return state.Load().(*serverState)
+}
+
+// currentConfig returns the current configuration
+func currentConfig() config.Configuration {
+	return currentState().cfg
+}
+
+// stateFromContext returns the state the request was started with, so
+// all handlers of a request see the same config and stores even if a
+// reload happens meanwhile. Outside of requests it is the current state.
+func stateFromContext(ctx context.Context) *serverState {
+	if st, ok := ctx.Value("state").(*serverState); ok {
+		return st
+	}
+	return currentState()
+}
+
+// configFromContext returns the configuration of the request state
+func configFromContext(ctx context.Context) config.Configuration {
+	return stateFromContext(ctx).cfg
+}
+
+// newServerState sets up the backend and routes for a config. If prev
+// is not nil, the backend, index and stores whose config did not change
+// are reused so in-memory backends keep their data and files are not
+// opened twice. On error everything that was newly opened is closed.
+func newServerState(cfg config.Configuration, prev *serverState, ctx context.Context) (_ *serverState, err error) {
+	log := logger.LogFromCtx("newServerState", ctx)
+	var st = &serverState{cfg: cfg}
+	defer func() {
+		if err != nil {
+			st.closeUnshared(prev, ctx)
+		}
+	}()
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.Backend, cfg.Backend) {
+		log.Info("Backend config unchanged, keeping backend")
+		st.storage = prev.storage
+	} else {
+		st.storage, err = setupStorage(cfg, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.Index, cfg.Index) {
+		st.idx = prev.idx
+	} else if len(cfg.Index.Name) > 0 {
+		st.idx, err = setupIndex(cfg, st.storage, ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case st.idx == nil:
+		st.backend = st.storage
+	case prev != nil && prev.storage == st.storage && prev.idx == st.idx:
+		st.backend = prev.backend
+	default:
+		st.backend = index.NewIndexedBackend(st.storage, st.idx)
+	}
+
+	if prev != nil && prev.cfg.DeleteTokenSecret() == cfg.DeleteTokenSecret() {
+		st.deleteKey = prev.deleteKey
+	} else {
+		switch {
+		case len(cfg.DeleteTokenSecret()) == 0:
+			log.Warn("No jwtkey configured, delete tokens are lost on restart")
+		case len(cfg.DeleteTokenKey) == 0:
+			log.Warn("No delete_token_key configured, delete tokens are lost when the jwtkey is rotated")
+		}
+		st.deleteKey, err = newDeleteTokenKey(cfg.DeleteTokenSecret())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.Tokens, cfg.Tokens) {
+		st.tokens = prev.tokens
+	} else if len(cfg.Tokens.Name) > 0 {
+		st.tokens, err = tokens.NewStore(cfg.Tokens.Name, cfg.Tokens.Params, ctx)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Loaded '%s' Token Store Driver", st.tokens.Name())
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.UserStore, cfg.UserStore) {
+		st.users = prev.users
+	} else if len(cfg.UserStore.Name) > 0 {
+		st.users, err = users.NewStore(cfg.UserStore.Name, cfg.UserStore.Params, ctx)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Loaded '%s' User Store Driver", st.users.Name())
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.Sessions.Store, cfg.Sessions.Store) {
+		st.sessions = prev.sessions
+	} else if cfg.Sessions.Enabled() {
+		st.sessions, err = sessions.NewStore(cfg.Sessions.Store.Name, cfg.Sessions.Store.Params, ctx)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Loaded '%s' Session Store Driver", st.sessions.Name())
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.TwoFactor.Store, cfg.TwoFactor.Store) {
+		st.totp = prev.totp
+	} else if cfg.TwoFactor.Enabled() {
+		st.totp, err = totp.NewStore(cfg.TwoFactor.Store.Name, cfg.TwoFactor.Store.Params, ctx)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Loaded '%s' TOTP Store Driver", st.totp.Name())
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.OIDC, cfg.OIDC) {
+		st.oidc = prev.oidc
+	} else if cfg.OIDC.Enabled() {
+		st.oidc = oidc.NewProvider(cfg.OIDC, nil)
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.LDAP, cfg.LDAP) {
+		st.ldap = prev.ldap
+	} else if cfg.LDAP.Enabled() {
+		st.ldap, err = ldapauth.New(cfg.LDAP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if prev != nil && reflect.DeepEqual(prev.cfg.RateLimit, cfg.RateLimit) {
+		st.limits = prev.limits
+	} else {
+		st.limits = newRateLimits(cfg.RateLimit)
+	}
+
+	st.router = newRouter(cfg, st.backend)
+	return st, nil
+}
+
+// reloadConfig reads the config file again and swaps the server state.
+// Requests still running on the old state are drained in the
+// background. On error the old state is kept.
+func reloadConfig(path string, ctx context.Context) error {
+	log := logger.LogFromCtx("reloadConfig", ctx)
+	if len(path) == 0 {
+		return errors.New("running on default config, nothing to reload")
+	}
+
+	log.Info("Reloading config from ", path)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	old := currentState()
+	if cfg.HTTPConf.ListenOn != old.cfg.HTTPConf.ListenOn ||
+		cfg.HTTPConf.Port != old.cfg.HTTPConf.Port ||
+		cfg.HTTPConf.TLS != old.cfg.HTTPConf.TLS {
+		log.Warn("Listener changes require a restart, keeping old listener")
+	}
+
+	st, err := newServerState(cfg, old, ctx)
+	if err != nil {
+		return err
+	}
+	state.Store(st)
+	logger.SetLoggingLevel(cfg.LogLevel, ctx)
+	log.Info("Config reloaded")
+
+	draining.Add(1)
+	go func() {
+		defer draining.Done()
+		old.inflight.Lock()
+		old.retired = true
+		old.inflight.Unlock()
+		old.closeUnshared(st, ctx)
+	}()
+	return nil
+}
+
+// closeUnshared closes the backend, index and stores of the state that
+// are not also used by other. other may be nil to close everything.
+func (st *serverState) closeUnshared(other *serverState, ctx context.Context) {
+	log := logger.LogFromCtx("closeUnshared", ctx)
+	if other == nil {
+		other = &serverState{}
+	}
+
+	// The storage is closed first so pending uploads can still reach
+	// the index.
+	if st.storage != nil && st.storage != other.storage {
+		log.Infof("Closing '%s' backend", st.storage.Name())
+		if err := common.CloseBackend(st.storage, ctx); err != nil {
+			log.Error("Could not close backend: ", err)
+		}
+	}
+	if st.idx != nil && st.idx != other.idx {
+		if err := closeIndex(st.idx, ctx); err != nil {
+			log.Error("Could not close index: ", err)
+		}
+	}
+	if st.tokens != nil && st.tokens != other.tokens {
+		if err := st.tokens.Close(ctx); err != nil {
+			log.Error("Could not close token store: ", err)
+		}
+	}
+	if st.users != nil && st.users != other.users {
+		if err := st.users.Close(ctx); err != nil {
+			log.Error("Could not close user store: ", err)
+		}
+	}
+	if st.sessions != nil && st.sessions != other.sessions {
+		if err := st.sessions.Close(ctx); err != nil {
+			log.Error("Could not close session store: ", err)
+		}
+	}
+	if st.totp != nil && st.totp != other.totp {
+		if err := st.totp.Close(ctx); err != nil {
+			log.Error("Could not close TOTP store: ", err)
+		}
+	}
+}
+
+type handlerReloadable struct{}
+
+// newHandlerReloadable returns the handler serving all requests with
+// the router of the current state. The state is put into the request
+// context, handlers must use stateFromContext instead of currentState.
+func newHandlerReloadable() http.Handler {
+	return &handlerReloadable{}
+}
+
+func (h *handlerReloadable) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	st := acquireState()
+	defer st.inflight.RUnlock()
+	r = r.WithContext(context.WithValue(r.Context(), "state", st))
+	st.router.ServeHTTP(rw, r)
+}
+
+// acquireState returns the current state read locked, so a reload
+// does not close its backend while it is used. The caller must
+// release it with st.inflight.RUnlock.
+func acquireState() *serverState {
+	for {
+		st := currentState()
+		st.inflight.RLock()
+		// The state was replaced while waiting for the lock
+		if st.retired {
+			st.inflight.RUnlock()
+			continue
+		}
+		return st
+	}
+}
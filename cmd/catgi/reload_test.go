@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadIndexOnly(t *testing.T) {
+	assert := assert.New(t)
+	ctx := logger.NewLoggingContext()
+
+	var cfg = config.Configuration{
+		Backend: config.DriverConfig{Name: "buntdb", Params: map[string]interface{}{}},
+		Index:   config.DriverConfig{Name: "buntdb", Params: map[string]interface{}{}},
+	}
+	prev, err := newServerState(cfg, nil, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+
+	cfg.Index.Params = map[string]interface{}{
+		"file": filepath.Join(t.TempDir(), "index.db"),
+	}
+	st, err := newServerState(cfg, prev, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(prev.storage == st.storage, "Storage must be reused")
+	assert.False(prev.idx == st.idx, "Index must be replaced")
+
+	prev.closeUnshared(st, ctx)
+	assert.NoError(st.backend.Upload("reload", &common.File{
+		Data:     []byte("still open"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 1)),
+	}, ctx), "Reused storage must stay open")
+
+	cfg.Index.Name = "no-such-index"
+	cfg.Backend.Params = map[string]interface{}{
+		"file": filepath.Join(t.TempDir(), "files.db"),
+	}
+	_, err = newServerState(cfg, st, ctx)
+	assert.Error(err)
+	_, err = st.backend.Get("reload", ctx)
+	assert.NoError(err, "Failed reload must not close the current backend")
+
+	st.closeUnshared(nil, ctx)
+	assert.Error(st.storage.Exists("reload", ctx), "Storage must be closed")
+}
+
+func TestRequestState(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+
+	var seen []*serverState
+	var next *serverState
+	st.router = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		seen = append(seen, stateFromContext(r.Context()))
+		next = reloadTestState(t, st, func(cfg *config.Configuration) {
+			cfg.MetricsToken = "reloaded"
+		})
+		seen = append(seen, stateFromContext(r.Context()))
+		rw.WriteHeader(204)
+	})
+	rw := serveWith(newHandlerReloadable(), "GET", "/", nil)
+	assert.Equal(204, rw.Code)
+
+	if assert.Len(seen, 2) {
+		assert.True(seen[0] == st, "Requests must use the state they started with")
+		assert.True(seen[1] == st, "A reload must not change the state of a running request")
+	}
+	assert.True(stateFromContext(context.Background()) == next,
+		"Outside of requests the current state is used")
+	assert.Equal("reloaded", configFromContext(context.Background()).MetricsToken)
+}
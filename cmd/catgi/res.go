@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"mime"
 	"net/http"
+	"path"
 
 	rice "github.com/GeertJohan/go.rice"
 
@@ -34,7 +36,9 @@ func (h *handlerServeResources) ServeHTTP(rw http.ResponseWriter, r *http.Reques
 		fmt.Fprint(rw, "index.html not found")
 		return
 	}
+	if ctype := mime.TypeByExtension(path.Ext(r.URL.Path)); len(ctype) > 0 {
+		rw.Header().Add("Content-Type", ctype)
+	}
 	rw.WriteHeader(200)
-	rw.Header().Add("Content-Type", "application/html")
 	rw.Write(dat)
 }
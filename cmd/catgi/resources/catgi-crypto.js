@@ -0,0 +1,205 @@
+// Client side encryption for catgi.
+//
+// Files are encrypted with a random AES-256-GCM key that only ever
+// appears in the fragment of the share URL. The format matches
+// crypto.EncryptClientFile: two framed EncryptedBlocks, the first
+// holds the JSON metadata, the second the file data. A framed block
+// is a little endian uint64 length followed by the msgpack encoded
+// block.
+"use strict";
+
+var catgiCrypto = (function () {
+    var CIPHER_AESGCM = 2;
+    var HEADER_SIZE = 8;
+    var enc = new TextEncoder();
+    var metaAD = enc.encode("catgi-meta");
+    var dataAD = enc.encode("catgi-data");
+
+    function b64url(bytes) {
+        var s = "";
+        for (var i = 0; i < bytes.length; i++) {
+            s += String.fromCharCode(bytes[i]);
+        }
+        return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+
+    function unb64url(s) {
+        s = s.replace(/-/g, "+").replace(/_/g, "/");
+        while (s.length % 4) {
+            s += "=";
+        }
+        var bin = atob(s);
+        var out = new Uint8Array(bin.length);
+        for (var i = 0; i < bin.length; i++) {
+            out[i] = bin.charCodeAt(i);
+        }
+        return out;
+    }
+
+    function concat(parts) {
+        var len = 0;
+        parts.forEach(function (p) { len += p.length; });
+        var out = new Uint8Array(len);
+        var off = 0;
+        parts.forEach(function (p) { out.set(p, off); off += p.length; });
+        return out;
+    }
+
+    // encodeBlock writes the subset of msgpack needed for an
+    // EncryptedBlock: a fixmap of fixstr keys, small uints and bins.
+    function encodeBlock(nonce, data) {
+        function str(s) {
+            return concat([new Uint8Array([0xa0 | s.length]), enc.encode(s)]);
+        }
+        function bin(b) {
+            var hdr = new Uint8Array(5);
+            hdr[0] = 0xc6;
+            new DataView(hdr.buffer).setUint32(1, b.length);
+            return concat([hdr, b]);
+        }
+        return concat([
+            new Uint8Array([0x85]),
+            str("cipher"), new Uint8Array([CIPHER_AESGCM]),
+            str("padding"), new Uint8Array([0]),
+            str("nonce"), bin(nonce),
+            str("salt"), bin(new Uint8Array(0)),
+            str("data"), bin(data)
+        ]);
+    }
+
+    function decodeBlock(buf) {
+        var view = new DataView(buf.buffer, buf.byteOffset, buf.byteLength);
+        var pos = 0;
+        function byte() {
+            if (pos >= buf.length) {
+                throw new Error("Truncated block");
+            }
+            return buf[pos++];
+        }
+        function bytes(n) {
+            if (pos + n > buf.length) {
+                throw new Error("Truncated block");
+            }
+            var out = buf.subarray(pos, pos + n);
+            pos += n;
+            return out;
+        }
+        function value() {
+            var c = byte();
+            var n;
+            if (c <= 0x7f) {
+                return c;
+            } else if ((c & 0xe0) === 0xa0) {
+                return new TextDecoder().decode(bytes(c & 0x1f));
+            }
+            switch (c) {
+            case 0xc0: return new Uint8Array(0);
+            case 0xcc: return byte();
+            case 0xcd: n = view.getUint16(pos); pos += 2; return n;
+            case 0xd9: return new TextDecoder().decode(bytes(byte()));
+            case 0xc4: return bytes(byte());
+            case 0xc5: n = view.getUint16(pos); pos += 2; return bytes(n);
+            case 0xc6: n = view.getUint32(pos); pos += 4; return bytes(n);
+            }
+            throw new Error("Unsupported msgpack code " + c);
+        }
+        var c = byte();
+        if ((c & 0xf0) !== 0x80) {
+            throw new Error("Block is not a map");
+        }
+        var block = {};
+        for (var i = 0; i < (c & 0x0f); i++) {
+            var k = value();
+            block[k] = value();
+        }
+        return block;
+    }
+
+    function frame(block) {
+        var hdr = new Uint8Array(HEADER_SIZE);
+        new DataView(hdr.buffer).setUint32(0, block.length, true);
+        return concat([hdr, block]);
+    }
+
+    function seal(key, data, ad) {
+        var nonce = crypto.getRandomValues(new Uint8Array(12));
+        return crypto.subtle.encrypt(
+            {name: "AES-GCM", iv: nonce, additionalData: ad}, key, data
+        ).then(function (ct) {
+            return frame(encodeBlock(nonce, new Uint8Array(ct)));
+        });
+    }
+
+    // open decrypts the block at off and returns the plaintext and
+    // the offset of the next block.
+    function open(key, buf, off, ad) {
+        if (buf.length - off < HEADER_SIZE) {
+            return Promise.reject(new Error("Not a client encrypted file"));
+        }
+        var view = new DataView(buf.buffer, buf.byteOffset + off, HEADER_SIZE);
+        var size = view.getUint32(0, true);
+        if (view.getUint32(4, true) !== 0 || off + HEADER_SIZE + size > buf.length) {
+            return Promise.reject(new Error("Not a client encrypted file"));
+        }
+        var end = off + HEADER_SIZE + size;
+        var block = decodeBlock(buf.subarray(off + HEADER_SIZE, end));
+        if (block.cipher !== CIPHER_AESGCM || block.padding !== 0) {
+            return Promise.reject(new Error("Not a client encrypted file"));
+        }
+        return crypto.subtle.decrypt(
+            {name: "AES-GCM", iv: block.nonce, additionalData: ad}, key, block.data
+        ).then(function (pt) {
+            return {data: new Uint8Array(pt), next: end};
+        });
+    }
+
+    // encryptFile encrypts a File or Blob and resolves to the
+    // ciphertext as Blob and the key for the URL fragment.
+    function encryptFile(file) {
+        var raw = crypto.getRandomValues(new Uint8Array(32));
+        var meta = enc.encode(JSON.stringify({name: file.name || "", type: file.type || ""}));
+        return Promise.all([
+            crypto.subtle.importKey("raw", raw, "AES-GCM", false, ["encrypt"]),
+            new Response(file).arrayBuffer()
+        ]).then(function (r) {
+            return Promise.all([
+                seal(r[0], meta, metaAD),
+                seal(r[0], new Uint8Array(r[1]), dataAD)
+            ]);
+        }).then(function (blocks) {
+            return {
+                blob: new Blob(blocks, {type: "application/octet-stream"}),
+                key: b64url(raw)
+            };
+        });
+    }
+
+    // decryptFile decrypts the ciphertext with the key from the URL
+    // fragment and resolves to the metadata and the data as Blob.
+    function decryptFile(ciphertext, fragment) {
+        var buf = new Uint8Array(ciphertext);
+        var key, meta;
+        return crypto.subtle.importKey(
+            "raw", unb64url(fragment), "AES-GCM", false, ["decrypt"]
+        ).then(function (k) {
+            key = k;
+            return open(key, buf, 0, metaAD);
+        }).then(function (m) {
+            meta = JSON.parse(new TextDecoder().decode(m.data));
+            return open(key, buf, m.next, dataAD).then(function (d) {
+                if (d.next !== buf.length) {
+                    throw new Error("Trailing data after file");
+                }
+                return d.data;
+            });
+        }).then(function (data) {
+            return {meta: meta, blob: new Blob([data], {type: meta.type || "application/octet-stream"})};
+        });
+    }
+
+    return {encryptFile: encryptFile, decryptFile: decryptFile};
+})();
+
+if (typeof module !== "undefined") {
+    module.exports = catgiCrypto;
+}
@@ -22,13 +22,10 @@ func newHandlerRunGC(b common.Backend) http.Handler {
 func (h *handlerRunGC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log := logger.LogFromCtx("runGC", r.Context())
 
-	log.Info("Starting GC")
-
 	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
 
-	// <- BEGIN BACKEND INTERACTION ->
-	files, err := h.backend.RunGC(r.Context())
-	// -> END BACKEND INTERACTION
+	// Waits if the scheduler is running the GC
+	files, err := runGC(h.backend, r.Context())
 
 	if err != nil && !common.IsHTTPOption(err) {
 		w.WriteHeader(500)
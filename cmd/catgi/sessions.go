@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/sessions"
+)
+
+// apiSession is a session as returned by the API
+type apiSession struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Current is set for the session of the request
+	Current bool `json:"current"`
+}
+
+func newAPISession(s sessions.Session, current string) apiSession {
+	return apiSession{
+		ID:        s.ID,
+		User:      s.User,
+		UserAgent: s.UserAgent,
+		IP:        s.IP,
+		CreatedAt: s.CreatedAt,
+		LastSeen:  s.LastSeen,
+		ExpiresAt: s.ExpiresAt,
+		Current:   s.ID == current,
+	}
+}
+
+// sessionStoreOrError returns the session store or writes an error if
+// sessions are not tracked. Like tokens, sessions are managed with a
+// login only.
+func sessionStoreOrError(rw http.ResponseWriter, r *http.Request) sessions.Store {
+	user := userFromContext(r.Context())
+	if len(user) == 0 || user == "anonymous" {
+		writeAPIError(rw, r, 401, apiCodeUnauthorized, "Login required")
+		return nil
+	}
+	if apiTokenFromContext(r.Context()) != nil {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "API tokens cannot manage sessions")
+		return nil
+	}
+	store := stateFromContext(r.Context()).sessions
+	if store == nil {
+		writeAPIError(rw, r, 501, apiCodeNotConfigured, "No session store configured")
+		return nil
+	}
+	return store
+}
+
+type handlerServeLogout struct{}
+
+// newHandlerServeLogout revokes the session of the request and clears
+// the auth cookie.
+func newHandlerServeLogout() http.Handler {
+	return &handlerServeLogout{}
+}
+
+func (h *handlerServeLogout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("logout", r.Context())
+	if store := stateFromContext(r.Context()).sessions; store != nil {
+		if id := sessionFromContext(r.Context()); len(id) > 0 {
+			if err := store.Remove(id, r.Context()); err != nil {
+				log.Error("Could not remove session: ", err)
+				w.WriteHeader(500)
+				fmt.Fprint(w, "500 - Internal Server Error")
+				return
+			}
+			log.Info("Logged out ", userFromContext(r.Context()))
+		}
+	}
+	clearAuthCookie(w)
+	fmt.Fprint(w, "Logged out.")
+}
+
+type handlerAPISessions struct{}
+
+func newHandlerAPISessions() http.Handler {
+	return &handlerAPISessions{}
+}
+
+// ServeHTTP lists the sessions of the caller, or for admins of the
+// user query parameter, on GET. DELETE revokes all of them except the
+// session of the request.
+func (h *handlerAPISessions) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiSessions", r.Context())
+	store := sessionStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	user := userFromContext(r.Context())
+	if other := r.URL.Query().Get("user"); len(other) > 0 && other != user {
+		if !roleFromContext(r.Context()).Includes(config.RoleAdmin) {
+			writeAPIError(rw, r, 403, apiCodeForbidden, "Requires role admin")
+			return
+		}
+		user = other
+	}
+	current := sessionFromContext(r.Context())
+
+	if r.Method == "DELETE" {
+		n, err := sessions.RevokeUser(store, user, current, r.Context())
+		if err != nil {
+			log.Error("Could not revoke sessions: ", err)
+			writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+			return
+		}
+		log.Infof("Revoked %d sessions of %s by %s", n, user, userFromContext(r.Context()))
+		rw.WriteHeader(204)
+		return
+	}
+
+	list, err := store.ListUser(r.Context(), user)
+	if err != nil {
+		log.Error("Could not list sessions: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	idle := configFromContext(r.Context()).Sessions.IdleDuration()
+	var resp = []apiSession{}
+	for _, v := range list {
+		if !v.Valid(idle, time.Now()) {
+			continue
+		}
+		resp = append(resp, newAPISession(v, current))
+	}
+	writeAPIJSON(rw, r, 200, struct {
+		Sessions []apiSession `json:"sessions"`
+	}{resp})
+}
+
+type handlerAPIRevokeSession struct{}
+
+func newHandlerAPIRevokeSession() http.Handler {
+	return &handlerAPIRevokeSession{}
+}
+
+// ServeHTTP revokes a session of the caller, admins may revoke
+// sessions of every user.
+func (h *handlerAPIRevokeSession) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiRevokeSession", r.Context())
+	store := sessionStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	session, err := store.Get(id, r.Context())
+	if err == sessions.ErrorSessionNotExists {
+		writeAPIError(rw, r, 404, apiCodeSessionNotFound, "Session does not exist")
+		return
+	} else if err != nil {
+		log.Error("Could not get session: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	user := userFromContext(r.Context())
+	if session.User != user && !roleFromContext(r.Context()).Includes(config.RoleAdmin) {
+		writeAPIError(rw, r, 404, apiCodeSessionNotFound, "Session does not exist")
+		return
+	}
+
+	if err := store.Remove(id, r.Context()); err != nil {
+		log.Error("Could not remove session: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	log.Infof("Session %s of %s revoked by %s", id, session.User, user)
+	if id == sessionFromContext(r.Context()) {
+		clearAuthCookie(rw)
+	}
+	rw.WriteHeader(204)
+}
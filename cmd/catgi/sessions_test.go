@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+// reloadTestState reloads the state with the changed config like a
+// SIGHUP would and makes it the current state.
+func reloadTestState(t *testing.T, prev *serverState, change func(*config.Configuration)) *serverState {
+	ctx := logger.NewLoggingContext()
+	cfg := prev.cfg
+	change(&cfg)
+	st, err := newServerState(cfg, prev, ctx)
+	if err != nil {
+		t.Fatal("Could not reload state: ", err)
+	}
+	t.Cleanup(func() { st.closeUnshared(prev, ctx) })
+	state.Store(st)
+	return st
+}
+
+// newSessionRouter routes the session API like newRouter does
+func newSessionRouter() http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/logout",
+		newHandlerCheckToken(true, newHandlerServeLogout()),
+	).Methods("POST")
+	router.Handle("/api/v1/sessions",
+		newHandlerCheckToken(false, newHandlerAPISessions()),
+	).Methods("GET", "DELETE")
+	router.Handle("/api/v1/sessions/{id}",
+		newHandlerCheckToken(false, newHandlerAPIRevokeSession()),
+	).Methods("DELETE")
+	router.Handle("/", newHandlerCheckToken(false, whoAmI))
+	return router
+}
+
+// listSessions returns the sessions the login sees
+func listSessions(t *testing.T, h http.Handler, cookie *http.Cookie) []apiSession {
+	rw := serveWith(h, "GET", "/api/v1/sessions", cookie)
+	if rw.Code != 200 {
+		t.Fatalf("Could not list sessions: %d %s", rw.Code, rw.Body)
+	}
+	var resp struct {
+		Sessions []apiSession `json:"sessions"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal("Could not decode sessions: ", err)
+	}
+	return resp.Sessions
+}
+
+func newSessionTestState(t *testing.T) *serverState {
+	return newTestState(t, config.Configuration{
+		Sessions: config.SessionConfig{
+			Store: config.DriverConfig{Name: "buntdb", Params: map[string]interface{}{}},
+		},
+	})
+}
+
+func TestLogout(t *testing.T) {
+	assert := assert.New(t)
+	st := newSessionTestState(t)
+	h := newSessionRouter()
+
+	cookie := loginCookie(t, st, "alice", config.RoleViewer)
+	other := loginCookie(t, st, "alice", config.RoleViewer)
+	rw := serveWith(h, "GET", "/", cookie)
+	assert.Equal("alice:viewer", rw.Body.String())
+
+	rw = serveWith(h, "POST", "/logout", cookie)
+	assert.Equal(200, rw.Code)
+	rw = serveWith(h, "GET", "/", cookie)
+	assert.Equal(401, rw.Code, "Logged out cookies must be rejected")
+
+	rw = serveWith(h, "GET", "/", other)
+	assert.Equal(200, rw.Code, "Logout must only end the own session")
+}
+
+func TestRevokeSessions(t *testing.T) {
+	assert := assert.New(t)
+	st := newSessionTestState(t)
+	h := newSessionRouter()
+
+	first := loginCookie(t, st, "alice", config.RoleViewer)
+	second := loginCookie(t, st, "alice", config.RoleViewer)
+	third := loginCookie(t, st, "alice", config.RoleViewer)
+	dave := loginCookie(t, st, "dave", config.RoleUploader)
+
+	list := listSessions(t, h, first)
+	if !assert.Len(list, 3) {
+		return
+	}
+	var secondID string
+	for _, v := range list {
+		assert.Equal("alice", v.User)
+		if !v.Current {
+			secondID = v.ID
+		}
+	}
+
+	rw := serveWith(h, "DELETE", "/api/v1/sessions/"+secondID, dave)
+	assert.Equal(404, rw.Code, "Sessions of other users must not be revoked")
+
+	rw = serveWith(h, "DELETE", "/api/v1/sessions/"+secondID, first)
+	assert.Equal(204, rw.Code)
+	assert.Len(listSessions(t, h, first), 2)
+
+	rw = serveWith(h, "DELETE", "/api/v1/sessions", first)
+	assert.Equal(204, rw.Code)
+	for _, v := range []*http.Cookie{second, third} {
+		rw = serveWith(h, "GET", "/", v)
+		assert.Equal(401, rw.Code, "Revoked sessions must be rejected")
+	}
+	rw = serveWith(h, "GET", "/", first)
+	assert.Equal(200, rw.Code, "Revoking all keeps the session of the request")
+	rw = serveWith(h, "GET", "/", dave)
+	assert.Equal(200, rw.Code)
+
+	rw = serveWith(h, "DELETE", "/api/v1/sessions?user=alice",
+		loginCookie(t, st, "bob", config.RoleAdmin))
+	assert.Equal(204, rw.Code)
+	rw = serveWith(h, "GET", "/", first)
+	assert.Equal(401, rw.Code, "Admins may revoke sessions of every user")
+}
+
+func TestRotateJWTKey(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{})
+	h := newHandlerCheckToken(false, whoAmI)
+	cookie := loginCookie(t, st, "alice", config.RoleViewer)
+
+	rotated := reloadTestState(t, st, func(cfg *config.Configuration) {
+		cfg.PreviousHMACKey = cfg.HMACKey
+		cfg.PreviousHMACKeyUntil = time.Now().Add(time.Hour).Format(time.RFC3339)
+		cfg.HMACKey = "new jwt key"
+	})
+	rw := serveWith(h, "GET", "/", cookie)
+	assert.Equal("alice:viewer", rw.Body.String(), "Logins of the previous key stay valid")
+	rw = serveWith(h, "GET", "/", loginCookie(t, rotated, "alice", config.RoleViewer))
+	assert.Equal("alice:viewer", rw.Body.String())
+
+	reloadTestState(t, rotated, func(cfg *config.Configuration) {
+		cfg.PreviousHMACKeyUntil = time.Now().Add(-time.Hour).Format(time.RFC3339)
+	})
+	rw = serveWith(h, "GET", "/", cookie)
+	assert.Equal(401, rw.Code, "Logins of the previous key end after the grace period")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes. Checks happen during handshakes, idle servers don't poll.
+const certCheckInterval = 10 * time.Second
+
+// certLoader keeps the certificate of the server and reloads it once
+// the files on disk change, so rotated certificates need no restart.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	ctx      context.Context
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+// newCertLoader loads the certificate, failing if it is not valid
+func newCertLoader(certFile, keyFile string, ctx context.Context) (*certLoader, error) {
+	c := &certLoader{certFile: certFile, keyFile: keyFile, ctx: ctx}
+	modTime, err := c.lastModified()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lastModified returns the newer modification time of both files
+func (c *certLoader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, v := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(v)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certLoader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If reloading
+// fails the old certificate is kept, a rotation may be half done.
+func (c *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = time.Now()
+
+	log := logger.LogFromCtx("certLoader", c.ctx)
+	modTime, err := c.lastModified()
+	if err != nil {
+		log.Warn("Could not check certificate: ", err)
+		return c.cert, nil
+	}
+	if !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.load(modTime); err != nil {
+		log.Warn("Could not reload certificate, keeping old one: ", err)
+		return c.cert, nil
+	}
+	log.Info("Reloaded certificate ", c.certFile)
+	return c.cert, nil
+}
+
+// newTLSConfig returns the TLS config of the server. HTTP/2 is offered
+// to clients supporting it.
+func newTLSConfig(cfg config.TLSConfig, ctx context.Context) (*tls.Config, error) {
+	minVersion, err := cfg.Version()
+	if err != nil {
+		return nil, err
+	}
+	loader, err := newCertLoader(cfg.CertFile, cfg.KeyFile, ctx)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: loader.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if len(cfg.ClientCA) > 0 {
+		dat, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(dat) {
+			return nil, errors.New("No certificates in " + cfg.ClientCA)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
+}
+
+type handlerRedirectHTTPS struct {
+	port uint16
+}
+
+// newHandlerRedirectHTTPS redirects all requests to the same URL on
+// the HTTPS port.
+func newHandlerRedirectHTTPS(port uint16) http.Handler {
+	return &handlerRedirectHTTPS{port: port}
+}
+
+func (h *handlerRedirectHTTPS) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = strings.Trim(r.Host, "[]")
+	}
+	if h.port != 443 {
+		host = net.JoinHostPort(host, fmt.Sprintf("%d", h.port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	status := http.StatusMovedPermanently
+	if r.Method != "GET" && r.Method != "HEAD" {
+		// Keep the method and body of uploads
+		status = http.StatusPermanentRedirect
+	}
+	http.Redirect(rw, r, target, status)
+}
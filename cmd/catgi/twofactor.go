@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/totp"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// pendingCookie carries a login waiting for the second factor
+const pendingCookie = "auth_2fa"
+
+// pendingAudience marks the JWT of a pending login, the token check
+// never accepts it as login.
+const pendingAudience = "catgi-2fa"
+
+// pendingTTL is how long a user may take to enter the code
+const pendingTTL = 5 * time.Minute
+
+// secondFactorHeader tells clients which second factor a login waits
+// for.
+const secondFactorHeader = "X-Catgi-Second-Factor"
+
+// Second factors a pending login waits for
+const (
+	// secondFactorTOTP asks for a code of the enrolled authenticator
+	secondFactorTOTP = "totp"
+	// secondFactorEnroll requires the user to enroll an authenticator
+	// and enter it's first code.
+	secondFactorEnroll = "enroll"
+)
+
+// pendingClaims are the claims of a login waiting for the second
+// factor
+type pendingClaims struct {
+	jwt.StandardClaims
+	Role config.Role `json:"role"`
+	// Method is the first factor of the login
+	Method string `json:"method"`
+	// Factor is the second factor the login waits for
+	Factor string `json:"factor"`
+}
+
+// maxCodeForm limits the form of a DELETE request with a code
+const maxCodeForm = 1024
+
+// enrollmentLocks serializes reading, checking and storing the
+// enrollment of a user, so a code or recovery code sent in parallel is
+// only accepted once. The mutex only protects the map.
+var enrollmentLocks = struct {
+	sync.Mutex
+	users map[string]*enrollmentLock
+}{users: map[string]*enrollmentLock{}}
+
+// enrollmentLock is held while the enrollment of a user is changed
+type enrollmentLock struct {
+	sync.Mutex
+	// refs counts holders and waiters, it is protected by
+	// enrollmentLocks.
+	refs int
+}
+
+// lockEnrollment locks the enrollment of the user and returns the
+// function releasing it.
+func lockEnrollment(user string) func() {
+	enrollmentLocks.Lock()
+	l, ok := enrollmentLocks.users[user]
+	if !ok {
+		l = &enrollmentLock{}
+		enrollmentLocks.users[user] = l
+	}
+	l.refs++
+	enrollmentLocks.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		enrollmentLocks.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(enrollmentLocks.users, user)
+		}
+		enrollmentLocks.Unlock()
+	}
+}
+
+// apiTwoFactorSetup is the secret of a new enrollment
+type apiTwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// secondFactor returns the second factor a user has to provide, empty
+// if the user has none and does not need one.
+func secondFactor(st *serverState, user string, role config.Role, ctx context.Context) (string, error) {
+	if st.totp == nil {
+		return "", nil
+	}
+	e, err := st.totp.Get(user, ctx)
+	if err != nil && err != totp.ErrorNotEnrolled {
+		return "", err
+	}
+	if err == nil && e.Confirmed {
+		return secondFactorTOTP, nil
+	}
+	if st.cfg.TwoFactor.Required(role) {
+		return secondFactorEnroll, nil
+	}
+	return "", nil
+}
+
+// finishLogin is called once the first factor of a login is verified.
+// If the user needs no second factor the auth cookie is set and true
+// is returned, otherwise the login is kept in the pending cookie and
+// the client is sent to the form of the second factor.
+func finishLogin(w http.ResponseWriter, r *http.Request, user string, role config.Role,
+	method string, st *serverState) (bool, error) {
+	factor, err := secondFactor(st, user, role, r.Context())
+	if err != nil {
+		return false, err
+	}
+	if len(factor) == 0 {
+		return true, setAuthCookie(w, r, user, role, []string{method}, st)
+	}
+
+	now := time.Now()
+	claims := &pendingClaims{
+		StandardClaims: jwt.StandardClaims{
+			Audience:  pendingAudience,
+			ExpiresAt: now.Add(pendingTTL).Unix(),
+			Issuer:    "catgi.rls.moe",
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			Subject:   user,
+		},
+		Role:   role,
+		Method: method,
+		Factor: factor,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS512, claims).
+		SignedString([]byte(st.cfg.HMACKey))
+	if err != nil {
+		return false, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingCookie,
+		Value:    token,
+		Path:     "/auth/2fa",
+		MaxAge:   int(pendingTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set(secondFactorHeader, factor)
+	http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+	return false, nil
+}
+
+// readPendingLogin returns the verified claims of the pending cookie
+func readPendingLogin(r *http.Request, cfg config.Configuration) (*pendingClaims, error) {
+	cookie, err := r.Cookie(pendingCookie)
+	if err != nil {
+		return nil, err
+	}
+	claims := &pendingClaims{}
+	_, err = jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() != jwt.SigningMethodHS512.Alg() {
+			return nil, jwt.ErrInvalidKeyType
+		}
+		return []byte(cfg.HMACKey), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyAudience(pendingAudience, true) {
+		return nil, errors.New("JWT is not a pending login")
+	}
+	return claims, nil
+}
+
+// clearPendingCookie removes the pending cookie from the client
+func clearPendingCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     pendingCookie,
+		Path:     "/auth/2fa",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+}
+
+type handlerServeAuthTwoFactor struct{}
+
+// newHandlerServeAuthTwoFactor completes a pending login with a code
+// or, if the login waits for enrollment, confirms the enrollment with
+// it's first code.
+func newHandlerServeAuthTwoFactor() http.Handler {
+	return &handlerServeAuthTwoFactor{}
+}
+
+func (h *handlerServeAuthTwoFactor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("postAuth2FA", r.Context())
+	st := stateFromContext(r.Context())
+	fail := func(status int, msg string) {
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "%d - %s", status, msg)
+	}
+	if st.totp == nil {
+		fail(404, "2FA is not configured")
+		return
+	}
+	pending, err := readPendingLogin(r, st.cfg)
+	if err != nil {
+		log.Warn("No valid pending login: ", err)
+		fail(401, "Login expired, please login again")
+		return
+	}
+	user := pending.Subject
+	lockKey := "user:" + user
+	if locked, wait := st.limits.lockout.Locked(lockKey); locked {
+		log.Warn("Code attempt for locked user ", user)
+		writeTooManyRequests(w, r, wait)
+		return
+	}
+
+	defer lockEnrollment(user)()
+	e, err := st.totp.Get(user, r.Context())
+	if err == totp.ErrorNotEnrolled {
+		fail(401, "Set up an authenticator first")
+		return
+	} else if err != nil {
+		log.Error("Could not get enrollment: ", err)
+		fail(500, "Internal Server Error")
+		return
+	}
+
+	var recovery []string
+	var ok bool
+	code := r.FormValue("code")
+	if e.Confirmed {
+		ok = e.Check(code, time.Now())
+	} else if pending.Factor == secondFactorEnroll && e.CheckCode(code, time.Now()) {
+		e.Confirmed = true
+		recovery, err = e.NewRecoveryCodes()
+		if err != nil {
+			log.Error("Could not create recovery codes: ", err)
+			fail(500, "Internal Server Error")
+			return
+		}
+		ok = true
+	}
+	if !ok {
+		log.Warn("Wrong code attempt for user ", user)
+		if st.limits.lockout.Fail(lockKey) {
+			log.Warn("Too many failed logins, locking user ", user)
+		}
+		fail(401, "Not Authorized")
+		return
+	}
+	if err := st.totp.Put(*e, r.Context()); err != nil {
+		log.Error("Could not store enrollment: ", err)
+		fail(500, "Internal Server Error")
+		return
+	}
+	st.limits.lockout.Reset(lockKey)
+
+	clearPendingCookie(w)
+	if err := setAuthCookie(w, r, user, pending.Role, []string{pending.Method, amrOTP}, st); err != nil {
+		log.Error("Error on auth: ", err)
+		fail(401, "Not Authorized")
+		return
+	}
+	if len(recovery) > 0 {
+		log.Info("User ", user, " enrolled an authenticator on login")
+		fmt.Fprintf(w, "Logged in as %s.\nStore these recovery codes, each can be used once "+
+			"instead of a code:\n\n%s\n", user, strings.Join(recovery, "\n"))
+		return
+	}
+	fmt.Fprintf(w, "Logged in as %s.\nReturn to main page to upload files now.", user)
+}
+
+type handlerServeAuthEnroll struct{}
+
+// newHandlerServeAuthEnroll creates the enrollment of a pending login
+// that has to enroll, the first code is sent to /auth/2fa.
+func newHandlerServeAuthEnroll() http.Handler {
+	return &handlerServeAuthEnroll{}
+}
+
+func (h *handlerServeAuthEnroll) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("postAuthEnroll", r.Context())
+	st := stateFromContext(r.Context())
+	if st.totp == nil {
+		writeAPIError(rw, r, 501, apiCodeNotConfigured, "2FA is not configured")
+		return
+	}
+	pending, err := readPendingLogin(r, st.cfg)
+	if err != nil {
+		log.Warn("No valid pending login: ", err)
+		writeAPIError(rw, r, 401, apiCodeUnauthorized, "Login expired, please login again")
+		return
+	}
+	if pending.Factor != secondFactorEnroll {
+		writeAPIError(rw, r, 409, apiCodeTwoFactorEnabled, "Authenticator is already set up")
+		return
+	}
+	startEnrollment(rw, r, st, pending.Subject)
+}
+
+// startEnrollment replaces an unconfirmed enrollment of the user with
+// a new secret and replies with it.
+func startEnrollment(rw http.ResponseWriter, r *http.Request, st *serverState, user string) {
+	log := logger.LogFromCtx("startEnrollment", r.Context())
+	defer lockEnrollment(user)()
+	if e, err := st.totp.Get(user, r.Context()); err == nil && e.Confirmed {
+		writeAPIError(rw, r, 409, apiCodeTwoFactorEnabled, "Authenticator is already set up")
+		return
+	} else if err != nil && err != totp.ErrorNotEnrolled {
+		log.Error("Could not get enrollment: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	e, err := totp.NewEnrollment(user)
+	if err == nil {
+		err = st.totp.Put(e, r.Context())
+	}
+	if err != nil {
+		log.Error("Could not create enrollment: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	writeAPIJSON(rw, r, 201, apiTwoFactorSetup{
+		Secret: e.Secret,
+		URI:    totp.URI(st.cfg.TwoFactor.IssuerName(), user, e.Secret),
+	})
+}
+
+// twoFactorStoreOrError returns the TOTP store or writes an error if
+// 2FA is disabled. Like tokens, 2FA is managed with a login only.
+func twoFactorStoreOrError(rw http.ResponseWriter, r *http.Request) totp.Store {
+	user := userFromContext(r.Context())
+	if len(user) == 0 || user == "anonymous" {
+		writeAPIError(rw, r, 401, apiCodeUnauthorized, "Login required")
+		return nil
+	}
+	if apiTokenFromContext(r.Context()) != nil {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "API tokens cannot manage 2FA")
+		return nil
+	}
+	store := stateFromContext(r.Context()).totp
+	if store == nil {
+		writeAPIError(rw, r, 501, apiCodeNotConfigured, "2FA is not configured")
+		return nil
+	}
+	return store
+}
+
+// enrollmentOrError returns the enrollment of the caller or writes an
+// error if there is none. The caller must hold the enrollment lock if
+// it stores the enrollment again.
+func enrollmentOrError(rw http.ResponseWriter, r *http.Request, store totp.Store) *totp.Enrollment {
+	e, err := store.Get(userFromContext(r.Context()), r.Context())
+	if err == totp.ErrorNotEnrolled {
+		writeAPIError(rw, r, 404, apiCodeTwoFactorNotEnabled, "No authenticator set up")
+		return nil
+	} else if err != nil {
+		logger.LogFromCtx("enrollmentOrError", r.Context()).Error("Could not get enrollment: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return nil
+	}
+	return e
+}
+
+// checkAccountCode checks the code against the enrollment of the
+// caller, which must be locked with lockEnrollment until the used code
+// is stored. Wrong codes count towards the login lockout. Without
+// allowRecovery only TOTP codes are accepted. On failure the error is
+// written and false returned.
+func checkAccountCode(rw http.ResponseWriter, r *http.Request, e *totp.Enrollment,
+	code string, allowRecovery bool) bool {
+	log := logger.LogFromCtx("checkAccountCode", r.Context())
+	st := stateFromContext(r.Context())
+	lockKey := "user:" + e.User
+	if locked, wait := st.limits.lockout.Locked(lockKey); locked {
+		writeTooManyRequests(rw, r, wait)
+		return false
+	}
+	var ok bool
+	if allowRecovery {
+		ok = e.Check(code, time.Now())
+	} else {
+		ok = e.CheckCode(code, time.Now())
+	}
+	if !ok {
+		log.Warn("Wrong code of user ", e.User)
+		st.limits.lockout.Fail(lockKey)
+		writeAPIError(rw, r, 403, apiCodeCodeInvalid, "Wrong code")
+		return false
+	}
+	st.limits.lockout.Reset(lockKey)
+	return true
+}
+
+type handlerAPITwoFactor struct{}
+
+func newHandlerAPITwoFactor() http.Handler {
+	return &handlerAPITwoFactor{}
+}
+
+// ServeHTTP reports the 2FA status of the caller on GET. POST starts
+// an enrollment, which has to be confirmed with the first code. DELETE
+// removes the enrollment and takes a code or recovery code, users of
+// roles requiring 2FA cannot remove it.
+func (h *handlerAPITwoFactor) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiTwoFactor", r.Context())
+	store := twoFactorStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	st := stateFromContext(r.Context())
+	user := userFromContext(r.Context())
+	required := st.cfg.TwoFactor.Required(roleFromContext(r.Context()))
+
+	switch r.Method {
+	case "GET":
+		var status struct {
+			Enabled       bool `json:"enabled"`
+			Required      bool `json:"required"`
+			RecoveryCodes int  `json:"recovery_codes"`
+		}
+		status.Required = required
+		e, err := store.Get(user, r.Context())
+		if err == nil && e.Confirmed {
+			status.Enabled = true
+			status.RecoveryCodes = len(e.RecoveryCodes)
+		} else if err != nil && err != totp.ErrorNotEnrolled {
+			log.Error("Could not get enrollment: ", err)
+			writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+			return
+		}
+		writeAPIJSON(rw, r, 200, status)
+	case "POST":
+		startEnrollment(rw, r, st, user)
+	case "DELETE":
+		if required {
+			writeAPIError(rw, r, 403, apiCodeForbidden, "2FA is required for your role")
+			return
+		}
+		defer lockEnrollment(user)()
+		e := enrollmentOrError(rw, r, store)
+		if e == nil {
+			return
+		}
+		if e.Confirmed {
+			// ParseForm ignores the body of DELETE requests
+			dat, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCodeForm))
+			form, perr := url.ParseQuery(string(dat))
+			if err != nil || perr != nil {
+				writeAPIError(rw, r, 400, apiCodeBadRequest, "Could not read code")
+				return
+			}
+			if !checkAccountCode(rw, r, e, form.Get("code"), true) {
+				return
+			}
+		}
+		if err := store.Remove(user, r.Context()); err != nil {
+			log.Error("Could not remove enrollment: ", err)
+			writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+			return
+		}
+		log.Info("2FA disabled by ", user)
+		rw.WriteHeader(204)
+	}
+}
+
+type handlerAPITwoFactorConfirm struct{}
+
+func newHandlerAPITwoFactorConfirm() http.Handler {
+	return &handlerAPITwoFactorConfirm{}
+}
+
+// ServeHTTP confirms the enrollment of the caller with the first code
+// and replies with the recovery codes.
+func (h *handlerAPITwoFactorConfirm) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiTwoFactorConfirm", r.Context())
+	store := twoFactorStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	defer lockEnrollment(userFromContext(r.Context()))()
+	e := enrollmentOrError(rw, r, store)
+	if e == nil {
+		return
+	}
+	if e.Confirmed {
+		writeAPIError(rw, r, 409, apiCodeTwoFactorEnabled, "Authenticator is already set up")
+		return
+	}
+	if !checkAccountCode(rw, r, e, r.FormValue("code"), false) {
+		return
+	}
+	e.Confirmed = true
+	writeRecoveryCodes(rw, r, store, e)
+	log.Info("2FA enabled by ", e.User)
+}
+
+type handlerAPIRecoveryCodes struct{}
+
+func newHandlerAPIRecoveryCodes() http.Handler {
+	return &handlerAPIRecoveryCodes{}
+}
+
+// ServeHTTP replaces the recovery codes of the caller, it takes a
+// current code.
+func (h *handlerAPIRecoveryCodes) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	store := twoFactorStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	defer lockEnrollment(userFromContext(r.Context()))()
+	e := enrollmentOrError(rw, r, store)
+	if e == nil {
+		return
+	}
+	if !e.Confirmed {
+		writeAPIError(rw, r, 404, apiCodeTwoFactorNotEnabled, "No authenticator set up")
+		return
+	}
+	if !checkAccountCode(rw, r, e, r.FormValue("code"), false) {
+		return
+	}
+	writeRecoveryCodes(rw, r, store, e)
+}
+
+// writeRecoveryCodes creates new recovery codes, stores the enrollment
+// and replies with the codes.
+func writeRecoveryCodes(rw http.ResponseWriter, r *http.Request, store totp.Store, e *totp.Enrollment) {
+	log := logger.LogFromCtx("writeRecoveryCodes", r.Context())
+	codes, err := e.NewRecoveryCodes()
+	if err == nil {
+		err = store.Put(*e, r.Context())
+	}
+	if err != nil {
+		log.Error("Could not store recovery codes: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	writeAPIJSON(rw, r, 200, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+type handlerAPIResetTwoFactor struct{}
+
+// newHandlerAPIResetTwoFactor removes the enrollment of a user who lost
+// the authenticator and the recovery codes, the route must be
+// restricted to admins.
+func newHandlerAPIResetTwoFactor() http.Handler {
+	return &handlerAPIResetTwoFactor{}
+}
+
+func (h *handlerAPIResetTwoFactor) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiResetTwoFactor", r.Context())
+	store := stateFromContext(r.Context()).totp
+	if store == nil {
+		writeAPIError(rw, r, 501, apiCodeNotConfigured, "2FA is not configured")
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if err := store.Remove(name, r.Context()); err != nil {
+		log.Error("Could not remove enrollment: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	log.Infof("2FA of %s reset by %s", name, userFromContext(r.Context()))
+	rw.WriteHeader(204)
+}
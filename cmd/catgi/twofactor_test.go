@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/totp"
+)
+
+func newTwoFactorTestState(t *testing.T) *serverState {
+	return newTestState(t, config.Configuration{
+		TwoFactor: config.TwoFactorConfig{
+			Store:         config.DriverConfig{Name: "buntdb", Params: map[string]interface{}{"file": ":memory:"}},
+			RequiredRoles: []config.Role{config.RoleAdmin},
+		},
+	})
+}
+
+// pendingLogin verifies the first factor of the user and returns the
+// pending cookie, it fails if the login needs no second factor.
+func pendingLogin(t *testing.T, st *serverState, user string, role config.Role) (*http.Cookie, string) {
+	rw := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/auth", nil)
+	done, err := finishLogin(rw, r, user, role, amrPassword, st)
+	if err != nil {
+		t.Fatal("Could not login: ", err)
+	}
+	if done {
+		t.Fatal("Login did not ask for a second factor")
+	}
+	for _, v := range rw.Result().Cookies() {
+		if v.Name == "auth" {
+			t.Fatal("Auth cookie set before the second factor")
+		}
+		if v.Name == pendingCookie {
+			return v, rw.Header().Get(secondFactorHeader)
+		}
+	}
+	t.Fatal("No pending cookie set")
+	return nil, ""
+}
+
+// postCode sends the code for the pending login and returns the
+// response and the auth cookie, if one was set.
+func postCode(pending *http.Cookie, code string) (*httptest.ResponseRecorder, *http.Cookie) {
+	rw := serveRequest(newHandlerServeAuthTwoFactor(), "POST", "/auth/2fa",
+		url.Values{"code": {code}}, pending, "")
+	for _, v := range rw.Result().Cookies() {
+		if v.Name == "auth" {
+			return rw, v
+		}
+	}
+	return rw, nil
+}
+
+// enrollUser stores a confirmed enrollment and returns it's recovery
+// codes.
+func enrollUser(t *testing.T, st *serverState, user string) (*totp.Enrollment, []string) {
+	e, err := totp.NewEnrollment(user)
+	if err != nil {
+		t.Fatal("Could not enroll: ", err)
+	}
+	e.Confirmed = true
+	codes, err := e.NewRecoveryCodes()
+	if err != nil {
+		t.Fatal("Could not create recovery codes: ", err)
+	}
+	if err := st.totp.Put(e, logger.NewLoggingContext()); err != nil {
+		t.Fatal("Could not store enrollment: ", err)
+	}
+	return &e, codes
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	assert := assert.New(t)
+	st := newTwoFactorTestState(t)
+	h := newHandlerCheckToken(false, whoAmI)
+
+	// Users without enrollment of roles without 2FA login directly
+	rw := httptest.NewRecorder()
+	done, err := finishLogin(rw, httptest.NewRequest("POST", "/auth", nil),
+		"alice", config.RoleViewer, amrPassword, st)
+	assert.NoError(err)
+	assert.True(done)
+
+	e, recovery := enrollUser(t, st, "alice")
+	pending, factor := pendingLogin(t, st, "alice", config.RoleViewer)
+	assert.Equal(secondFactorTOTP, factor)
+
+	rw = serveWith(h, "GET", "/", pending)
+	assert.Equal(401, rw.Code, "Pending logins are no logins")
+
+	rw, cookie := postCode(pending, "000000")
+	assert.Equal(401, rw.Code, "Wrong codes must be rejected")
+	assert.Nil(cookie)
+
+	rw, cookie = postCode(&http.Cookie{Name: pendingCookie, Value: "forged"}, recovery[0])
+	assert.Equal(401, rw.Code, "Codes need a pending login")
+
+	code, err := totp.Code(e.Secret, time.Now())
+	assert.NoError(err)
+	rw, cookie = postCode(pending, code)
+	assert.Equal(200, rw.Code)
+	if assert.NotNil(cookie) {
+		rw = serveWith(h, "GET", "/", cookie)
+		assert.Equal("alice:viewer", rw.Body.String())
+	}
+	rw, _ = postCode(pending, code)
+	assert.Equal(401, rw.Code, "Codes must not be used twice")
+
+	rw, cookie = postCode(pending, strings.ToUpper(recovery[0]))
+	assert.Equal(200, rw.Code, "Recovery codes replace the code")
+	assert.NotNil(cookie)
+	rw, _ = postCode(pending, recovery[0])
+	assert.Equal(401, rw.Code, "Recovery codes must not be used twice")
+}
+
+func TestTwoFactorRequired(t *testing.T) {
+	assert := assert.New(t)
+	st := newTwoFactorTestState(t)
+	h := newHandlerCheckToken(false, whoAmI)
+
+	rw := serveWith(h, "GET", "/", loginCookie(t, st, "bob", config.RoleAdmin, amrPassword))
+	assert.Equal(401, rw.Code, "Required roles must login with a second factor")
+
+	pending, factor := pendingLogin(t, st, "bob", config.RoleAdmin)
+	assert.Equal(secondFactorEnroll, factor, "Required roles must enroll on login")
+
+	rw, _ = postCode(pending, "000000")
+	assert.Equal(401, rw.Code, "Codes need an enrollment")
+
+	rw = serveRequest(newHandlerServeAuthEnroll(), "POST", "/auth/2fa/enroll", nil, pending, "")
+	if !assert.Equal(201, rw.Code) {
+		return
+	}
+	var setup apiTwoFactorSetup
+	assert.NoError(json.Unmarshal(rw.Body.Bytes(), &setup))
+	assert.Contains(setup.URI, setup.Secret)
+
+	code, err := totp.Code(setup.Secret, time.Now())
+	assert.NoError(err)
+	rw, cookie := postCode(pending, code)
+	assert.Equal(200, rw.Code)
+	assert.Contains(rw.Body.String(), "recovery codes", "Enrolling on login returns recovery codes")
+	if assert.NotNil(cookie) {
+		rw = serveWith(h, "GET", "/", cookie)
+		assert.Equal("bob:admin", rw.Body.String())
+	}
+
+	e, err := st.totp.Get("bob", logger.NewLoggingContext())
+	assert.NoError(err)
+	assert.True(e.Confirmed)
+	assert.Len(e.RecoveryCodes, totp.RecoveryCodes)
+
+	// Once enrolled the authenticator cannot be replaced on login
+	pending, factor = pendingLogin(t, st, "bob", config.RoleAdmin)
+	assert.Equal(secondFactorTOTP, factor)
+	rw = serveRequest(newHandlerServeAuthEnroll(), "POST", "/auth/2fa/enroll", nil, pending, "")
+	assert.Equal(409, rw.Code)
+}
+
+// slowTOTPStore delays returning enrollments so parallel requests all
+// read before any of them stores the used code
+type slowTOTPStore struct {
+	totp.Store
+}
+
+func (s slowTOTPStore) Get(user string, ctx context.Context) (*totp.Enrollment, error) {
+	e, err := s.Store.Get(user, ctx)
+	time.Sleep(20 * time.Millisecond)
+	return e, err
+}
+
+func TestTwoFactorParallelCodes(t *testing.T) {
+	assert := assert.New(t)
+	st := newTwoFactorTestState(t)
+	st.totp = slowTOTPStore{st.totp}
+	e, recovery := enrollUser(t, st, "alice")
+	code, err := totp.Code(e.Secret, time.Now())
+	assert.NoError(err)
+
+	for _, v := range []string{code, recovery[0]} {
+		var logins []*http.Cookie
+		for i := 0; i < 8; i++ {
+			pending, _ := pendingLogin(t, st, "alice", config.RoleViewer)
+			logins = append(logins, pending)
+		}
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var accepted int
+		for _, pending := range logins {
+			pending := pending
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rw, _ := postCode(pending, v)
+				t.Log(rw.Code, rw.Body.String())
+				if rw.Code == 200 {
+					mu.Lock()
+					accepted++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(1, accepted, "Codes sent in parallel must only be accepted once")
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"path/filepath"
 	"time"
@@ -26,97 +28,150 @@ func newHandlerServePost(b common.Backend) http.Handler {
 func (h *handlerServePost) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	log := logger.LogFromCtx("postFile", r.Context())
 
-	log.Debug("Getting snowflake")
-	flake, err := snowflakes.NewSnowflake()
+	upload, err := readUploadForm(r)
 	if err != nil {
-		log.Error("Could not obtain a snowflake: ", err)
+		log.Warn("Could not read upload: ", err)
 		rw.WriteHeader(500)
 		fmt.Fprintf(rw, "Error: %s", err)
 		return
 	}
-	log.Debug("Request Snowflake is ", flake)
+	defer upload.Close()
+	file := &upload.file
 
-	err = r.ParseMultipartForm(25 * 1024 * 1024)
-	if err != nil {
-		log.Warn("Could not read form")
+	var disableRedirect = false
+	{
+		val := r.Form.Get("disable_redirect")
+		disableRedirect = (val == "on")
+	}
+
+	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+
+	release, err := reserveQuota(h.backend, upload, r.Context())
+	if err == nil {
+		defer release()
+
+		// <- BEGIN BACKEND INTERACTION ->
+		err = common.NewStreamAdapter(h.backend).UploadReader(file.Flake, file, upload.data, r.Context())
+		// -> END BACKEND INTERACTION <-
+	}
+
+	if errors.Is(err, common.ErrorQuotaExceeded) {
+		log.Warn("Upload rejected: ", err)
+		rw.WriteHeader(413)
+		fmt.Fprintf(rw, "Error: %s", err)
+		return
+	} else if err != nil && !common.IsHTTPOption(err) {
+		log.Warn("Could not commit file to database")
 		rw.WriteHeader(500)
 		fmt.Fprintf(rw, "Error: %s", err)
 		return
+	} else if common.IsHTTPOption(err) {
+		httpopt := err.(common.ErrorHTTPOptions)
+		httpopt.PassOverHTTP(rw)
+		if httpopt.WantsTakeover() {
+			httpopt.HTTPTakeover(r, rw, r.Context())
+			return
+		}
+	}
+
+	if token, err := newDeleteToken(file.Flake, r.Context()); err == nil {
+		rw.Header().Set(deleteTokenHeader, token)
+	} else {
+		log.Error("Could not create delete token: ", err)
+	}
+
+	if !disableRedirect {
+		http.Redirect(rw, r, "/f/"+file.Flake+"/"+upload.filename, 302)
+	} else {
+		fmt.Fprint(rw, "/f/"+file.Flake+"/"+upload.filename)
+	}
+}
+
+// uploadForm is a parsed upload request, the file data is streamed
+// from the form file when the upload is stored.
+type uploadForm struct {
+	file     common.File
+	data     multipart.File
+	filename string
+	size     int64
+}
+
+// readUploadForm parses the multipart form of an upload and fills
+// the metadata of the file, including a fresh flake and the owner.
+// Large form files are buffered on disk, not in memory.
+func readUploadForm(r *http.Request) (*uploadForm, error) {
+	log := logger.LogFromCtx("readUploadForm", r.Context())
+
+	log.Debug("Getting snowflake")
+	flake, err := snowflakes.NewSnowflake()
+	if err != nil {
+		log.Error("Could not obtain a snowflake: ", err)
+		return nil, err
+	}
+	log.Debug("Request Snowflake is ", flake)
+
+	err = r.ParseMultipartForm(25 * 1024 * 1024)
+	if err != nil {
+		return nil, err
 	}
 
-	var file common.File
 	httpFile, hdr, err := r.FormFile("data")
 	if err != nil {
-		log.Warn("Could not read form file")
-		rw.WriteHeader(500)
-		fmt.Fprintf(rw, "Error: %s", err)
-		return
+		return nil, err
+	}
+	var upload = &uploadForm{
+		data:     httpFile,
+		filename: hdr.Filename,
+		size:     hdr.Size,
 	}
-	fileData, err := ioutil.ReadAll(httpFile)
+	contentType, err := detectContentType(httpFile)
 	if err != nil {
-		log.Warn("Could not read form file")
-		rw.WriteHeader(500)
-		fmt.Fprintf(rw, "Error: %s", err)
-		return
+		upload.Close()
+		return nil, err
 	}
-	file.Data = fileData
-	log.Debugf("Read %d bytes of a file", len(file.Data))
+	log.Debugf("Received %d bytes of a file", hdr.Size)
 	dAt, err := common.FromString(r.Form.Get("delete_at"))
 	if err != nil {
-		log.Warn("Could not read delete time: ", err)
-		rw.WriteHeader(500)
-		fmt.Fprintf(rw, "Error: %s", err)
-		return
+		upload.Close()
+		return nil, err
 	}
+
+	var file = &upload.file
 	file.DeleteAt = dAt
 	file.CreatedAt = common.FromTime(time.Now().UTC())
 	file.FileExtension = filepath.Ext(hdr.Filename)
-	file.ContentType = http.DetectContentType(file.Data)
+	file.ContentType = contentType
 	file.Flake = flake
+	file.Public = r.Form.Get("public") == "on"
 
-	{
-		ctx := r.Context()
-		usr := ctx.Value("user")
-		if usr != nil {
-			if val, ok := usr.(string); ok {
-				log.Debug("User Context, setting owner")
-				file.User = val
-			}
-		}
+	if usr := userFromContext(r.Context()); len(usr) > 0 {
+		log.Debug("User Context, setting owner")
+		file.User = usr
 	}
 
-	var disableRedirect = false
-	{
-		val := r.Form.Get("disable_redirect")
-		disableRedirect = (val == "on")
+	if r.Form.Get("encrypted") == "on" {
+		log.Debug("Client encrypted upload, dropping sensitive metadata")
+		markEncrypted(upload)
 	}
 
-	// TODO Implement Public Gallery
-	file.Public = false
-
-	r = r.WithContext(utils.PutHTTPIntoContext(r, r.Context()))
+	return upload, nil
+}
 
-	// <- BEGIN BACKEND INTERACTION ->
-	err = h.backend.Upload(flake, &file, r.Context())
-	// -> END BACKEND INTERACTION <-
+// Close closes the form file
+func (u *uploadForm) Close() error {
+	return u.data.Close()
+}
 
-	if err != nil && !common.IsHTTPOption(err) {
-		log.Warn("Could not commit file to database")
-		rw.WriteHeader(500)
-		fmt.Fprintf(rw, "Error: %s", err)
-		return
-	} else if common.IsHTTPOption(err) {
-		httpopt := err.(common.ErrorHTTPOptions)
-		httpopt.PassOverHTTP(rw)
-		if httpopt.WantsTakeover() {
-			httpopt.HTTPTakeover(r, rw, r.Context())
-			return
-		}
+// detectContentType sniffs the content type from the start of
+// the file and rewinds it.
+func detectContentType(f io.ReadSeeker) (string, error) {
+	var buf = make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
 	}
-
-	if !disableRedirect {
-		http.Redirect(rw, r, "/f/"+file.Flake+"/"+hdr.Filename, 302)
-	} else {
-		fmt.Fprint(rw, "/f/"+file.Flake+"/"+hdr.Filename)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
 	}
+	return http.DetectContentType(buf[:n]), nil
 }
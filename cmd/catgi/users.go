@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/sessions"
+	"git.timschuster.info/rls.moe/catgi/users"
+	"git.timschuster.info/rls.moe/catgi/utils"
+)
+
+// minPasswordLength is the shortest password accepted by the API
+const minPasswordLength = 8
+
+// lookupUser returns a user of the config or, if there is none with
+// the name, of the user store.
+func lookupUser(st *serverState, name string, ctx context.Context) (config.UserConfig, bool, error) {
+	if ucfg, ok := st.cfg.User(name); ok {
+		return ucfg, true, nil
+	}
+	if st.users == nil {
+		return config.UserConfig{}, false, nil
+	}
+	ucfg, err := st.users.Get(name, ctx)
+	if err == users.ErrorUserNotExists {
+		return config.UserConfig{}, false, nil
+	} else if err != nil {
+		return config.UserConfig{}, false, err
+	}
+	return *ucfg, true, nil
+}
+
+// rehashPassword replaces the legacy passlib hash of a store user with
+// a dropbox hash of the password that was just verified. Users of the
+// config have to be updated by hand.
+func rehashPassword(st *serverState, ucfg config.UserConfig, pass string, ctx context.Context) {
+	log := logger.LogFromCtx("rehashPassword", ctx)
+	if _, ok := st.cfg.User(ucfg.Username); ok || st.users == nil {
+		log.Infof("User %s has a legacy password hash, regenerate it with makepass", ucfg.Username)
+		return
+	}
+	hash, at, err := utils.HashPassword(pass, st.cfg.Pepper)
+	if err != nil {
+		log.Error("Could not rehash password: ", err)
+		return
+	}
+	ucfg.PassHash = hash
+	ucfg.AuthType = at
+	if err := st.users.Put(ucfg, ctx); err != nil {
+		log.Error("Could not store rehashed password: ", err)
+		return
+	}
+	log.Infof("Rehashed legacy password of %s", ucfg.Username)
+}
+
+// revokeSessions ends all logins of a user except the session except,
+// errors are only logged.
+func revokeSessions(st *serverState, user, except string, r *http.Request) {
+	if st.sessions == nil {
+		return
+	}
+	if _, err := sessions.RevokeUser(st.sessions, user, except, r.Context()); err != nil {
+		logger.LogFromCtx("revokeSessions", r.Context()).Error("Could not revoke sessions: ", err)
+	}
+}
+
+// apiUser is a user as returned by the API, without the password hash
+type apiUser struct {
+	Username string                    `json:"username"`
+	AuthType config.AuthenticationType `json:"authtype"`
+	Role     config.Role               `json:"role"`
+	Quota    config.QuotaConfig        `json:"quota"`
+	Disabled bool                      `json:"disabled"`
+	// Source is "config" for users of the config file, which cannot
+	// be changed with the API, and "store" otherwise.
+	Source string `json:"source"`
+}
+
+func newAPIUser(u config.UserConfig, source string) apiUser {
+	return apiUser{
+		Username: u.Username,
+		AuthType: u.AuthType,
+		Role:     u.GetRole(),
+		Quota:    u.Quota,
+		Disabled: u.Disabled,
+		Source:   source,
+	}
+}
+
+// userStoreOrError returns the user store or writes an error if no
+// user store is configured.
+func userStoreOrError(rw http.ResponseWriter, r *http.Request) users.Store {
+	store := stateFromContext(r.Context()).users
+	if store == nil {
+		writeAPIError(rw, r, 501, apiCodeNotConfigured, "No user store configured")
+		return nil
+	}
+	return store
+}
+
+// readUserForm applies the role, quota and password fields of the
+// form to the user. Fields missing in the form are left unchanged.
+func readUserForm(r *http.Request, cfg config.Configuration, u *config.UserConfig) error {
+	if role := r.FormValue("role"); len(role) > 0 {
+		if !config.Role(role).Valid() {
+			return errors.New("Unknown role " + role)
+		}
+		u.Role = config.Role(role)
+	}
+	for _, v := range []struct {
+		field string
+		dst   *int64
+	}{
+		{"max_file_size", &u.Quota.MaxFileSize},
+		{"max_storage", &u.Quota.MaxStorage},
+	} {
+		if val := r.FormValue(v.field); len(val) > 0 {
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n < 0 {
+				return errors.New("Invalid " + v.field + " " + val)
+			}
+			*v.dst = n
+		}
+	}
+	if val := r.FormValue("max_files"); len(val) > 0 {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 0 {
+			return errors.New("Invalid max_files " + val)
+		}
+		u.Quota.MaxFiles = n
+	}
+	if val, ok := r.Form["max_ttl"]; ok {
+		if len(val[0]) > 0 {
+			if _, err := time.ParseDuration(val[0]); err != nil {
+				return errors.New("Invalid max_ttl " + val[0])
+			}
+		}
+		u.Quota.MaxTTL = val[0]
+	}
+	if u.Quota.MaxStorage > 0 && len(cfg.Index.Name) == 0 {
+		return errors.New("Storage quota requires an index")
+	}
+	if pass := r.FormValue("password"); len(pass) > 0 {
+		if u.AuthType == config.ATOIDC || u.AuthType == config.ATLDAP {
+			return errors.New("Users of auth type " + string(u.AuthType) + " have no password")
+		}
+		if len(pass) < minPasswordLength {
+			return errors.New("Password must have at least " +
+				strconv.Itoa(minPasswordLength) + " characters")
+		}
+		hash, at, err := utils.HashPassword(pass, cfg.Pepper)
+		if err != nil {
+			return err
+		}
+		u.PassHash = hash
+		u.AuthType = at
+	}
+	return nil
+}
+
+type handlerAPIUsers struct{}
+
+// newHandlerAPIUsers lists and adds users, the route must be
+// restricted to admins.
+func newHandlerAPIUsers() http.Handler {
+	return &handlerAPIUsers{}
+}
+
+// ServeHTTP lists the users of the config and the user store on GET
+// and adds a user to the store on POST. The form takes the username,
+// an authtype of "ldap" or "oidc" or else a password, and optionally
+// a role and the quota fields.
+func (h *handlerAPIUsers) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiUsers", r.Context())
+	st := stateFromContext(r.Context())
+
+	if r.Method == "GET" {
+		var list = []apiUser{}
+		for _, v := range st.cfg.Users {
+			list = append(list, newAPIUser(v, "config"))
+		}
+		if st.users != nil {
+			stored, err := st.users.List(r.Context())
+			if err != nil {
+				log.Error("Could not list users: ", err)
+				writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+				return
+			}
+			for _, v := range stored {
+				if _, ok := st.cfg.User(v.Username); ok {
+					continue
+				}
+				list = append(list, newAPIUser(v, "store"))
+			}
+		}
+		writeAPIJSON(rw, r, 200, struct {
+			Users []apiUser `json:"users"`
+		}{list})
+		return
+	}
+
+	store := userStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("username"))
+	if len(name) == 0 || name == "anonymous" || strings.ContainsAny(name, "/*?") {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, "Invalid username")
+		return
+	}
+	if _, ok, err := lookupUser(st, name, r.Context()); err != nil {
+		log.Error("Could not lookup user: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	} else if ok {
+		writeAPIError(rw, r, 409, apiCodeUserExists, "User already exists")
+		return
+	}
+
+	var user = config.UserConfig{Username: name}
+	switch at := config.AuthenticationType(r.FormValue("authtype")); at {
+	case config.ATOIDC:
+		if !st.cfg.OIDC.Enabled() {
+			writeAPIError(rw, r, 400, apiCodeBadRequest, "OIDC is not configured")
+			return
+		}
+		user.AuthType = at
+	case config.ATLDAP:
+		if !st.cfg.LDAP.Enabled() {
+			writeAPIError(rw, r, 400, apiCodeBadRequest, "LDAP is not configured")
+			return
+		}
+		user.AuthType = at
+	case config.ATPasslib, config.ATDropbox:
+		if len(r.FormValue("password")) == 0 {
+			writeAPIError(rw, r, 400, apiCodeBadRequest, "Password is required")
+			return
+		}
+	default:
+		writeAPIError(rw, r, 400, apiCodeBadRequest, "Unknown authtype "+string(at))
+		return
+	}
+	if err := readUserForm(r, st.cfg, &user); err != nil {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+
+	if err := store.Put(user, r.Context()); err != nil {
+		log.Error("Could not add user: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	log.Infof("User %s added by %s", name, userFromContext(r.Context()))
+	writeAPIJSON(rw, r, 201, newAPIUser(user, "store"))
+}
+
+type handlerAPIUser struct{}
+
+// newHandlerAPIUser changes and deletes users of the user store, the
+// route must be restricted to admins.
+func newHandlerAPIUser() http.Handler {
+	return &handlerAPIUser{}
+}
+
+// ServeHTTP updates a user on PATCH, the form takes disabled, a new
+// password and the fields accepted when adding a user. DELETE removes
+// the user, it's API tokens and 2FA enrollment. Admins cannot disable
+// or delete themselves.
+func (h *handlerAPIUser) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiUser", r.Context())
+	store := userStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	st := stateFromContext(r.Context())
+	name := mux.Vars(r)["name"]
+	admin := userFromContext(r.Context())
+
+	if _, ok := st.cfg.User(name); ok {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "User is managed in the config file")
+		return
+	}
+	user, err := store.Get(name, r.Context())
+	if err == users.ErrorUserNotExists {
+		writeAPIError(rw, r, 404, apiCodeUserNotFound, "User does not exist")
+		return
+	} else if err != nil {
+		log.Error("Could not get user: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+
+	if r.Method == "DELETE" {
+		if name == admin {
+			writeAPIError(rw, r, 403, apiCodeForbidden, "Cannot delete yourself")
+			return
+		}
+		if err := store.Remove(name, r.Context()); err != nil {
+			log.Error("Could not remove user: ", err)
+			writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+			return
+		}
+		// A new user of the same name must not inherit the tokens
+		if st.tokens != nil {
+			list, err := st.tokens.ListUser(r.Context(), name)
+			if err != nil {
+				log.Error("Could not list tokens of removed user: ", err)
+			}
+			for _, v := range list {
+				if err := st.tokens.Remove(v.ID, r.Context()); err != nil {
+					log.Error("Could not remove token of removed user: ", err)
+				}
+			}
+		}
+		// Nor the authenticator of the removed user
+		if st.totp != nil {
+			if err := st.totp.Remove(name, r.Context()); err != nil {
+				log.Error("Could not remove enrollment of removed user: ", err)
+			}
+		}
+		revokeSessions(st, name, "", r)
+		log.Infof("User %s deleted by %s", name, admin)
+		rw.WriteHeader(204)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	if val := r.FormValue("disabled"); len(val) > 0 {
+		disabled, err := strconv.ParseBool(val)
+		if err != nil {
+			writeAPIError(rw, r, 400, apiCodeBadRequest, "Invalid disabled "+val)
+			return
+		}
+		if disabled && name == admin {
+			writeAPIError(rw, r, 403, apiCodeForbidden, "Cannot disable yourself")
+			return
+		}
+		user.Disabled = disabled
+	}
+	if err := readUserForm(r, st.cfg, user); err != nil {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	if err := store.Put(*user, r.Context()); err != nil {
+		log.Error("Could not update user: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	if len(r.FormValue("password")) > 0 {
+		revokeSessions(st, name, "", r)
+	}
+	log.Infof("User %s updated by %s", name, admin)
+	writeAPIJSON(rw, r, 200, newAPIUser(*user, "store"))
+}
+
+type handlerAPIChangePassword struct{}
+
+// newHandlerAPIChangePassword lets users of the user store change
+// their own password.
+func newHandlerAPIChangePassword() http.Handler {
+	return &handlerAPIChangePassword{}
+}
+
+// ServeHTTP takes the current password as password and the new one as
+// new_password. Failed attempts count towards the login lockout.
+func (h *handlerAPIChangePassword) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	log := logger.LogFromCtx("apiChangePassword", r.Context())
+	name := userFromContext(r.Context())
+	if len(name) == 0 || name == "anonymous" {
+		writeAPIError(rw, r, 401, apiCodeUnauthorized, "Login required")
+		return
+	}
+	if apiTokenFromContext(r.Context()) != nil {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "API tokens cannot change passwords")
+		return
+	}
+	store := userStoreOrError(rw, r)
+	if store == nil {
+		return
+	}
+	st := stateFromContext(r.Context())
+	if _, ok := st.cfg.User(name); ok {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "Password is managed in the config file")
+		return
+	}
+	user, err := store.Get(name, r.Context())
+	if err == users.ErrorUserNotExists {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "Password is not managed by catgi")
+		return
+	} else if err != nil {
+		log.Error("Could not get user: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	if user.AuthType == config.ATOIDC || user.AuthType == config.ATLDAP {
+		writeAPIError(rw, r, 403, apiCodeForbidden, "Password is managed by "+string(user.AuthType))
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, err.Error())
+		return
+	}
+	lockKey := "user:" + name
+	if locked, wait := st.limits.lockout.Locked(lockKey); locked {
+		writeTooManyRequests(rw, r, wait)
+		return
+	}
+	if err := utils.VerifyUserPassword(*user, r.FormValue("password"), st.cfg.Pepper); err != nil {
+		log.Warn("Wrong password on password change of ", name)
+		st.limits.lockout.Fail(lockKey)
+		writeAPIError(rw, r, 403, apiCodeForbidden, "Wrong password")
+		return
+	}
+	st.limits.lockout.Reset(lockKey)
+
+	newPass := r.FormValue("new_password")
+	if len(newPass) < minPasswordLength {
+		writeAPIError(rw, r, 400, apiCodeBadRequest, "Password must have at least "+
+			strconv.Itoa(minPasswordLength)+" characters")
+		return
+	}
+	user.PassHash, user.AuthType, err = utils.HashPassword(newPass, st.cfg.Pepper)
+	if err == nil {
+		err = store.Put(*user, r.Context())
+	}
+	if err != nil {
+		log.Error("Could not change password: ", err)
+		writeAPIError(rw, r, 500, apiCodeInternal, "Internal server error")
+		return
+	}
+	revokeSessions(st, name, sessionFromContext(r.Context()), r)
+	log.Info("Password changed by ", name)
+	rw.WriteHeader(204)
+}
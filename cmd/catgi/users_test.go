@@ -0,0 +1,274 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/totp"
+)
+
+// newUserRouter routes the user API, the token API and logins like
+// newRouter does
+func newUserRouter() http.Handler {
+	router := mux.NewRouter()
+	router.Handle("/auth", newHandlerServeAuth()).Methods("POST")
+	router.Handle("/api/v1/admin/users",
+		newHandlerCheckRole(config.RoleAdmin, newHandlerAPIUsers()),
+	).Methods("GET", "POST")
+	router.Handle("/api/v1/admin/users/{name}",
+		newHandlerCheckRole(config.RoleAdmin, newHandlerAPIUser()),
+	).Methods("PATCH", "DELETE")
+	router.Handle("/api/v1/account/password",
+		newHandlerCheckToken(false, newHandlerAPIChangePassword()),
+	).Methods("POST")
+	router.Handle("/api/v1/tokens",
+		newHandlerCheckToken(false, newHandlerAPITokens()),
+	).Methods("GET", "POST")
+	router.Handle("/", newHandlerCheckToken(false, whoAmI))
+	return router
+}
+
+func newUserTestState(t *testing.T) *serverState {
+	return newTestState(t, config.Configuration{
+		UserStore: config.DriverConfig{
+			Name:   "buntdb",
+			Params: map[string]interface{}{"file": ":memory:"},
+		},
+		Tokens: config.DriverConfig{
+			Name:   "buntdb",
+			Params: map[string]interface{}{"file": ":memory:"},
+		},
+	})
+}
+
+// addUser adds a user to the store through the admin API
+func addUser(t *testing.T, h http.Handler, admin *http.Cookie, name, pass string, role config.Role) {
+	rw := serveRequest(h, "POST", "/api/v1/admin/users", url.Values{
+		"username": {name},
+		"password": {pass},
+		"role":     {string(role)},
+	}, admin, "")
+	if rw.Code != 201 {
+		t.Fatalf("Could not add user %s: %d %s", name, rw.Code, rw.Body)
+	}
+}
+
+// login posts the login form and returns the status code
+func login(h http.Handler, user, pass string) int {
+	return serveRequest(h, "POST", "/auth", url.Values{"user": {user}, "pass": {pass}}, nil, "").Code
+}
+
+func TestAdminUsers(t *testing.T) {
+	assert := assert.New(t)
+	st := newUserTestState(t)
+	h := newUserRouter()
+	alice := loginCookie(t, st, "alice", config.RoleViewer)
+	bob := loginCookie(t, st, "bob", config.RoleAdmin)
+
+	var tests = []struct {
+		name   string
+		method string
+		target string
+		form   url.Values
+		cookie *http.Cookie
+		code   int
+	}{
+		{"viewer add", "POST", "/api/v1/admin/users",
+			url.Values{"username": {"erin"}, "password": {"erin password"}},
+			alice, 403},
+		{"add", "POST", "/api/v1/admin/users",
+			url.Values{"username": {"erin"}, "password": {"erin password"}},
+			bob, 201},
+		{"add existing", "POST", "/api/v1/admin/users",
+			url.Values{"username": {"erin"}, "password": {"erin password"}},
+			bob, 409},
+		{"add config user", "POST", "/api/v1/admin/users",
+			url.Values{"username": {"alice"}, "password": {"alice password"}},
+			bob, 409},
+		{"add anonymous", "POST", "/api/v1/admin/users",
+			url.Values{"username": {"anonymous"}, "password": {"anon password"}},
+			bob, 400},
+		{"add short password", "POST", "/api/v1/admin/users",
+			url.Values{"username": {"frank"}, "password": {"short"}},
+			bob, 400},
+		{"add ldap unconfigured", "POST", "/api/v1/admin/users",
+			url.Values{"username": {"frank"}, "authtype": {"ldap"}},
+			bob, 400},
+		{"update role", "PATCH", "/api/v1/admin/users/erin",
+			url.Values{"role": {"uploader"}, "max_files": {"10"}}, bob, 200},
+		{"update invalid role", "PATCH", "/api/v1/admin/users/erin",
+			url.Values{"role": {"root"}}, bob, 400},
+		{"update config user", "PATCH", "/api/v1/admin/users/alice",
+			url.Values{"role": {"admin"}}, bob, 403},
+		{"update missing", "PATCH", "/api/v1/admin/users/nobody",
+			url.Values{"role": {"admin"}}, bob, 404},
+		{"delete config user", "DELETE", "/api/v1/admin/users/alice", nil, bob, 403},
+		{"delete missing", "DELETE", "/api/v1/admin/users/nobody", nil, bob, 404},
+	}
+	for _, v := range tests {
+		rw := serveRequest(h, v.method, v.target, v.form, v.cookie, "")
+		assert.Equal(v.code, rw.Code, "%s: %s", v.name, rw.Body)
+	}
+
+	erin, err := st.users.Get("erin", logger.NewLoggingContext())
+	if assert.NoError(err) {
+		assert.Equal(config.RoleUploader, erin.Role)
+		assert.Equal(10, erin.Quota.MaxFiles)
+	}
+	assert.Equal(200, login(h, "erin", "erin password"))
+
+	rw := serveRequest(h, "PATCH", "/api/v1/admin/users/erin",
+		url.Values{"disabled": {"true"}}, bob, "")
+	assert.Equal(200, rw.Code)
+	assert.Equal(401, login(h, "erin", "erin password"), "Disabled users must not login")
+
+	rw = serveRequest(h, "PATCH", "/api/v1/admin/users/erin",
+		url.Values{"password": {"new erin password"}, "disabled": {"false"}}, bob, "")
+	assert.Equal(200, rw.Code)
+	assert.Equal(401, login(h, "erin", "erin password"))
+	assert.Equal(200, login(h, "erin", "new erin password"))
+
+	rw = serveRequest(h, "DELETE", "/api/v1/admin/users/erin", nil, bob, "")
+	assert.Equal(204, rw.Code)
+	assert.Equal(401, login(h, "erin", "new erin password"), "Deleted users must not login")
+}
+
+func TestAdminUsersSelf(t *testing.T) {
+	assert := assert.New(t)
+	st := newUserTestState(t)
+	h := newUserRouter()
+	addUser(t, h, loginCookie(t, st, "bob", config.RoleAdmin), "grace", "grace password", config.RoleAdmin)
+	grace := loginCookie(t, st, "grace", config.RoleAdmin)
+
+	rw := serveRequest(h, "DELETE", "/api/v1/admin/users/grace", nil, grace, "")
+	assert.Equal(403, rw.Code, "Admins must not delete themselves")
+	assert.Contains(rw.Body.String(), "yourself")
+
+	rw = serveRequest(h, "PATCH", "/api/v1/admin/users/grace",
+		url.Values{"disabled": {"true"}}, grace, "")
+	assert.Equal(403, rw.Code, "Admins must not disable themselves")
+	assert.Contains(rw.Body.String(), "yourself")
+
+	_, err := st.users.Get("grace", logger.NewLoggingContext())
+	assert.NoError(err)
+}
+
+func TestDeleteUserTokens(t *testing.T) {
+	assert := assert.New(t)
+	st := newUserTestState(t)
+	h := newUserRouter()
+	bob := loginCookie(t, st, "bob", config.RoleAdmin)
+	addUser(t, h, bob, "henry", "henry password", config.RoleUploader)
+
+	token := createToken(t, h, loginCookie(t, st, "henry", config.RoleUploader), "read")
+	rw := serveRequest(h, "GET", "/", nil, nil, token.Token)
+	assert.Equal("henry:uploader", rw.Body.String())
+
+	rw = serveRequest(h, "DELETE", "/api/v1/admin/users/henry", nil, bob, "")
+	assert.Equal(204, rw.Code)
+
+	list, err := st.tokens.ListUser(logger.NewLoggingContext(), "henry")
+	assert.NoError(err)
+	assert.Empty(list, "Tokens of deleted users must be removed")
+	rw = serveRequest(h, "GET", "/", nil, nil, token.Token)
+	assert.Equal(401, rw.Code)
+
+	// A new user of the same name does not inherit the tokens
+	addUser(t, h, bob, "henry", "other password", config.RoleUploader)
+	rw = serveRequest(h, "GET", "/", nil, nil, token.Token)
+	assert.Equal(401, rw.Code)
+}
+
+func TestChangePassword(t *testing.T) {
+	assert := assert.New(t)
+	st := newUserTestState(t)
+	h := newUserRouter()
+	addUser(t, h, loginCookie(t, st, "bob", config.RoleAdmin), "ivy", "ivy password", config.RoleUploader)
+	ivy := loginCookie(t, st, "ivy", config.RoleUploader)
+	token := createToken(t, h, ivy, "read", "upload")
+
+	var tests = []struct {
+		name   string
+		form   url.Values
+		cookie *http.Cookie
+		bearer string
+		code   int
+	}{
+		{"anonymous", url.Values{"password": {"ivy password"}, "new_password": {"new ivy password"}},
+			nil, "", 401},
+		{"api token", url.Values{"password": {"ivy password"}, "new_password": {"new ivy password"}},
+			nil, token.Token, 403},
+		{"config user", url.Values{"password": {"alice"}, "new_password": {"new alice password"}},
+			loginCookie(t, st, "alice", config.RoleViewer), "", 403},
+		{"wrong password", url.Values{"password": {"wrong"}, "new_password": {"new ivy password"}},
+			ivy, "", 403},
+		{"short password", url.Values{"password": {"ivy password"}, "new_password": {"short"}},
+			ivy, "", 400},
+		{"change", url.Values{"password": {"ivy password"}, "new_password": {"new ivy password"}},
+			ivy, "", 204},
+	}
+	for _, v := range tests {
+		rw := serveRequest(h, "POST", "/api/v1/account/password", v.form, v.cookie, v.bearer)
+		assert.Equal(v.code, rw.Code, "%s: %s", v.name, rw.Body)
+	}
+
+	assert.Equal(401, login(h, "ivy", "ivy password"))
+	assert.Equal(200, login(h, "ivy", "new ivy password"))
+}
+
+func TestRehashLegacyPassword(t *testing.T) {
+	assert := assert.New(t)
+	ctx := logger.NewLoggingContext()
+	prev := newUserTestState(t)
+	h := newUserRouter()
+	addUser(t, h, loginCookie(t, prev, "bob", config.RoleAdmin), "judy", "judy password", config.RoleUploader)
+
+	judy, err := prev.users.Get("judy", ctx)
+	if assert.NoError(err) {
+		assert.Equal(config.ATPasslib, judy.AuthType)
+	}
+
+	st := reloadTestState(t, prev, func(cfg *config.Configuration) {
+		cfg.Pepper = "0123456789abcdef0123456789abcdef"
+	})
+	assert.Equal(401, login(h, "judy", "wrong password"))
+	judy, err = st.users.Get("judy", ctx)
+	if assert.NoError(err) {
+		assert.Equal(config.ATPasslib, judy.AuthType, "Failed logins must not rehash")
+	}
+
+	assert.Equal(200, login(h, "judy", "judy password"))
+	judy, err = st.users.Get("judy", ctx)
+	if assert.NoError(err) {
+		assert.Equal(config.ATDropbox, judy.AuthType, "Legacy hashes must be replaced on login")
+	}
+	assert.Equal(200, login(h, "judy", "judy password"), "The new hash must verify")
+}
+
+func TestDeleteUserTwoFactor(t *testing.T) {
+	assert := assert.New(t)
+	st := newTestState(t, config.Configuration{
+		UserStore: config.DriverConfig{
+			Name:   "buntdb",
+			Params: map[string]interface{}{"file": ":memory:"},
+		},
+		TwoFactor: config.TwoFactorConfig{
+			Store: config.DriverConfig{Name: "buntdb", Params: map[string]interface{}{"file": ":memory:"}},
+		},
+	})
+	h := newUserRouter()
+	bob := loginCookie(t, st, "bob", config.RoleAdmin)
+	addUser(t, h, bob, "kim", "kim password", config.RoleUploader)
+	enrollUser(t, st, "kim")
+
+	rw := serveRequest(h, "DELETE", "/api/v1/admin/users/kim", nil, bob, "")
+	assert.Equal(204, rw.Code)
+	_, err := st.totp.Get("kim", logger.NewLoggingContext())
+	assert.Equal(totp.ErrorNotEnrolled, err, "A new user of the same name must not inherit the authenticator")
+}
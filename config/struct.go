@@ -1,21 +1,327 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
 )
 
 type Configuration struct {
-	Backend    DriverConfig `json:"backend"`
-	Index      DriverConfig `json:"index"`
-	HMACKey    string       `json:"jwtkey"`
-	Pepper     string       `json:"password_pepper"`
-	Users      []UserConfig `json:"users"`
-	IgnoreAuth bool         `json:"ignore_login"`
-	HTTPConf   HTTPConfig   `json:"http"`
-	LogLevel   string       `json:"loglevel"`
-	Piwik      PiwikConfig  `json:"piwik"`
+	Backend DriverConfig `json:"backend"`
+	Index   DriverConfig `json:"index"`
+	// Tokens is the store of API tokens, without one API tokens
+	// are disabled.
+	Tokens  DriverConfig `json:"tokens"`
+	HMACKey string       `json:"jwtkey"`
+	// PreviousHMACKey still verifies logins until
+	// PreviousHMACKeyUntil, an RFC 3339 time, so the jwtkey can be
+	// rotated without logging everyone out.
+	PreviousHMACKey      string `json:"previous_jwtkey"`
+	PreviousHMACKeyUntil string `json:"previous_jwtkey_until"`
+	// DeleteTokenKey derives the delete tokens of uploads. Unlike the
+	// jwtkey it is never rotated, tokens handed out stay valid as long
+	// as the file. Empty falls back to the jwtkey and is only allowed
+	// without previous_jwtkey.
+	DeleteTokenKey string       `json:"delete_token_key"`
+	Pepper         string       `json:"password_pepper"`
+	Users          []UserConfig `json:"users"`
+	// UserStore keeps users managed with the admin API next to the
+	// users of the config, without one only the config is used.
+	UserStore  DriverConfig    `json:"user_store"`
+	IgnoreAuth bool            `json:"ignore_login"`
+	HTTPConf   HTTPConfig      `json:"http"`
+	LogLevel   string          `json:"loglevel"`
+	Piwik      PiwikConfig     `json:"piwik"`
+	RateLimit  RateLimitConfig `json:"ratelimit"`
+	// MetricsToken protects /metrics if set
+	MetricsToken string     `json:"metrics_token"`
+	GC           GCConfig   `json:"gc"`
+	OIDC         OIDCConfig `json:"oidc"`
+	LDAP         LDAPConfig `json:"ldap"`
+	// ClaimedRoleTTL limits logins of users that are not configured
+	// and got their role from OIDC or LDAP groups, they have to login
+	// again so the role is looked up again. Default "24h".
+	ClaimedRoleTTL string `json:"claimed_role_ttl"`
+	// Sessions tracks logins so they can be listed and revoked
+	Sessions SessionConfig `json:"sessions"`
+	// TwoFactor enables TOTP as second step of logins
+	TwoFactor TwoFactorConfig `json:"twofactor"`
+}
+
+// TwoFactorConfig enables TOTP codes as second factor of logins
+type TwoFactorConfig struct {
+	// Store keeps the enrollments of users, without one 2FA is
+	// disabled.
+	Store DriverConfig `json:"store"`
+	// Issuer is the name shown in authenticator apps, default "catgi"
+	Issuer string `json:"issuer"`
+	// RequiredRoles must login with a second factor, users of these
+	// roles without one have to enroll on their next login.
+	RequiredRoles []Role `json:"required_roles"`
+}
+
+// Enabled returns true if a store is configured
+func (t TwoFactorConfig) Enabled() bool {
+	return len(t.Store.Name) > 0
+}
+
+// IssuerName returns the issuer or the default
+func (t TwoFactorConfig) IssuerName() string {
+	if len(t.Issuer) == 0 {
+		return "catgi"
+	}
+	return t.Issuer
+}
+
+// Required returns true if users of the role must use a second factor
+func (t TwoFactorConfig) Required(role Role) bool {
+	for _, v := range t.RequiredRoles {
+		if v == role {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionConfig configures the registry of logins
+type SessionConfig struct {
+	// Store keeps the sessions, without one logins cannot be revoked
+	// and are valid until they expire.
+	Store DriverConfig `json:"store"`
+	// IdleTimeout ends sessions that were not used for the duration,
+	// ie "168h". Empty only ends sessions when the login expires.
+	IdleTimeout string `json:"idle_timeout"`
+}
+
+// Enabled returns true if a session store is configured
+func (s SessionConfig) Enabled() bool {
+	return len(s.Store.Name) > 0
+}
+
+// IdleDuration returns the idle timeout, 0 if disabled
+func (s SessionConfig) IdleDuration() time.Duration { return parseDuration(s.IdleTimeout) }
+
+// DefaultClaimedRoleTTL is used if no claimed_role_ttl is configured
+const DefaultClaimedRoleTTL = 24 * time.Hour
+
+// ClaimedRoleDuration returns the parsed ClaimedRoleTTL or the default
+func (c Configuration) ClaimedRoleDuration() time.Duration {
+	d, err := time.ParseDuration(c.ClaimedRoleTTL)
+	if err != nil || d <= 0 {
+		return DefaultClaimedRoleTTL
+	}
+	return d
+}
+
+// DeleteTokenSecret returns the secret the delete tokens are derived
+// from, the delete_token_key or else the jwtkey.
+func (c Configuration) DeleteTokenSecret() string {
+	if len(c.DeleteTokenKey) > 0 {
+		return c.DeleteTokenKey
+	}
+	return c.HMACKey
+}
+
+// PreviousKeyValid returns true if the previous jwtkey may still be
+// used to verify at the given time.
+func (c Configuration) PreviousKeyValid(now time.Time) bool {
+	if len(c.PreviousHMACKey) == 0 {
+		return false
+	}
+	until, err := time.Parse(time.RFC3339, c.PreviousHMACKeyUntil)
+	return err == nil && now.Before(until)
+}
+
+// OIDCConfig enables login with an OpenID Connect provider
+type OIDCConfig struct {
+	// Issuer URL of the provider, the endpoints are discovered from
+	// it. Empty disables OIDC.
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL is the public URL of /login/oidc/callback
+	RedirectURL string `json:"redirect_url"`
+	// JWKSURL overrides the discovered key set of the provider
+	JWKSURL string `json:"jwks_url"`
+	// Scopes requested besides "openid", default "email" and "profile"
+	Scopes []string `json:"scopes"`
+	// UsernameClaim is the claim used as username, default "email"
+	UsernameClaim string `json:"username_claim"`
+	// GroupsClaim is the claim listing the groups, default "groups"
+	GroupsClaim string `json:"groups_claim"`
+	// Roles maps groups to roles, users get the highest role of their
+	// groups.
+	Roles map[string]Role `json:"roles"`
+	// DefaultRole is the role of users without a mapped group, empty
+	// denies them the login. Users in the config have their role.
+	DefaultRole Role `json:"default_role"`
+}
+
+// Enabled returns true if an issuer is configured
+func (o OIDCConfig) Enabled() bool {
+	return len(o.Issuer) > 0
+}
+
+// LDAPConfig enables login with a password checked by a bind against
+// an LDAP server. Users do not have to be listed in the config.
+type LDAPConfig struct {
+	// URL of the server, ie "ldaps://ldap.example.com". Empty
+	// disables LDAP.
+	URL string `json:"url"`
+	// StartTLS upgrades ldap:// connections before binding
+	StartTLS bool `json:"start_tls"`
+	// AllowInsecure permits ldap:// without StartTLS, passwords are
+	// then sent in plain text.
+	AllowInsecure bool `json:"allow_insecure"`
+	// CAFile is a PEM file of CAs trusted for the server certificate,
+	// empty uses the system CAs.
+	CAFile string `json:"ca_file"`
+	// UserDN is the DN users bind as, "%s" is replaced by the escaped
+	// username, ie "uid=%s,ou=people,dc=example,dc=com". If empty,
+	// the user is searched with BindDN and UserFilter first.
+	UserDN string `json:"user_dn"`
+	// BindDN and BindPassword are used to search users, empty binds
+	// anonymously.
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+	// BaseDN is searched for users
+	BaseDN string `json:"base_dn"`
+	// UserFilter finds the user, "%s" is replaced by the escaped
+	// username, default "(uid=%s)".
+	UserFilter string `json:"user_filter"`
+	// GroupFilter must match the entry of the user to allow the
+	// login, ie "(memberOf=cn=catgi,ou=groups,dc=example,dc=com)".
+	GroupFilter string `json:"group_filter"`
+	// GroupAttribute lists the groups of a user, default "memberOf"
+	GroupAttribute string `json:"group_attribute"`
+	// Roles maps group DNs to roles, users get the highest role of
+	// their groups.
+	Roles map[string]Role `json:"roles"`
+	// DefaultRole is the role of users without a mapped group,
+	// default DefaultRole. Users in the config have their role.
+	DefaultRole Role `json:"default_role"`
+	// CacheTime is how long a successful bind is remembered, default
+	// "5m". "0s" disables the cache.
+	CacheTime string `json:"cache_time"`
+	// Timeout of connecting and every request, default "10s"
+	Timeout string `json:"timeout"`
+}
+
+// Enabled returns true if a server is configured
+func (l LDAPConfig) Enabled() bool {
+	return len(l.URL) > 0
+}
+
+// CacheDuration returns how long binds are cached, 0 if disabled
+func (l LDAPConfig) CacheDuration() time.Duration {
+	if len(l.CacheTime) == 0 {
+		return 5 * time.Minute
+	}
+	return parseDuration(l.CacheTime)
+}
+
+// TimeoutDuration returns the timeout of requests to the server
+func (l LDAPConfig) TimeoutDuration() time.Duration {
+	if d := parseDuration(l.Timeout); d > 0 {
+		return d
+	}
+	return 10 * time.Second
+}
+
+// GCConfig schedules GC runs in the background
+type GCConfig struct {
+	// Interval between runs, ie "6h". Empty disables the scheduler.
+	Interval string `json:"interval"`
+	// Jitter is a random delay up to the given duration added to
+	// every interval.
+	Jitter string `json:"jitter"`
+	// MaxRuntime aborts runs taking longer, empty is unlimited
+	MaxRuntime string `json:"max_runtime"`
+	// Window restricts scheduled runs to a time of day in local time,
+	// ie "02:00-05:00". It may wrap over midnight.
+	Window string `json:"window"`
+}
+
+// parseDuration returns 0 for an empty or invalid duration
+func parseDuration(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// IntervalDuration returns the interval, 0 if disabled
+func (g GCConfig) IntervalDuration() time.Duration { return parseDuration(g.Interval) }
+
+// JitterDuration returns the jitter, 0 if none
+func (g GCConfig) JitterDuration() time.Duration { return parseDuration(g.Jitter) }
+
+// MaxRuntimeDuration returns the runtime limit, 0 if unlimited
+func (g GCConfig) MaxRuntimeDuration() time.Duration { return parseDuration(g.MaxRuntime) }
+
+// WindowTimes returns start and end of the window as offset from
+// midnight, ok is false if no window is configured.
+func (g GCConfig) WindowTimes() (start, end time.Duration, ok bool, err error) {
+	if len(g.Window) == 0 {
+		return 0, 0, false, nil
+	}
+	parts := strings.Split(g.Window, "-")
+	if len(parts) != 2 {
+		return 0, 0, false, errors.New("GC window must be like 02:00-05:00")
+	}
+	var times [2]time.Duration
+	for i, v := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(v))
+		if err != nil {
+			return 0, 0, false, err
+		}
+		times[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if times[0] == times[1] {
+		return 0, 0, false, errors.New("GC window must not be empty")
+	}
+	return times[0], times[1], true, nil
+}
+
+// RateLimitConfig configures the request budgets of clients. Logged in
+// users are limited by name, everyone else by IP.
+type RateLimitConfig struct {
+	Auth     RateConfig `json:"auth"`
+	Upload   RateConfig `json:"upload"`
+	Download RateConfig `json:"download"`
+	// LockoutAttempts is the number of failed logins after which
+	// a user is locked, 0 disables it.
+	LockoutAttempts int `json:"lockout_attempts"`
+	// LockoutTime is how long a user is locked, default "15m"
+	LockoutTime string `json:"lockout_time"`
+	// TrustProxy uses the last X-Forwarded-For entry as client IP and
+	// X-Forwarded-Proto as scheme of URLs, only enable it behind a
+	// single proxy that appends to them.
+	TrustProxy bool `json:"trust_proxy"`
+}
+
+// RateConfig is a token bucket, PerMinute 0 means unlimited
+type RateConfig struct {
+	PerMinute float64 `json:"per_minute"`
+	Burst     int     `json:"burst"`
+}
+
+// DefaultLockoutTime is used if no lockout time is configured
+const DefaultLockoutTime = 15 * time.Minute
+
+// LockoutDuration returns the parsed lockout time or the default
+func (r RateLimitConfig) LockoutDuration() time.Duration {
+	d, err := time.ParseDuration(r.LockoutTime)
+	if err != nil || d <= 0 {
+		return DefaultLockoutTime
+	}
+	return d
 }
 
 type PiwikConfig struct {
@@ -28,6 +334,62 @@ type PiwikConfig struct {
 type HTTPConfig struct {
 	Port     uint16 `json:"port"`
 	ListenOn string `json:"listen"`
+	// ShutdownTimeout is how long running requests may take to finish
+	// on shutdown, ie "30s". Defaults to DefaultShutdownTimeout.
+	ShutdownTimeout string `json:"shutdown_timeout"`
+	// TLS enables HTTPS on the listener if a certificate is set
+	TLS TLSConfig `json:"tls"`
+}
+
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files, they are reloaded when
+	// they change on disk.
+	CertFile string `json:"cert"`
+	KeyFile  string `json:"key"`
+	// MinVersion is one of "1.0", "1.1", "1.2" or "1.3", default "1.2"
+	MinVersion string `json:"min_version"`
+	// ClientCA is a PEM file, if set clients must present a
+	// certificate signed by it.
+	ClientCA string `json:"client_ca"`
+	// RedirectPort opens a plain HTTP listener on the same address
+	// that redirects to HTTPS. 0 disables it.
+	RedirectPort uint16 `json:"redirect_port"`
+}
+
+// Enabled returns true if TLS is configured
+func (t TLSConfig) Enabled() bool {
+	return len(t.CertFile) > 0
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Version returns the minimum TLS version
+func (t TLSConfig) Version() (uint16, error) {
+	if len(t.MinVersion) == 0 {
+		return tls.VersionTLS12, nil
+	}
+	v, ok := tlsVersions[t.MinVersion]
+	if !ok {
+		return 0, errors.New("Unknown TLS version " + t.MinVersion)
+	}
+	return v, nil
+}
+
+// DefaultShutdownTimeout is used if no shutdown timeout is configured
+const DefaultShutdownTimeout = 30 * time.Second
+
+// ShutdownDeadline returns the parsed shutdown timeout or the default
+func (h HTTPConfig) ShutdownDeadline() time.Duration {
+	d, err := time.ParseDuration(h.ShutdownTimeout)
+	if err != nil || d <= 0 {
+		return DefaultShutdownTimeout
+	}
+	return d
 }
 
 type DriverConfig struct {
@@ -40,12 +402,112 @@ type AuthenticationType string
 const (
 	ATPasslib AuthenticationType = ""
 	ATDropbox AuthenticationType = "dropbox"
+	// ATOIDC users login with the OIDC provider only
+	ATOIDC AuthenticationType = "oidc"
+	// ATLDAP users login with their LDAP password
+	ATLDAP AuthenticationType = "ldap"
 )
 
 type UserConfig struct {
 	Username string             `json:"username"`
 	PassHash string             `json:"password"`
 	AuthType AuthenticationType `json:"authtype"`
+	Quota    QuotaConfig        `json:"quota"`
+	// Role of the user, defaults to DefaultRole
+	Role Role `json:"role"`
+	// Disabled users cannot login and their logins and tokens stop
+	// working.
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// Role of a user, every role has the permissions of the roles
+// before it.
+type Role string
+
+const (
+	// RoleViewer may view and list files
+	RoleViewer Role = "viewer"
+	// RoleUploader may upload files
+	RoleUploader Role = "uploader"
+	// RoleAdmin may run the GC, list and delete all files and view
+	// the usage of all users
+	RoleAdmin Role = "admin"
+)
+
+// DefaultRole is the role of users without one and of anonymous users
+const DefaultRole = RoleUploader
+
+var roleLevels = map[Role]int{
+	RoleViewer:   1,
+	RoleUploader: 2,
+	RoleAdmin:    3,
+}
+
+// Valid returns true if the role is known
+func (r Role) Valid() bool {
+	_, ok := roleLevels[r]
+	return ok
+}
+
+// Includes returns true if the role has the permissions of other,
+// unknown roles have no permissions.
+func (r Role) Includes(other Role) bool {
+	return r.Valid() && roleLevels[r] >= roleLevels[other]
+}
+
+// Min returns the role with less permissions
+func (r Role) Min(other Role) Role {
+	if r.Includes(other) {
+		return other
+	}
+	return r
+}
+
+// GetRole returns the role of the user or the default
+func (u UserConfig) GetRole() Role {
+	if len(u.Role) == 0 {
+		return DefaultRole
+	}
+	return u.Role
+}
+
+// QuotaConfig limits the uploads of a user, zero values are unlimited.
+type QuotaConfig struct {
+	// MaxFileSize is the size limit of a single file in bytes
+	MaxFileSize int64 `json:"max_file_size"`
+	// MaxStorage is the limit of the total size of all live files
+	// in bytes, it requires an index.
+	MaxStorage int64 `json:"max_storage"`
+	// MaxFiles is the limit of live files
+	MaxFiles int `json:"max_files"`
+	// MaxTTL is the longest lifetime of a file, ie "72h"
+	MaxTTL string `json:"max_ttl"`
+}
+
+// TTL returns the parsed MaxTTL, 0 if it is unlimited
+func (q QuotaConfig) TTL() time.Duration {
+	d, err := time.ParseDuration(q.MaxTTL)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// AuthEnabled returns true if users are configured, kept in a user
+// store or login with OIDC or LDAP and logins are not ignored.
+func (c Configuration) AuthEnabled() bool {
+	return !c.IgnoreAuth && (len(c.Users) > 0 || len(c.UserStore.Name) > 0 ||
+		c.LDAP.Enabled() || c.OIDC.Enabled())
+}
+
+// User returns the config of a user and whether the user exists
+func (c Configuration) User(name string) (UserConfig, bool) {
+	for _, v := range c.Users {
+		if v.Username == name {
+			return v, true
+		}
+	}
+	return UserConfig{}, false
 }
 
 func LoadConfig(path string) (Configuration, error) {
@@ -60,5 +522,128 @@ func LoadConfig(path string) (Configuration, error) {
 	if len(c.Pepper) > 0 && len(c.Pepper) != 32 {
 		return c, errors.New("Pepper must be 32 characters")
 	}
+	if len(c.LogLevel) == 0 {
+		c.LogLevel = "info"
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return c, err
+	}
+	if len(c.HTTPConf.ShutdownTimeout) > 0 {
+		if _, err := time.ParseDuration(c.HTTPConf.ShutdownTimeout); err != nil {
+			return c, err
+		}
+	}
+	if c.HTTPConf.TLS.Enabled() {
+		if len(c.HTTPConf.TLS.KeyFile) == 0 {
+			return c, errors.New("TLS certificate configured without key")
+		}
+		if _, err := c.HTTPConf.TLS.Version(); err != nil {
+			return c, err
+		}
+	} else if c.HTTPConf.TLS != (TLSConfig{}) {
+		return c, errors.New("TLS options configured without certificate")
+	}
+	for _, v := range []string{c.GC.Interval, c.GC.Jitter, c.GC.MaxRuntime} {
+		if len(v) > 0 {
+			if _, err := time.ParseDuration(v); err != nil {
+				return c, err
+			}
+		}
+	}
+	if _, _, _, err := c.GC.WindowTimes(); err != nil {
+		return c, err
+	}
+	if len(c.RateLimit.LockoutTime) > 0 {
+		if _, err := time.ParseDuration(c.RateLimit.LockoutTime); err != nil {
+			return c, err
+		}
+	}
+	for _, v := range c.Users {
+		if !v.GetRole().Valid() {
+			return c, errors.New("Unknown role " + string(v.Role) + " of " + v.Username)
+		}
+		if len(v.Quota.MaxTTL) > 0 {
+			if _, err := time.ParseDuration(v.Quota.MaxTTL); err != nil {
+				return c, err
+			}
+		}
+		if v.Quota.MaxStorage > 0 && len(c.Index.Name) == 0 {
+			return c, errors.New("Storage quota of " + v.Username + " requires an index")
+		}
+		if v.AuthType == ATOIDC && !c.OIDC.Enabled() {
+			return c, errors.New("User " + v.Username + " requires OIDC to be configured")
+		}
+		if v.AuthType == ATLDAP && !c.LDAP.Enabled() {
+			return c, errors.New("User " + v.Username + " requires LDAP to be configured")
+		}
+	}
+	if c.OIDC.Enabled() {
+		if len(c.OIDC.ClientID) == 0 || len(c.OIDC.RedirectURL) == 0 {
+			return c, errors.New("OIDC requires client_id and redirect_url")
+		}
+		for group, role := range c.OIDC.Roles {
+			if !role.Valid() {
+				return c, errors.New("Unknown role " + string(role) + " of group " + group)
+			}
+		}
+		if len(c.OIDC.DefaultRole) > 0 && !c.OIDC.DefaultRole.Valid() {
+			return c, errors.New("Unknown OIDC default role " + string(c.OIDC.DefaultRole))
+		}
+	}
+	if c.LDAP.Enabled() {
+		if len(c.LDAP.UserDN) == 0 && len(c.LDAP.BaseDN) == 0 {
+			return c, errors.New("LDAP requires user_dn or base_dn")
+		}
+		if len(c.LDAP.UserDN) > 0 && strings.Count(c.LDAP.UserDN, "%s") != 1 {
+			return c, errors.New("LDAP user_dn must contain %s once")
+		}
+		if len(c.LDAP.UserFilter) > 0 && strings.Count(c.LDAP.UserFilter, "%s") != 1 {
+			return c, errors.New("LDAP user_filter must contain %s once")
+		}
+		for group, role := range c.LDAP.Roles {
+			if !role.Valid() {
+				return c, errors.New("Unknown role " + string(role) + " of group " + group)
+			}
+		}
+		if len(c.LDAP.DefaultRole) > 0 && !c.LDAP.DefaultRole.Valid() {
+			return c, errors.New("Unknown LDAP default role " + string(c.LDAP.DefaultRole))
+		}
+		for _, v := range []string{c.LDAP.CacheTime, c.LDAP.Timeout} {
+			if len(v) > 0 {
+				if _, err := time.ParseDuration(v); err != nil {
+					return c, err
+				}
+			}
+		}
+	}
+	if len(c.Sessions.IdleTimeout) > 0 {
+		if _, err := time.ParseDuration(c.Sessions.IdleTimeout); err != nil {
+			return c, err
+		}
+	}
+	if len(c.PreviousHMACKey) > 0 {
+		if c.PreviousHMACKey == c.HMACKey {
+			return c, errors.New("previous_jwtkey must differ from jwtkey")
+		}
+		if _, err := time.Parse(time.RFC3339, c.PreviousHMACKeyUntil); err != nil {
+			return c, errors.New("previous_jwtkey requires previous_jwtkey_until as RFC 3339 time")
+		}
+		// Delete tokens derived from the previous jwtkey would become
+		// invalid with the rotation
+		if len(c.DeleteTokenKey) == 0 {
+			return c, errors.New("previous_jwtkey requires delete_token_key, set it to the previous jwtkey to keep delete tokens")
+		}
+	}
+	for _, role := range c.TwoFactor.RequiredRoles {
+		if !role.Valid() {
+			return c, errors.New("Unknown role " + string(role) + " requiring 2FA")
+		}
+		if !c.TwoFactor.Enabled() {
+			return c, errors.New("Requiring 2FA needs a twofactor store")
+		}
+	}
+	if len(c.Backend.Name) == 0 {
+		return c, errors.New("No backend driver configured")
+	}
 	return c, nil
 }
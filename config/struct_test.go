@@ -0,0 +1,42 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func loadTestConfig(t *testing.T, dat string) (Configuration, error) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(dat), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+func TestPreviousKeyRequiresDeleteKey(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := loadTestConfig(t, `{
+		"backend": {"driver": "buntdb"},
+		"jwtkey": "new key",
+		"previous_jwtkey": "old key",
+		"previous_jwtkey_until": "2026-12-01T00:00:00Z"
+	}`)
+	if assert.Error(err, "Rotating the jwtkey must not invalidate delete tokens") {
+		assert.Contains(err.Error(), "delete_token_key")
+	}
+
+	c, err := loadTestConfig(t, `{
+		"backend": {"driver": "buntdb"},
+		"jwtkey": "new key",
+		"previous_jwtkey": "old key",
+		"previous_jwtkey_until": "2026-12-01T00:00:00Z",
+		"delete_token_key": "old key"
+	}`)
+	if assert.NoError(err) {
+		assert.Equal("old key", c.DeleteTokenSecret())
+	}
+}
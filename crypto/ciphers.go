@@ -17,6 +17,9 @@ const (
 
 	// Encrypt and Decrypt using Chacha20 with Poly1305
 	CipherPolyCha20 = iota
+	// Encrypt and Decrypt using AES-256 in GCM mode, only used for
+	// client side encryption since browsers lack Chacha20
+	CipherAESGCM
 )
 
 type CryptMode string
@@ -0,0 +1,143 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ClientKeySize is the size of the random key used for client
+// side encryption.
+const ClientKeySize = 32
+
+var (
+	clientMetaAD = []byte("catgi-meta")
+	clientDataAD = []byte("catgi-data")
+)
+
+// ErrNotClientEncrypted is returned if the data was not produced by
+// EncryptClientFile or a compatible client.
+var ErrNotClientEncrypted = errors.New("Data is not client side encrypted")
+
+// ClientMeta is the sensitive metadata of a client side encrypted
+// file, it is encrypted along with the file data.
+type ClientMeta struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// NewClientKey returns a random key for EncryptClientFile
+func NewClientKey() ([]byte, error) {
+	return getNonce(ClientKeySize)
+}
+
+// EncryptClientFile encrypts a file the way the browser does so
+// the server only ever sees ciphertext.
+//
+// The output consists of two framed EncryptedBlocks using
+// CipherAESGCM with the raw key, the first contains the JSON encoded
+// metadata, the second the file data. Blocks are bound to their
+// position by the additional data of the AEAD.
+//
+// Unlike the other functions in this package the key is used as is,
+// it should come from NewClientKey and must not be reused for
+// other purposes.
+func EncryptClientFile(key []byte, meta ClientMeta, data []byte) ([]byte, error) {
+	aead, err := newClientAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	metaBlock, err := sealClientBlock(aead, metaData, clientMetaAD)
+	if err != nil {
+		return nil, err
+	}
+	dataBlock, err := sealClientBlock(aead, data, clientDataAD)
+	if err != nil {
+		return nil, err
+	}
+	return append(metaBlock, dataBlock...), nil
+}
+
+// DecryptClientFile reverses EncryptClientFile
+func DecryptClientFile(key []byte, data []byte) (*ClientMeta, []byte, error) {
+	aead, err := newClientAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	metaData, rest, err := openClientBlock(aead, data, clientMetaAD)
+	if err != nil {
+		return nil, nil, err
+	}
+	fileData, rest, err := openClientBlock(aead, rest, clientDataAD)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) != 0 {
+		return nil, nil, fmt.Errorf("%d bytes of trailing data", len(rest))
+	}
+	var meta = &ClientMeta{}
+	if err := json.Unmarshal(metaData, meta); err != nil {
+		return nil, nil, err
+	}
+	return meta, fileData, nil
+}
+
+func newClientAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != ClientKeySize {
+		return nil, fmt.Errorf("Key was %d bytes but %d bytes are required", len(key), ClientKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealClientBlock(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return frameBlock(&EncryptedBlock{
+		Cipher: CipherAESGCM,
+		Nonce:  nonce,
+		Salt:   []byte{},
+		Data:   aead.Seal([]byte{}, nonce, data, ad),
+	})
+}
+
+// openClientBlock decrypts the first framed block of data and returns
+// the plaintext and the remaining data.
+func openClientBlock(aead cipher.AEAD, data, ad []byte) ([]byte, []byte, error) {
+	if len(data) < BlockHeaderSize {
+		return nil, nil, ErrNotClientEncrypted
+	}
+	size := binary.LittleEndian.Uint64(data[0:BlockHeaderSize])
+	if size > uint64(len(data)-BlockHeaderSize) {
+		return nil, nil, ErrNotClientEncrypted
+	}
+	end := BlockHeaderSize + int(size)
+	block, err := unframeBlock(data[:end])
+	if err != nil {
+		return nil, nil, err
+	}
+	if block.Cipher != CipherAESGCM || block.Padding != 0 {
+		return nil, nil, ErrNotClientEncrypted
+	}
+	if len(block.Nonce) != aead.NonceSize() {
+		return nil, nil, fmt.Errorf("Nonce was %d bytes but AEAD expected %d bytes", len(block.Nonce), aead.NonceSize())
+	}
+	plaintext, err := aead.Open([]byte{}, block.Nonce, block.Data, ad)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plaintext, data[end:], nil
+}
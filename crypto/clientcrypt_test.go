@@ -0,0 +1,65 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientFile(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := NewClientKey()
+	assert.NoError(err)
+	assert.Len(key, ClientKeySize)
+
+	meta := ClientMeta{Name: "cat.png", Type: "image/png"}
+	plaintext := []byte("THIS IS A PLAINTEXT!")
+
+	ciphertext, err := EncryptClientFile(key, meta, plaintext)
+	assert.NoError(err)
+	assert.NotContains(string(ciphertext), "cat.png")
+
+	recMeta, recovered, err := DecryptClientFile(key, ciphertext)
+	assert.NoError(err)
+	assert.EqualValues(meta, *recMeta)
+	assert.EqualValues(plaintext, recovered)
+
+	otherKey, err := NewClientKey()
+	assert.NoError(err)
+	_, _, err = DecryptClientFile(otherKey, ciphertext)
+	assert.Error(err, "Wrong key must not decrypt")
+
+	_, _, err = DecryptClientFile(key, ciphertext[:len(ciphertext)-1])
+	assert.Error(err, "Truncated data must not decrypt")
+}
+
+func TestClientFileSwappedBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := NewClientKey()
+	assert.NoError(err)
+
+	ciphertext, err := EncryptClientFile(key, ClientMeta{Name: "a"}, []byte("{}"))
+	assert.NoError(err)
+
+	split := BlockHeaderSize + int(binary.LittleEndian.Uint64(ciphertext))
+	swapped := append(append([]byte{}, ciphertext[split:]...), ciphertext[:split]...)
+
+	_, _, err = DecryptClientFile(key, swapped)
+	assert.Error(err, "Blocks must be bound to their position")
+}
+
+func TestClientFileRejectsServerCiphertext(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := NewClientKey()
+	assert.NoError(err)
+
+	ciphertext, err := EncryptBytes(NewSecretKey(key), []byte("data"))
+	assert.NoError(err)
+
+	_, _, err = DecryptClientFile(key, ciphertext)
+	assert.Equal(ErrNotClientEncrypted, err)
+}
@@ -95,28 +95,10 @@ func (c *DecryptWorker) decipherBlock() error {
 // decipherData will read and decipher the given cipherBlock
 // Padding options are applied automatically.
 func (c *DecryptWorker) decipherData(data []byte) ([]byte, error) {
-	if len(data) < BlockHeaderSize {
-		return nil, errors.New("Insufficient data for decryption")
-	}
-	cipherBlockSize := binary.LittleEndian.Uint64(data[0:BlockHeaderSize])
-
-	if uint64(len(data)-BlockHeaderSize) != cipherBlockSize {
-		return nil, fmt.Errorf(
-			"Incomplete Ciphertext: Have %d, Want %d Bytes",
-			uint64(len(data)-BlockHeaderSize),
-			cipherBlockSize)
-	}
-
-	if cipherBlockSize == 0 {
-		return []byte{}, ErrEmptyBlock
-	}
-
-	// Cut out the header
-	data = data[BlockHeaderSize:]
-
-	var cipherBlock = &EncryptedBlock{}
-	err := msgpack.Unmarshal(data, cipherBlock)
-	if err != nil {
+	cipherBlock, err := unframeBlock(data)
+	if err == ErrEmptyBlock {
+		return []byte{}, err
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -141,3 +123,30 @@ func (c *DecryptWorker) decipherData(data []byte) ([]byte, error) {
 
 	return data, err
 }
+
+// unframeBlock checks the block header of a single framed block
+// and decodes the block.
+func unframeBlock(data []byte) (*EncryptedBlock, error) {
+	if len(data) < BlockHeaderSize {
+		return nil, errors.New("Insufficient data for decryption")
+	}
+	cipherBlockSize := binary.LittleEndian.Uint64(data[0:BlockHeaderSize])
+
+	if uint64(len(data)-BlockHeaderSize) != cipherBlockSize {
+		return nil, fmt.Errorf(
+			"Incomplete Ciphertext: Have %d, Want %d Bytes",
+			uint64(len(data)-BlockHeaderSize),
+			cipherBlockSize)
+	}
+
+	if cipherBlockSize == 0 {
+		return nil, ErrEmptyBlock
+	}
+
+	var cipherBlock = &EncryptedBlock{}
+	err := msgpack.Unmarshal(data[BlockHeaderSize:], cipherBlock)
+	if err != nil {
+		return nil, err
+	}
+	return cipherBlock, nil
+}
@@ -129,17 +129,19 @@ func (c *EncryptWorker) cipherData(data []byte, padding uint16) ([]byte, error)
 
 	block.Data = c.AEAD.Seal(block.Data, block.Nonce, data, nil)
 
+	return frameBlock(block)
+}
+
+// frameBlock encodes the block and prefixes it with the block header
+func frameBlock(block *EncryptedBlock) ([]byte, error) {
 	cipherBlock, err := msgpack.Marshal(block)
 	if err != nil {
 		return nil, err
 	}
 
-	{
-		output := make([]byte, len(cipherBlock)+BlockHeaderSize)
-		binary.LittleEndian.PutUint64(output[0:BlockHeaderSize], uint64(len(cipherBlock)))
-		copy(output[BlockHeaderSize:], cipherBlock)
-		cipherBlock = output
-	}
+	output := make([]byte, len(cipherBlock)+BlockHeaderSize)
+	binary.LittleEndian.PutUint64(output[0:BlockHeaderSize], uint64(len(cipherBlock)))
+	copy(output[BlockHeaderSize:], cipherBlock)
 
-	return cipherBlock, nil
+	return output, nil
 }
@@ -0,0 +1,131 @@
+package keyfile
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+
+	"git.timschuster.info/rls.moe/catgi/crypto"
+)
+
+// ErrDCDCorrupt is returned if decryptor challenge data cannot be
+// opened with the given key.
+var ErrDCDCorrupt = errors.New("Decryptor challenge data corrupt or not for this key")
+
+// Secret is what a recipient needs to decrypt a file, it is sealed
+// into the decryptor challenge data of each recipient.
+type Secret struct {
+	Key     []byte `msgpack:"key"`     // Key is the random key of the file cipher
+	Nonce   []byte `msgpack:"nonce"`   // Nonce is the random starting nonce
+	HMACKey []byte `msgpack:"hmackey"` // HMACKey authenticates the decrypted data
+}
+
+// NewSecret generates a random secret for a new file
+func NewSecret() (*Secret, error) {
+	var s = &Secret{
+		Key:     make([]byte, 32),
+		Nonce:   make([]byte, 12),
+		HMACKey: make([]byte, 32),
+	}
+	for _, v := range [][]byte{s.Key, s.Nonce, s.HMACKey} {
+		if _, err := rand.Read(v); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// dcd is the encoded decryptor challenge data. Every DCD uses a fresh
+// ephemeral keypair so DCDs of the same recipient cannot be linked.
+type dcd struct {
+	Ephemeral []byte `msgpack:"epk"`
+	Nonce     []byte `msgpack:"nonce"`
+	Data      []byte `msgpack:"data"`
+}
+
+// SealDCD encrypts the secret for the recipient
+func SealDCD(recipient [32]byte, secret *Secret) (string, error) {
+	eph, err := NewBoxKey()
+	if err != nil {
+		return "", err
+	}
+	key, err := dcdKey(eph.Private, recipient, eph.Public)
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return "", err
+	}
+	plain, err := msgpack.Marshal(secret)
+	if err != nil {
+		return "", err
+	}
+	var d = &dcd{
+		Ephemeral: eph.Public[:],
+		Nonce:     make([]byte, aead.NonceSize()),
+	}
+	if _, err := rand.Read(d.Nonce); err != nil {
+		return "", err
+	}
+	d.Data = aead.Seal([]byte{}, d.Nonce, plain, recipient[:])
+	dat, err := msgpack.Marshal(d)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(dat), nil
+}
+
+// OpenDCD decrypts the secret with the private key of the recipient
+func OpenDCD(data string, recipient *BoxKey) (*Secret, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return nil, ErrDCDCorrupt
+	}
+	var d = &dcd{}
+	if err := msgpack.Unmarshal(raw, d); err != nil || len(d.Ephemeral) != 32 {
+		return nil, ErrDCDCorrupt
+	}
+	var eph [32]byte
+	copy(eph[:], d.Ephemeral)
+	key, err := dcdKey(recipient.Private, eph, eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.Nonce) != aead.NonceSize() {
+		return nil, ErrDCDCorrupt
+	}
+	plain, err := aead.Open([]byte{}, d.Nonce, d.Data, recipient.Public[:])
+	if err != nil {
+		return nil, ErrDCDCorrupt
+	}
+	var s = &Secret{}
+	if err := msgpack.Unmarshal(plain, s); err != nil {
+		return nil, ErrDCDCorrupt
+	}
+	return s, nil
+}
+
+// dcdKey combines the private key with the public key of the other
+// side and derives the DCD cipher key, bound to the ephemeral key.
+func dcdKey(priv, pub, ephemeral [32]byte) ([]byte, error) {
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, &priv, &pub)
+	var zero [32]byte
+	if shared == zero {
+		return nil, ErrDCDCorrupt
+	}
+	key, err := crypto.NewSecretKey(shared[:]).DeriveKey("catgi", "keyfile", "dcd", EncodeKey(ephemeral[:]))
+	if err != nil {
+		return nil, err
+	}
+	return key.GetNSecretBytes(chacha20poly1305.KeySize, nil)
+}
@@ -0,0 +1,8 @@
+// Package keyfile implements the key file of the catgi encryption
+// paper.
+//
+// Recipients have X25519 keypairs, the secret of a file is sealed
+// for each of them as decryptor challenge data. Key files are signed
+// with an Ed25519 primary keypair and optionally a primary keypair
+// master, the server only accepts updates signed by either.
+package keyfile
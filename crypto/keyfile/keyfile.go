@@ -0,0 +1,153 @@
+package keyfile
+
+import (
+	"encoding/json"
+	"errors"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+var (
+	// ErrInvalidSignature is returned if a signature of the key file
+	// does not verify.
+	ErrInvalidSignature = errors.New("Key file signature invalid")
+	// ErrNotRecipient is returned if the key file has no DCD for a key
+	ErrNotRecipient = errors.New("Key is not a recipient of the key file")
+	// ErrUpdateNotAllowed is returned if a key file update is not signed
+	// by the original primary key or primary keypair master.
+	ErrUpdateNotAllowed = errors.New("Key file update not signed by the original key or master")
+	// ErrStaleUpdate is returned if a key file update does not have a
+	// higher version than the stored key file, ie a replayed old file.
+	ErrStaleUpdate = errors.New("Key file update does not increase the version")
+	// ErrWrongFlake is returned if a key file is stored for another
+	// flake than it was signed for.
+	ErrWrongFlake = errors.New("Key file is signed for another file")
+)
+
+// KeyFile lists the decryptor challenge data of all recipients of
+// a file, see papers/catgi_encryption.md.
+//
+// The primary key signs the key file, if a primary keypair master
+// is used it signs the primary key so updates may come from any
+// primary key of the same master. The flake is signed so a key file
+// cannot be copied to another file of the same primary key.
+type KeyFile struct {
+	FLK string            `json:"flk"`           // FLK is the flake the key file belongs to
+	PFP string            `json:"pfp"`           // PFP is the primary public key
+	PKM string            `json:"pkm,omitempty"` // PKM is the primary keypair master public key
+	KMS string            `json:"kms,omitempty"` // KMS is the signature of the master over PFP
+	DCD map[string]string `json:"dcd"`           // DCD maps recipient public keys to their DCD
+	NKF string            `json:"nkf,omitempty"` // NKF links to a newer key file
+	Ver uint64            `json:"ver"`           // Ver increases with every update
+	Sig string            `json:"sig"`           // Sig is the signature of the primary key
+}
+
+// New returns an empty key file for the flake
+func New(flake string) *KeyFile {
+	return &KeyFile{FLK: flake, DCD: map[string]string{}}
+}
+
+// AddRecipient seals the secret for the recipient, the key file must
+// be signed again afterwards.
+func (kf *KeyFile) AddRecipient(recipient [32]byte, secret *Secret) error {
+	dat, err := SealDCD(recipient, secret)
+	if err != nil {
+		return err
+	}
+	if kf.DCD == nil {
+		kf.DCD = map[string]string{}
+	}
+	kf.DCD[EncodeKey(recipient[:])] = dat
+	return nil
+}
+
+// Open returns the secret of the recipient
+func (kf *KeyFile) Open(recipient *BoxKey) (*Secret, error) {
+	dat, ok := kf.DCD[EncodeKey(recipient.Public[:])]
+	if !ok {
+		return nil, ErrNotRecipient
+	}
+	return OpenDCD(dat, recipient)
+}
+
+// Sign signs the key file with the primary key. If master is not nil
+// it signs the primary key.
+func (kf *KeyFile) Sign(primary, master *SigningKey) error {
+	kf.PFP = EncodeKey(primary.Public)
+	kf.PKM, kf.KMS = "", ""
+	if master != nil {
+		kf.PKM = EncodeKey(master.Public)
+		kf.KMS = EncodeKey(ed25519.Sign(master.Private, primary.Public))
+	}
+	dat, err := kf.signedData()
+	if err != nil {
+		return err
+	}
+	kf.Sig = EncodeKey(ed25519.Sign(primary.Private, dat))
+	return nil
+}
+
+// Verify checks the signature of the primary key and, if present,
+// the signature of the master.
+func (kf *KeyFile) Verify() error {
+	pfp, err := DecodeKey(kf.PFP, ed25519.PublicKeySize)
+	if err != nil {
+		return err
+	}
+	if len(kf.PKM) > 0 || len(kf.KMS) > 0 {
+		pkm, err := DecodeKey(kf.PKM, ed25519.PublicKeySize)
+		if err != nil {
+			return err
+		}
+		kms, err := DecodeKey(kf.KMS, ed25519.SignatureSize)
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		if !ed25519.Verify(pkm, pfp, kms) {
+			return ErrInvalidSignature
+		}
+	}
+	sig, err := DecodeKey(kf.Sig, ed25519.SignatureSize)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	dat, err := kf.signedData()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pfp, dat, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// AllowsUpdate returns nil if next is a valid replacement of the key
+// file, it must be signed for the same flake by the same primary key
+// or by a primary key of the same master and have a higher version.
+// The version is signed, so older key files cannot be replayed.
+func (kf *KeyFile) AllowsUpdate(next *KeyFile) error {
+	if err := next.Verify(); err != nil {
+		return err
+	}
+	if next.FLK != kf.FLK {
+		return ErrWrongFlake
+	}
+	if next.Ver <= kf.Ver {
+		return ErrStaleUpdate
+	}
+	if next.PFP == kf.PFP {
+		return nil
+	}
+	if len(kf.PKM) > 0 && next.PKM == kf.PKM {
+		return nil
+	}
+	return ErrUpdateNotAllowed
+}
+
+// signedData is the data covered by Sig, the JSON encoding of all
+// other fields. Map keys are sorted by encoding/json.
+func (kf *KeyFile) signedData() ([]byte, error) {
+	var c = *kf
+	c.Sig = ""
+	return json.Marshal(&c)
+}
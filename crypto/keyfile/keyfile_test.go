@@ -0,0 +1,133 @@
+package keyfile
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDCD(t *testing.T) {
+	assert := assert.New(t)
+
+	alice, err := NewBoxKey()
+	assert.NoError(err)
+	bob, err := NewBoxKey()
+	assert.NoError(err)
+	secret, err := NewSecret()
+	assert.NoError(err)
+
+	dcd, err := SealDCD(alice.Public, secret)
+	assert.NoError(err)
+
+	opened, err := OpenDCD(dcd, alice)
+	assert.NoError(err)
+	assert.EqualValues(secret, opened)
+
+	_, err = OpenDCD(dcd, bob)
+	assert.Equal(ErrDCDCorrupt, err)
+
+	restored := BoxKeyFromPrivate(alice.Private)
+	assert.Equal(alice.Public, restored.Public)
+}
+
+func TestKeyFile(t *testing.T) {
+	assert := assert.New(t)
+
+	primary, err := NewSigningKey()
+	assert.NoError(err)
+	alice, err := NewBoxKey()
+	assert.NoError(err)
+	bob, err := NewBoxKey()
+	assert.NoError(err)
+	eve, err := NewBoxKey()
+	assert.NoError(err)
+	secret, err := NewSecret()
+	assert.NoError(err)
+
+	kf := New("0123456789")
+	assert.NoError(kf.AddRecipient(alice.Public, secret))
+	assert.NoError(kf.AddRecipient(bob.Public, secret))
+	assert.NoError(kf.Sign(primary, nil))
+	assert.NoError(kf.Verify())
+
+	// Round trip through JSON like the server does
+	dat, err := json.Marshal(kf)
+	assert.NoError(err)
+	var loaded = &KeyFile{}
+	assert.NoError(json.Unmarshal(dat, loaded))
+	assert.NoError(loaded.Verify())
+
+	for _, r := range []*BoxKey{alice, bob} {
+		s, err := loaded.Open(r)
+		assert.NoError(err)
+		assert.EqualValues(secret, s)
+	}
+	_, err = loaded.Open(eve)
+	assert.Equal(ErrNotRecipient, err)
+
+	// Adding a recipient without signing again breaks the signature
+	assert.NoError(loaded.AddRecipient(eve.Public, secret))
+	assert.Equal(ErrInvalidSignature, loaded.Verify())
+}
+
+func TestKeyFileUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	primary, err := NewSigningKey()
+	assert.NoError(err)
+	other, err := NewSigningKey()
+	assert.NoError(err)
+	master, err := NewSigningKey()
+	assert.NoError(err)
+
+	orig := New("0123456789")
+	assert.NoError(orig.Sign(primary, nil))
+
+	same := New("0123456789")
+	same.NKF = "/api/v1/files/next/keyfile"
+	same.Ver = 1
+	assert.NoError(same.Sign(primary, nil))
+	assert.NoError(orig.AllowsUpdate(same))
+
+	// Replaying an older key file must fail
+	assert.Equal(ErrStaleUpdate, same.AllowsUpdate(orig))
+	assert.Equal(ErrStaleUpdate, same.AllowsUpdate(same))
+
+	bumped := *same
+	bumped.Ver = 2
+	assert.Equal(ErrInvalidSignature, same.AllowsUpdate(&bumped),
+		"The version must be covered by the signature")
+
+	moved := New("9876543210")
+	moved.Ver = 1
+	assert.NoError(moved.Sign(primary, nil))
+	assert.Equal(ErrWrongFlake, orig.AllowsUpdate(moved),
+		"A key file of another flake must not replace this one")
+
+	relabeled := *same
+	relabeled.FLK = "9876543210"
+	assert.Equal(ErrInvalidSignature, relabeled.Verify(),
+		"The flake must be covered by the signature")
+
+	foreign := New("0123456789")
+	foreign.Ver = 1
+	assert.NoError(foreign.Sign(other, nil))
+	assert.Equal(ErrUpdateNotAllowed, orig.AllowsUpdate(foreign))
+
+	// With a master any primary key signed by it may update
+	mastered := New("0123456789")
+	assert.NoError(mastered.Sign(primary, master))
+	assert.NoError(mastered.Verify())
+
+	rotated := New("0123456789")
+	rotated.Ver = 1
+	assert.NoError(rotated.Sign(other, master))
+	assert.NoError(mastered.AllowsUpdate(rotated))
+
+	forged := New("0123456789")
+	forged.Ver = 1
+	assert.NoError(forged.Sign(other, master))
+	forged.KMS = mastered.KMS
+	assert.Equal(ErrInvalidSignature, mastered.AllowsUpdate(forged))
+}
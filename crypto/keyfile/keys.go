@@ -0,0 +1,89 @@
+package keyfile
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+// ErrInvalidKey is returned if an encoded key has the wrong size
+var ErrInvalidKey = errors.New("Invalid key")
+
+// SigningKey is an Ed25519 keypair used as primary keypair or
+// primary keypair master of a key file.
+type SigningKey struct {
+	Public  ed25519.PublicKey
+	Private ed25519.PrivateKey
+}
+
+// NewSigningKey generates a random signing keypair
+func NewSigningKey() (*SigningKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &SigningKey{Public: pub, Private: priv}, nil
+}
+
+// SigningKeyFromSeed restores a signing keypair from the 32 byte seed
+func SigningKeyFromSeed(seed []byte) (*SigningKey, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidKey
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &SigningKey{Public: priv.Public().(ed25519.PublicKey), Private: priv}, nil
+}
+
+// BoxKey is a X25519 keypair of a recipient, the public key is
+// used to create decryptor challenge data the private key opens.
+type BoxKey struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+// NewBoxKey generates a random recipient keypair
+func NewBoxKey() (*BoxKey, error) {
+	var priv [32]byte
+	if _, err := rand.Read(priv[:]); err != nil {
+		return nil, err
+	}
+	return BoxKeyFromPrivate(priv), nil
+}
+
+// BoxKeyFromPrivate restores a recipient keypair from the private key
+func BoxKeyFromPrivate(priv [32]byte) *BoxKey {
+	var key = &BoxKey{Private: priv}
+	curve25519.ScalarBaseMult(&key.Public, &key.Private)
+	return key
+}
+
+// EncodeKey encodes a key for use in a key file
+func EncodeKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeKey decodes a key of a key file and checks the size
+func DecodeKey(key string, size int) ([]byte, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(dat) != size {
+		return nil, ErrInvalidKey
+	}
+	return dat, nil
+}
+
+// DecodeBoxPublic decodes the public key of a recipient
+func DecodeBoxPublic(key string) ([32]byte, error) {
+	var pub [32]byte
+	dat, err := DecodeKey(key, 32)
+	if err != nil {
+		return pub, err
+	}
+	copy(pub[:], dat)
+	return pub, nil
+}
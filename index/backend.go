@@ -0,0 +1,238 @@
+package index
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+)
+
+const packageName = "index"
+
+// IndexedBackend records every upload and delete of the wrapped
+// backend in an index. Listings and GC are answered from the index
+// and never scan the storage backend.
+type IndexedBackend struct {
+	underlyingBackend common.Backend
+	index             Index
+}
+
+// NewIndexedBackend wraps the backend with the index
+func NewIndexedBackend(b common.Backend, idx Index) *IndexedBackend {
+	return &IndexedBackend{
+		underlyingBackend: b,
+		index:             idx,
+	}
+}
+
+// FromBackend returns the index of an IndexedBackend or nil if the
+// backend has no index.
+func FromBackend(b common.Backend) Index {
+	if ib, ok := b.(*IndexedBackend); ok {
+		return ib.index
+	}
+	return nil
+}
+
+// Index returns the index used by the backend
+func (i *IndexedBackend) Index() Index { return i.index }
+
+// Name returns the name of the wrapped backend
+func (i *IndexedBackend) Name() string { return i.underlyingBackend.Name() }
+
+// Upload stores the file and records it in the index. If the index
+// cannot be updated the file is still stored, Rebuild will pick it up.
+func (i *IndexedBackend) Upload(flake string, file *common.File, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".Upload", ctx)
+	err := i.underlyingBackend.Upload(flake, file, ctx)
+	if err != nil && !common.IsHTTPOption(err) {
+		return err
+	}
+	if ierr := i.index.Put(NewEntry(file, int64(len(file.Data))), ctx); ierr != nil {
+		log.Error("Could not index file: ", ierr)
+	}
+	return err
+}
+
+func (i *IndexedBackend) Exists(flake string, ctx context.Context) error {
+	return i.underlyingBackend.Exists(flake, ctx)
+}
+
+func (i *IndexedBackend) Get(flake string, ctx context.Context) (*common.File, error) {
+	f, err := i.underlyingBackend.Get(flake, ctx)
+	if err == common.ErrorExpired || common.IsFileNotExists(err) {
+		i.remove(flake, ctx)
+	}
+	return f, err
+}
+
+func (i *IndexedBackend) Delete(flake string, ctx context.Context) error {
+	err := i.underlyingBackend.Delete(flake, ctx)
+	if err == nil || common.IsFileNotExists(err) {
+		i.remove(flake, ctx)
+	}
+	return err
+}
+
+// ListGlob returns the files whose flake starts with prefix
+func (i *IndexedBackend) ListGlob(ctx context.Context, prefix string) ([]*common.File, error) {
+	entries, err := i.index.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var files = []*common.File{}
+	for _, v := range entries {
+		files = append(files, v.File())
+	}
+	return files, nil
+}
+
+// RunGC deletes all files the index reports as expired and then lets
+// the backend run it's maintenance if it has any.
+func (i *IndexedBackend) RunGC(ctx context.Context) ([]common.File, error) {
+	log := logger.LogFromCtx(packageName+".RunGC", ctx)
+
+	entries, err := i.index.ListExpired(ctx, time.Now().UTC())
+	if err != nil {
+		log.Error("Could not query expired files: ", err)
+		return nil, err
+	}
+
+	log.Debugf("About to clean %d files", len(entries))
+
+	var deletedFiles = []common.File{}
+	for _, v := range entries {
+		if !v.Expired() {
+			continue
+		}
+		log.Debug("Starting delete for ", v.Flake)
+		err := i.Delete(v.Flake, ctx)
+		if err != nil && !common.IsFileNotExists(err) {
+			log.Error("Error while deleting flake ", v.Flake, ": ", err)
+			return deletedFiles, err
+		}
+		deletedFiles = append(deletedFiles, *v.File())
+	}
+
+	log.Debugf("Deleted %d flakes", len(deletedFiles))
+
+	if m, ok := i.underlyingBackend.(common.BackendWithMaintenance); ok {
+		log.Debug("Running backend maintenance")
+		if err := m.RunMaintenance(ctx); err != nil {
+			log.Error("Error in backend maintenance: ", err)
+			return deletedFiles, err
+		}
+	}
+
+	return deletedFiles, nil
+}
+
+// UploadReader streams the file into the wrapped backend, backends
+// without streaming support are adapted.
+func (i *IndexedBackend) UploadReader(flake string, file *common.File, data io.ReadSeeker, ctx context.Context) error {
+	log := logger.LogFromCtx(packageName+".UploadReader", ctx)
+	size, err := data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err = common.NewStreamAdapter(i.underlyingBackend).UploadReader(flake, file, data, ctx)
+	if err != nil && !common.IsHTTPOption(err) {
+		return err
+	}
+	if ierr := i.index.Put(NewEntry(file, size), ctx); ierr != nil {
+		log.Error("Could not index file: ", ierr)
+	}
+	return err
+}
+
+func (i *IndexedBackend) GetReader(flake string, ctx context.Context) (*common.File, io.ReadCloser, error) {
+	f, r, err := common.NewStreamAdapter(i.underlyingBackend).GetReader(flake, ctx)
+	if err == common.ErrorExpired || common.IsFileNotExists(err) {
+		i.remove(flake, ctx)
+	}
+	return f, r, err
+}
+
+// WriteReader passes raw objects to the wrapped backend, they are
+// not indexed.
+func (i *IndexedBackend) WriteReader(name string, data io.ReadSeeker, ctx context.Context) error {
+	return common.NewStreamAdapter(i.underlyingBackend).WriteReader(name, data, ctx)
+}
+
+// ReadReader reads raw objects from the wrapped backend
+func (i *IndexedBackend) ReadReader(name string, ctx context.Context) (io.ReadCloser, error) {
+	return common.NewStreamAdapter(i.underlyingBackend).ReadReader(name, ctx)
+}
+
+// GetOptions returns BackendOptionDirectReaderIO if the wrapped
+// backend supports streaming, the index implements no other options.
+func (i *IndexedBackend) GetOptions() common.BackendOption {
+	if common.BackendHasOptions(i.underlyingBackend, common.BackendOptionDirectReaderIO) {
+		return common.BackendOptionDirectReaderIO
+	}
+	return 0
+}
+
+// GetFirstWith asks the wrapped backend, the index itself has no
+// options.
+func (i *IndexedBackend) GetFirstWith(options common.BackendOption) common.Backend {
+	if ob, ok := i.underlyingBackend.(common.OnionBackend); ok {
+		return ob.GetFirstWith(options)
+	}
+	return nil
+}
+
+// GetAllWith asks the wrapped backend, the index itself has no
+// options.
+func (i *IndexedBackend) GetAllWith(options common.BackendOption) []common.Backend {
+	if ob, ok := i.underlyingBackend.(common.OnionBackend); ok {
+		return ob.GetAllWith(options)
+	}
+	return []common.Backend{}
+}
+
+func (i *IndexedBackend) remove(flake string, ctx context.Context) {
+	log := logger.LogFromCtx(packageName+".remove", ctx)
+	if err := i.index.Remove(flake, ctx); err != nil {
+		log.Error("Could not remove ", flake, " from index: ", err)
+	}
+}
+
+// Rebuild indexes all files the backend lists. Sizes are unknown
+// since listings do not contain file data.
+func Rebuild(b common.Backend, idx Index, ctx context.Context) (int, error) {
+	log := logger.LogFromCtx(packageName+".Rebuild", ctx)
+	files, err := b.ListGlob(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	var indexed = 0
+	for _, v := range files {
+		if v == nil || len(v.Flake) == 0 {
+			continue
+		}
+		if err := idx.Put(NewEntry(v, -1), ctx); err != nil {
+			log.Error("Could not index ", v.Flake, ": ", err)
+			continue
+		}
+		indexed++
+	}
+	return indexed, nil
+}
+
+// Close closes the underlying backend first so that pending uploads
+// can still reach the index, then the index if it holds resources.
+func (i *IndexedBackend) Close(ctx context.Context) error {
+	err := common.CloseBackend(i.underlyingBackend, ctx)
+	if c, ok := i.index.(common.BackendWithClose); ok {
+		if ierr := c.Close(ctx); ierr != nil && err == nil {
+			err = ierr
+		}
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+package index_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend"
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/backend/compl_test"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"github.com/stretchr/testify/assert"
+
+	_ "git.timschuster.info/rls.moe/catgi/backend/buntdb"
+	_ "git.timschuster.info/rls.moe/catgi/index/buntdb"
+)
+
+func getTestBackend(t *testing.T) (*index.IndexedBackend, common.Backend) {
+	ctx := compltest.GetTestCtx()
+	be, err := backend.NewBackend("buntdb", map[string]interface{}{
+		"file":           ":memory:",
+		"no_auto_expire": true,
+	}, ctx)
+	if err != nil {
+		t.Log("Error on creating Testing Backend: ", err)
+		t.FailNow()
+	}
+	idx, err := index.NewIndex("buntdb", map[string]interface{}{}, ctx)
+	if err != nil {
+		t.Log("Error on creating Testing Index: ", err)
+		t.FailNow()
+	}
+	return index.NewIndexedBackend(be, idx), be
+}
+
+func TestCompliance(t *testing.T) {
+	ib, _ := getTestBackend(t)
+	compltest.RunTestSuite(ib, t)
+}
+
+func TestIndexedGC(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	ib, be := getTestBackend(t)
+
+	assert.NoError(ib.Upload("expired", &common.File{
+		Data:     []byte("old"),
+		User:     "alice",
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, -1)),
+	}, ctx))
+	assert.NoError(common.NewStreamAdapter(ib).UploadReader("live", &common.File{
+		User:     "alice",
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, bytes.NewReader([]byte("streamed")), ctx))
+
+	// Files that are not in the index are not touched by the GC
+	assert.NoError(be.Upload("unindexed", &common.File{
+		Data:     []byte("old"),
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, -1)),
+	}, ctx))
+
+	entries, err := ib.Index().ListUser(ctx, "alice")
+	assert.NoError(err)
+	assert.Len(entries, 2)
+
+	live, err := ib.Index().Get("live", ctx)
+	assert.NoError(err)
+	assert.EqualValues(len("streamed"), live.Size)
+
+	deleted, err := ib.RunGC(ctx)
+	assert.NoError(err)
+	if assert.Len(deleted, 1) {
+		assert.Equal("expired", deleted[0].Flake)
+	}
+	assert.True(common.IsFileNotExists(be.Exists("expired", ctx)))
+	assert.NoError(be.Exists("unindexed", ctx))
+
+	files, err := ib.ListGlob(ctx, "")
+	assert.NoError(err)
+	assert.Len(files, 1)
+}
+
+func TestRebuild(t *testing.T) {
+	assert := assert.New(t)
+	ctx := compltest.GetTestCtx()
+	ib, be := getTestBackend(t)
+
+	assert.NoError(be.Upload("existing", &common.File{
+		Data:     []byte("data"),
+		User:     "bob",
+		DeleteAt: common.FromTime(time.Now().AddDate(0, 0, 2)),
+	}, ctx))
+
+	n, err := index.Rebuild(be, ib.Index(), ctx)
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	entries, err := ib.Index().ListUser(ctx, "bob")
+	assert.NoError(err)
+	assert.Len(entries, 1)
+}
@@ -0,0 +1,196 @@
+package buntdb
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"github.com/tidwall/buntdb"
+)
+
+const packageName = "index/buntdb"
+const driverName = "buntdb"
+
+const (
+	indexUser     = "user"
+	indexDeleteAt = "delete_at"
+	indexPublic   = "public"
+)
+
+type buntConfig struct {
+	// File is the path of the database, ":memory:" keeps the
+	// index in memory only.
+	File string `cgc:"file"`
+}
+
+func init() {
+	index.NewDriver(driverName, NewBuntIndex)
+}
+
+// BuntIndex keeps the entries as JSON in a BuntDB with secondary
+// indices on the owner and the expiry date.
+type BuntIndex struct {
+	db *buntdb.DB
+}
+
+func NewBuntIndex(params map[string]interface{}, ctx context.Context) (index.Index, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	log.Debug("Loading Config")
+	var config = &buntConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("file", ":memory:"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Opening DB ", config.File)
+	db, err := buntdb.Open(config.File)
+	if err != nil {
+		log.Error("Error on DB open, returning: ", err)
+		return nil, err
+	}
+
+	err = db.CreateIndex(indexUser, "/entry/*",
+		buntdb.IndexJSONCaseSensitive("user"))
+	if err != nil && err != buntdb.ErrIndexExists {
+		return nil, err
+	}
+	err = db.CreateIndex(indexDeleteAt, "/entry/*",
+		buntdb.IndexJSON("delete_at"))
+	if err != nil && err != buntdb.ErrIndexExists {
+		return nil, err
+	}
+
+	err = db.CreateIndex(indexPublic, "/entry/*",
+		buntdb.IndexJSON("public"))
+	if err != nil && err != buntdb.ErrIndexExists {
+		return nil, err
+	}
+
+	return &BuntIndex{db: db}, nil
+}
+
+func (b *BuntIndex) Name() string { return driverName }
+
+func (b *BuntIndex) Put(entry index.Entry, ctx context.Context) error {
+	dat, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("/entry/"+entry.Flake, string(dat), nil)
+		return err
+	})
+}
+
+func (b *BuntIndex) Remove(flake string, ctx context.Context) error {
+	err := b.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete("/entry/" + flake)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *BuntIndex) Get(flake string, ctx context.Context) (*index.Entry, error) {
+	var entry = &index.Entry{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		dat, err := tx.Get("/entry/" + flake)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(dat), entry)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, common.NewErrorFileNotExists(flake, err)
+	} else if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (b *BuntIndex) List(ctx context.Context, prefix string) ([]index.Entry, error) {
+	log := logger.LogFromCtx(packageName+".List", ctx)
+	var entries = []index.Entry{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("/entry/"+prefix+"*", func(key, value string) bool {
+			entries = appendEntry(entries, value, log)
+			return true
+		})
+	})
+	return entries, err
+}
+
+func (b *BuntIndex) ListUser(ctx context.Context, user string) ([]index.Entry, error) {
+	log := logger.LogFromCtx(packageName+".ListUser", ctx)
+	pivot, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return nil, err
+	}
+	var entries = []index.Entry{}
+	err = b.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendEqual(indexUser, string(pivot), func(key, value string) bool {
+			entries = appendEntry(entries, value, log)
+			return true
+		})
+	})
+	return entries, err
+}
+
+func (b *BuntIndex) ListPublic(ctx context.Context) ([]index.Entry, error) {
+	log := logger.LogFromCtx(packageName+".ListPublic", ctx)
+	var entries = []index.Entry{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendEqual(indexPublic, `{"public":true}`, func(key, value string) bool {
+			entries = appendEntry(entries, value, log)
+			return true
+		})
+	})
+	return entries, err
+}
+
+// ListExpired walks the expiry index until it reaches entries that
+// expire after the given time. Entries without expiry are skipped.
+func (b *BuntIndex) ListExpired(ctx context.Context, before time.Time) ([]index.Entry, error) {
+	log := logger.LogFromCtx(packageName+".ListExpired", ctx)
+	var entries = []index.Entry{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend(indexDeleteAt, func(key, value string) bool {
+			var entry index.Entry
+			if err := json.Unmarshal([]byte(value), &entry); err != nil {
+				log.Error("Error decoding entry ", key, ": ", err)
+				return true
+			}
+			if entry.DeleteAt == nil {
+				return true
+			}
+			if entry.DeleteAt.After(before) {
+				return false
+			}
+			entries = append(entries, entry)
+			return true
+		})
+	})
+	return entries, err
+}
+
+func appendEntry(entries []index.Entry, value string, log logger.Logger) []index.Entry {
+	var entry index.Entry
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		log.Error("Error decoding entry: ", err)
+		return entries
+	}
+	return append(entries, entry)
+}
+
+// Close closes the DB
+func (b *BuntIndex) Close(ctx context.Context) error {
+	return b.db.Close()
+}
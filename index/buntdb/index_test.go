@@ -0,0 +1,69 @@
+package buntdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/index"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueries(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	idx, err := NewBuntIndex(map[string]interface{}{}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+
+	now := time.Now().UTC()
+	entries := []index.Entry{
+		{Flake: "a1", User: "alice", Size: 1, DeleteAt: common.FromTime(now.AddDate(0, 0, -1))},
+		{Flake: "a2", User: "alice", Size: 2, DeleteAt: common.FromTime(now.AddDate(0, 0, 5))},
+		{Flake: "b1", User: "bob", Size: 3, DeleteAt: common.FromTime(now.AddDate(0, 0, -2))},
+		{Flake: "n1", Size: 4, Public: true},
+	}
+	for _, v := range entries {
+		assert.NoError(idx.Put(v, ctx))
+	}
+
+	all, err := idx.List(ctx, "")
+	assert.NoError(err)
+	assert.Len(all, 4)
+
+	prefixed, err := idx.List(ctx, "a")
+	assert.NoError(err)
+	assert.Len(prefixed, 2)
+
+	alice, err := idx.ListUser(ctx, "alice")
+	assert.NoError(err)
+	assert.Len(alice, 2)
+	for _, v := range alice {
+		assert.Equal("alice", v.User)
+	}
+
+	public, err := idx.ListPublic(ctx)
+	assert.NoError(err)
+	if assert.Len(public, 1) {
+		assert.Equal("n1", public[0].Flake)
+	}
+
+	expired, err := idx.ListExpired(ctx, now)
+	assert.NoError(err)
+	if assert.Len(expired, 2) {
+		assert.Equal("b1", expired[0].Flake)
+		assert.Equal("a1", expired[1].Flake)
+	}
+
+	e, err := idx.Get("a2", ctx)
+	assert.NoError(err)
+	assert.EqualValues(2, e.Size)
+
+	assert.NoError(idx.Remove("a2", ctx))
+	assert.NoError(idx.Remove("a2", ctx), "Removing a missing entry is not an error")
+	_, err = idx.Get("a2", ctx)
+	assert.True(common.IsFileNotExists(err))
+}
@@ -0,0 +1,50 @@
+package index
+
+import (
+	"context"
+	"fmt"
+)
+
+type driverCreator func(map[string]interface{}, context.Context) (Index, error)
+
+var indexDrivers = map[string]driverCreator{}
+
+type noDriverError struct {
+	drvName string
+}
+
+func (n noDriverError) Error() string {
+	return fmt.Sprintf("Index driver '%s' not installed", n.drvName)
+}
+
+func newNoDriverError(drv string) error {
+	return noDriverError{drvName: drv}
+}
+
+// NewIndex initializes the index named via driver-name with the given
+// parameter mapping. The context is used for logging purposes.
+// If the driver does not exist it returns an error.
+func NewIndex(
+	driver string, params map[string]interface{}, ctx context.Context) (Index, error) {
+	if f, ok := indexDrivers[driver]; ok {
+		return f(params, ctx)
+	}
+	return nil, newNoDriverError(driver)
+}
+
+// InstalledDrivers returns a list of all index drivers that are
+// currently installed.
+func InstalledDrivers() []string {
+	var list = []string{}
+	for v := range indexDrivers {
+		list = append(list, v)
+	}
+	return list
+}
+
+// NewDriver accepts an index init function and saves it into the list
+// of installed index drivers.
+func NewDriver(driver string,
+	dfunc func(map[string]interface{}, context.Context) (Index, error)) {
+	indexDrivers[driver] = dfunc
+}
@@ -0,0 +1,88 @@
+package index
+
+import (
+	"context"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+)
+
+// Index stores the metadata of all files so listings and GC do not
+// have to scan the storage backend.
+type Index interface {
+	// Name returns the name of the index driver
+	Name() string
+	// Put stores or replaces the entry of a flake
+	Put(entry Entry, ctx context.Context) error
+	// Remove deletes the entry of a flake, removing a missing
+	// entry is not an error.
+	Remove(flake string, ctx context.Context) error
+	// Get returns the entry of a flake or common.ErrorFileNotExists
+	Get(flake string, ctx context.Context) (*Entry, error)
+	// List returns all entries whose flake starts with prefix
+	List(ctx context.Context, prefix string) ([]Entry, error)
+	// ListUser returns all entries owned by the user
+	ListUser(ctx context.Context, user string) ([]Entry, error)
+	// ListPublic returns all entries marked public
+	ListPublic(ctx context.Context) ([]Entry, error)
+	// ListExpired returns all entries that expire at or before
+	// the given time.
+	ListExpired(ctx context.Context, before time.Time) ([]Entry, error)
+}
+
+// Entry is the metadata of a file as stored in the index
+type Entry struct {
+	// Flake is the identifier of the file
+	Flake string `json:"flake"`
+	// User is the owner of the file
+	User string `json:"user"`
+	// Size of the file data in bytes, -1 if unknown
+	Size int64 `json:"size"`
+	// ContentType is the detected mime type
+	ContentType string `json:"mime"`
+	// FileExtension is the extension used for downloads
+	FileExtension string `json:"ext"`
+	// Public marks if the file is public or not
+	Public bool `json:"public"`
+	// CreatedAt is the creation time of the file
+	CreatedAt *common.DateOnlyTime `json:"created_at"`
+	// DeleteAt is the expiry date of the file
+	DeleteAt *common.DateOnlyTime `json:"delete_at"`
+	// Options are the file options
+	Options []common.FileOption `json:"opts,omitempty"`
+}
+
+// NewEntry creates the entry for a file with the given data size
+func NewEntry(file *common.File, size int64) Entry {
+	return Entry{
+		Flake:         file.Flake,
+		User:          file.User,
+		Size:          size,
+		ContentType:   file.ContentType,
+		FileExtension: file.FileExtension,
+		Public:        file.Public,
+		CreatedAt:     file.CreatedAt,
+		DeleteAt:      file.DeleteAt,
+		Options:       file.Options,
+	}
+}
+
+// File returns the entry as file without data
+func (e Entry) File() *common.File {
+	return &common.File{
+		Flake:         e.Flake,
+		User:          e.User,
+		ContentType:   e.ContentType,
+		FileExtension: e.FileExtension,
+		Public:        e.Public,
+		CreatedAt:     e.CreatedAt,
+		DeleteAt:      e.DeleteAt,
+		Options:       e.Options,
+		Data:          []byte{},
+	}
+}
+
+// Expired returns true if the entry has a DeleteAt and it's TTL is over
+func (e Entry) Expired() bool {
+	return e.DeleteAt != nil && e.DeleteAt.TTL() == 0
+}
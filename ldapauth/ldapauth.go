@@ -0,0 +1,312 @@
+// Package ldapauth checks passwords with a bind against an LDAP server.
+// Users are either bound with a DN built from a template or searched
+// with a service account first. Successful binds are cached briefly so
+// not every login hits the server.
+package ldapauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrorInvalidCredentials is returned if the user does not exist
+	// or the password is wrong
+	ErrorInvalidCredentials = errors.New("Invalid LDAP credentials")
+	// ErrorNotInGroup is returned if the user does not match the
+	// group filter
+	ErrorNotInGroup = errors.New("User does not match the LDAP group filter")
+	// ErrorInsecureURL is returned by New for ldap:// URLs without
+	// StartTLS, unless insecure connections are allowed
+	ErrorInsecureURL = errors.New("LDAP passwords would be sent in plain text, use ldaps://, start_tls or allow_insecure")
+)
+
+// Result is the user a bind succeeded for
+type Result struct {
+	DN     string
+	Groups []string
+	// Role is the highest role of the groups or the default role
+	Role config.Role
+}
+
+// conn is the part of *ldap.Conn used, tests replace it
+type conn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// cacheEntry is a successful bind, the password is only kept hashed
+type cacheEntry struct {
+	hash    [sha256.Size]byte
+	result  Result
+	expires time.Time
+}
+
+// Authenticator checks passwords against one LDAP server
+type Authenticator struct {
+	cfg  config.LDAPConfig
+	dial func() (conn, error)
+	now  func() time.Time
+
+	// salt makes the cached hashes useless outside of this process
+	salt  []byte
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// New creates an authenticator for the config. The server is only
+// contacted on logins.
+func New(cfg config.LDAPConfig) (*Authenticator, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "ldap" && !cfg.StartTLS && !cfg.AllowInsecure {
+		return nil, ErrorInsecureURL
+	}
+	tlsConf := &tls.Config{ServerName: u.Hostname()}
+	if len(cfg.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", cfg.CAFile)
+		}
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	a := &Authenticator{
+		cfg:   cfg,
+		now:   time.Now,
+		salt:  salt,
+		cache: map[string]cacheEntry{},
+	}
+	a.dial = func() (conn, error) {
+		timeout := cfg.TimeoutDuration()
+		c, err := ldap.DialURL(cfg.URL, ldap.DialWithTLSDialer(tlsConf, &net.Dialer{Timeout: timeout}))
+		if err != nil {
+			return nil, err
+		}
+		c.SetTimeout(timeout)
+		if cfg.StartTLS {
+			if err := c.StartTLS(tlsConf); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
+	}
+	return a, nil
+}
+
+// Authenticate binds as the user with the password and returns the
+// groups and role of the user.
+func (a *Authenticator) Authenticate(user, pass string, ctx context.Context) (Result, error) {
+	// An empty password is an unauthenticated bind that servers
+	// accept for every DN
+	if len(user) == 0 || len(pass) == 0 {
+		return Result{}, ErrorInvalidCredentials
+	}
+	hash := a.hash(pass)
+	if res, ok := a.cached(user, hash); ok {
+		return res, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	res, err := a.lookup(user, pass)
+	if err != nil {
+		return Result{}, err
+	}
+	a.store(user, hash, res)
+	return res, nil
+}
+
+func (a *Authenticator) hash(pass string) [sha256.Size]byte {
+	return sha256.Sum256(append(append([]byte{}, a.salt...), pass...))
+}
+
+func (a *Authenticator) cached(user string, hash [sha256.Size]byte) (Result, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.cache[user]
+	if !ok || !a.now().Before(e.expires) {
+		return Result{}, false
+	}
+	if subtle.ConstantTimeCompare(e.hash[:], hash[:]) != 1 {
+		return Result{}, false
+	}
+	return e.result, true
+}
+
+func (a *Authenticator) store(user string, hash [sha256.Size]byte, res Result) {
+	ttl := a.cfg.CacheDuration()
+	if ttl <= 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	for k, v := range a.cache {
+		if !now.Before(v.expires) {
+			delete(a.cache, k)
+		}
+	}
+	a.cache[user] = cacheEntry{hash: hash, result: res, expires: now.Add(ttl)}
+}
+
+// lookup binds as the user, either directly with the DN template or
+// after searching the DN with the service account.
+func (a *Authenticator) lookup(user, pass string) (Result, error) {
+	c, err := a.dial()
+	if err != nil {
+		return Result{}, err
+	}
+	defer c.Close()
+
+	groupAttr := a.cfg.GroupAttribute
+	if len(groupAttr) == 0 {
+		groupAttr = "memberOf"
+	}
+	var entry *ldap.Entry
+
+	if len(a.cfg.UserDN) > 0 {
+		dn := fmt.Sprintf(a.cfg.UserDN, escapeDN(user))
+		if err := bind(c, dn, pass); err != nil {
+			return Result{}, err
+		}
+		entry = &ldap.Entry{DN: dn}
+		if len(a.cfg.GroupFilter) > 0 || len(a.cfg.Roles) > 0 {
+			filter := a.cfg.GroupFilter
+			if len(filter) == 0 {
+				filter = "(objectClass=*)"
+			}
+			entries, err := search(c, dn, ldap.ScopeBaseObject, filter, groupAttr)
+			if err != nil {
+				return Result{}, err
+			}
+			if len(entries) != 1 {
+				return Result{}, ErrorNotInGroup
+			}
+			entry = entries[0]
+		}
+	} else {
+		if len(a.cfg.BindDN) > 0 {
+			if err := c.Bind(a.cfg.BindDN, a.cfg.BindPassword); err != nil {
+				return Result{}, fmt.Errorf("Service bind failed: %s", err)
+			}
+		}
+		userFilter := a.cfg.UserFilter
+		if len(userFilter) == 0 {
+			userFilter = "(uid=%s)"
+		}
+		filter := fmt.Sprintf(userFilter, ldap.EscapeFilter(user))
+		if len(a.cfg.GroupFilter) > 0 {
+			filter = "(&" + filter + a.cfg.GroupFilter + ")"
+		}
+		entries, err := search(c, a.cfg.BaseDN, ldap.ScopeWholeSubtree, filter, groupAttr)
+		if err != nil {
+			return Result{}, err
+		}
+		if len(entries) > 1 {
+			return Result{}, fmt.Errorf("Username %s matches %d entries", user, len(entries))
+		}
+		// Users not in the group are indistinguishable from unknown
+		// users here, both fail like a wrong password
+		if len(entries) == 0 {
+			return Result{}, ErrorInvalidCredentials
+		}
+		entry = entries[0]
+		if err := bind(c, entry.DN, pass); err != nil {
+			return Result{}, err
+		}
+	}
+
+	res := Result{DN: entry.DN, Groups: entry.GetAttributeValues(groupAttr)}
+	res.Role = a.role(res.Groups)
+	return res, nil
+}
+
+// role returns the highest role of the groups or the default role
+func (a *Authenticator) role(groups []string) config.Role {
+	role := a.cfg.DefaultRole
+	if len(role) == 0 {
+		role = config.DefaultRole
+	}
+	mapped := false
+	for _, g := range groups {
+		for group, r := range a.cfg.Roles {
+			if !strings.EqualFold(g, group) {
+				continue
+			}
+			if !mapped || r.Includes(role) {
+				role = r
+			}
+			mapped = true
+		}
+	}
+	return role
+}
+
+func bind(c conn, dn, pass string) error {
+	err := c.Bind(dn, pass)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrorInvalidCredentials
+	}
+	return err
+}
+
+func search(c conn, base string, scope int, filter, attr string) ([]*ldap.Entry, error) {
+	res, err := c.Search(ldap.NewSearchRequest(base, scope, ldap.NeverDerefAliases,
+		2, 0, false, filter, []string{attr}, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	}
+	// The size limit of 2 is enough to find ambiguous usernames, the
+	// entries found so far are returned with the error.
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// escapeDN escapes a value for an attribute of a DN as in RFC 4514
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`"+,;<>\=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(s)-1):
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
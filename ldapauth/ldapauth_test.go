@@ -0,0 +1,182 @@
+package ldapauth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDir is a directory that answers searches by base and exact
+// filter, which also checks the filters are built as expected.
+type testDir struct {
+	passwords map[string]string
+	searches  map[string][]*ldap.Entry
+	binds     []string
+	dials     int
+}
+
+func (d *testDir) Bind(dn, pass string) error {
+	d.binds = append(d.binds, dn)
+	if p, ok := d.passwords[dn]; !ok || p != pass {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, nil)
+	}
+	return nil
+}
+
+func (d *testDir) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return &ldap.SearchResult{Entries: d.searches[req.BaseDN+" "+req.Filter]}, nil
+}
+
+func (d *testDir) Close() error { return nil }
+
+const (
+	aliceDN = "uid=alice,ou=people,dc=example,dc=com"
+	adminDN = "cn=admins,ou=groups,dc=example,dc=com"
+	staffDN = "cn=staff,ou=groups,dc=example,dc=com"
+)
+
+func newTestAuth(t *testing.T, cfg config.LDAPConfig) (*Authenticator, *testDir) {
+	cfg.URL = "ldap://ldap.example.com"
+	cfg.StartTLS = true
+	a, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := &testDir{
+		passwords: map[string]string{
+			aliceDN:                      "secret",
+			"cn=catgi,dc=example,dc=com": "service",
+		},
+		searches: map[string][]*ldap.Entry{},
+	}
+	a.dial = func() (conn, error) {
+		dir.dials++
+		return dir, nil
+	}
+	return a, dir
+}
+
+func TestDirectBind(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	a, dir := newTestAuth(t, config.LDAPConfig{
+		UserDN:      "uid=%s,ou=people,dc=example,dc=com",
+		GroupFilter: "(memberOf=" + staffDN + ")",
+		Roles:       map[string]config.Role{adminDN: config.RoleAdmin},
+	})
+	dir.searches[aliceDN+" (memberOf="+staffDN+")"] = []*ldap.Entry{
+		ldap.NewEntry(aliceDN, map[string][]string{"memberOf": {staffDN, adminDN}}),
+	}
+
+	res, err := a.Authenticate("alice", "secret", ctx)
+	if assert.NoError(err) {
+		assert.Equal(aliceDN, res.DN)
+		assert.Equal(config.RoleAdmin, res.Role)
+	}
+
+	_, err = a.Authenticate("alice", "wrong", ctx)
+	assert.Equal(ErrorInvalidCredentials, err)
+	_, err = a.Authenticate("alice", "", ctx)
+	assert.Equal(ErrorInvalidCredentials, err, "Empty passwords must never reach the server")
+
+	dir.searches = map[string][]*ldap.Entry{}
+	a.cache = map[string]cacheEntry{}
+	_, err = a.Authenticate("alice", "secret", ctx)
+	assert.Equal(ErrorNotInGroup, err)
+
+	_, err = a.Authenticate("bob,ou=admins", "secret", ctx)
+	assert.Equal(ErrorInvalidCredentials, err)
+	assert.Equal(`uid=bob\,ou\=admins,ou=people,dc=example,dc=com`, dir.binds[len(dir.binds)-1])
+}
+
+func TestSearchBind(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	a, dir := newTestAuth(t, config.LDAPConfig{
+		BindDN:       "cn=catgi,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "dc=example,dc=com",
+		GroupFilter:  "(memberOf=" + staffDN + ")",
+		DefaultRole:  config.RoleViewer,
+	})
+	dir.searches["dc=example,dc=com (&(uid=alice)(memberOf="+staffDN+"))"] = []*ldap.Entry{
+		ldap.NewEntry(aliceDN, map[string][]string{"memberOf": {staffDN}}),
+	}
+
+	res, err := a.Authenticate("alice", "secret", ctx)
+	if assert.NoError(err) {
+		assert.Equal(aliceDN, res.DN)
+		assert.Equal([]string{staffDN}, res.Groups)
+		assert.Equal(config.RoleViewer, res.Role, "Unmapped groups get the default role")
+	}
+	assert.Equal([]string{"cn=catgi,dc=example,dc=com", aliceDN}, dir.binds)
+
+	_, err = a.Authenticate("bob", "secret", ctx)
+	assert.Equal(ErrorInvalidCredentials, err, "Unknown users must fail like wrong passwords")
+
+	dir.searches["dc=example,dc=com (&(uid=a\\2a)(memberOf="+staffDN+"))"] = []*ldap.Entry{
+		ldap.NewEntry(aliceDN, nil),
+		ldap.NewEntry("uid=amy,ou=people,dc=example,dc=com", nil),
+	}
+	_, err = a.Authenticate("a*", "secret", ctx)
+	assert.Error(err, "Ambiguous usernames must fail")
+}
+
+func TestCache(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	a, dir := newTestAuth(t, config.LDAPConfig{
+		UserDN:    "uid=%s,ou=people,dc=example,dc=com",
+		CacheTime: "1m",
+	})
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	_, err := a.Authenticate("alice", "secret", ctx)
+	assert.NoError(err)
+	_, err = a.Authenticate("alice", "secret", ctx)
+	assert.NoError(err)
+	assert.Equal(1, dir.dials, "Cached binds must not contact the server")
+
+	_, err = a.Authenticate("alice", "wrong", ctx)
+	assert.Equal(ErrorInvalidCredentials, err, "The cache must not accept other passwords")
+	assert.Equal(2, dir.dials)
+
+	now = now.Add(time.Minute)
+	dir.passwords[aliceDN] = "changed"
+	_, err = a.Authenticate("alice", "secret", ctx)
+	assert.Equal(ErrorInvalidCredentials, err, "Expired binds must be checked again")
+
+	a.cfg.CacheTime = "0s"
+	a.cache = map[string]cacheEntry{}
+	_, err = a.Authenticate("alice", "changed", ctx)
+	assert.NoError(err)
+	_, err = a.Authenticate("alice", "changed", ctx)
+	assert.NoError(err)
+	assert.Equal(5, dir.dials, "A cache time of 0s must disable the cache")
+}
+
+func TestEscapeDN(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("alice", escapeDN("alice"))
+	assert.Equal(`\#a\+b\;c\ `, escapeDN("#a+b;c "))
+	assert.Equal(`\ a\<b\>\"\\\00`, escapeDN(" a<b>\"\\\x00"))
+}
+
+func TestInsecureURL(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := New(config.LDAPConfig{URL: "ldap://ldap.example.com"})
+	assert.Equal(ErrorInsecureURL, err, "Plain ldap:// must need StartTLS")
+
+	_, err = New(config.LDAPConfig{URL: "ldap://ldap.example.com", StartTLS: true})
+	assert.NoError(err)
+	_, err = New(config.LDAPConfig{URL: "ldap://ldap.example.com", AllowInsecure: true})
+	assert.NoError(err)
+	_, err = New(config.LDAPConfig{URL: "ldaps://ldap.example.com"})
+	assert.NoError(err)
+}
@@ -56,6 +56,20 @@ func CreateRequestIDContext(ctx context.Context) context.Context {
 
 }
 
+// DetachContext returns a background context that carries the logger
+// and request ID of ctx but is not cancelled with it. This is used for
+// work that has to outlive the request that started it.
+func DetachContext(ctx context.Context) context.Context {
+	detached := context.Background()
+	if log := ctx.Value("logger"); log != nil {
+		detached = context.WithValue(detached, "logger", log)
+	}
+	if reqId := ctx.Value("logger-req-id"); reqId != nil {
+		detached = context.WithValue(detached, "logger-req-id", reqId)
+	}
+	return detached
+}
+
 // SetLoggingLevel sets the logging level of a logger inside
 // the context.
 // If the logging level is unknown it panics.
@@ -0,0 +1,163 @@
+// Package metrics collects counters and histograms and exposes them in
+// the Prometheus text format. It only implements what catgi needs,
+// metrics are registered once and live for the whole process.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets in seconds
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Default is the registry used by catgi and its backends
+var Default = NewRegistry()
+
+// Registry holds all metrics exposed by a handler
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]family
+}
+
+// family is a metric with all its label combinations
+type family interface {
+	write(w *bufio.Writer)
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]family{}}
+}
+
+// register adds the family or returns the one already registered under
+// the name, so packages can register the same metric repeatedly.
+func (r *Registry) register(name string, f family) family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.families[name]; ok {
+		return old
+	}
+	r.families[name] = f
+	return f
+}
+
+// NewCounter registers a counter with the given label names. Counters
+// registered twice under the same name must use the same labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: map[string]*counterValue{},
+	}
+	return r.register(name, c).(*Counter)
+}
+
+// NewHistogram registers a histogram with the given upper bounds of
+// the buckets and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	return r.register(name, h).(*Histogram)
+}
+
+// WriteText writes all metrics in the Prometheus text format
+func (r *Registry) WriteText(out io.Writer) error {
+	r.mu.Lock()
+	var names = make([]string, 0, len(r.families))
+	for k := range r.families {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var families = make([]family, 0, len(names))
+	for _, v := range names {
+		families = append(families, r.families[v])
+	}
+	r.mu.Unlock()
+
+	w := bufio.NewWriter(out)
+	for _, v := range families {
+		v.write(w)
+	}
+	return w.Flush()
+}
+
+// ServeHTTP exposes the metrics to Prometheus
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(rw)
+}
+
+// desc is the name and labels of a family
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+// key joins label values, values must match the label names
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s needs %d label values, got %d",
+			d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func (d desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escape(d.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, kind)
+}
+
+// labelString formats the labels of a series, extra is appended as is
+func (d desc) labelString(key string, extra string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+"=\""+escape(v, true)+"\"")
+		}
+	}
+	if len(extra) > 0 {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string, quotes bool) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	if quotes {
+		s = strings.Replace(s, "\"", "\\\"", -1)
+	}
+	return s
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return fmt.Sprint(f)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	var keys = make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
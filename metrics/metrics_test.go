@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	assert := assert.New(t)
+	reg := NewRegistry()
+
+	c := reg.NewCounter("test_total", "A test counter", "op", "code")
+	c.Inc("get", "200")
+	c.Add(2, "get", "200")
+	c.Inc("put", "500")
+	c.Add(-1, "put", "500")
+
+	assert.Equal(3.0, c.Value("get", "200"))
+	assert.Equal(1.0, c.Value("put", "500"), "Negative values must be ignored")
+	assert.Equal(0.0, c.Value("del", "200"))
+
+	assert.True(c == reg.NewCounter("test_total", "A test counter", "op", "code"),
+		"Registering twice must return the same counter")
+
+	assert.Panics(func() { c.Inc("get") }, "Wrong label count must panic")
+
+	var buf bytes.Buffer
+	assert.NoError(reg.WriteText(&buf))
+	assert.Equal(`# HELP test_total A test counter
+# TYPE test_total counter
+test_total{op="get",code="200"} 3
+test_total{op="put",code="500"} 1
+`, buf.String())
+}
+
+func TestHistogram(t *testing.T) {
+	assert := assert.New(t)
+	reg := NewRegistry()
+
+	h := reg.NewHistogram("test_seconds", "A test histogram", []float64{0.5, 1})
+	h.Observe(0.2)
+	h.Observe(0.7)
+	h.Observe(3)
+
+	assert.EqualValues(3, h.Count())
+
+	var buf bytes.Buffer
+	assert.NoError(reg.WriteText(&buf))
+	assert.Equal(`# HELP test_seconds A test histogram
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 3.9
+test_seconds_count 3
+`, buf.String())
+}
+
+func TestEscape(t *testing.T) {
+	assert := assert.New(t)
+	reg := NewRegistry()
+
+	c := reg.NewCounter("esc_total", "Line\nbreak", "path")
+	c.Inc("a\"b\\c")
+
+	var buf bytes.Buffer
+	assert.NoError(reg.WriteText(&buf))
+	assert.Contains(buf.String(), `# HELP esc_total Line\nbreak`)
+	assert.Contains(buf.String(), `esc_total{path="a\"b\\c"} 1`)
+}
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+type counterValue struct {
+	value float64
+}
+
+// Counter is a value that only goes up, ie requests or bytes
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+// Add adds v to the counter of the label values, v must not be
+// negative.
+func (c *Counter) Add(v float64, labels ...string) {
+	if v < 0 {
+		return
+	}
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cv, ok := c.values[key]
+	if !ok {
+		cv = &counterValue{}
+		c.values[key] = cv
+	}
+	cv.value += v
+}
+
+// Inc adds 1 to the counter of the label values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Value returns the counter of the label values
+func (c *Counter) Value(labels ...string) float64 {
+	key := c.key(labels)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cv, ok := c.values[key]; ok {
+		return cv.value
+	}
+	return 0
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w, "counter")
+	var keys = map[string]struct{}{}
+	for k := range c.values {
+		keys[k] = struct{}{}
+	}
+	for _, k := range sortedKeys(keys) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(k, ""),
+			formatFloat(c.values[k].value))
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations into buckets, ie request durations
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// Observe records v for the label values
+func (h *Histogram) Observe(v float64, labels ...string) {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// ObserveSince records the seconds passed since start
+func (h *Histogram) ObserveSince(start time.Time, labels ...string) {
+	h.Observe(time.Since(start).Seconds(), labels...)
+}
+
+// Count returns the number of observations of the label values
+func (h *Histogram) Count(labels ...string) uint64 {
+	key := h.key(labels)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hv, ok := h.values[key]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w, "histogram")
+	var keys = map[string]struct{}{}
+	for k := range h.values {
+		keys[k] = struct{}{}
+	}
+	for _, k := range sortedKeys(keys) {
+		hv := h.values[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				h.labelString(k, "le=\""+formatFloat(b)+"\""), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			h.labelString(k, "le=\""+formatFloat(math.Inf(1))+"\""), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(k, ""), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(k, ""), hv.count)
+	}
+}
@@ -0,0 +1,181 @@
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyRefresh is the minimum time between fetches of the key set, an
+// unknown key id does not refetch it more often.
+const keyRefresh = time.Minute
+
+// jwk is a JSON Web Key, only RSA and EC keys are supported
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// keySet caches the signing keys of the provider and refetches them
+// when a token names an unknown key, ie after a key rotation.
+type keySet struct {
+	uri   string
+	fetch func(ctx context.Context, u string, v interface{}) error
+	now   func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+func newKeySet(uri string, fetch func(context.Context, string, interface{}) error) *keySet {
+	return &keySet{
+		uri:   uri,
+		fetch: fetch,
+		now:   time.Now,
+	}
+}
+
+// get returns the key with the id for the algorithm, an empty id
+// matches if the set has a single key of the algorithm.
+func (k *keySet) get(kid, alg string, ctx context.Context) (interface{}, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key := k.lookup(kid, alg); key != nil {
+		return key, nil
+	}
+	if k.now().Sub(k.fetched) < keyRefresh {
+		return nil, fmt.Errorf("Unknown key %q", kid)
+	}
+	if err := k.refresh(ctx); err != nil {
+		return nil, err
+	}
+	if key := k.lookup(kid, alg); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown key %q", kid)
+}
+
+func (k *keySet) lookup(kid, alg string) interface{} {
+	var match interface{}
+	for id, key := range k.keys {
+		if !keyFits(key, alg) {
+			continue
+		}
+		if id == kid {
+			return key
+		}
+		if len(kid) == 0 {
+			if match != nil {
+				return nil
+			}
+			match = key
+		}
+	}
+	return match
+}
+
+func (k *keySet) refresh(ctx context.Context) error {
+	k.fetched = k.now()
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := k.fetch(ctx, k.uri, &set); err != nil {
+		return err
+	}
+	var keys = map[string]interface{}{}
+	for _, v := range set.Keys {
+		if len(v.Use) > 0 && v.Use != "sig" {
+			continue
+		}
+		key, err := v.publicKey()
+		if err != nil {
+			// Keys of unsupported types are skipped
+			continue
+		}
+		keys[v.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("Key set has no usable keys")
+	}
+	k.keys = keys
+	return nil
+}
+
+func (j jwk) publicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %s", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %s", j.Kty)
+}
+
+// keyFits returns true if the key can verify the algorithm
+func keyFits(key interface{}, alg string) bool {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return strings.HasPrefix(alg, "ES")
+	}
+	return false
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(dat), nil
+}
@@ -0,0 +1,225 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testIssuer is a stand-in provider that issues ID tokens with the
+// claims of the code the client redeems.
+type testIssuer struct {
+	srv   *httptest.Server
+	key   *rsa.PrivateKey
+	kid   string
+	codes map[string]jwt.MapClaims
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss := &testIssuer{key: key, kid: "k1", codes: map[string]jwt.MapClaims{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 iss.srv.URL,
+			"authorization_endpoint": iss.srv.URL + "/auth",
+			"token_endpoint":         iss.srv.URL + "/token",
+			"jwks_uri":               iss.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": iss.kid,
+				"use": "sig",
+				"n":   enc.EncodeToString(iss.key.N.Bytes()),
+				"e":   enc.EncodeToString(big.NewInt(int64(iss.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		claims, ok := iss.codes[r.FormValue("code")]
+		if user != "catgi" || pass != "secret" || !ok {
+			rw.WriteHeader(400)
+			json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]string{
+			"access_token": "unused",
+			"id_token":     iss.sign(claims),
+		})
+	})
+	iss.srv = httptest.NewServer(mux)
+	return iss
+}
+
+func (i *testIssuer) sign(claims jwt.MapClaims) string {
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = i.kid
+	raw, err := t.SignedString(i.key)
+	if err != nil {
+		panic(err)
+	}
+	return raw
+}
+
+func (i *testIssuer) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            i.srv.URL,
+		"aud":            "catgi",
+		"sub":            "1234",
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"groups":         []string{"staff", "ops"},
+		"nonce":          nonce,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func (i *testIssuer) provider() *Provider {
+	return NewProvider(config.OIDCConfig{
+		Issuer:       i.srv.URL,
+		ClientID:     "catgi",
+		ClientSecret: "secret",
+		RedirectURL:  "https://catgi.example/login/oidc/callback",
+		Roles: map[string]config.Role{
+			"staff": config.RoleUploader,
+			"ops":   config.RoleAdmin,
+		},
+	}, nil)
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	defer iss.srv.Close()
+	p := iss.provider()
+
+	authURL, err := p.AuthURL("state1", "nonce1", ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	u, err := url.Parse(authURL)
+	assert.NoError(err)
+	assert.Equal(iss.srv.URL+"/auth", strings.Split(authURL, "?")[0])
+	assert.Equal("state1", u.Query().Get("state"))
+	assert.Equal("nonce1", u.Query().Get("nonce"))
+	assert.Equal("openid email profile", u.Query().Get("scope"))
+
+	iss.codes["code1"] = iss.claims("nonce1")
+	raw, err := p.Exchange("code1", ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	claims, err := p.Verify(raw, "nonce1", ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	id, err := p.Identity(claims)
+	assert.NoError(err)
+	assert.Equal("alice@example.com", id.Username)
+	assert.Equal([]string{"staff", "ops"}, id.Groups)
+	assert.Equal(config.RoleAdmin, id.Role, "The highest role of the groups must be used")
+
+	_, err = p.Exchange("unknown", ctx)
+	assert.Error(err)
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	iss := newTestIssuer(t)
+	defer iss.srv.Close()
+	p := iss.provider()
+
+	_, err := p.Verify(iss.sign(iss.claims("n")), "other", ctx)
+	assert.Error(err, "Wrong nonce must fail")
+
+	claims := iss.claims("n")
+	claims["aud"] = "someone-else"
+	_, err = p.Verify(iss.sign(claims), "n", ctx)
+	assert.Error(err, "Wrong audience must fail")
+
+	claims = iss.claims("n")
+	claims["aud"] = []string{"someone-else", "catgi"}
+	_, err = p.Verify(iss.sign(claims), "n", ctx)
+	assert.NoError(err, "Audience lists must be accepted")
+
+	claims = iss.claims("n")
+	claims["iss"] = "https://evil.example"
+	_, err = p.Verify(iss.sign(claims), "n", ctx)
+	assert.Error(err, "Wrong issuer must fail")
+
+	claims = iss.claims("n")
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = p.Verify(iss.sign(claims), "n", ctx)
+	assert.Error(err, "Expired token must fail")
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, iss.claims("n"))
+	raw, _ := forged.SignedString([]byte("secret"))
+	_, err = p.Verify(raw, "n", ctx)
+	assert.Error(err, "HMAC signed tokens must fail")
+
+	// Rotating the key is picked up once the refresh interval passed
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if !assert.NoError(err) {
+		return
+	}
+	iss.key, iss.kid = other, "k2"
+	_, err = p.Verify(iss.sign(iss.claims("n")), "n", ctx)
+	assert.Error(err, "Keys must not be refetched within the refresh interval")
+	p.keys.now = func() time.Time { return time.Now().Add(keyRefresh) }
+	_, err = p.Verify(iss.sign(iss.claims("n")), "n", ctx)
+	assert.NoError(err, "Rotated key must be fetched")
+}
+
+func TestIdentity(t *testing.T) {
+	assert := assert.New(t)
+	p := NewProvider(config.OIDCConfig{
+		Issuer:        "https://sso.example",
+		UsernameClaim: "preferred_username",
+		Roles:         map[string]config.Role{"interns": config.RoleViewer},
+	}, nil)
+
+	id, err := p.Identity(jwt.MapClaims{"preferred_username": "bob", "groups": "interns"})
+	assert.NoError(err)
+	assert.Equal("bob", id.Username)
+	assert.Equal(config.RoleViewer, id.Role)
+
+	id, err = p.Identity(jwt.MapClaims{"preferred_username": "eve"})
+	assert.NoError(err)
+	assert.Equal(config.Role(""), id.Role, "Users without groups or default role get no role")
+
+	_, err = p.Identity(jwt.MapClaims{"email": "bob@example.com"})
+	assert.Equal(ErrorNoUsername, err)
+
+	p = NewProvider(config.OIDCConfig{Issuer: "https://sso.example"}, nil)
+	_, err = p.Identity(jwt.MapClaims{"email": "bob@example.com", "email_verified": false})
+	assert.Equal(ErrorEmailUnverified, err, "Unverified emails must be rejected")
+	_, err = p.Identity(jwt.MapClaims{"email": "bob@example.com"})
+	assert.Equal(ErrorEmailUnverified, err, "Emails without email_verified must be rejected")
+	id, err = p.Identity(jwt.MapClaims{"email": "bob@example.com", "email_verified": true})
+	assert.NoError(err)
+	assert.Equal("bob@example.com", id.Username)
+}
@@ -0,0 +1,282 @@
+// Package oidc implements the authorization code flow of OpenID
+// Connect to login users with an external provider. Only what catgi
+// needs is implemented: discovery, the code exchange and verifying
+// RSA and ECDSA signed ID tokens.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var (
+	// ErrorInvalidToken is returned if an ID token fails verification
+	ErrorInvalidToken = errors.New("Invalid ID token")
+	// ErrorNoUsername is returned if the username claim is missing
+	ErrorNoUsername = errors.New("ID token has no username claim")
+	// ErrorEmailUnverified is returned if the username is an email the
+	// provider did not verify
+	ErrorEmailUnverified = errors.New("Email of the ID token is not verified")
+)
+
+// discovery is the part of the provider metadata used by catgi
+type discovery struct {
+	Issuer        string `json:"issuer"`
+	AuthEndpoint  string `json:"authorization_endpoint"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// Identity is the user an ID token was issued for
+type Identity struct {
+	Username string
+	Groups   []string
+	// Role is the highest role of the groups or the default role,
+	// empty if the user has neither.
+	Role config.Role
+}
+
+// Provider talks to one OpenID Connect provider. Discovery happens on
+// first use so catgi starts while the provider is down.
+type Provider struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	endpoints *discovery
+	keys      *keySet
+}
+
+// NewProvider creates a provider for the config, a nil client uses a
+// client with a 30 second timeout.
+func NewProvider(cfg config.OIDCConfig, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Provider{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+// discover returns the endpoints of the provider, fetching them once
+func (p *Provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	var d discovery
+	wellKnown := strings.TrimRight(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("Provider reports issuer %s instead of %s", d.Issuer, p.cfg.Issuer)
+	}
+	if len(p.cfg.JWKSURL) > 0 {
+		d.JWKSURI = p.cfg.JWKSURL
+	}
+	if len(d.AuthEndpoint) == 0 || len(d.TokenEndpoint) == 0 || len(d.JWKSURI) == 0 {
+		return nil, errors.New("Provider metadata is missing endpoints")
+	}
+	p.endpoints = &d
+	p.keys = newKeySet(d.JWKSURI, p.getJSON)
+	return p.endpoints, nil
+}
+
+// AuthURL returns the URL of the provider the user is sent to
+func (p *Provider) AuthURL(state, nonce string, ctx context.Context) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	scopes := p.cfg.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.cfg.ClientID},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"scope":         {strings.Join(append([]string{"openid"}, scopes...), " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems the code of the callback and returns the raw ID
+// token.
+func (p *Provider) Exchange(code string, ctx context.Context) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.cfg.RedirectURL},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return "", fmt.Errorf("Token endpoint returned %s: %s", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || len(tok.Error) > 0 {
+		return "", fmt.Errorf("Token endpoint returned %s: %s", resp.Status, tok.Error)
+	}
+	if len(tok.IDToken) == 0 {
+		return "", errors.New("Token endpoint returned no ID token")
+	}
+	return tok.IDToken, nil
+}
+
+// Verify checks the signature, issuer, audience, lifetime and nonce of
+// an ID token and returns it's claims.
+func (p *Provider) Verify(raw, nonce string, ctx context.Context) (jwt.MapClaims, error) {
+	if _, err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	t, err := jwt.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("Unsupported signing method %s", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		return p.keys.get(kid, t.Method.Alg(), ctx)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ErrorInvalidToken, err)
+	}
+	claims, ok := t.Claims.(jwt.MapClaims)
+	if !ok || !t.Valid {
+		return nil, ErrorInvalidToken
+	}
+	if iss, _ := claims["iss"].(string); iss != p.cfg.Issuer {
+		return nil, fmt.Errorf("%s: issuer %s", ErrorInvalidToken, iss)
+	}
+	if !hasAudience(claims["aud"], p.cfg.ClientID) {
+		return nil, fmt.Errorf("%s: wrong audience", ErrorInvalidToken)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, fmt.Errorf("%s: no expiry", ErrorInvalidToken)
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("%s: wrong nonce", ErrorInvalidToken)
+	}
+	return claims, nil
+}
+
+// Identity maps the claims to the username and role
+func (p *Provider) Identity(claims jwt.MapClaims) (Identity, error) {
+	userClaim := p.cfg.UsernameClaim
+	if len(userClaim) == 0 {
+		userClaim = "email"
+	}
+	groupsClaim := p.cfg.GroupsClaim
+	if len(groupsClaim) == 0 {
+		groupsClaim = "groups"
+	}
+
+	var id Identity
+	id.Username, _ = claims[userClaim].(string)
+	if len(id.Username) == 0 {
+		return id, ErrorNoUsername
+	}
+	// Emails are only trusted if the provider says it verified them,
+	// a missing claim could be an address anyone can register
+	if userClaim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return id, ErrorEmailUnverified
+		}
+	}
+
+	switch groups := claims[groupsClaim].(type) {
+	case []interface{}:
+		for _, v := range groups {
+			if g, ok := v.(string); ok {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+	case string:
+		id.Groups = []string{groups}
+	}
+
+	id.Role = p.cfg.DefaultRole
+	for _, g := range id.Groups {
+		role, ok := p.cfg.Roles[g]
+		if ok && (len(id.Role) == 0 || role.Includes(id.Role)) {
+			id.Role = role
+		}
+	}
+	return id, nil
+}
+
+// getJSON fetches an URL and decodes the JSON response into v
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("GET %s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
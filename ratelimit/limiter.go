@@ -0,0 +1,90 @@
+// Package ratelimit provides token bucket rate limiting and lockouts
+// for repeated failures, both keyed by arbitrary strings like IPs or
+// usernames. All state is kept in memory.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is the number of buckets after which full buckets
+// are dropped on the next access.
+const maxIdleBuckets = 10000
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a set of token buckets. Every key may do burst requests
+// at once and then perMinute requests per minute.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+}
+
+// NewLimiter returns a Limiter, a perMinute of 0 or less disables it.
+// A burst below 1 is raised to 1.
+func NewLimiter(perMinute float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Enabled returns false if the limiter allows everything
+func (l *Limiter) Enabled() bool {
+	return l != nil && l.rate > 0
+}
+
+// Allow takes a token from the bucket of key. If none is left it
+// returns false and the time until the next token is available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.buckets) > maxIdleBuckets {
+		l.cleanup(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanup drops all buckets that have refilled completely, they
+// behave like new buckets.
+func (l *Limiter) cleanup(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// Lockout locks a key for a duration after too many failures in a row,
+// ie failed logins. Failures older than the lock duration are
+// forgotten.
+type Lockout struct {
+	attempts int
+	duration time.Duration
+
+	mu   sync.Mutex
+	keys map[string]*failures
+	now  func() time.Time
+}
+
+// NewLockout returns a Lockout that locks after attempts failures,
+// an attempts of 0 or less disables it.
+func NewLockout(attempts int, duration time.Duration) *Lockout {
+	return &Lockout{
+		attempts: attempts,
+		duration: duration,
+		keys:     map[string]*failures{},
+		now:      time.Now,
+	}
+}
+
+// Enabled returns false if the lockout never locks
+func (l *Lockout) Enabled() bool {
+	return l != nil && l.attempts > 0 && l.duration > 0
+}
+
+// Locked returns true and the remaining time if the key is locked
+func (l *Lockout) Locked(key string) (bool, time.Duration) {
+	if !l.Enabled() {
+		return false, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.keys[key]
+	if !ok {
+		return false, 0
+	}
+	if left := f.lockedUntil.Sub(l.now()); left > 0 {
+		return true, left
+	}
+	return false, 0
+}
+
+// Fail records a failure and returns true if the key is now locked
+func (l *Lockout) Fail(key string) bool {
+	if !l.Enabled() {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.cleanup(now)
+	f, ok := l.keys[key]
+	if !ok {
+		f = &failures{}
+		l.keys[key] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= l.attempts {
+		f.count = 0
+		f.lockedUntil = now.Add(l.duration)
+		return true
+	}
+	return false
+}
+
+// Reset forgets all failures of a key, ie after a successful login
+func (l *Lockout) Reset(key string) {
+	if !l.Enabled() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+}
+
+// cleanup forgets keys that are neither locked nor failed recently
+func (l *Lockout) cleanup(now time.Time) {
+	for k, f := range l.keys {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > l.duration {
+			delete(l.keys, k)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+
+	l := NewLimiter(60, 2)
+	l.now = clock.now
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("a")
+		assert.True(ok, "Burst must be allowed")
+	}
+	ok, wait := l.Allow("a")
+	assert.False(ok, "Empty bucket must deny")
+	assert.Equal(time.Second, wait)
+
+	ok, _ = l.Allow("b")
+	assert.True(ok, "Keys must not share buckets")
+
+	clock.t = clock.t.Add(time.Second)
+	ok, _ = l.Allow("a")
+	assert.True(ok, "Bucket must refill")
+	ok, _ = l.Allow("a")
+	assert.False(ok)
+
+	clock.t = clock.t.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		ok, _ = l.Allow("a")
+		assert.True(ok, "Bucket must not fill beyond burst")
+	}
+	ok, _ = l.Allow("a")
+	assert.False(ok, "Bucket must not fill beyond burst")
+}
+
+func TestLimiterDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	var nilLimiter *Limiter
+	for _, l := range []*Limiter{nilLimiter, NewLimiter(0, 1)} {
+		assert.False(l.Enabled())
+		for i := 0; i < 100; i++ {
+			ok, _ := l.Allow("a")
+			assert.True(ok)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	assert := assert.New(t)
+	clock := &fakeClock{t: time.Unix(1000, 0)}
+
+	l := NewLockout(3, time.Minute)
+	l.now = clock.now
+
+	assert.False(l.Fail("alice"))
+	assert.False(l.Fail("alice"))
+	locked, _ := l.Locked("alice")
+	assert.False(locked)
+
+	assert.True(l.Fail("alice"), "Third failure must lock")
+	locked, left := l.Locked("alice")
+	assert.True(locked)
+	assert.Equal(time.Minute, left)
+
+	locked, _ = l.Locked("bob")
+	assert.False(locked, "Other keys must not be locked")
+
+	clock.t = clock.t.Add(time.Minute)
+	locked, _ = l.Locked("alice")
+	assert.False(locked, "Lock must expire")
+
+	l.Fail("alice")
+	l.Fail("alice")
+	l.Reset("alice")
+	assert.False(l.Fail("alice"), "Reset must forget failures")
+}
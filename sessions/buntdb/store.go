@@ -0,0 +1,136 @@
+package buntdb
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/sessions"
+	"github.com/tidwall/buntdb"
+)
+
+const packageName = "sessions/buntdb"
+const driverName = "buntdb"
+
+const indexUser = "user"
+
+type buntConfig struct {
+	// File is the path of the database, ":memory:" logs everyone out
+	// on restart.
+	File string `cgc:"file"`
+}
+
+func init() {
+	sessions.NewDriver(driverName, NewBuntStore)
+}
+
+// BuntStore keeps the sessions as JSON in a BuntDB with a secondary
+// index on the user. Sessions expire with their login.
+type BuntStore struct {
+	db *buntdb.DB
+}
+
+func NewBuntStore(params map[string]interface{}, ctx context.Context) (sessions.Store, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	log.Debug("Loading Config")
+	var config = &buntConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("file", ":memory:"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Opening DB ", config.File)
+	db, err := buntdb.Open(config.File)
+	if err != nil {
+		log.Error("Error on DB open, returning: ", err)
+		return nil, err
+	}
+
+	err = db.CreateIndex(indexUser, "/session/*",
+		buntdb.IndexJSONCaseSensitive("user"))
+	if err != nil && err != buntdb.ErrIndexExists {
+		return nil, err
+	}
+
+	return &BuntStore{db: db}, nil
+}
+
+func (b *BuntStore) Name() string { return driverName }
+
+func (b *BuntStore) Put(session sessions.Session, ctx context.Context) error {
+	dat, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	var opts *buntdb.SetOptions
+	if !session.ExpiresAt.IsZero() {
+		ttl := time.Until(session.ExpiresAt)
+		if ttl <= 0 {
+			return b.Remove(session.ID, ctx)
+		}
+		opts = &buntdb.SetOptions{Expires: true, TTL: ttl}
+	}
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("/session/"+session.ID, string(dat), opts)
+		return err
+	})
+}
+
+func (b *BuntStore) Get(id string, ctx context.Context) (*sessions.Session, error) {
+	var session = &sessions.Session{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		dat, err := tx.Get("/session/" + id)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(dat), session)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, sessions.ErrorSessionNotExists
+	} else if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (b *BuntStore) Remove(id string, ctx context.Context) error {
+	err := b.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete("/session/" + id)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *BuntStore) ListUser(ctx context.Context, user string) ([]sessions.Session, error) {
+	log := logger.LogFromCtx(packageName+".ListUser", ctx)
+	pivot, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return nil, err
+	}
+	var list = []sessions.Session{}
+	err = b.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendEqual(indexUser, string(pivot), func(key, value string) bool {
+			var session sessions.Session
+			if err := json.Unmarshal([]byte(value), &session); err != nil {
+				log.Error("Error decoding session ", key, ": ", err)
+				return true
+			}
+			list = append(list, session)
+			return true
+		})
+	})
+	return list, err
+}
+
+// Close closes the DB
+func (b *BuntStore) Close(ctx context.Context) error {
+	return b.db.Close()
+}
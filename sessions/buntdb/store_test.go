@@ -0,0 +1,111 @@
+package buntdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSession(id, user string, ttl time.Duration) sessions.Session {
+	now := time.Now().UTC()
+	return sessions.Session{
+		ID:        id,
+		User:      user,
+		UserAgent: "test",
+		IP:        "::1",
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+}
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store, err := NewBuntStore(map[string]interface{}{}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	defer store.Close(ctx)
+
+	for _, v := range []sessions.Session{
+		newSession("1", "alice", time.Hour),
+		newSession("2", "alice", time.Hour),
+		newSession("3", "bob", time.Hour),
+	} {
+		assert.NoError(store.Put(v, ctx))
+	}
+
+	got, err := store.Get("2", ctx)
+	if assert.NoError(err) {
+		assert.Equal("alice", got.User)
+		assert.Equal("test", got.UserAgent)
+	}
+
+	alice, err := store.ListUser(ctx, "alice")
+	assert.NoError(err)
+	assert.Len(alice, 2)
+
+	n, err := sessions.RevokeUser(store, "alice", "2", ctx)
+	assert.NoError(err)
+	assert.Equal(1, n, "The excepted session must be kept")
+	_, err = store.Get("1", ctx)
+	assert.Equal(sessions.ErrorSessionNotExists, err)
+	_, err = store.Get("2", ctx)
+	assert.NoError(err)
+
+	assert.NoError(store.Remove("3", ctx))
+	assert.NoError(store.Remove("3", ctx), "Removing twice must not fail")
+	_, err = store.Get("3", ctx)
+	assert.Equal(sessions.ErrorSessionNotExists, err)
+
+	assert.NoError(store.Put(newSession("4", "bob", -time.Minute), ctx))
+	_, err = store.Get("4", ctx)
+	assert.Equal(sessions.ErrorSessionNotExists, err, "Expired sessions must not be stored")
+}
+
+func TestTouch(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store, err := NewBuntStore(map[string]interface{}{}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	defer store.Close(ctx)
+
+	session := newSession("1", "alice", time.Hour)
+	session.LastSeen = session.LastSeen.Add(-10 * time.Minute)
+	assert.NoError(store.Put(session, ctx))
+
+	got, err := sessions.Touch(store, "1", "alice", time.Hour, ctx)
+	if assert.NoError(err) {
+		assert.WithinDuration(time.Now(), got.LastSeen, time.Second)
+	}
+	stored, err := store.Get("1", ctx)
+	if assert.NoError(err) {
+		assert.WithinDuration(time.Now(), stored.LastSeen, time.Second,
+			"Last use must be written back")
+	}
+
+	_, err = sessions.Touch(store, "1", "bob", time.Hour, ctx)
+	assert.Equal(sessions.ErrorSessionInvalid, err, "Session of another user must fail")
+	_, err = sessions.Touch(store, "missing", "alice", time.Hour, ctx)
+	assert.Equal(sessions.ErrorSessionInvalid, err, "Revoked session must fail")
+
+	idle := newSession("2", "alice", time.Hour)
+	idle.LastSeen = idle.LastSeen.Add(-2 * time.Hour)
+	assert.NoError(store.Put(idle, ctx))
+	_, err = sessions.Touch(store, "2", "alice", 0, ctx)
+	assert.NoError(err, "Idle timeout of 0 must be ignored")
+	idle.LastSeen = idle.LastSeen.Add(-2 * time.Hour)
+	assert.NoError(store.Put(idle, ctx))
+	_, err = sessions.Touch(store, "2", "alice", time.Hour, ctx)
+	assert.Equal(sessions.ErrorSessionInvalid, err, "Idle session must fail")
+	_, err = store.Get("2", ctx)
+	assert.Equal(sessions.ErrorSessionNotExists, err, "Idle session must be removed")
+}
@@ -0,0 +1,113 @@
+// Package sessions records the logins issued as auth cookies. Every
+// login is a Session keyed by the id claim of it's JWT, removing the
+// session from the Store revokes the login.
+package sessions
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrorSessionNotExists is returned by stores for unknown sessions
+	ErrorSessionNotExists = errors.New("Session does not exist")
+	// ErrorSessionInvalid is returned if a session is revoked, expired
+	// or idle for too long.
+	ErrorSessionInvalid = errors.New("Session is invalid")
+)
+
+// TouchInterval is how often the last use of a session is written
+// back to the store at most.
+const TouchInterval = time.Minute
+
+// Store keeps the sessions of all users
+type Store interface {
+	// Name returns the name of the store driver
+	Name() string
+	// Put stores or replaces a session, the store may drop it once
+	// it expired.
+	Put(session Session, ctx context.Context) error
+	// Get returns the session with the id or ErrorSessionNotExists
+	Get(id string, ctx context.Context) (*Session, error)
+	// Remove deletes a session, removing a missing session is not an
+	// error.
+	Remove(id string, ctx context.Context) error
+	// ListUser returns all sessions of the user
+	ListUser(ctx context.Context, user string) ([]Session, error)
+	// Close closes the store
+	Close(ctx context.Context) error
+}
+
+// Session is a login of a user
+type Session struct {
+	// ID is the id claim of the JWT
+	ID   string `json:"id"`
+	User string `json:"user"`
+	// UserAgent and IP of the client that logged in
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastSeen is the last request with the session, it is updated
+	// every TouchInterval at most.
+	LastSeen  time.Time `json:"last_seen"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Valid returns false if the session expired or was not used for
+// longer than idle. An idle timeout of 0 is ignored.
+func (s Session) Valid(idle time.Duration, now time.Time) bool {
+	if !now.Before(s.ExpiresAt) {
+		return false
+	}
+	return idle <= 0 || now.Sub(s.LastSeen) <= idle
+}
+
+// Touch looks up the session of a login and returns it if it is valid
+// and belongs to the user. The last use is updated, invalid sessions
+// are removed.
+func Touch(store Store, id, user string, idle time.Duration, ctx context.Context) (*Session, error) {
+	session, err := store.Get(id, ctx)
+	if err == ErrorSessionNotExists {
+		return nil, ErrorSessionInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if session.User != user {
+		return nil, ErrorSessionInvalid
+	}
+	now := time.Now().UTC()
+	if !session.Valid(idle, now) {
+		if err := store.Remove(id, ctx); err != nil {
+			return nil, err
+		}
+		return nil, ErrorSessionInvalid
+	}
+	if now.Sub(session.LastSeen) >= TouchInterval {
+		session.LastSeen = now
+		if err := store.Put(*session, ctx); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// RevokeUser removes all sessions of the user except the one with the
+// id except and returns the number of removed sessions.
+func RevokeUser(store Store, user, except string, ctx context.Context) (int, error) {
+	list, err := store.ListUser(ctx, user)
+	if err != nil {
+		return 0, err
+	}
+	var n = 0
+	for _, v := range list {
+		if v.ID == except {
+			continue
+		}
+		if err := store.Remove(v.ID, ctx); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
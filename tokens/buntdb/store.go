@@ -0,0 +1,127 @@
+package buntdb
+
+import (
+	"context"
+	"encoding/json"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/tokens"
+	"github.com/tidwall/buntdb"
+)
+
+const packageName = "tokens/buntdb"
+const driverName = "buntdb"
+
+const indexUser = "user"
+
+type buntConfig struct {
+	// File is the path of the database, ":memory:" loses all tokens
+	// on restart.
+	File string `cgc:"file"`
+}
+
+func init() {
+	tokens.NewDriver(driverName, NewBuntStore)
+}
+
+// BuntStore keeps the tokens as JSON in a BuntDB with a secondary
+// index on the user.
+type BuntStore struct {
+	db *buntdb.DB
+}
+
+func NewBuntStore(params map[string]interface{}, ctx context.Context) (tokens.Store, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	log.Debug("Loading Config")
+	var config = &buntConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("file", "tokens.db"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Opening DB ", config.File)
+	db, err := buntdb.Open(config.File)
+	if err != nil {
+		log.Error("Error on DB open, returning: ", err)
+		return nil, err
+	}
+
+	err = db.CreateIndex(indexUser, "/token/*",
+		buntdb.IndexJSONCaseSensitive("user"))
+	if err != nil && err != buntdb.ErrIndexExists {
+		return nil, err
+	}
+
+	return &BuntStore{db: db}, nil
+}
+
+func (b *BuntStore) Name() string { return driverName }
+
+func (b *BuntStore) Put(token tokens.Token, ctx context.Context) error {
+	dat, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("/token/"+token.ID, string(dat), nil)
+		return err
+	})
+}
+
+func (b *BuntStore) Get(id string, ctx context.Context) (*tokens.Token, error) {
+	var token = &tokens.Token{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		dat, err := tx.Get("/token/" + id)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(dat), token)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, tokens.ErrorTokenNotExists
+	} else if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (b *BuntStore) Remove(id string, ctx context.Context) error {
+	err := b.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete("/token/" + id)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *BuntStore) ListUser(ctx context.Context, user string) ([]tokens.Token, error) {
+	log := logger.LogFromCtx(packageName+".ListUser", ctx)
+	pivot, err := json.Marshal(map[string]string{"user": user})
+	if err != nil {
+		return nil, err
+	}
+	var list = []tokens.Token{}
+	err = b.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendEqual(indexUser, string(pivot), func(key, value string) bool {
+			var token tokens.Token
+			if err := json.Unmarshal([]byte(value), &token); err != nil {
+				log.Error("Error decoding token ", key, ": ", err)
+				return true
+			}
+			list = append(list, token)
+			return true
+		})
+	})
+	return list, err
+}
+
+// Close closes the DB
+func (b *BuntStore) Close(ctx context.Context) error {
+	return b.db.Close()
+}
@@ -0,0 +1,85 @@
+package buntdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store, err := NewBuntStore(map[string]interface{}{"file": ":memory:"}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	defer store.Close(ctx)
+
+	ci, _, err := tokens.New("alice", "ci", []tokens.Scope{tokens.ScopeUpload}, 0)
+	assert.NoError(err)
+	bot, _, err := tokens.New("alice", "bot", []tokens.Scope{tokens.ScopeRead}, time.Hour)
+	assert.NoError(err)
+	other, _, err := tokens.New("bob", "ci", []tokens.Scope{tokens.ScopeRead}, 0)
+	assert.NoError(err)
+	for _, v := range []tokens.Token{ci, bot, other} {
+		assert.NoError(store.Put(v, ctx))
+	}
+
+	got, err := store.Get(bot.ID, ctx)
+	if assert.NoError(err) {
+		assert.Equal("bot", got.Name)
+		assert.True(got.HasScope(tokens.ScopeRead))
+		assert.False(got.HasScope(tokens.ScopeUpload))
+		assert.NotNil(got.ExpiresAt)
+	}
+
+	alice, err := store.ListUser(ctx, "alice")
+	assert.NoError(err)
+	assert.Len(alice, 2)
+
+	assert.NoError(store.Remove(ci.ID, ctx))
+	assert.NoError(store.Remove(ci.ID, ctx), "Removing twice must not fail")
+	_, err = store.Get(ci.ID, ctx)
+	assert.Equal(tokens.ErrorTokenNotExists, err)
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store, err := NewBuntStore(map[string]interface{}{"file": ":memory:"}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	defer store.Close(ctx)
+
+	token, raw, err := tokens.New("alice", "ci", []tokens.Scope{tokens.ScopeUpload}, 0)
+	assert.NoError(err)
+	assert.NoError(store.Put(token, ctx))
+
+	got, err := tokens.Verify(store, raw, ctx)
+	if assert.NoError(err) {
+		assert.Equal("alice", got.User)
+	}
+
+	_, err = tokens.Verify(store, token.ID+".wrong", ctx)
+	assert.Equal(tokens.ErrorTokenInvalid, err, "Wrong secret must fail")
+	_, err = tokens.Verify(store, "garbage", ctx)
+	assert.Equal(tokens.ErrorTokenInvalid, err, "Malformed token must fail")
+
+	expired, rawExpired, err := tokens.New("alice", "old", nil, time.Hour)
+	assert.NoError(err)
+	past := time.Now().Add(-time.Minute)
+	expired.ExpiresAt = &past
+	assert.NoError(store.Put(expired, ctx))
+	_, err = tokens.Verify(store, rawExpired, ctx)
+	assert.Equal(tokens.ErrorTokenInvalid, err, "Expired token must fail")
+
+	assert.NoError(store.Remove(token.ID, ctx))
+	_, err = tokens.Verify(store, raw, ctx)
+	assert.Equal(tokens.ErrorTokenInvalid, err, "Revoked token must fail")
+}
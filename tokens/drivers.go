@@ -0,0 +1,50 @@
+package tokens
+
+import (
+	"context"
+	"fmt"
+)
+
+type driverCreator func(map[string]interface{}, context.Context) (Store, error)
+
+var storeDrivers = map[string]driverCreator{}
+
+type noDriverError struct {
+	drvName string
+}
+
+func (n noDriverError) Error() string {
+	return fmt.Sprintf("Token store driver '%s' not installed", n.drvName)
+}
+
+func newNoDriverError(drv string) error {
+	return noDriverError{drvName: drv}
+}
+
+// NewStore initializes the store named via driver-name with the given
+// parameter mapping. The context is used for logging purposes.
+// If the driver does not exist it returns an error.
+func NewStore(
+	driver string, params map[string]interface{}, ctx context.Context) (Store, error) {
+	if f, ok := storeDrivers[driver]; ok {
+		return f(params, ctx)
+	}
+	return nil, newNoDriverError(driver)
+}
+
+// InstalledDrivers returns a list of all store drivers that are
+// currently installed.
+func InstalledDrivers() []string {
+	var list = []string{}
+	for v := range storeDrivers {
+		list = append(list, v)
+	}
+	return list
+}
+
+// NewDriver accepts a store init function and saves it into the list
+// of installed store drivers.
+func NewDriver(driver string,
+	dfunc func(map[string]interface{}, context.Context) (Store, error)) {
+	storeDrivers[driver] = dfunc
+}
@@ -0,0 +1,167 @@
+// Package tokens provides API tokens that users create for scripts.
+// Tokens carry scopes and an optional expiry and are kept in a Store
+// so revoking one applies to the next request.
+package tokens
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"git.timschuster.info/rls.moe/catgi/snowflakes"
+)
+
+// Scope is a permission of a token
+type Scope string
+
+const (
+	// ScopeRead allows viewing and listing files
+	ScopeRead Scope = "read"
+	// ScopeUpload allows uploading files
+	ScopeUpload Scope = "upload"
+	// ScopeDelete allows deleting files
+	ScopeDelete Scope = "delete"
+	// ScopeAdmin allows everything the admin role may do
+	ScopeAdmin Scope = "admin"
+)
+
+// Scopes lists all known scopes
+var Scopes = []Scope{ScopeRead, ScopeUpload, ScopeDelete, ScopeAdmin}
+
+// Valid returns true if the scope is known
+func (s Scope) Valid() bool {
+	for _, v := range Scopes {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// ErrorTokenNotExists is returned by stores for unknown tokens
+	ErrorTokenNotExists = errors.New("Token does not exist")
+	// ErrorTokenInvalid is returned if a token is malformed, expired
+	// or does not match the stored hash.
+	ErrorTokenInvalid = errors.New("Token is invalid")
+)
+
+// Store keeps the tokens of all users
+type Store interface {
+	// Name returns the name of the store driver
+	Name() string
+	// Put stores or replaces a token
+	Put(token Token, ctx context.Context) error
+	// Get returns the token with the id or ErrorTokenNotExists
+	Get(id string, ctx context.Context) (*Token, error)
+	// Remove deletes a token, removing a missing token is not an
+	// error.
+	Remove(id string, ctx context.Context) error
+	// ListUser returns all tokens of the user
+	ListUser(ctx context.Context, user string) ([]Token, error)
+	// Close closes the store
+	Close(ctx context.Context) error
+}
+
+// Token is a token as stored, the secret is only known to the client.
+type Token struct {
+	// ID identifies the token, it is the part before the dot
+	ID string `json:"id"`
+	// User the token acts as
+	User string `json:"user"`
+	// Name is chosen by the user to tell tokens apart
+	Name string `json:"name"`
+	// Hash is the hex encoded SHA256 of the secret
+	Hash string `json:"hash"`
+	// Scopes the token may use
+	Scopes []Scope `json:"scopes"`
+	// CreatedAt is the time the token was created
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is the time the token stops working, nil if never
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// New creates a token for the user and returns it with the string
+// the client has to send. A ttl of 0 never expires.
+func New(user, name string, scopes []Scope, ttl time.Duration) (Token, string, error) {
+	id, err := snowflakes.NewSnowflake()
+	if err != nil {
+		return Token{}, "", err
+	}
+	var secret = make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Token{}, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+	token := Token{
+		ID:        id,
+		User:      user,
+		Name:      name,
+		Hash:      hashSecret(encoded),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expires := token.CreatedAt.Add(ttl)
+		token.ExpiresAt = &expires
+	}
+	return token, id + "." + encoded, nil
+}
+
+// Split returns the id and secret of a token string
+func Split(raw string) (id, secret string, err error) {
+	parts := strings.SplitN(raw, ".", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", ErrorTokenInvalid
+	}
+	return parts[0], parts[1], nil
+}
+
+// Verify looks up a token string in the store and checks the secret
+// and expiry.
+func Verify(store Store, raw string, ctx context.Context) (*Token, error) {
+	id, secret, err := Split(raw)
+	if err != nil {
+		return nil, err
+	}
+	token, err := store.Get(id, ctx)
+	if err == ErrorTokenNotExists {
+		return nil, ErrorTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(token.Hash)) != 1 {
+		return nil, ErrorTokenInvalid
+	}
+	if token.Expired() {
+		return nil, ErrorTokenInvalid
+	}
+	return token, nil
+}
+
+// Expired returns true if the token has an expiry in the past
+func (t Token) Expired() bool {
+	return t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)
+}
+
+// HasScope returns true if the token has the scope
+func (t Token) HasScope(scope Scope) bool {
+	for _, v := range t.Scopes {
+		if v == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,97 @@
+package buntdb
+
+import (
+	"context"
+	"encoding/json"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/totp"
+	"github.com/tidwall/buntdb"
+)
+
+const packageName = "totp/buntdb"
+const driverName = "buntdb"
+
+type buntConfig struct {
+	// File is the path of the database, ":memory:" loses all
+	// enrollments on restart.
+	File string `cgc:"file"`
+}
+
+func init() {
+	totp.NewDriver(driverName, NewBuntStore)
+}
+
+// BuntStore keeps the enrollments as JSON in a BuntDB keyed by user
+type BuntStore struct {
+	db *buntdb.DB
+}
+
+func NewBuntStore(params map[string]interface{}, ctx context.Context) (totp.Store, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	log.Debug("Loading Config")
+	var config = &buntConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("file", "totp.db"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Opening DB ", config.File)
+	db, err := buntdb.Open(config.File)
+	if err != nil {
+		log.Error("Error on DB open, returning: ", err)
+		return nil, err
+	}
+
+	return &BuntStore{db: db}, nil
+}
+
+func (b *BuntStore) Name() string { return driverName }
+
+func (b *BuntStore) Put(enrollment totp.Enrollment, ctx context.Context) error {
+	dat, err := json.Marshal(enrollment)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("/totp/"+enrollment.User, string(dat), nil)
+		return err
+	})
+}
+
+func (b *BuntStore) Get(user string, ctx context.Context) (*totp.Enrollment, error) {
+	var enrollment = &totp.Enrollment{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		dat, err := tx.Get("/totp/" + user)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(dat), enrollment)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, totp.ErrorNotEnrolled
+	} else if err != nil {
+		return nil, err
+	}
+	return enrollment, nil
+}
+
+func (b *BuntStore) Remove(user string, ctx context.Context) error {
+	err := b.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete("/totp/" + user)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Close closes the DB
+func (b *BuntStore) Close(ctx context.Context) error {
+	return b.db.Close()
+}
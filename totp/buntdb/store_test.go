@@ -0,0 +1,50 @@
+package buntdb
+
+import (
+	"context"
+	"testing"
+
+	"git.timschuster.info/rls.moe/catgi/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store, err := NewBuntStore(map[string]interface{}{"file": ":memory:"}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	defer store.Close(ctx)
+
+	enrollment, err := totp.NewEnrollment("alice")
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = enrollment.NewRecoveryCodes()
+	assert.NoError(err)
+	assert.NoError(store.Put(enrollment, ctx))
+
+	got, err := store.Get("alice", ctx)
+	if assert.NoError(err) {
+		assert.Equal(enrollment.Secret, got.Secret)
+		assert.Equal(enrollment.RecoveryCodes, got.RecoveryCodes)
+		assert.False(got.Confirmed)
+	}
+
+	got.Confirmed = true
+	assert.NoError(store.Put(*got, ctx))
+	got, err = store.Get("alice", ctx)
+	if assert.NoError(err) {
+		assert.True(got.Confirmed, "Put must replace the enrollment")
+	}
+
+	_, err = store.Get("bob", ctx)
+	assert.Equal(totp.ErrorNotEnrolled, err)
+
+	assert.NoError(store.Remove("alice", ctx))
+	assert.NoError(store.Remove("alice", ctx), "Removing twice must not fail")
+	_, err = store.Get("alice", ctx)
+	assert.Equal(totp.ErrorNotEnrolled, err)
+}
@@ -0,0 +1,253 @@
+// Package totp implements time based one time passwords as in RFC 6238,
+// compatible with the usual authenticator apps, as second factor of
+// logins. The Enrollment of a user is kept in a Store together with
+// hashes of recovery codes for a lost authenticator.
+package totp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits of a code
+	Digits = 6
+	// Period is the lifetime of a code in seconds
+	Period = 30
+	// Skew is the number of periods a code may be early or late to
+	// allow for clock drift.
+	Skew = 1
+	// RecoveryCodes is the number of recovery codes of an enrollment
+	RecoveryCodes = 10
+	// recoveryCodeBytes is the entropy of a recovery code, 80 bits
+	recoveryCodeBytes = 10
+	// recoverySaltBytes is the length of the salt of a code hash
+	recoverySaltBytes = 16
+)
+
+var (
+	// ErrorNotEnrolled is returned by stores for users without
+	// enrollment
+	ErrorNotEnrolled = errors.New("User is not enrolled")
+	// ErrorSecretInvalid is returned for secrets that are not base32
+	ErrorSecretInvalid = errors.New("TOTP secret is invalid")
+)
+
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Store keeps the enrollments of all users
+type Store interface {
+	// Name returns the name of the store driver
+	Name() string
+	// Put stores or replaces the enrollment of a user
+	Put(enrollment Enrollment, ctx context.Context) error
+	// Get returns the enrollment of the user or ErrorNotEnrolled
+	Get(user string, ctx context.Context) (*Enrollment, error)
+	// Remove deletes the enrollment of a user, removing a missing
+	// enrollment is not an error.
+	Remove(user string, ctx context.Context) error
+	// Close closes the store
+	Close(ctx context.Context) error
+}
+
+// NewSecret returns a random base32 encoded secret of 160 bits
+func NewSecret() (string, error) {
+	var secret = make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return secretEncoding.EncodeToString(secret), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := secretEncoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrorSecretInvalid
+	}
+	return key, nil
+}
+
+// hotp returns the code of a counter as in RFC 4226
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	var mod uint32 = 1
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%mod)
+}
+
+// Step returns the time step of a time
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code of the secret at the time
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, Step(t)), nil
+}
+
+// Verify checks a code against the secret and returns the time step
+// it belongs to. Codes up to Skew steps before or after t are valid.
+func Verify(secret, code string, t time.Time) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth URI of the secret, authenticator apps
+// import it from a QR code or as link.
+func URI(issuer, account, secret string) string {
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(Digits)},
+		"period":    {fmt.Sprint(Period)},
+	}
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// Enrollment is the second factor of a user
+type Enrollment struct {
+	User string `json:"user"`
+	// Secret is the base32 encoded TOTP secret
+	Secret string `json:"secret"`
+	// Confirmed is set once the first code was verified, unconfirmed
+	// enrollments are not asked for on login.
+	Confirmed bool `json:"confirmed"`
+	// RecoveryCodes are the salted hashes of the unused codes, as
+	// "<hex salt>$<hex SHA256 of salt and code>"
+	RecoveryCodes []string `json:"recovery_codes"`
+	// LastStep is the time step of the last accepted code, a code
+	// cannot be used twice.
+	LastStep  int64     `json:"last_step"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewEnrollment returns an unconfirmed enrollment with a new secret
+func NewEnrollment(user string) (Enrollment, error) {
+	secret, err := NewSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+	return Enrollment{
+		User:      user,
+		Secret:    secret,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// CheckCode verifies a TOTP code and remembers it's time step, the
+// enrollment has to be stored again afterwards.
+func (e *Enrollment) CheckCode(code string, now time.Time) bool {
+	step, ok := Verify(e.Secret, code, now)
+	if !ok || step <= e.LastStep {
+		return false
+	}
+	e.LastStep = step
+	return true
+}
+
+// UseRecoveryCode removes the recovery code if it is one of the
+// enrollment, the enrollment has to be stored again afterwards.
+func (e *Enrollment) UseRecoveryCode(code string) bool {
+	for i, v := range e.RecoveryCodes {
+		if checkRecoveryCode(code, v) {
+			e.RecoveryCodes = append(e.RecoveryCodes[:i], e.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Check accepts a TOTP code or a recovery code of a confirmed
+// enrollment.
+func (e *Enrollment) Check(code string, now time.Time) bool {
+	if !e.Confirmed {
+		return false
+	}
+	return e.CheckCode(code, now) || e.UseRecoveryCode(code)
+}
+
+// NewRecoveryCodes replaces the recovery codes and returns the new
+// codes, only their salted hashes are kept.
+func (e *Enrollment) NewRecoveryCodes() ([]string, error) {
+	var codes = []string{}
+	var hashes = []string{}
+	for i := 0; i < RecoveryCodes; i++ {
+		var dat = make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(dat); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(secretEncoding.EncodeToString(dat))
+		code := raw[:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		var salt = make([]byte, recoverySaltBytes)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code, salt))
+	}
+	e.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// hashRecoveryCode ignores case, spaces and dashes of the code
+func hashRecoveryCode(code string, salt []byte) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(code))
+	return hex.EncodeToString(salt) + "$" + hex.EncodeToString(h.Sum(nil))
+}
+
+// checkRecoveryCode returns true if the code matches the salted hash
+func checkRecoveryCode(code, hash string) bool {
+	i := strings.IndexByte(hash, '$')
+	if i < 0 {
+		return false
+	}
+	salt, err := hex.DecodeString(hash[:i])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashRecoveryCode(code, salt)), []byte(hash)) == 1
+}
@@ -0,0 +1,97 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rfcSecret is the SHA1 secret of the test vectors of RFC 6238
+var rfcSecret = secretEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	assert := assert.New(t)
+
+	// The last 6 digits of the 8 digit codes of the RFC
+	for ts, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := Code(rfcSecret, time.Unix(ts, 0))
+		assert.NoError(err)
+		assert.Equal(want, got, "Code at %d", ts)
+	}
+
+	_, err := Code("not base32!", time.Now())
+	assert.Equal(ErrorSecretInvalid, err)
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1111111111, 0)
+
+	step, ok := Verify(rfcSecret, "050471", now)
+	assert.True(ok)
+	assert.Equal(Step(now), step)
+
+	_, ok = Verify(rfcSecret, "050471", now.Add(Period*time.Second))
+	assert.True(ok, "Late codes within the skew must be valid")
+	_, ok = Verify(rfcSecret, "050471", now.Add(3*Period*time.Second))
+	assert.False(ok, "Codes outside the skew must fail")
+	_, ok = Verify(rfcSecret, "123456", now)
+	assert.False(ok)
+	_, ok = Verify(rfcSecret, "", now)
+	assert.False(ok)
+}
+
+func TestEnrollment(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Now()
+
+	e, err := NewEnrollment("alice")
+	if !assert.NoError(err) {
+		return
+	}
+	code, err := Code(e.Secret, now)
+	assert.NoError(err)
+	assert.False(e.Check(code, now), "Unconfirmed enrollments must fail")
+
+	assert.True(e.CheckCode(code, now))
+	assert.False(e.CheckCode(code, now), "Codes must not be used twice")
+	e.Confirmed = true
+
+	codes, err := e.NewRecoveryCodes()
+	assert.NoError(err)
+	assert.Len(codes, RecoveryCodes)
+	assert.Len(e.RecoveryCodes, RecoveryCodes)
+	assert.NotContains(e.RecoveryCodes, codes[0], "Only hashes must be kept")
+	assert.Len(strings.Replace(codes[0], "-", "", -1), 16, "Recovery codes have 80 bits")
+
+	// The same code hashes differently with every salt
+	again, err := e.NewRecoveryCodes()
+	assert.NoError(err)
+	clone := Enrollment{Confirmed: true, RecoveryCodes: []string{
+		hashRecoveryCode(again[0], []byte("salt one")),
+		hashRecoveryCode(again[0], []byte("salt two")),
+	}}
+	assert.NotEqual(clone.RecoveryCodes[0], clone.RecoveryCodes[1])
+	assert.True(clone.UseRecoveryCode(again[0]))
+	assert.False(e.Check(codes[0], now), "Replaced recovery codes must fail")
+	codes = again
+
+	assert.True(e.Check(strings.ToUpper(codes[0]), now), "Recovery codes ignore case")
+	assert.False(e.Check(codes[0], now), "Recovery codes must not be used twice")
+	assert.Len(e.RecoveryCodes, RecoveryCodes-1)
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("catgi", "alice@example.com", "JBSWY3DPEHPK3PXP")
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/catgi:alice@example.com?"))
+	assert.Contains(t, uri, "secret=JBSWY3DPEHPK3PXP")
+	assert.Contains(t, uri, "issuer=catgi")
+}
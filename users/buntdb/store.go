@@ -0,0 +1,115 @@
+package buntdb
+
+import (
+	"context"
+	"encoding/json"
+
+	"git.timschuster.info/rls.moe/catgi/backend/common"
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/logger"
+	"git.timschuster.info/rls.moe/catgi/users"
+	"github.com/tidwall/buntdb"
+)
+
+const packageName = "users/buntdb"
+const driverName = "buntdb"
+
+type buntConfig struct {
+	// File is the path of the database, ":memory:" loses all users
+	// on restart.
+	File string `cgc:"file"`
+}
+
+func init() {
+	users.NewDriver(driverName, NewBuntStore)
+}
+
+// BuntStore keeps the users as JSON in a BuntDB keyed by name
+type BuntStore struct {
+	db *buntdb.DB
+}
+
+func NewBuntStore(params map[string]interface{}, ctx context.Context) (users.Store, error) {
+	log := logger.LogFromCtx(packageName+".New", ctx)
+
+	log.Debug("Loading Config")
+	var config = &buntConfig{}
+	err := common.DecodeConfig(config, params, ctx,
+		common.ConfigDefault("file", "users.db"),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("Opening DB ", config.File)
+	db, err := buntdb.Open(config.File)
+	if err != nil {
+		log.Error("Error on DB open, returning: ", err)
+		return nil, err
+	}
+
+	return &BuntStore{db: db}, nil
+}
+
+func (b *BuntStore) Name() string { return driverName }
+
+func (b *BuntStore) Put(user config.UserConfig, ctx context.Context) error {
+	dat, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set("/user/"+user.Username, string(dat), nil)
+		return err
+	})
+}
+
+func (b *BuntStore) Get(name string, ctx context.Context) (*config.UserConfig, error) {
+	var user = &config.UserConfig{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		dat, err := tx.Get("/user/" + name)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal([]byte(dat), user)
+	})
+	if err == buntdb.ErrNotFound {
+		return nil, users.ErrorUserNotExists
+	} else if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (b *BuntStore) Remove(name string, ctx context.Context) error {
+	err := b.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete("/user/" + name)
+		return err
+	})
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (b *BuntStore) List(ctx context.Context) ([]config.UserConfig, error) {
+	log := logger.LogFromCtx(packageName+".List", ctx)
+	var list = []config.UserConfig{}
+	err := b.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys("/user/*", func(key, value string) bool {
+			var user config.UserConfig
+			if err := json.Unmarshal([]byte(value), &user); err != nil {
+				log.Error("Error decoding user ", key, ": ", err)
+				return true
+			}
+			list = append(list, user)
+			return true
+		})
+	})
+	return list, err
+}
+
+// Close closes the DB
+func (b *BuntStore) Close(ctx context.Context) error {
+	return b.db.Close()
+}
@@ -0,0 +1,54 @@
+package buntdb
+
+import (
+	"context"
+	"testing"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+	"git.timschuster.info/rls.moe/catgi/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	store, err := NewBuntStore(map[string]interface{}{"file": ":memory:"}, ctx)
+	if !assert.NoError(err) {
+		return
+	}
+	defer store.Close(ctx)
+
+	for _, v := range []config.UserConfig{
+		{Username: "bob", PassHash: "hash", Role: config.RoleViewer},
+		{Username: "alice", PassHash: "hash", AuthType: config.ATDropbox},
+		{Username: "carol", AuthType: config.ATLDAP, Disabled: true},
+	} {
+		assert.NoError(store.Put(v, ctx))
+	}
+
+	got, err := store.Get("bob", ctx)
+	if assert.NoError(err) {
+		assert.Equal(config.RoleViewer, got.GetRole())
+		assert.Equal("hash", got.PassHash)
+	}
+
+	list, err := store.List(ctx)
+	if assert.NoError(err) && assert.Len(list, 3) {
+		assert.Equal("alice", list[0].Username, "Users must be sorted by name")
+		assert.Equal("carol", list[2].Username)
+		assert.True(list[2].Disabled)
+	}
+
+	got.Disabled = true
+	assert.NoError(store.Put(*got, ctx))
+	got, err = store.Get("bob", ctx)
+	if assert.NoError(err) {
+		assert.True(got.Disabled, "Put must replace the user")
+	}
+
+	assert.NoError(store.Remove("bob", ctx))
+	assert.NoError(store.Remove("bob", ctx), "Removing twice must not fail")
+	_, err = store.Get("bob", ctx)
+	assert.Equal(users.ErrorUserNotExists, err)
+}
@@ -0,0 +1,33 @@
+// Package users provides a store for users managed at runtime. Users
+// of the store live next to the users of the config file, which take
+// precedence and cannot be changed through the store.
+package users
+
+import (
+	"context"
+	"errors"
+
+	"git.timschuster.info/rls.moe/catgi/config"
+)
+
+var (
+	// ErrorUserNotExists is returned by stores for unknown users
+	ErrorUserNotExists = errors.New("User does not exist")
+)
+
+// Store keeps the users that are not in the config file
+type Store interface {
+	// Name returns the name of the store driver
+	Name() string
+	// Put stores or replaces a user
+	Put(user config.UserConfig, ctx context.Context) error
+	// Get returns the user with the name or ErrorUserNotExists
+	Get(name string, ctx context.Context) (*config.UserConfig, error)
+	// Remove deletes a user, removing a missing user is not an
+	// error.
+	Remove(name string, ctx context.Context) error
+	// List returns all users sorted by name
+	List(ctx context.Context) ([]config.UserConfig, error)
+	// Close closes the store
+	Close(ctx context.Context) error
+}
@@ -13,23 +13,53 @@ import (
 func VerifyPassword(user, pass string, conf config.Configuration) error {
 	for _, v := range conf.Users {
 		if v.Username == user {
-			switch v.AuthType {
-			case config.ATPasslib:
-				_, err := passlib.Verify(pass, v.PassHash)
-				return err
-			case config.ATDropbox:
-				if len(conf.Pepper) != 32 {
-					return errors.New("Pepper corrupt or missing")
-				}
-				isValid := password.IsValid(pass, v.PassHash, conf.Pepper)
-				if isValid {
-					return nil
-				}
-				return errors.New("Password Invalid")
-			default:
-				return errors.New("Invalid AT, Abort Request")
-			}
+			return VerifyUserPassword(v, pass, conf.Pepper)
 		}
 	}
 	return errors.New("User not found")
 }
+
+// VerifyUserPassword validates the password of a user with the hash
+// scheme of it's auth type.
+func VerifyUserPassword(user config.UserConfig, pass, pepper string) error {
+	switch user.AuthType {
+	case config.ATPasslib:
+		_, err := passlib.Verify(pass, user.PassHash)
+		return err
+	case config.ATDropbox:
+		if len(pepper) != 32 {
+			return errors.New("Pepper corrupt or missing")
+		}
+		isValid := password.IsValid(pass, user.PassHash, pepper)
+		if isValid {
+			return nil
+		}
+		return errors.New("Password Invalid")
+	case config.ATOIDC:
+		return errors.New("User must login with OIDC")
+	case config.ATLDAP:
+		return errors.New("User must be verified by LDAP")
+	default:
+		return errors.New("Invalid AT, Abort Request")
+	}
+}
+
+// HashPassword hashes a password with the dropbox scheme if a pepper
+// is set and with passlib otherwise, it returns the hash and the
+// matching auth type.
+func HashPassword(pass, pepper string) (string, config.AuthenticationType, error) {
+	if len(pepper) == 32 {
+		hash, err := password.Hash(pass, pepper)
+		return hash, config.ATDropbox, err
+	} else if len(pepper) > 0 {
+		return "", "", errors.New("Pepper corrupt or missing")
+	}
+	hash, err := passlib.Hash(pass)
+	return hash, config.ATPasslib, err
+}
+
+// NeedsRehash returns true if the user has a legacy passlib hash that
+// should be replaced by a dropbox hash with the pepper.
+func NeedsRehash(user config.UserConfig, pepper string) bool {
+	return user.AuthType == config.ATPasslib && len(pepper) == 32
+}